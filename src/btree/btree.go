@@ -0,0 +1,740 @@
+// Package btree implements a B+tree of string keys and values kept in a
+// file, so that it can hold more data than fits in memory. Only a bounded
+// number of nodes is cached in memory at a time; the least recently used
+// ones are written back to the file when the cache overflows.
+//
+// Sync makes the tree as it stands survive its process: Open finds the tree
+// of the last Sync, whatever changed in the file afterwards. The first two
+// pages of the file hold alternating copies of a header naming the root of
+// the synced tree, and the nodes of that tree are never written over until
+// the next Sync: a node changed after a Sync is written to a new slot, and
+// the slot it leaves is only reused once the next Sync no longer needs it.
+//
+// Nodes are stored in slots of whole pages. A node that outgrows its slot
+// moves to a larger one, and a node that grows past a page is split, unless
+// it holds too few entries to split. Deleting never merges nodes, but nodes
+// left empty are removed. A Tree is not safe for concurrent use.
+package btree
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const pageSize = 4096
+
+// DefaultCacheNodes is the number of nodes cached by a tree created with a
+// cache size of 0.
+const DefaultCacheNodes = 1024
+
+var (
+	errCorrupt = errors.New("btree: corrupt node")
+	errMeta    = errors.New("btree: meta does not fit in a header")
+)
+
+type node struct {
+	id       uint64 // first page of the node's slot
+	pages    int    // size of the slot, in pages
+	leaf     bool
+	keys     []string
+	values   []string // of a leaf, values[i] belongs to keys[i]
+	children []uint64 // of an internal node, the keys of children[i] are at least keys[i-1] and below keys[i]
+	dirty    bool
+	elem     *list.Element
+}
+
+// slot is a run of pages holding a node.
+type slot struct {
+	id    uint64
+	pages int
+}
+
+// Tree is a B+tree stored in a file.
+type Tree struct {
+	file     *os.File
+	root     uint64
+	next     uint64           // first page past the end of the file
+	free     map[int][]uint64 // free slots by size in pages
+	fresh    map[uint64]bool  // slots taken since the last Sync
+	pending  []slot           // slots left since the last Sync, which the synced tree may still use
+	cache    map[uint64]*node // nodes in memory by ID
+	lru      *list.List       // of *node, most recently used first
+	capacity int
+	count    int
+	seq      uint64 // number of the last Sync
+	meta     string // caller's data saved by the last Sync
+}
+
+func newTree(f *os.File, cacheNodes int) *Tree {
+	if cacheNodes <= 0 {
+		cacheNodes = DefaultCacheNodes
+	}
+	return &Tree{
+		file:     f,
+		next:     headerPages,
+		free:     make(map[int][]uint64),
+		fresh:    make(map[uint64]bool),
+		cache:    make(map[uint64]*node),
+		lru:      list.New(),
+		capacity: cacheNodes,
+	}
+}
+
+// Create creates a tree in the file at path, truncating it, which caches up
+// to cacheNodes nodes in memory.
+func Create(path string, cacheNodes int) (*Tree, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := newTree(f, cacheNodes)
+	root := t.newNode(true)
+	t.root = root.id
+	return t, nil
+}
+
+// Open opens the tree last synced to the file at path, which caches up to
+// cacheNodes nodes in memory. Whatever changed after that Sync is lost. If
+// the file does not exist, or no tree was ever synced to it, the tree is
+// empty.
+func Open(path string, cacheNodes int) (*Tree, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := newTree(f, cacheNodes)
+	h, ok := readHeader(f)
+	if !ok {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		root := t.newNode(true)
+		t.root = root.id
+		return t, nil
+	}
+	t.seq, t.root, t.next, t.count, t.meta = h.seq, h.root, h.next, int(h.count), h.meta
+	if err := t.reclaim(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Len returns the number of keys in the tree.
+func (t *Tree) Len() int {
+	return t.count
+}
+
+// Meta returns the meta saved by the last Sync, or "" if there was none.
+func (t *Tree) Meta() string {
+	return t.meta
+}
+
+// Sync writes every changed node to the file, then a header naming the
+// tree's root along with meta, so that Open finds the tree as it stands.
+func (t *Tree) Sync(meta string) error {
+	h := header{seq: t.seq + 1, root: t.root, next: t.next, count: uint64(t.count), meta: meta}
+	b := encodeHeader(h)
+	if len(b) > pageSize {
+		return errMeta
+	}
+	for _, n := range t.cache {
+		if !n.dirty {
+			continue
+		}
+		if _, err := t.file.WriteAt(encode(n), int64(n.id)*pageSize); err != nil {
+			return err
+		}
+		n.dirty = false
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	// Write over the older of the two headers, so that the newer one
+	// survives a crash in the middle.
+	if _, err := t.file.WriteAt(b, int64(h.seq%headerPages)*pageSize); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	t.seq, t.meta = h.seq, meta
+	for _, s := range t.pending {
+		t.free[s.pages] = append(t.free[s.pages], s.id)
+	}
+	t.pending = nil
+	t.fresh = make(map[uint64]bool)
+	return nil
+}
+
+// Close closes the tree's file. The tree cannot be used afterwards.
+func (t *Tree) Close() error {
+	return t.file.Close()
+}
+
+// Get returns the value of key.
+func (t *Tree) Get(key string) (value string, ok bool, err error) {
+	defer t.trim(&err)
+	n, err := t.node(t.root)
+	for err == nil && !n.leaf {
+		n, err = t.node(n.children[childIndex(n, key)])
+	}
+	if err != nil {
+		return "", false, err
+	}
+	i := sort.SearchStrings(n.keys, key)
+	if i < len(n.keys) && n.keys[i] == key {
+		return n.values[i], true, nil
+	}
+	return "", false, nil
+}
+
+// Put sets the value of key, and reports whether key is new to the tree.
+func (t *Tree) Put(key, value string) (added bool, err error) {
+	defer t.trim(&err)
+	root, err := t.node(t.root)
+	if err != nil {
+		return false, err
+	}
+	added, right, sep, err := t.insert(root, key, value)
+	if err != nil {
+		return false, err
+	}
+	if right != nil {
+		// The root split: grow the tree by a level.
+		top := t.newNode(false)
+		top.keys = []string{sep}
+		top.children = []uint64{root.id, right.id}
+		t.fit(top)
+		t.root = top.id
+	} else {
+		t.root = root.id
+	}
+	if added {
+		t.count++
+	}
+	return added, nil
+}
+
+// insert puts key in the subtree rooted at n. If n had to split, it returns
+// the new right sibling and the separator between them. n may have moved to
+// a new slot, so the caller must refresh its pointer to it.
+func (t *Tree) insert(n *node, key, value string) (bool, *node, string, error) {
+	added := false
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			n.values[i] = value
+		} else {
+			n.keys = insertString(n.keys, i, key)
+			n.values = insertString(n.values, i, value)
+			added = true
+		}
+	} else {
+		i := childIndex(n, key)
+		child, err := t.node(n.children[i])
+		if err != nil {
+			return false, nil, "", err
+		}
+		var right *node
+		var sep string
+		added, right, sep, err = t.insert(child, key, value)
+		if err != nil {
+			return false, nil, "", err
+		}
+		n.children[i] = child.id
+		if right != nil {
+			n.keys = insertString(n.keys, i, sep)
+			n.children = insertID(n.children, i+1, right.id)
+		}
+	}
+	n.dirty = true
+	if right, sep := t.split(n); right != nil {
+		return added, right, sep, nil
+	}
+	t.fit(n)
+	return added, nil, "", nil
+}
+
+// split moves the upper half of n, by size, to a new right sibling if n no
+// longer fits in a page, and returns the sibling and the separator between
+// them.
+func (t *Tree) split(n *node) (*node, string) {
+	size := encodedSize(n)
+	if size <= pageSize || (n.leaf && len(n.keys) < 2) || (!n.leaf && len(n.keys) < 3) {
+		return nil, ""
+	}
+	mid, acc := 0, 0
+	for mid < len(n.keys)-1 && acc < size/2 {
+		acc += entrySize(n, mid)
+		mid++
+	}
+	if mid == 0 {
+		mid = 1
+	}
+	right := t.newNode(n.leaf)
+	var sep string
+	if n.leaf {
+		right.keys = append(right.keys, n.keys[mid:]...)
+		right.values = append(right.values, n.values[mid:]...)
+		n.keys, n.values = n.keys[:mid:mid], n.values[:mid:mid]
+		sep = right.keys[0]
+	} else {
+		if mid == len(n.keys)-1 {
+			mid--
+		}
+		sep = n.keys[mid]
+		right.keys = append(right.keys, n.keys[mid+1:]...)
+		right.children = append(right.children, n.children[mid+1:]...)
+		n.keys, n.children = n.keys[:mid:mid], n.children[:mid+1:mid+1]
+	}
+	t.fit(n)
+	t.fit(right)
+	return right, sep
+}
+
+// Delete removes key from the tree and reports whether it was there.
+func (t *Tree) Delete(key string) (found bool, err error) {
+	defer t.trim(&err)
+	root, err := t.node(t.root)
+	if err != nil {
+		return false, err
+	}
+	found, err = t.remove(root, key)
+	if err != nil || !found {
+		return found, err
+	}
+	t.count--
+	// Drop root levels left with a single child.
+	for !root.leaf && len(root.children) == 1 {
+		child, err := t.node(root.children[0])
+		if err != nil {
+			return true, err
+		}
+		t.release(root)
+		root = child
+	}
+	if !root.leaf && len(root.children) == 0 {
+		t.release(root)
+		root = t.newNode(true)
+	}
+	t.root = root.id
+	return true, nil
+}
+
+// remove deletes key from the subtree rooted at n, removing the children
+// left empty. Like insert, it may move n to a new slot.
+func (t *Tree) remove(n *node, key string) (bool, error) {
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return false, nil
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		n.dirty = true
+		t.fit(n)
+		return true, nil
+	}
+	i := childIndex(n, key)
+	child, err := t.node(n.children[i])
+	if err != nil {
+		return false, err
+	}
+	found, err := t.remove(child, key)
+	if err != nil || !found {
+		return found, err
+	}
+	if len(child.keys) == 0 && (child.leaf || len(child.children) == 0) {
+		t.release(child)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		if len(n.keys) > 0 {
+			// Drop the separator on the side of the removed child.
+			k := i
+			if k == len(n.keys) {
+				k--
+			}
+			n.keys = append(n.keys[:k], n.keys[k+1:]...)
+		}
+	} else {
+		n.children[i] = child.id
+	}
+	n.dirty = true
+	t.fit(n)
+	return true, nil
+}
+
+// childIndex returns the index of the child of n whose keys cover key.
+func childIndex(n *node, key string) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+}
+
+func insertString(s []string, i int, v string) []string {
+	s = append(s, "")
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func insertID(s []uint64, i int, v uint64) []uint64 {
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+// Header storage. A header is a magic string, the sequence number of the
+// Sync that wrote it, the root, the end of the file, the number of keys and
+// the caller's meta, followed by a checksum of all that.
+
+const (
+	headerPages = 2
+	magic       = "btree\x00v1"
+)
+
+type header struct {
+	seq, root, next, count uint64
+	meta                   string
+}
+
+func encodeHeader(h header) []byte {
+	b := []byte(magic)
+	for _, x := range []uint64{h.seq, h.root, h.next, h.count} {
+		b = appendID(b, x)
+	}
+	b = appendString(b, h.meta)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b))
+	return append(b, sum[:]...)
+}
+
+func decodeHeader(b []byte) (header, bool) {
+	var h header
+	if len(b) < len(magic) || string(b[:len(magic)]) != magic {
+		return h, false
+	}
+	d := &decoder{b: b[len(magic):]}
+	h.seq, h.root, h.next, h.count = d.id(), d.id(), d.id(), d.id()
+	h.meta = d.string()
+	if d.err != nil || len(d.b) < 4 {
+		return h, false
+	}
+	size := len(b) - len(d.b)
+	if binary.LittleEndian.Uint32(d.b) != crc32.ChecksumIEEE(b[:size]) {
+		return h, false
+	}
+	return h, true
+}
+
+// readHeader returns the newer of the valid headers in f, if any.
+func readHeader(f *os.File) (header, bool) {
+	var best header
+	found := false
+	for i := 0; i < headerPages; i++ {
+		b := make([]byte, pageSize)
+		n, err := f.ReadAt(b, int64(i)*pageSize)
+		if err != nil && err != io.EOF {
+			continue
+		}
+		if h, ok := decodeHeader(b[:n]); ok && (!found || h.seq > best.seq) {
+			best, found = h, true
+		}
+	}
+	return best, found
+}
+
+// Node storage. A slot starts with the length of the encoded node and the
+// size of the slot in pages, and the encoding is a kind byte, the number of
+// keys and then the keys with either their values or the children around
+// them.
+
+const (
+	kindInternal = 0
+	kindLeaf     = 1
+	headerSize   = 8
+)
+
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+func stringSize(s string) int {
+	return uvarintSize(uint64(len(s))) + len(s)
+}
+
+// entrySize returns the encoded size of the i-th key of n along with its
+// value or following child.
+func entrySize(n *node, i int) int {
+	if n.leaf {
+		return stringSize(n.keys[i]) + stringSize(n.values[i])
+	}
+	return stringSize(n.keys[i]) + 8
+}
+
+func encodedSize(n *node) int {
+	size := headerSize + 1 + uvarintSize(uint64(len(n.keys)))
+	if !n.leaf {
+		size += 8
+	}
+	for i := range n.keys {
+		size += entrySize(n, i)
+	}
+	return size
+}
+
+func pagesFor(size int) int {
+	return (size + pageSize - 1) / pageSize
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendID(b []byte, id uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], id)
+	return append(b, buf[:]...)
+}
+
+func encode(n *node) []byte {
+	b := make([]byte, headerSize, encodedSize(n))
+	kind := byte(kindInternal)
+	if n.leaf {
+		kind = kindLeaf
+	}
+	b = append(b, kind)
+	b = appendUvarint(b, uint64(len(n.keys)))
+	if !n.leaf {
+		b = appendID(b, n.children[0])
+	}
+	for i, key := range n.keys {
+		b = appendString(b, key)
+		if n.leaf {
+			b = appendString(b, n.values[i])
+		} else {
+			b = appendID(b, n.children[i+1])
+		}
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-headerSize))
+	binary.LittleEndian.PutUint32(b[4:], uint32(n.pages))
+	return b
+}
+
+// decoder reads the fields of an encoded node, remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decoder) id() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = errCorrupt
+		return 0
+	}
+	x := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return x
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errCorrupt
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func decode(id uint64, pages int, b []byte) (*node, error) {
+	if len(b) < 1 {
+		return nil, errCorrupt
+	}
+	n := &node{id: id, pages: pages, leaf: b[0] == kindLeaf}
+	d := &decoder{b: b[1:]}
+	count := d.uvarint()
+	if !n.leaf {
+		n.children = append(n.children, d.id())
+	}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		n.keys = append(n.keys, d.string())
+		if n.leaf {
+			n.values = append(n.values, d.string())
+		} else {
+			n.children = append(n.children, d.id())
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%v at page %d", d.err, id)
+	}
+	return n, nil
+}
+
+// node returns the node stored at id, reading it in if it is not cached.
+func (t *Tree) node(id uint64) (*node, error) {
+	if n, ok := t.cache[id]; ok {
+		t.lru.MoveToFront(n.elem)
+		return n, nil
+	}
+	var header [headerSize]byte
+	if _, err := t.file.ReadAt(header[:], int64(id)*pageSize); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.LittleEndian.Uint32(header[:]))
+	if _, err := t.file.ReadAt(b, int64(id)*pageSize+headerSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	n, err := decode(id, int(binary.LittleEndian.Uint32(header[4:])), b)
+	if err != nil {
+		return nil, err
+	}
+	t.cache[id] = n
+	n.elem = t.lru.PushFront(n)
+	return n, nil
+}
+
+// newNode returns a new, empty node in a slot of its own.
+func (t *Tree) newNode(leaf bool) *node {
+	n := &node{leaf: leaf, dirty: true}
+	n.pages = 1
+	n.id = t.alloc(n.pages)
+	t.cache[n.id] = n
+	n.elem = t.lru.PushFront(n)
+	return n
+}
+
+// fit moves n to a larger slot if it has outgrown its own, or to a new one
+// if its slot belongs to the synced tree.
+func (t *Tree) fit(n *node) {
+	pages := pagesFor(encodedSize(n))
+	if pages <= n.pages && t.fresh[n.id] {
+		return
+	}
+	if pages < n.pages {
+		pages = n.pages
+	}
+	t.leave(n.id, n.pages)
+	delete(t.cache, n.id)
+	n.id, n.pages = t.alloc(pages), pages
+	t.cache[n.id] = n
+	n.dirty = true
+}
+
+// release frees the slot of n, which is no longer part of the tree.
+func (t *Tree) release(n *node) {
+	t.leave(n.id, n.pages)
+	delete(t.cache, n.id)
+	t.lru.Remove(n.elem)
+}
+
+// alloc returns the first page of a free slot of the given size.
+func (t *Tree) alloc(pages int) uint64 {
+	var id uint64
+	if ids := t.free[pages]; len(ids) > 0 {
+		id = ids[len(ids)-1]
+		t.free[pages] = ids[:len(ids)-1]
+	} else {
+		id = t.next
+		t.next += uint64(pages)
+	}
+	t.fresh[id] = true
+	return id
+}
+
+// leave frees a slot no node uses anymore. A slot of the synced tree is
+// only freed by the next Sync.
+func (t *Tree) leave(id uint64, pages int) {
+	if t.fresh[id] {
+		delete(t.fresh, id)
+		t.free[pages] = append(t.free[pages], id)
+		return
+	}
+	t.pending = append(t.pending, slot{id, pages})
+}
+
+// reclaim rebuilds the free slots of an opened tree: every page past the
+// headers that no node of the tree uses becomes a free slot of one page.
+func (t *Tree) reclaim() (err error) {
+	used := make(map[uint64]int)
+	ids := []uint64{t.root}
+	for len(ids) > 0 && err == nil {
+		id := ids[len(ids)-1]
+		ids = ids[:len(ids)-1]
+		var n *node
+		if n, err = t.node(id); err != nil {
+			return err
+		}
+		used[id] = n.pages
+		if !n.leaf {
+			ids = append(ids, n.children...)
+		}
+		t.trim(&err)
+	}
+	for id := uint64(headerPages); id < t.next && err == nil; {
+		if pages, ok := used[id]; ok {
+			id += uint64(pages)
+			continue
+		}
+		t.free[1] = append(t.free[1], id)
+		id++
+	}
+	return err
+}
+
+// trim evicts the least recently used nodes, writing back the modified ones,
+// until the cache is within its capacity. It runs at the end of every
+// operation, so that no node in use by one is evicted, and stores the first
+// write error in *err unless that already holds an error.
+func (t *Tree) trim(err *error) {
+	for t.lru.Len() > t.capacity {
+		n := t.lru.Back().Value.(*node)
+		if n.dirty {
+			if _, werr := t.file.WriteAt(encode(n), int64(n.id)*pageSize); werr != nil {
+				if *err == nil {
+					*err = werr
+				}
+				return
+			}
+			n.dirty = false
+		}
+		t.lru.Remove(n.elem)
+		delete(t.cache, n.id)
+	}
+}
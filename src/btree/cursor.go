@@ -0,0 +1,170 @@
+package btree
+
+import "sort"
+
+// Cursor walks the keys of a tree in order. A cursor is positioned either
+// at a key, past the last key or before the first one; only in the first
+// case is it Valid. Changing the tree invalidates its cursors.
+type Cursor struct {
+	t    *Tree
+	path []frame // from the root down to the current leaf
+	end  bool    // past the last key, rather than before the first
+	err  error
+}
+
+// frame is a node on the path of a cursor along with the index of the key,
+// in a leaf, or of the child, in an internal node, that the path follows.
+type frame struct {
+	n *node
+	i int
+}
+
+// Seek returns a cursor at the first key at or after key.
+func (t *Tree) Seek(key string) *Cursor {
+	c := &Cursor{t: t}
+	defer t.trim(&c.err)
+	n, err := t.node(t.root)
+	for err == nil && !n.leaf {
+		i := childIndex(n, key)
+		c.path = append(c.path, frame{n, i})
+		n, err = t.node(n.children[i])
+	}
+	if err != nil {
+		c.fail(err)
+		return c
+	}
+	c.path = append(c.path, frame{n, sort.SearchStrings(n.keys, key)})
+	c.forward()
+	return c
+}
+
+// Valid reports whether the cursor is at a key.
+func (c *Cursor) Valid() bool {
+	return len(c.path) > 0
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Key returns the key the cursor is at. The cursor must be valid.
+func (c *Cursor) Key() string {
+	top := c.path[len(c.path)-1]
+	return top.n.keys[top.i]
+}
+
+// Value returns the value of the key the cursor is at. The cursor must be
+// valid.
+func (c *Cursor) Value() string {
+	top := c.path[len(c.path)-1]
+	return top.n.values[top.i]
+}
+
+// Next moves the cursor to the next key. A cursor before the first key
+// moves to the first key.
+func (c *Cursor) Next() {
+	if c.err != nil || c.end {
+		return
+	}
+	defer c.t.trim(&c.err)
+	if !c.Valid() {
+		c.descend(c.t.root, 0, false)
+		c.forward()
+		return
+	}
+	c.path[len(c.path)-1].i++
+	c.forward()
+}
+
+// Prev moves the cursor to the previous key. A cursor past the last key
+// moves to the last key.
+func (c *Cursor) Prev() {
+	if c.err != nil || (!c.Valid() && !c.end) {
+		return
+	}
+	defer c.t.trim(&c.err)
+	if c.end {
+		c.end = false
+		c.descend(c.t.root, 0, true)
+		c.backward()
+		return
+	}
+	c.path[len(c.path)-1].i--
+	c.backward()
+}
+
+// forward moves the cursor from a position just past the end of a leaf to
+// the next key, if any.
+func (c *Cursor) forward() {
+	for c.Valid() {
+		top := c.path[len(c.path)-1]
+		if top.i < len(top.n.keys) {
+			return
+		}
+		// Climb to the nearest ancestor with a child further right.
+		c.path = c.path[:len(c.path)-1]
+		for len(c.path) > 0 && c.path[len(c.path)-1].i+1 >= len(c.path[len(c.path)-1].n.children) {
+			c.path = c.path[:len(c.path)-1]
+		}
+		if len(c.path) == 0 {
+			c.end = true
+			return
+		}
+		parent := &c.path[len(c.path)-1]
+		parent.i++
+		c.descend(parent.n.children[parent.i], len(c.path), false)
+	}
+}
+
+// backward moves the cursor from a position just before the start of a
+// leaf to the previous key, if any.
+func (c *Cursor) backward() {
+	for c.Valid() {
+		top := c.path[len(c.path)-1]
+		if top.i >= 0 {
+			return
+		}
+		c.path = c.path[:len(c.path)-1]
+		for len(c.path) > 0 && c.path[len(c.path)-1].i == 0 {
+			c.path = c.path[:len(c.path)-1]
+		}
+		if len(c.path) == 0 {
+			return
+		}
+		parent := &c.path[len(c.path)-1]
+		parent.i--
+		c.descend(parent.n.children[parent.i], len(c.path), true)
+	}
+}
+
+// descend extends the path, cut to depth frames, from the node at id down
+// to its first leaf position or, if last, its last one.
+func (c *Cursor) descend(id uint64, depth int, last bool) {
+	c.path = c.path[:depth]
+	for {
+		n, err := c.t.node(id)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		i := 0
+		if last {
+			i = len(n.keys) - 1
+			if !n.leaf {
+				i = len(n.children) - 1
+			}
+		}
+		c.path = append(c.path, frame{n, i})
+		if n.leaf {
+			return
+		}
+		id = n.children[i]
+	}
+}
+
+func (c *Cursor) fail(err error) {
+	c.err = err
+	c.path = nil
+	c.end = false
+}
@@ -0,0 +1,59 @@
+package failuredetector
+
+import (
+	"time"
+
+	"rpc/fdrpc"
+)
+
+// State is what a failure detector believes about a member of its cluster.
+type State int
+
+const (
+	Alive     State = iota // Heard from within SuspectTimeout.
+	Suspected              // Missed a heartbeat or silent for longer than SuspectTimeout; callers may probe it.
+	Dead                   // Silent for longer than DeadTimeout, or declared failed.
+)
+
+// Timing of the heartbeats. Every member sends one to every other member
+// each HeartbeatInterval.
+const (
+	HeartbeatInterval = 200 * time.Millisecond
+	SuspectTimeout    = 1 * time.Second
+	DeadTimeout       = 5 * time.Second
+)
+
+// FailureDetector tracks the liveness of the members of a cluster by
+// exchanging heartbeats with them. Members are named by host:port.
+type FailureDetector interface {
+
+	// SetMembers replaces the members being watched. Members not watched
+	// before start out Alive.
+	SetMembers(hostports []string)
+
+	// State returns the current belief about hostport. The detector's own
+	// host and unknown hosts are Alive.
+	State(hostport string) State
+
+	// Alive reports whether hostport is not Dead.
+	Alive(hostport string) bool
+
+	// Heard records that hostport just answered a call, which counts as a
+	// heartbeat.
+	Heard(hostport string)
+
+	// Failed declares hostport Dead, for instance after a call to it timed
+	// out. It comes back Alive with its next heartbeat.
+	Failed(hostport string)
+
+	// Notify registers fn to be called whenever a member dies or comes back.
+	// fn runs on its own goroutine.
+	Notify(fn func(hostport string, alive bool))
+
+	// Close stops the heartbeats and drops the connections to the members.
+	Close()
+
+	// Heartbeat is the RPC that members send each other. It replies with
+	// status NotMember if the sender is not being watched.
+	Heartbeat(*fdrpc.HeartbeatArgs, *fdrpc.HeartbeatReply) error
+}
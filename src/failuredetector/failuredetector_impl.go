@@ -0,0 +1,233 @@
+package failuredetector
+
+import (
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"rpc/fdrpc"
+	"util"
+)
+
+type member struct {
+	heard    time.Time // Last heartbeat or answered call.
+	missed   time.Time // Last heartbeat that went unanswered.
+	failed   time.Time // Last time the member was declared failed.
+	alive    bool      // Liveness last reported to the watchers.
+	conn     *rpc.Client
+	inFlight bool // Whether a heartbeat to the member is outstanding.
+}
+
+type failureDetector struct {
+	hostPort string
+	service  string
+	members  map[string]*member
+	watchers []func(hostport string, alive bool)
+	lock     sync.Mutex
+	done     chan struct{} // closed by Close
+}
+
+// NewFailureDetector creates a failure detector for the server at myHostPort
+// and starts sending heartbeats. service is the name under which every member
+// of the cluster registers its detector to receive RPCs, which the caller
+// does with:
+//
+//	rpc.RegisterName(service, fdrpc.Wrap(fd))
+func NewFailureDetector(myHostPort, service string) FailureDetector {
+	fd := &failureDetector{
+		hostPort: myHostPort,
+		service:  service,
+		members:  make(map[string]*member),
+		done:     make(chan struct{}),
+	}
+	go fd.heartbeater()
+	return fd
+}
+
+func (fd *failureDetector) Close() {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	select {
+	case <-fd.done:
+		return
+	default:
+	}
+	close(fd.done)
+	for _, m := range fd.members {
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}
+	fd.members = make(map[string]*member)
+}
+
+func (fd *failureDetector) SetMembers(hostports []string) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	members := make(map[string]*member)
+	for _, hostport := range hostports {
+		if hostport == fd.hostPort {
+			continue
+		}
+		m, ok := fd.members[hostport]
+		if !ok {
+			m = &member{heard: time.Now(), alive: true}
+		}
+		members[hostport] = m
+	}
+	for hostport, m := range fd.members {
+		if _, ok := members[hostport]; !ok && m.conn != nil {
+			m.conn.Close()
+		}
+	}
+	fd.members = members
+}
+
+// state returns m's state at time now. A single unanswered heartbeat is
+// enough to suspect a member. The caller must hold fd.lock.
+func (m *member) state(now time.Time) State {
+	silence := now.Sub(m.heard)
+	if m.failed.After(m.heard) || silence >= DeadTimeout {
+		return Dead
+	} else if m.missed.After(m.heard) || silence >= SuspectTimeout {
+		return Suspected
+	}
+	return Alive
+}
+
+func (fd *failureDetector) State(hostport string) State {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	if m, ok := fd.members[hostport]; ok {
+		return m.state(time.Now())
+	}
+	return Alive
+}
+
+func (fd *failureDetector) Alive(hostport string) bool {
+	return fd.State(hostport) != Dead
+}
+
+func (fd *failureDetector) Heard(hostport string) {
+	fd.lock.Lock()
+	if m, ok := fd.members[hostport]; ok {
+		m.heard = time.Now()
+	}
+	fd.lock.Unlock()
+	fd.update()
+}
+
+func (fd *failureDetector) Failed(hostport string) {
+	fd.lock.Lock()
+	if m, ok := fd.members[hostport]; ok {
+		m.failed = time.Now()
+	}
+	fd.lock.Unlock()
+	fd.update()
+}
+
+func (fd *failureDetector) Notify(fn func(hostport string, alive bool)) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	fd.watchers = append(fd.watchers, fn)
+}
+
+func (fd *failureDetector) Heartbeat(args *fdrpc.HeartbeatArgs, reply *fdrpc.HeartbeatReply) error {
+	fd.lock.Lock()
+	_, ok := fd.members[args.HostPort]
+	fd.lock.Unlock()
+	if !ok {
+		reply.Status = fdrpc.NotMember
+		return nil
+	}
+	fd.Heard(args.HostPort)
+	reply.Status = fdrpc.OK
+	return nil
+}
+
+// update tells the watchers about every member whose liveness changed since
+// they were last told.
+func (fd *failureDetector) update() {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	now := time.Now()
+	for hostport, m := range fd.members {
+		alive := m.state(now) != Dead
+		if alive == m.alive {
+			continue
+		}
+		m.alive = alive
+		if alive {
+			log.Printf("%s is alive again", hostport)
+		} else {
+			log.Printf("%s is dead", hostport)
+		}
+		for _, fn := range fd.watchers {
+			go fn(hostport, alive)
+		}
+	}
+}
+
+func (fd *failureDetector) heartbeater() {
+	for {
+		select {
+		case <-fd.done:
+			return
+		case <-time.After(HeartbeatInterval):
+		}
+		fd.lock.Lock()
+		for hostport, m := range fd.members {
+			if !m.inFlight {
+				m.inFlight = true
+				go fd.sendHeartbeat(hostport, m)
+			}
+		}
+		fd.lock.Unlock()
+		fd.update()
+	}
+}
+
+// sendHeartbeat sends one heartbeat to m. Heartbeats are answered by the
+// receiver's detector, so a reply counts as hearing from m.
+func (fd *failureDetector) sendHeartbeat(hostport string, m *member) {
+	fd.lock.Lock()
+	cli := m.conn
+	fd.lock.Unlock()
+	var err error
+	if cli == nil {
+		if cli, err = util.DialHTTPTimeout(hostport, SuspectTimeout); err != nil {
+			fd.lock.Lock()
+			m.inFlight = false
+			m.missed = time.Now()
+			fd.lock.Unlock()
+			return
+		}
+	}
+	args := &fdrpc.HeartbeatArgs{HostPort: fd.hostPort}
+	reply := &fdrpc.HeartbeatReply{}
+	call := cli.Go(fd.service+".Heartbeat", args, reply, nil)
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(SuspectTimeout):
+		err = rpc.ErrShutdown
+	}
+
+	fd.lock.Lock()
+	m.inFlight = false
+	if err != nil {
+		m.missed = time.Now()
+		cli.Close()
+		cli = nil
+	}
+	if fd.members[hostport] == m {
+		m.conn = cli
+	} else if cli != nil {
+		cli.Close()
+	}
+	fd.lock.Unlock()
+	if err == nil {
+		fd.Heard(hostport)
+	}
+}
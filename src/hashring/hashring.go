@@ -0,0 +1,211 @@
+// Package hashring implements the consistent hashing ring shared by the
+// storage servers and the libstores. Every storage server owns one or more
+// points on the ring, and a key hash belongs to the first point at or after
+// it, wrapping around past the largest point.
+//
+// Without virtual nodes a server owns the single point equal to its ID. With
+// virtual nodes it owns VirtualNodes*Weight points, the first of which is
+// still its ID, so that every server computes the same layout from the same
+// list of nodes.
+package hashring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+)
+
+// Node is a physical storage server on the ring.
+type Node struct {
+	ID     uint32
+	Weight int // Relative capacity. Values below 1 count as 1.
+}
+
+// Ring is an immutable ring layout.
+type Ring struct {
+	points []uint32 // Sorted.
+	owners []uint32 // owners[i] is the ID of the node owning points[i].
+	nodes  []Node   // Sorted by ID.
+	vnodes int
+}
+
+// New builds the ring made of nodes. vnodes is the number of points each
+// node owns per unit of weight; 0 gives every node the single point equal
+// to its ID, ignoring weights. Nodes listed twice are only counted once.
+func New(nodes []Node, vnodes int) *Ring {
+	r := &Ring{vnodes: vnodes}
+	seen := make(map[uint32]bool)
+	for _, node := range nodes {
+		if seen[node.ID] {
+			continue
+		}
+		seen[node.ID] = true
+		if node.Weight < 1 {
+			node.Weight = 1
+		}
+		r.nodes = append(r.nodes, node)
+	}
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i].ID < r.nodes[j].ID })
+
+	type point struct{ hash, owner uint32 }
+	var points []point
+	for _, node := range r.nodes {
+		for _, p := range pointsOf(node, vnodes) {
+			points = append(points, point{p, node.ID})
+		}
+	}
+	// A point claimed twice goes to the lower ID.
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	for i, p := range points {
+		if i > 0 && p.hash == points[i-1].hash {
+			continue
+		}
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// pointsOf returns the points node owns on a ring with vnodes virtual nodes.
+// Points other than the node's ID are taken from an MD5 digest, which, unlike
+// the FNV hash used for keys, spreads consecutive inputs evenly.
+func pointsOf(node Node, vnodes int) []uint32 {
+	if vnodes < 1 {
+		return []uint32{node.ID}
+	}
+	n := vnodes * node.Weight
+	points := make([]uint32, 0, n)
+	points = append(points, node.ID)
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], node.ID)
+	for i := 1; i < n; i++ {
+		binary.BigEndian.PutUint32(buf[4:], uint32(i))
+		sum := md5.Sum(buf[:])
+		points = append(points, binary.BigEndian.Uint32(sum[:4]))
+	}
+	return points
+}
+
+// Len returns the number of nodes on the ring.
+func (r *Ring) Len() int {
+	return len(r.nodes)
+}
+
+// Nodes returns the nodes on the ring, sorted by ID.
+func (r *Ring) Nodes() []Node {
+	return append([]Node{}, r.nodes...)
+}
+
+// IDs returns the IDs of the nodes on the ring, in increasing order.
+func (r *Ring) IDs() []uint32 {
+	ids := make([]uint32, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		ids = append(ids, node.ID)
+	}
+	return ids
+}
+
+// VirtualNodes returns the number of points per unit of weight the ring was
+// built with.
+func (r *Ring) VirtualNodes() int {
+	return r.vnodes
+}
+
+// Contains reports whether the node with the given ID is on the ring.
+func (r *Ring) Contains(id uint32) bool {
+	i := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].ID >= id })
+	return i < len(r.nodes) && r.nodes[i].ID == id
+}
+
+// search returns the index of the point owning hash.
+func (r *Ring) search(hash uint32) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Point returns the point whose key range contains hash. The ring must not
+// be empty.
+func (r *Ring) Point(hash uint32) uint32 {
+	return r.points[r.search(hash)]
+}
+
+// AllPoints returns every point on the ring in increasing order.
+func (r *Ring) AllPoints() []uint32 {
+	return append([]uint32{}, r.points...)
+}
+
+// Owner returns the ID of the node owning hash. The ring must not be empty.
+func (r *Ring) Owner(hash uint32) uint32 {
+	return r.owners[r.search(hash)]
+}
+
+// ReplicaSet returns the IDs of the nodes holding hash: its owner followed
+// by the owners of the next points clockwise, skipping nodes already in the
+// set, up to replicas backups. It returns nil if the ring is empty.
+func (r *Ring) ReplicaSet(hash uint32, replicas int) []uint32 {
+	if len(r.points) == 0 {
+		return nil
+	}
+	n := replicas + 1
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	set := make([]uint32, 0, n)
+	start := r.search(hash)
+	for j := 0; j < len(r.points) && len(set) < n; j++ {
+		owner := r.owners[(start+j)%len(r.points)]
+		if !contains(set, owner) {
+			set = append(set, owner)
+		}
+	}
+	return set
+}
+
+func contains(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Points returns the points owned by the node with the given ID, in
+// increasing order.
+func (r *Ring) Points(id uint32) []uint32 {
+	var points []uint32
+	for i, owner := range r.owners {
+		if owner == id {
+			points = append(points, r.points[i])
+		}
+	}
+	return points
+}
+
+// Ownership returns, by node ID, the fraction of the hash space each node
+// owns.
+func (r *Ring) Ownership() map[uint32]float64 {
+	fractions := make(map[uint32]float64)
+	for _, node := range r.nodes {
+		fractions[node.ID] = 0
+	}
+	if len(r.points) == 1 {
+		fractions[r.owners[0]] = 1
+		return fractions
+	}
+	for i, p := range r.points {
+		prev := r.points[(i+len(r.points)-1)%len(r.points)]
+		// The point owns the hashes after the previous point up to itself;
+		// uint32 arithmetic takes care of the wraparound.
+		fractions[r.owners[i]] += float64(p-prev) / (1 << 32)
+	}
+	return fractions
+}
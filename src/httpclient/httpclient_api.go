@@ -1,6 +1,10 @@
 package httpclient
 
-import "rpc/stwrpc"
+import (
+	"context"
+
+	"rpc/stwrpc"
+)
 
 type HttpClient interface {
 	CreateUser(userID string) (stwrpc.Status, error)
@@ -10,6 +14,18 @@ type HttpClient interface {
 	HomeTimeline(userID string) ([]stwrpc.Post, stwrpc.Status, error)
 	Post(userID, contents string) (stwrpc.PostReply, error)
 	DeletePost(userID, postKey string) (stwrpc.Status, error)
+
+	// The Context variants give up once ctx is done, returning its error,
+	// and send the time left until the deadline of ctx along to the web
+	// server in the stwrpc.TimeoutHeader header.
+	CreateUserContext(ctx context.Context, userID string) (stwrpc.Status, error)
+	SubscribeContext(ctx context.Context, userID, targetUser string) (stwrpc.Status, error)
+	UnsubscribeContext(ctx context.Context, userID, targetUser string) (stwrpc.Status, error)
+	TimelineContext(ctx context.Context, userID string) ([]stwrpc.Post, stwrpc.Status, error)
+	HomeTimelineContext(ctx context.Context, userID string) ([]stwrpc.Post, stwrpc.Status, error)
+	PostContext(ctx context.Context, userID, contents string) (stwrpc.PostReply, error)
+	DeletePostContext(ctx context.Context, userID, postKey string) (stwrpc.Status, error)
+
 	DownloadIMG() error
 	Close() error
 }
@@ -1,6 +1,7 @@
 package httpclient
 
 import (
+	"context"
 	"net"
 	//"net/rpc"
 	"net/http"
@@ -28,147 +29,145 @@ func NewHttpClient(serverHost string, serverPort int) (HttpClient, error) {
 	return tc, nil
 }
 
+// do sends req, bound to ctx and carrying its deadline, and decodes the
+// JSON reply into reply. A 504 Gateway Timeout from the web server is
+// returned as context.DeadlineExceeded.
+func (tc *httpClient) do(ctx context.Context, req *http.Request, reply interface{}) error {
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if timeout := stwrpc.TimeoutOf(ctx); timeout != 0 {
+		req.Header.Set(stwrpc.TimeoutHeader, timeout.String())
+	}
+	resp, err := tc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGatewayTimeout {
+		return context.DeadlineExceeded
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
 func (tc *httpClient) CreateUser(userID string) (stwrpc.Status, error) {
+	return tc.CreateUserContext(context.Background(), userID)
+}
+
+func (tc *httpClient) CreateUserContext(ctx context.Context, userID string) (stwrpc.Status, error) {
 	args := &stwrpc.CreateUserArgs{UserID: userID}
 	var reply stwrpc.CreateUserReply
 
 	jsonStr, _ := json.Marshal(args)
 	req, err := http.NewRequest("POST", tc.serverAddr+"/users", bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := tc.client.Do(req)
-    if err != nil {
-        return 0, err
-    }
-    defer resp.Body.Close()
-    decoder := json.NewDecoder(resp.Body)
-
-    err = decoder.Decode(&reply)
-    if err!=nil {
+	if err != nil {
+		return 0, err
+	}
+	if err = tc.do(ctx, req, &reply); err != nil {
 		return 0, err
 	}
 	return reply.Status, nil
 }
 
 func (tc *httpClient) Subscribe(userID, targetUserID string) (stwrpc.Status, error) {
-	return tc.doSub("POST", userID, targetUserID)
+	return tc.doSub(context.Background(), "POST", userID, targetUserID)
+}
+
+func (tc *httpClient) SubscribeContext(ctx context.Context, userID, targetUserID string) (stwrpc.Status, error) {
+	return tc.doSub(ctx, "POST", userID, targetUserID)
 }
 
 func (tc *httpClient) Unsubscribe(userID, targetUserID string) (stwrpc.Status, error) {
-	return tc.doSub("DELETE", userID, targetUserID)
+	return tc.doSub(context.Background(), "DELETE", userID, targetUserID)
 }
 
-func (tc *httpClient) doSub(method, userID, targetUserID string) (stwrpc.Status, error) {
+func (tc *httpClient) UnsubscribeContext(ctx context.Context, userID, targetUserID string) (stwrpc.Status, error) {
+	return tc.doSub(ctx, "DELETE", userID, targetUserID)
+}
+
+func (tc *httpClient) doSub(ctx context.Context, method, userID, targetUserID string) (stwrpc.Status, error) {
 	args := &stwrpc.SubscriptionArgs{UserID: userID, TargetUserID: targetUserID}
 	var reply stwrpc.SubscriptionReply
 
 	req, err := http.NewRequest(method, tc.serverAddr+"/subscriptions", nil)
-	req.Header.Set("Content-Type", "application/json")
-
+	if err != nil {
+		return 0, err
+	}
 	q := req.URL.Query()
 	q.Add("UserID", args.UserID)
 	q.Add("TargetUserID", args.TargetUserID)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := tc.client.Do(req)
-    if err != nil {
-        return 0, err
-    }
-    defer resp.Body.Close()
-    decoder := json.NewDecoder(resp.Body)
-    
-    err = decoder.Decode(&reply)
-    if err!=nil {
+	if err = tc.do(ctx, req, &reply); err != nil {
 		return 0, err
 	}
 	return reply.Status, nil
 }
 
 func (tc *httpClient) Timeline(userID string) ([]stwrpc.Post, stwrpc.Status, error) {
-	args := &stwrpc.TimelineArgs{UserID: userID}
-	var reply stwrpc.TimelineReply
-
-	req, err := http.NewRequest("GET", tc.serverAddr+"/timeline", nil)
-	req.Header.Set("Content-Type", "application/json")
-	
-	q := req.URL.Query()
-	q.Add("UserID", args.UserID)
-	req.URL.RawQuery = q.Encode()
+	return tc.TimelineContext(context.Background(), userID)
+}
 
-	resp, err := tc.client.Do(req)
-    if err != nil {
-    	LOGE.Println(err)
-        return nil, 0, err
-    }
-    defer resp.Body.Close()
-    decoder := json.NewDecoder(resp.Body)
-    
-    err = decoder.Decode(&reply)
-    if err!=nil {
-		return nil, 0, err
-	}
-	return reply.Posts, reply.Status, nil
+func (tc *httpClient) TimelineContext(ctx context.Context, userID string) ([]stwrpc.Post, stwrpc.Status, error) {
+	return tc.getTimeline(ctx, "/timeline", userID)
 }
 
 func (tc *httpClient) HomeTimeline(userID string) ([]stwrpc.Post, stwrpc.Status, error) {
+	return tc.HomeTimelineContext(context.Background(), userID)
+}
+
+func (tc *httpClient) HomeTimelineContext(ctx context.Context, userID string) ([]stwrpc.Post, stwrpc.Status, error) {
+	return tc.getTimeline(ctx, "/home", userID)
+}
+
+// getTimeline gets the timeline of userID at path, /timeline or /home.
+func (tc *httpClient) getTimeline(ctx context.Context, path, userID string) ([]stwrpc.Post, stwrpc.Status, error) {
 	args := &stwrpc.TimelineArgs{UserID: userID}
 	var reply stwrpc.TimelineReply
 
-	req, err := http.NewRequest("GET", tc.serverAddr+"/home", nil)
-	req.Header.Set("Content-Type", "application/json")
-
+	req, err := http.NewRequest("GET", tc.serverAddr+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
 	q := req.URL.Query()
 	q.Add("UserID", args.UserID)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := tc.client.Do(req)
-    if err != nil {
-        return nil, 0, err
-    }
-    defer resp.Body.Close()
-    decoder := json.NewDecoder(resp.Body)
-    
-    err = decoder.Decode(&reply)
-    if err != nil {
+	if err = tc.do(ctx, req, &reply); err != nil {
+		LOGE.Println(err)
 		return nil, 0, err
 	}
 	return reply.Posts, reply.Status, nil
 }
 
 func (tc *httpClient) Post(userID, contents string) (stwrpc.PostReply, error) {
+	return tc.PostContext(context.Background(), userID, contents)
+}
+
+func (tc *httpClient) PostContext(ctx context.Context, userID, contents string) (stwrpc.PostReply, error) {
 	args := &stwrpc.PostArgs{UserID: userID, Contents: contents}
 	var reply stwrpc.PostReply
 	jsonStr, _ := json.Marshal(args)
 	req, err := http.NewRequest("POST", tc.serverAddr+"/posts", bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := tc.client.Do(req)
-    if err != nil {
-        return reply, err
-    }
-    defer resp.Body.Close()
-    decoder := json.NewDecoder(resp.Body)
-    
-    err = decoder.Decode(&reply)
-    if err!=nil {
+	if err != nil {
 		return reply, err
 	}
-	return reply, nil
+	err = tc.do(ctx, req, &reply)
+	return reply, err
 }
 
 func (tc *httpClient) DeletePost(userID, postKey string) (stwrpc.Status, error) {
+	return tc.DeletePostContext(context.Background(), userID, postKey)
+}
+
+func (tc *httpClient) DeletePostContext(ctx context.Context, userID, postKey string) (stwrpc.Status, error) {
 	args := &stwrpc.DeletePostArgs{UserID: userID, PostKey: postKey}
 	var reply stwrpc.DeletePostReply
 	jsonStr, _ := json.Marshal(args)
 	req, err := http.NewRequest("DELETE", tc.serverAddr+"/posts", bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := tc.client.Do(req)
-    if err != nil {
-        return 0, err
-    }
-    defer resp.Body.Close()
-    decoder := json.NewDecoder(resp.Body)
-    
-    err = decoder.Decode(&reply)
-    if err!=nil {
+	if err != nil {
+		return 0, err
+	}
+	if err = tc.do(ctx, req, &reply); err != nil {
 		return 0, err
 	}
 	return reply.Status, nil
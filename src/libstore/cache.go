@@ -0,0 +1,223 @@
+package libstore
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// The lease cache. Each cache shard keeps the values of the keys the
+// libstore holds leases on in a list, most recently used first, and evicts
+// the least recently used ones once it is over its share of the limits of
+// Config, the limits being spread evenly over the shards. It also keeps the
+// times of the latest reads of every key read lately, for the lease policy.
+// A heap of deadlines per shard, served by a single timer, drops the values
+// of a key the moment its lease expires, and the reads of a key left unread
+// for readHistoryTTL.
+
+// readHistoryTTL is how long the reads of a key are remembered after the
+// last one.
+const readHistoryTTL = time.Minute
+
+// defaultCacheBytes is the byte limit of the cache if Config leaves it 0.
+const defaultCacheBytes = 64 << 20
+
+type record struct {
+	history []time.Time   // times of the latest reads, up to maxReadHistory
+	values  []string      // the cached values, while the libstore holds a lease
+	expires time.Time     // when the lease runs out
+	size    int           // bytes of the key and its cached values
+	elem    *list.Element // place in the shard's list while cached
+	due     time.Time     // the deadline in the heap for the key, if any
+}
+
+// deadline is a time at which the cache has to look at a key again.
+type deadline struct {
+	key string
+	at  time.Time
+}
+
+type deadlineHeap []deadline
+
+func (h deadlineHeap) Len() int            { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h deadlineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x interface{}) { *h = append(*h, x.(deadline)) }
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+type cacheShard struct {
+	lock       sync.Mutex
+	records    map[string]*record
+	lru        list.List // keys of the cached records, most recently used first
+	bytes      int       // total size of the cached records
+	maxEntries int       // 0 for no limit
+	maxBytes   int       // 0 for no limit
+	deadlines  deadlineHeap
+	timer      *time.Timer
+	stats      CacheStats
+}
+
+func newCacheShard(maxEntries, maxBytes int) *cacheShard {
+	sh := &cacheShard{records: make(map[string]*record), maxEntries: maxEntries, maxBytes: maxBytes}
+	sh.timer = time.AfterFunc(time.Hour, sh.expire)
+	sh.timer.Stop()
+	return sh
+}
+
+// newCacheShards spreads the cache limits of config over the shards.
+func newCacheShards(config Config) [numCacheShards]*cacheShard {
+	maxBytes := config.CacheBytes
+	if maxBytes == 0 {
+		maxBytes = defaultCacheBytes
+	}
+	var shards [numCacheShards]*cacheShard
+	for i := range shards {
+		shards[i] = newCacheShard(shareOf(config.CacheEntries), shareOf(maxBytes))
+	}
+	return shards
+}
+
+// shareOf returns a shard's share of limit, rounded up, or 0, for no limit,
+// if limit is not positive.
+func shareOf(limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+	return (limit + numCacheShards - 1) / numCacheShards
+}
+
+// get returns the cached values of key, marking them as the most recently
+// used, if the libstore holds an unexpired lease on key. The caller must
+// hold sh.lock.
+func (sh *cacheShard) get(key string) ([]string, bool) {
+	rec, ok := sh.records[key]
+	if !ok || rec.elem == nil || !time.Now().Before(rec.expires) {
+		sh.stats.Misses++
+		return nil, false
+	}
+	sh.stats.Hits++
+	sh.lru.MoveToFront(rec.elem)
+	return rec.values, true
+}
+
+// read records a read of key and returns its record. The caller must hold
+// sh.lock.
+func (sh *cacheShard) read(key string) *record {
+	rec, ok := sh.records[key]
+	if !ok {
+		rec = &record{history: make([]time.Time, 0, maxReadHistory)}
+		sh.records[key] = rec
+	}
+	rec.history = append(rec.history, time.Now())
+	if len(rec.history) > maxReadHistory {
+		rec.history = rec.history[len(rec.history)-maxReadHistory:]
+	}
+	sh.schedule(key, rec)
+	return rec
+}
+
+// put caches values under key until expires, evicting the least recently
+// used keys as needed. Values too big for the shard on their own are not
+// cached. The caller must hold sh.lock.
+func (sh *cacheShard) put(key string, rec *record, values []string, expires time.Time) {
+	size := len(key)
+	for _, v := range values {
+		size += len(v)
+	}
+	if sh.maxBytes > 0 && size > sh.maxBytes {
+		sh.drop(rec)
+		return
+	}
+	if rec.elem == nil {
+		rec.elem = sh.lru.PushFront(key)
+	} else {
+		sh.lru.MoveToFront(rec.elem)
+		sh.bytes -= rec.size
+	}
+	rec.values, rec.size, rec.expires = values, size, expires
+	sh.bytes += size
+	for (sh.maxEntries > 0 && sh.lru.Len() > sh.maxEntries) || (sh.maxBytes > 0 && sh.bytes > sh.maxBytes) {
+		sh.drop(sh.records[sh.lru.Back().Value.(string)])
+		sh.stats.Evictions++
+	}
+	sh.schedule(key, rec)
+}
+
+// drop drops the cached values of rec, if any, and reports whether there
+// were any. The caller must hold sh.lock.
+func (sh *cacheShard) drop(rec *record) bool {
+	if rec.elem == nil {
+		return false
+	}
+	sh.lru.Remove(rec.elem)
+	sh.bytes -= rec.size
+	rec.values, rec.size, rec.elem = nil, 0, nil
+	return true
+}
+
+// schedule makes sure that the heap holds a deadline for key no later than
+// the expiry of its lease and of its reads. The caller must hold sh.lock.
+func (sh *cacheShard) schedule(key string, rec *record) {
+	at := rec.history[len(rec.history)-1].Add(readHistoryTTL)
+	if rec.elem != nil && rec.expires.Before(at) {
+		at = rec.expires
+	}
+	if !rec.due.IsZero() && !at.Before(rec.due) {
+		return
+	}
+	rec.due = at
+	heap.Push(&sh.deadlines, deadline{key: key, at: at})
+	if sh.deadlines[0].at.Equal(at) {
+		sh.timer.Reset(time.Until(at))
+	}
+}
+
+// expire handles the deadlines that have passed, and sets the timer for the
+// next one.
+func (sh *cacheShard) expire() {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	now := time.Now()
+	for len(sh.deadlines) > 0 && !sh.deadlines[0].at.After(now) {
+		d := heap.Pop(&sh.deadlines).(deadline)
+		rec, ok := sh.records[d.key]
+		if !ok || !rec.due.Equal(d.at) {
+			// Superseded by an earlier deadline.
+			continue
+		}
+		rec.due = time.Time{}
+		if rec.elem != nil && !rec.expires.After(now) {
+			sh.drop(rec)
+			sh.stats.Expirations++
+		}
+		if rec.elem == nil && !rec.history[len(rec.history)-1].Add(readHistoryTTL).After(now) {
+			delete(sh.records, d.key)
+			continue
+		}
+		sh.schedule(d.key, rec)
+	}
+	if len(sh.deadlines) > 0 {
+		sh.timer.Reset(time.Until(sh.deadlines[0].at))
+	}
+}
+
+func (ls *libstore) CacheStats() CacheStats {
+	var total CacheStats
+	for _, sh := range ls.shards {
+		sh.lock.Lock()
+		total.Hits += sh.stats.Hits
+		total.Misses += sh.stats.Misses
+		total.Evictions += sh.stats.Evictions
+		total.Expirations += sh.stats.Expirations
+		total.Entries += sh.lru.Len()
+		total.Bytes += sh.bytes
+		sh.lock.Unlock()
+	}
+	return total
+}
@@ -0,0 +1,68 @@
+package libstore
+
+import (
+	"context"
+
+	"rpc/storagerpc"
+)
+
+func (ls *libstore) GetVersion(key string) (string, uint64, error) {
+	return ls.GetVersionContext(context.Background(), key)
+}
+
+func (ls *libstore) GetVersionContext(ctx context.Context, key string) (string, uint64, error) {
+	args := &storagerpc.GetArgs{Key: key, HostPort: ls.hostPort, Timeout: storagerpc.TimeoutOf(ctx)}
+	var reply storagerpc.GetReply
+	if err := ls.call(ctx, key, "StorageServer.Get", args, &reply); err != nil {
+		return "", 0, err
+	}
+	switch reply.Status {
+	case storagerpc.OK:
+		return reply.Value, reply.Version, nil
+	case storagerpc.KeyNotFound:
+		return "", 0, &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	}
+	return "", 0, &StatusError{Method: "StorageServer.Get", Key: key, Status: reply.Status}
+}
+
+func (ls *libstore) ConditionalPut(key, value string, version uint64) (uint64, error) {
+	return ls.ConditionalPutContext(context.Background(), key, value, version)
+}
+
+func (ls *libstore) ConditionalPutContext(ctx context.Context, key, value string, version uint64) (uint64, error) {
+	args := &storagerpc.ConditionalPutArgs{Key: key, Value: value, Version: version, Timeout: storagerpc.TimeoutOf(ctx)}
+	return ls.conditionalPut(ctx, key, "StorageServer.ConditionalPut", args)
+}
+
+func (ls *libstore) PutIfAbsent(key, value string) (uint64, error) {
+	return ls.PutIfAbsentContext(context.Background(), key, value)
+}
+
+func (ls *libstore) PutIfAbsentContext(ctx context.Context, key, value string) (uint64, error) {
+	args := &storagerpc.PutArgs{Key: key, Value: value, Timeout: storagerpc.TimeoutOf(ctx)}
+	return ls.conditionalPut(ctx, key, "StorageServer.PutIfAbsent", args)
+}
+
+func (ls *libstore) CompareAndSwap(key, oldValue, newValue string) (uint64, error) {
+	return ls.CompareAndSwapContext(context.Background(), key, oldValue, newValue)
+}
+
+func (ls *libstore) CompareAndSwapContext(ctx context.Context, key, oldValue, newValue string) (uint64, error) {
+	args := &storagerpc.CompareAndSwapArgs{Key: key, OldValue: oldValue, NewValue: newValue, Timeout: storagerpc.TimeoutOf(ctx)}
+	return ls.conditionalPut(ctx, key, "StorageServer.CompareAndSwap", args)
+}
+
+func (ls *libstore) conditionalPut(ctx context.Context, key, method string, args interface{}) (uint64, error) {
+	ls.policy.Wrote(key)
+	var reply storagerpc.PutReply
+	if err := ls.call(ctx, key, method, args, &reply); err != nil {
+		return 0, err
+	}
+	switch reply.Status {
+	case storagerpc.OK:
+		return reply.Version, nil
+	case storagerpc.Conflict:
+		return reply.Version, ErrConflict
+	}
+	return 0, &StatusError{Method: method, Key: key, Status: reply.Status}
+}
@@ -0,0 +1,238 @@
+package libstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Connections. The libstore keeps one connection per storage server, dialed
+// when first needed, with a bound on how long dialing may take. A call that
+// fails without a reply from the server drops the connection and has the
+// server skipped in favor of its backups, for downSeconds after a first
+// failure and twice as long after each further one in a row, up to
+// maxDownSeconds; the next call to the server dials it again. Every call
+// gives up after the CallTimeout of Config. Reads, which can be repeated
+// safely, are tried again over the whole replica set a few times, after a
+// growing pause, before the libstore gives up on them. The Context variants
+// of the operations also give up once their context is done, and send its
+// deadline along for the storage servers to refuse calls that arrive too
+// late.
+const (
+	maxDownSeconds     = 30
+	dialTimeout        = 2 * time.Second
+	defaultCallTimeout = 30 * time.Second
+	callRetries        = 3
+	callRetryPause     = 100 * time.Millisecond
+)
+
+// idempotent holds the methods that call may send again after a failure.
+var idempotent = map[string]bool{
+	"StorageServer.Get":               true,
+	"StorageServer.GetList":           true,
+	"StorageServer.GetListRange":      true,
+	"StorageServer.MultiGet":          true,
+	"StorageServer.MultiGetList":      true,
+	"StorageServer.MultiGetListRange": true,
+	"StorageServer.Scan":              true,
+}
+
+var (
+	errCallTimeout  = errors.New("the call timed out")
+	errNoServers    = errors.New("no storage server holds the key")
+	errRingMoving   = errors.New("the storage servers kept replying WrongServer")
+	errUnreplicated = errors.New("the write was not applied by enough replicas")
+)
+
+// callTimeoutOf returns the call timeout set by config.
+func callTimeoutOf(config Config) time.Duration {
+	switch {
+	case config.CallTimeout == 0:
+		return defaultCallTimeout
+	case config.CallTimeout < 0:
+		return 0
+	}
+	return config.CallTimeout
+}
+
+// isContextError reports whether err tells that the context of a call was
+// done, which says nothing about the server called.
+func isContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// sleep pauses for d, or until ctx is done, in which case it returns the
+// error of ctx.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextErr returns the error of ctx if it is done or its deadline has
+// passed. The connection deadline dialHTTP takes from ctx may pass a moment
+// before ctx is marked done.
+func contextErr(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return ctx.Err()
+}
+
+// dialHTTP is rpc.DialHTTP with a bound on how long connecting may take. It
+// repeats util.DialHTTPTimeout, which the libstore cannot import since util
+// imports the libstore, and also gives up, returning the error of ctx, once
+// ctx is done.
+func dialHTTP(ctx context.Context, hostport string, timeout time.Duration) (*rpc.Client, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", hostport)
+	if err != nil {
+		if ctxErr := contextErr(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	deadline, _ := dialCtx.Deadline()
+	conn.SetDeadline(deadline)
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == "200 Connected to Go RPC" {
+		conn.SetDeadline(time.Time{})
+		return rpc.NewClient(conn), nil
+	}
+	conn.Close()
+	if ctxErr := contextErr(ctx); ctxErr != nil {
+		return nil, ctxErr
+	} else if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	return nil, err
+}
+
+func (ls *libstore) getStorageServer(ctx context.Context, id uint32) (*rpc.Client, error) {
+	ls.connLock.Lock()
+	defer ls.connLock.Unlock()
+	if cli, ok := ls.conns[id]; ok {
+		return cli, nil
+	}
+	ls.ringLock.RLock()
+	hostport := ls.nodes[id]
+	ls.ringLock.RUnlock()
+	cli, err := dialHTTP(ctx, hostport, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ls.conns[id] = cli
+	return cli, nil
+}
+
+// invoke calls method on storage server id. A failure other than an error
+// returned by the server itself, or the end of ctx, marks the server down,
+// and a success clears its failures.
+func (ls *libstore) invoke(ctx context.Context, id uint32, method string, args, reply interface{}) error {
+	cli, err := ls.getStorageServer(ctx, id)
+	if err == nil {
+		if err = ls.callClient(ctx, cli, method, args, reply); err == nil {
+			ls.connLock.Lock()
+			delete(ls.failures, id)
+			ls.connLock.Unlock()
+			return nil
+		}
+	}
+	if _, ok := err.(rpc.ServerError); !ok && !isContextError(err) {
+		ls.markDown(id)
+	}
+	return err
+}
+
+// callClient calls method on cli, giving up after the call timeout or once
+// ctx is done. A server's refusal of a call past its deadline is returned as
+// context.DeadlineExceeded.
+func (ls *libstore) callClient(ctx context.Context, cli *rpc.Client, method string, args, reply interface{}) error {
+	var timeout <-chan time.Time
+	if ls.callTimeout > 0 {
+		timer := time.NewTimer(ls.callTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	call := cli.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ServerError(context.DeadlineExceeded.Error()) {
+			return context.DeadlineExceeded
+		}
+		return call.Error
+	case <-timeout:
+		return errCallTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// markDown drops the connection to storage server id and skips the server
+// for a time that doubles with each failure in a row.
+func (ls *libstore) markDown(id uint32) {
+	ls.connLock.Lock()
+	defer ls.connLock.Unlock()
+	if cli, ok := ls.conns[id]; ok {
+		cli.Close()
+		delete(ls.conns, id)
+	}
+	skip := time.Duration(downSeconds) * time.Second << uint(ls.failures[id])
+	if skip > maxDownSeconds*time.Second {
+		skip = maxDownSeconds * time.Second
+	} else {
+		ls.failures[id]++
+	}
+	ls.down[id] = time.Now().Add(skip)
+}
+
+// refreshRing asks the master for the ring and adopts it, dialing the
+// master again if needed. It reports whether the ring changed.
+func (ls *libstore) refreshRing() bool {
+	ls.masterLock.Lock()
+	defer ls.masterLock.Unlock()
+	if ls.masterCli == nil {
+		cli, err := dialHTTP(context.Background(), ls.master, dialTimeout)
+		if err != nil {
+			return false
+		}
+		ls.masterCli = cli
+	}
+	args := storagerpc.GetServersArgs{}
+	reply := storagerpc.GetServersReply{}
+	if err := ls.callClient(context.Background(), ls.masterCli, "StorageServer.GetServers", args, &reply); err != nil {
+		ls.masterCli.Close()
+		ls.masterCli = nil
+		return false
+	}
+	if reply.Status != storagerpc.OK {
+		return false
+	}
+	changed := !ls.sameRing(reply.Servers)
+	ls.useServers(reply.Servers)
+	return changed
+}
+
+// ringRefresher periodically asks the master for the ring, so that ring
+// changes and dead servers are noticed before an operation runs into them.
+func (ls *libstore) ringRefresher() {
+	for {
+		time.Sleep(refreshSeconds * time.Second)
+		ls.refreshRing()
+	}
+}
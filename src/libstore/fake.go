@@ -0,0 +1,576 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+	"skiplist"
+)
+
+// The fake libstore. A FakeLibstore keeps its keys in memory, in the process
+// that uses it, standing in for a libstore along with the storage servers
+// behind it, so that code built on a Libstore, such as an app server, can be
+// tested without starting any. It follows the storage servers: lists are
+// kept sorted, appending an item that is already there fails with
+// ErrItemExists and removing one that is not with ErrItemNotFound, every
+// write gives its key a later version, and the errors are those of the real
+// libstore. It has no lease cache, and expired keys vanish without a
+// DeleteEvent. SetFault and SetDelay inject failures and slow storage.
+
+// Fault decides whether an operation of a FakeLibstore fails: a non-nil
+// error is returned instead of carrying the operation out. method is the
+// storage server RPC that the real libstore would call, such as
+// "StorageServer.Get", and key the key it would call it for. Operations on
+// several keys consult the Fault once per key, and scans and watches with
+// their prefix.
+type Fault func(method, key string) error
+
+var errInjected = errors.New("injected fault")
+
+// Unavailable is a Fault that fails every operation as if no storage server
+// could be reached.
+func Unavailable(method, key string) error {
+	return &UnavailableError{Method: method, Key: key, Err: errInjected}
+}
+
+// FakeLibstore is an in-memory Libstore. It is safe for concurrent use.
+type FakeLibstore struct {
+	lock     sync.Mutex
+	lists    map[string]*skiplist.List // values of each key; a plain value is a list of one
+	versions map[string]uint64
+	expires  map[string]int64 // expiry time of the keys written with a TTL
+	clock    uint64           // last version given
+	watches  map[*Watch]bool  // open watches, and whether each has dropped changes
+	fault    Fault
+	delay    time.Duration
+}
+
+// NewFakeLibstore returns an empty FakeLibstore without faults.
+func NewFakeLibstore() *FakeLibstore {
+	return &FakeLibstore{
+		lists:    make(map[string]*skiplist.List),
+		versions: make(map[string]uint64),
+		expires:  make(map[string]int64),
+		watches:  make(map[*Watch]bool),
+	}
+}
+
+// SetFault makes every later operation consult fault before it is carried
+// out. nil removes the fault.
+func (f *FakeLibstore) SetFault(fault Fault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fault = fault
+}
+
+// SetDelay makes every later operation wait for d before it is carried out,
+// like a slow storage server, or give up with the error of its context if
+// that is done first. 0 removes the delay.
+func (f *FakeLibstore) SetDelay(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.delay = d
+}
+
+// begin waits out the delay of an operation, then consults the fault for
+// each of its keys.
+func (f *FakeLibstore) begin(ctx context.Context, method string, keys ...string) error {
+	f.lock.Lock()
+	fault, delay := f.fault, f.delay
+	f.lock.Unlock()
+	if err := sleep(ctx, delay); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if fault != nil {
+		for _, key := range keys {
+			if err := fault(method, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// get returns the values of key, without copying them, unless it is missing
+// or has expired, in which case it is dropped. The caller must hold f.lock.
+func (f *FakeLibstore) get(key string) (*skiplist.List, bool) {
+	if t, ok := f.expires[key]; ok && time.Now().UnixNano() >= t {
+		delete(f.lists, key)
+		delete(f.versions, key)
+		delete(f.expires, key)
+	}
+	list, ok := f.lists[key]
+	return list, ok
+}
+
+// check returns the status a storage server would reply to m with, setting
+// m.Version to the key's version on Conflict. The caller must hold f.lock.
+func (f *FakeLibstore) check(m *storagerpc.Mutation) storagerpc.Status {
+	list, ok := f.get(m.Key)
+	version := f.versions[m.Key]
+	switch m.Cond {
+	case storagerpc.IfVersion:
+		if version != m.Expect {
+			m.Version = version
+			return storagerpc.Conflict
+		}
+	case storagerpc.IfValue:
+		if !ok || list.Len() != 1 || !list.Contains(m.Old) {
+			m.Version = version
+			return storagerpc.Conflict
+		}
+	}
+	switch m.Op {
+	case storagerpc.DeleteOp:
+		if !ok {
+			return storagerpc.KeyNotFound
+		}
+	case storagerpc.AppendOp:
+		if ok && list.Contains(m.Value) {
+			return storagerpc.ItemExists
+		}
+	case storagerpc.RemoveOp:
+		if !ok || !list.Contains(m.Value) {
+			return storagerpc.ItemNotFound
+		}
+	}
+	return storagerpc.OK
+}
+
+// apply performs m, which check has passed, gives its key the next version,
+// stored in m.Version, and tells the watches. The caller must hold f.lock.
+func (f *FakeLibstore) apply(m *storagerpc.Mutation) {
+	f.clock++
+	m.Version = f.clock
+	switch m.Op {
+	case storagerpc.PutOp:
+		f.lists[m.Key] = skiplist.FromSorted([]string{m.Value})
+	case storagerpc.DeleteOp:
+		delete(f.lists, m.Key)
+	case storagerpc.AppendOp:
+		list, ok := f.lists[m.Key]
+		if !ok {
+			list = skiplist.New()
+			f.lists[m.Key] = list
+		}
+		list.Insert(m.Value)
+	case storagerpc.RemoveOp:
+		// The key stays even if no items are left.
+		f.lists[m.Key].Remove(m.Value)
+	}
+	if _, ok := f.lists[m.Key]; !ok {
+		delete(f.versions, m.Key)
+		delete(f.expires, m.Key)
+	} else {
+		f.versions[m.Key] = m.Version
+		if m.Expires != 0 {
+			f.expires[m.Key] = m.Expires
+		} else if m.Op == storagerpc.PutOp {
+			delete(f.expires, m.Key)
+		}
+	}
+	f.notify(m)
+}
+
+// write checks and applies m, returning the status of the check.
+func (f *FakeLibstore) write(m *storagerpc.Mutation) storagerpc.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := f.check(m)
+	if status == storagerpc.OK {
+		f.apply(m)
+	}
+	return status
+}
+
+// expiresAt returns the expiry time of a key written now with ttl, or 0 if
+// ttl is 0, rounding ttl up to whole seconds like the real libstore.
+func expiresAt(ttl time.Duration) int64 {
+	if seconds := ttlSeconds(ttl); seconds > 0 {
+		return time.Now().Add(time.Duration(seconds) * time.Second).UnixNano()
+	}
+	return 0
+}
+
+// writeError returns the error of the real libstore when a storage server
+// replies to method, performing m, with status.
+func writeError(method string, m *storagerpc.Mutation, status storagerpc.Status) error {
+	switch status {
+	case storagerpc.OK:
+		return nil
+	case storagerpc.KeyNotFound:
+		return &keyError{"Key " + m.Key + " not found", ErrKeyNotFound}
+	case storagerpc.ItemExists:
+		return &keyError{"Item " + m.Value + " exists under key " + m.Key, ErrItemExists}
+	case storagerpc.ItemNotFound:
+		return &keyError{"Item " + m.Value + " not found under key " + m.Key, ErrItemNotFound}
+	}
+	return &StatusError{Method: method, Key: m.Key, Status: status}
+}
+
+func (f *FakeLibstore) Get(key string) (string, error) {
+	return f.GetContext(context.Background(), key)
+}
+
+func (f *FakeLibstore) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := f.GetVersionContext(ctx, key)
+	return value, err
+}
+
+func (f *FakeLibstore) GetVersion(key string) (string, uint64, error) {
+	return f.GetVersionContext(context.Background(), key)
+}
+
+func (f *FakeLibstore) GetVersionContext(ctx context.Context, key string) (string, uint64, error) {
+	if err := f.begin(ctx, "StorageServer.Get", key); err != nil {
+		return "", 0, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list, ok := f.get(key)
+	if !ok {
+		return "", 0, &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	}
+	return first(list), f.versions[key], nil
+}
+
+// first returns the first value of list, or "" if it has none.
+func first(list *skiplist.List) string {
+	if values := list.Range(0, 1, false); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (f *FakeLibstore) Put(key, value string) error {
+	return f.PutWithTTLContext(context.Background(), key, value, 0)
+}
+
+func (f *FakeLibstore) PutContext(ctx context.Context, key, value string) error {
+	return f.PutWithTTLContext(ctx, key, value, 0)
+}
+
+func (f *FakeLibstore) PutWithTTL(key, value string, ttl time.Duration) error {
+	return f.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+func (f *FakeLibstore) PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := f.begin(ctx, "StorageServer.Put", key); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: key, Value: value, Expires: expiresAt(ttl)}
+	return writeError("StorageServer.Put", m, f.write(m))
+}
+
+func (f *FakeLibstore) Delete(key string) error {
+	return f.DeleteContext(context.Background(), key)
+}
+
+func (f *FakeLibstore) DeleteContext(ctx context.Context, key string) error {
+	if err := f.begin(ctx, "StorageServer.Delete", key); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.DeleteOp, Key: key}
+	return writeError("StorageServer.Delete", m, f.write(m))
+}
+
+func (f *FakeLibstore) GetList(key string) ([]string, error) {
+	return f.GetListContext(context.Background(), key)
+}
+
+func (f *FakeLibstore) GetListContext(ctx context.Context, key string) ([]string, error) {
+	if err := f.begin(ctx, "StorageServer.GetList", key); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list, ok := f.get(key)
+	if !ok {
+		return nil, &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	}
+	return list.Values(), nil
+}
+
+func (f *FakeLibstore) GetListRange(key string, start, count int, reverse bool) ([]string, error) {
+	return f.GetListRangeContext(context.Background(), key, start, count, reverse)
+}
+
+func (f *FakeLibstore) GetListRangeContext(ctx context.Context, key string, start, count int, reverse bool) ([]string, error) {
+	if err := f.begin(ctx, "StorageServer.GetListRange", key); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list, ok := f.get(key)
+	if !ok {
+		return nil, &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	}
+	return list.Range(start, count, reverse), nil
+}
+
+func (f *FakeLibstore) MultiGetListRange(keys []string, start, count int, reverse bool) (map[string][]string, error) {
+	return f.MultiGetListRangeContext(context.Background(), keys, start, count, reverse)
+}
+
+func (f *FakeLibstore) MultiGetListRangeContext(ctx context.Context, keys []string, start, count int, reverse bool) (map[string][]string, error) {
+	if err := f.begin(ctx, "StorageServer.MultiGetListRange", keys...); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	values := make(map[string][]string)
+	for _, key := range keys {
+		if list, ok := f.get(key); ok {
+			values[key] = list.Range(start, count, reverse)
+		}
+	}
+	return values, nil
+}
+
+func (f *FakeLibstore) AppendToList(key, newItem string) error {
+	return f.AppendToListWithTTLContext(context.Background(), key, newItem, 0)
+}
+
+func (f *FakeLibstore) AppendToListContext(ctx context.Context, key, newItem string) error {
+	return f.AppendToListWithTTLContext(ctx, key, newItem, 0)
+}
+
+func (f *FakeLibstore) AppendToListWithTTL(key, newItem string, ttl time.Duration) error {
+	return f.AppendToListWithTTLContext(context.Background(), key, newItem, ttl)
+}
+
+func (f *FakeLibstore) AppendToListWithTTLContext(ctx context.Context, key, newItem string, ttl time.Duration) error {
+	if err := f.begin(ctx, "StorageServer.AppendToList", key); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.AppendOp, Key: key, Value: newItem, Expires: expiresAt(ttl)}
+	return writeError("StorageServer.AppendToList", m, f.write(m))
+}
+
+func (f *FakeLibstore) RemoveFromList(key, removeItem string) error {
+	return f.RemoveFromListContext(context.Background(), key, removeItem)
+}
+
+func (f *FakeLibstore) RemoveFromListContext(ctx context.Context, key, removeItem string) error {
+	if err := f.begin(ctx, "StorageServer.RemoveFromList", key); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.RemoveOp, Key: key, Value: removeItem}
+	return writeError("StorageServer.RemoveFromList", m, f.write(m))
+}
+
+func (f *FakeLibstore) MultiGet(keys []string) (map[string]string, error) {
+	return f.MultiGetContext(context.Background(), keys)
+}
+
+func (f *FakeLibstore) MultiGetContext(ctx context.Context, keys []string) (map[string]string, error) {
+	if err := f.begin(ctx, "StorageServer.MultiGet", keys...); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	values := make(map[string]string)
+	for _, key := range keys {
+		if list, ok := f.get(key); ok {
+			values[key] = first(list)
+		}
+	}
+	return values, nil
+}
+
+func (f *FakeLibstore) MultiGetList(keys []string) (map[string][]string, error) {
+	return f.MultiGetListContext(context.Background(), keys)
+}
+
+func (f *FakeLibstore) MultiGetListContext(ctx context.Context, keys []string) (map[string][]string, error) {
+	if err := f.begin(ctx, "StorageServer.MultiGetList", keys...); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	values := make(map[string][]string)
+	for _, key := range keys {
+		if list, ok := f.get(key); ok {
+			values[key] = list.Values()
+		}
+	}
+	return values, nil
+}
+
+func (f *FakeLibstore) ConditionalPut(key, value string, version uint64) (uint64, error) {
+	return f.ConditionalPutContext(context.Background(), key, value, version)
+}
+
+func (f *FakeLibstore) ConditionalPutContext(ctx context.Context, key, value string, version uint64) (uint64, error) {
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: key, Value: value, Cond: storagerpc.IfVersion, Expect: version}
+	return f.conditionalPut(ctx, "StorageServer.ConditionalPut", m)
+}
+
+func (f *FakeLibstore) PutIfAbsent(key, value string) (uint64, error) {
+	return f.PutIfAbsentContext(context.Background(), key, value)
+}
+
+func (f *FakeLibstore) PutIfAbsentContext(ctx context.Context, key, value string) (uint64, error) {
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: key, Value: value, Cond: storagerpc.IfVersion}
+	return f.conditionalPut(ctx, "StorageServer.PutIfAbsent", m)
+}
+
+func (f *FakeLibstore) CompareAndSwap(key, oldValue, newValue string) (uint64, error) {
+	return f.CompareAndSwapContext(context.Background(), key, oldValue, newValue)
+}
+
+func (f *FakeLibstore) CompareAndSwapContext(ctx context.Context, key, oldValue, newValue string) (uint64, error) {
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: key, Value: newValue, Cond: storagerpc.IfValue, Old: oldValue}
+	return f.conditionalPut(ctx, "StorageServer.CompareAndSwap", m)
+}
+
+func (f *FakeLibstore) conditionalPut(ctx context.Context, method string, m *storagerpc.Mutation) (uint64, error) {
+	if err := f.begin(ctx, method, m.Key); err != nil {
+		return 0, err
+	}
+	switch status := f.write(m); status {
+	case storagerpc.OK:
+		return m.Version, nil
+	case storagerpc.Conflict:
+		return m.Version, ErrConflict
+	default:
+		return 0, writeError(method, m, status)
+	}
+}
+
+func (f *FakeLibstore) Scan(prefix, startAfter string, limit int) ([]string, string, error) {
+	return f.ScanContext(context.Background(), prefix, startAfter, limit)
+}
+
+func (f *FakeLibstore) ScanContext(ctx context.Context, prefix, startAfter string, limit int) ([]string, string, error) {
+	if err := f.begin(ctx, "StorageServer.Scan", prefix); err != nil {
+		return nil, "", err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	keys := make([]string, 0)
+	for key := range f.lists {
+		if strings.HasPrefix(key, prefix) && key > startAfter {
+			if _, ok := f.get(key); ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	more := false
+	if limit > 0 && len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+	return keys, token(keys, more), nil
+}
+
+func (f *FakeLibstore) Transact(ops []TxnOp) error {
+	return f.TransactContext(context.Background(), ops)
+}
+
+func (f *FakeLibstore) TransactContext(ctx context.Context, ops []TxnOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	muts, err := txnMutations(ops)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	if err := f.begin(ctx, "StorageServer.Transact", keys...); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i := range muts {
+		if status := f.check(&muts[i]); status != storagerpc.OK {
+			return txnError(status, muts[i].Key)
+		}
+	}
+	for i := range muts {
+		f.apply(&muts[i])
+	}
+	return nil
+}
+
+func (f *FakeLibstore) WatchKey(key string) (*Watch, error) {
+	return f.watch(storagerpc.WatchArgs{Prefix: key, Exact: true})
+}
+
+func (f *FakeLibstore) WatchPrefix(prefix string) (*Watch, error) {
+	return f.watch(storagerpc.WatchArgs{Prefix: prefix})
+}
+
+// watch opens a watch that notify sends the changes to. The watch counts as
+// having a poller until it is closed and no longer known to f, so that its
+// channel is only closed once notify cannot send to it.
+func (f *FakeLibstore) watch(args storagerpc.WatchArgs) (*Watch, error) {
+	if err := f.begin(context.Background(), "StorageServer.Watch", args.Prefix); err != nil {
+		return nil, err
+	}
+	events := make(chan WatchEvent, watchChannelSize)
+	w := &Watch{Events: events, args: args, events: events, done: make(chan struct{})}
+	w.pollers.Add(1)
+	f.lock.Lock()
+	f.watches[w] = false
+	f.lock.Unlock()
+	go func() {
+		<-w.done
+		f.lock.Lock()
+		delete(f.watches, w)
+		f.lock.Unlock()
+		w.pollers.Done()
+	}()
+	return w, nil
+}
+
+// notify sends the change m made to the watches of its key. A change that
+// does not fit in a watch's channel is dropped, and a LostEvent is sent
+// once there is room. The caller must hold f.lock.
+func (f *FakeLibstore) notify(m *storagerpc.Mutation) {
+	event := WatchEvent{Key: m.Key, Value: m.Value, Version: m.Version}
+	switch m.Op {
+	case storagerpc.PutOp:
+		event.Type = PutEvent
+	case storagerpc.DeleteOp:
+		event.Type, event.Value = DeleteEvent, ""
+	case storagerpc.AppendOp:
+		event.Type = AppendEvent
+	case storagerpc.RemoveOp:
+		event.Type = RemoveEvent
+	}
+	for w, lost := range f.watches {
+		if !strings.HasPrefix(m.Key, w.args.Prefix) || w.args.Exact && m.Key != w.args.Prefix {
+			continue
+		}
+		if lost {
+			select {
+			case w.events <- WatchEvent{Type: LostEvent}:
+				f.watches[w] = false
+			default:
+				continue
+			}
+		}
+		select {
+		case w.events <- event:
+		default:
+			f.watches[w] = true
+		}
+	}
+}
+
+// CacheStats returns zero counters, as a FakeLibstore has no lease cache.
+func (f *FakeLibstore) CacheStats() CacheStats {
+	return CacheStats{}
+}
@@ -0,0 +1,138 @@
+package libstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// checkError fails t unless err is of the kind target and reads msg.
+func checkError(t *testing.T, err, target error, msg string) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Fatalf("error %v, expected an error that is %q", err, target)
+	}
+	if err.Error() != msg {
+		t.Fatalf("incorrect error message %q, expected %q", err, msg)
+	}
+}
+
+// checkList fails t unless list is expected and err is nil.
+func checkList(t *testing.T, list []string, err error, expected []string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Fatalf("list %v, expected %v", list, expected)
+	}
+}
+
+// Test that the fake keeps lists sorted and fails with the errors of the
+// real libstore.
+func TestFakeLists(t *testing.T) {
+	ls := NewFakeLibstore()
+	for _, item := range []string{"carol", "alice", "bob"} {
+		if err := ls.AppendToList("list:a", item); err != nil {
+			t.Fatal("AppendToList:", err)
+		}
+	}
+	list, err := ls.GetList("list:a")
+	checkList(t, list, err, []string{"alice", "bob", "carol"})
+	list, err = ls.GetListRange("list:a", 0, 2, true)
+	checkList(t, list, err, []string{"carol", "bob"})
+	lists, err := ls.MultiGetListRange([]string{"list:a", "list:b"}, 1, 2, false)
+	if err != nil || len(lists) != 1 {
+		t.Fatal("MultiGetListRange:", lists, err)
+	}
+	checkList(t, lists["list:a"], nil, []string{"bob", "carol"})
+	checkError(t, ls.AppendToList("list:a", "bob"), ErrItemExists, "Item bob exists under key list:a")
+	checkError(t, ls.RemoveFromList("list:a", "dave"), ErrItemNotFound, "Item dave not found under key list:a")
+	_, err = ls.GetList("list:b")
+	checkError(t, err, ErrKeyNotFound, "Key list:b not found")
+
+	// A list emptied by its removals is still there.
+	ls.RemoveFromList("list:a", "alice")
+	ls.RemoveFromList("list:a", "bob")
+	ls.RemoveFromList("list:a", "carol")
+	list, err = ls.GetList("list:a")
+	checkList(t, list, err, []string{})
+}
+
+// Test versions, conditional writes, transactions and scans.
+func TestFakeVersions(t *testing.T) {
+	ls := NewFakeLibstore()
+	v1, err := ls.PutIfAbsent("ver:a", "1")
+	if err != nil || v1 == 0 {
+		t.Fatal("PutIfAbsent failed:", v1, err)
+	}
+	if v, err := ls.PutIfAbsent("ver:a", "2"); err != ErrConflict || v != v1 {
+		t.Fatal("PutIfAbsent of a present key:", v, err)
+	}
+	v2, err := ls.CompareAndSwap("ver:a", "1", "2")
+	if err != nil || v2 <= v1 {
+		t.Fatal("CompareAndSwap failed:", v2, err)
+	}
+	if _, err := ls.ConditionalPut("ver:a", "3", v1); err != ErrConflict {
+		t.Fatal("ConditionalPut of an old version:", err)
+	}
+
+	err = ls.Transact([]TxnOp{
+		{Type: TxnPut, Key: "ver:b", Value: "b"},
+		{Type: TxnDelete, Key: "ver:c"},
+	})
+	checkError(t, err, ErrKeyNotFound, "Key ver:c not found")
+	if _, err := ls.Get("ver:b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal("a failed transaction was applied:", err)
+	}
+
+	ls.Put("ver:b", "b")
+	ls.Put("ver:c", "c")
+	keys, next, err := ls.Scan("ver:", "", 2)
+	checkList(t, keys, err, []string{"ver:a", "ver:b"})
+	keys, next, err = ls.Scan("ver:", next, 2)
+	checkList(t, keys, err, []string{"ver:c"})
+	if next != "" {
+		t.Fatalf("Scan past the last key returned %q to continue from", next)
+	}
+}
+
+// Test that watches of the fake receive its changes, and are closed.
+func TestFakeWatch(t *testing.T) {
+	ls := NewFakeLibstore()
+	w, err := ls.WatchPrefix("watch:")
+	if err != nil {
+		t.Fatal("WatchPrefix:", err)
+	}
+	defer w.Close()
+	ls.Put("other:a", "x")
+	ls.Put("watch:a", "1")
+	ls.AppendToList("watch:b", "item")
+	ls.Delete("watch:a")
+	expected := []WatchEvent{
+		{Type: PutEvent, Key: "watch:a", Value: "1"},
+		{Type: AppendEvent, Key: "watch:b", Value: "item"},
+		{Type: DeleteEvent, Key: "watch:a"},
+	}
+	for _, e := range expected {
+		select {
+		case event := <-w.Events:
+			if event.Type != e.Type || event.Key != e.Key || event.Value != e.Value || event.Version == 0 {
+				t.Fatalf("event %v, expected %v", event, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, expected %v", e)
+		}
+	}
+
+	w.Close()
+	select {
+	case _, ok := <-w.Events:
+		if ok {
+			t.Fatal("event after the watch was closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the watch was not closed")
+	}
+}
@@ -0,0 +1,216 @@
+package libstore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rpc/adminrpc"
+	"rpc/storagerpc"
+)
+
+// Lease policies. In Normal mode a libstore asks its LeasePolicy, on every
+// read of a key it holds no lease on, whether to ask for a lease and for how
+// long, given the times of the earlier reads of the key. The policy is told
+// of every read, of the writes the libstore makes and of the leases storage
+// servers revoke, which stand for writes that may have been made elsewhere.
+// A storage server may still grant a shorter lease than asked for, or none.
+
+// maxReadHistory is the number of earlier reads of a key that policies are
+// given. Thresholds above it act as maxReadHistory.
+const maxReadHistory = 8
+
+// LeasePolicy decides which reads ask for leases. Its methods may be called
+// concurrently.
+type LeasePolicy interface {
+	// LeaseSeconds returns how long a lease a read of key should ask for,
+	// or 0 for none, given the times of the reads of the key before this
+	// one, up to the last maxReadHistory of them, oldest first. Reads are
+	// forgotten once the key has gone unread for readHistoryTTL.
+	LeaseSeconds(key string, reads []time.Time) int
+
+	// Read and Wrote are told of every read of key, cached or not, and of
+	// every write to it.
+	Read(key string)
+	Wrote(key string)
+}
+
+type frequencyPolicy struct {
+	threshold int
+	window    time.Duration
+	seconds   int
+}
+
+// NewFrequencyPolicy returns the policy that asks for a lease of
+// leaseDuration, rounded up to whole seconds and at most
+// storagerpc.LeaseSeconds, on a key read threshold times within the window
+// before this read. A threshold below 1 never asks for leases.
+func NewFrequencyPolicy(threshold int, window, leaseDuration time.Duration) LeasePolicy {
+	if threshold > maxReadHistory {
+		threshold = maxReadHistory
+	}
+	seconds := ttlSeconds(leaseDuration)
+	if seconds > storagerpc.LeaseSeconds {
+		seconds = storagerpc.LeaseSeconds
+	}
+	return &frequencyPolicy{threshold: threshold, window: window, seconds: seconds}
+}
+
+// DefaultLeasePolicy returns the policy used by NewLibstore: a lease of
+// storagerpc.LeaseSeconds on a key read storagerpc.QueryCacheThresh times
+// within storagerpc.QueryCacheSeconds.
+func DefaultLeasePolicy() LeasePolicy {
+	return NewFrequencyPolicy(storagerpc.QueryCacheThresh, storagerpc.QueryCacheSeconds*time.Second,
+		storagerpc.LeaseSeconds*time.Second)
+}
+
+func (p *frequencyPolicy) LeaseSeconds(key string, reads []time.Time) int {
+	if p.threshold < 1 || len(reads) < p.threshold {
+		return 0
+	}
+	if time.Since(reads[len(reads)-p.threshold]) >= p.window {
+		return 0
+	}
+	return p.seconds
+}
+
+func (p *frequencyPolicy) Read(key string)  {}
+func (p *frequencyPolicy) Wrote(key string) {}
+
+// The adaptive policy counts the reads and writes of each key type over
+// windows of adaptiveWindow, the last window counting half. The counts of a
+// type left alone for a few windows are dropped.
+const adaptiveWindow = 30 * time.Second
+
+type typeLoad struct {
+	reads, writes float64
+	start         time.Time // when the current window started
+}
+
+type adaptivePolicy struct {
+	base  frequencyPolicy
+	lock  sync.Mutex
+	loads map[string]*typeLoad // by prefix type
+	swept time.Time            // when stale loads were last dropped
+}
+
+// NewAdaptivePolicy returns the policy of NewFrequencyPolicy with the same
+// arguments, tuned by the ratio of writes to reads of each key type, such
+// as users' post lists, as adminrpc.PrefixType tells them apart. A type
+// that is only read gets leases after one read fewer than base asks for;
+// the more a type is written, the more reads a lease takes and the shorter
+// it is, and a type written as often as it is read gets none.
+func NewAdaptivePolicy(threshold int, window, leaseDuration time.Duration) LeasePolicy {
+	base := NewFrequencyPolicy(threshold, window, leaseDuration).(*frequencyPolicy)
+	return &adaptivePolicy{base: *base, loads: make(map[string]*typeLoad)}
+}
+
+// load returns the counts of the type of key, moving them on to the
+// current window. The caller must hold p.lock.
+func (p *adaptivePolicy) load(key string, now time.Time) *typeLoad {
+	if now.Sub(p.swept) > adaptiveWindow {
+		for key, l := range p.loads {
+			if now.Sub(l.start) > 4*adaptiveWindow {
+				delete(p.loads, key)
+			}
+		}
+		p.swept = now
+	}
+	keyType := adminrpc.PrefixType(key)
+	l, ok := p.loads[keyType]
+	if !ok {
+		l = &typeLoad{start: now}
+		p.loads[keyType] = l
+	}
+	for now.Sub(l.start) >= adaptiveWindow {
+		l.reads, l.writes = l.reads/2, l.writes/2
+		l.start = l.start.Add(adaptiveWindow)
+		if l.reads < 0.5 && l.writes < 0.5 {
+			l.reads, l.writes, l.start = 0, 0, now
+		}
+	}
+	return l
+}
+
+func (p *adaptivePolicy) LeaseSeconds(key string, reads []time.Time) int {
+	p.lock.Lock()
+	l := p.load(key, time.Now())
+	ratio := 1.0
+	if l.reads > 0 {
+		ratio = l.writes / l.reads
+	}
+	p.lock.Unlock()
+
+	tuned := p.base
+	switch {
+	case tuned.threshold < 1:
+		return 0
+	case ratio >= 1:
+		return 0
+	case ratio == 0:
+		if tuned.threshold > 1 {
+			tuned.threshold--
+		}
+	default:
+		tuned.threshold += int(ratio*float64(maxReadHistory-tuned.threshold) + 0.5)
+		tuned.seconds = int(float64(tuned.seconds)*(1-ratio) + 0.5)
+		if tuned.seconds < 1 {
+			tuned.seconds = 1
+		}
+	}
+	return tuned.LeaseSeconds(key, reads)
+}
+
+func (p *adaptivePolicy) Read(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.load(key, time.Now()).reads++
+}
+
+func (p *adaptivePolicy) Wrote(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.load(key, time.Now()).writes++
+}
+
+type prefixPolicy struct {
+	prefixes []string // longest first
+	policies map[string]LeasePolicy
+	fallback LeasePolicy
+}
+
+// NewPrefixPolicy returns a policy that hands each key to the policy of the
+// longest prefix of overrides the key starts with, or to fallback if there
+// is none.
+func NewPrefixPolicy(overrides map[string]LeasePolicy, fallback LeasePolicy) LeasePolicy {
+	p := &prefixPolicy{policies: make(map[string]LeasePolicy, len(overrides)), fallback: fallback}
+	for prefix, policy := range overrides {
+		p.prefixes = append(p.prefixes, prefix)
+		p.policies[prefix] = policy
+	}
+	sort.Slice(p.prefixes, func(i, j int) bool { return len(p.prefixes[i]) > len(p.prefixes[j]) })
+	return p
+}
+
+// policyOf returns the policy for key.
+func (p *prefixPolicy) policyOf(key string) LeasePolicy {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return p.policies[prefix]
+		}
+	}
+	return p.fallback
+}
+
+func (p *prefixPolicy) LeaseSeconds(key string, reads []time.Time) int {
+	return p.policyOf(key).LeaseSeconds(key, reads)
+}
+
+func (p *prefixPolicy) Read(key string) {
+	p.policyOf(key).Read(key)
+}
+
+func (p *prefixPolicy) Wrote(key string) {
+	p.policyOf(key).Wrote(key)
+}
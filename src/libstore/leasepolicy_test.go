@@ -0,0 +1,26 @@
+package libstore
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that the adaptive policy learns per key type: writes to the post
+// lists of some users stop leases on every user's post list, and on no
+// other type of key.
+func TestAdaptivePolicyByKeyType(t *testing.T) {
+	p := NewAdaptivePolicy(2, 10*time.Second, 10*time.Second)
+	for _, user := range []string{"alice", "bob", "carol"} {
+		p.Read(user + ":postlist")
+		p.Wrote(user + ":postlist")
+		p.Read(user + ":usrid")
+	}
+	now := time.Now()
+	reads := []time.Time{now, now}
+	if seconds := p.LeaseSeconds("dave:postlist", reads); seconds != 0 {
+		t.Fatalf("a lease of %d seconds on a post list, which is written as often as read", seconds)
+	}
+	if seconds := p.LeaseSeconds("dave:usrid", reads); seconds != 10 {
+		t.Fatalf("a lease of %d seconds on a user key, which is only read, expected 10", seconds)
+	}
+}
@@ -3,8 +3,12 @@
 package libstore
 
 import (
+	"context"
+	"errors"
 	"hash/fnv"
+	"strconv"
 	"strings"
+	"time"
 
 	"rpc/storagerpc"
 )
@@ -19,6 +23,36 @@ const (
 	Always                  // Always request leases.
 )
 
+// Config holds the settings of a libstore that NewLibstore leaves to their
+// defaults.
+type Config struct {
+	// Policy decides which reads ask for leases in Normal mode. nil means
+	// DefaultLeasePolicy().
+	Policy LeasePolicy
+
+	// CacheEntries and CacheBytes bound the number of keys in the lease
+	// cache and the bytes of their keys and values; past either, the least
+	// recently used keys are evicted. 0 means no limit on the number of keys
+	// and 64 MiB, and a negative CacheBytes means no limit on the bytes.
+	CacheEntries int
+	CacheBytes   int
+
+	// CallTimeout bounds how long a call to a storage server may take. 0
+	// means 30 seconds, and a negative value means no bound.
+	CallTimeout time.Duration
+}
+
+// CacheStats counts the work of the lease cache since the libstore was
+// created.
+type CacheStats struct {
+	Hits        uint64 // reads answered from the cache
+	Misses      uint64 // reads of keys the cache could not answer, in Normal mode
+	Evictions   uint64 // keys dropped to keep the cache within its limits
+	Expirations uint64 // keys dropped as their leases expired
+	Entries     int    // keys in the cache now
+	Bytes       int    // bytes of their keys and values
+}
+
 // Libstore defines the set of methods that a TribServer can call on its
 // local cache.
 type Libstore interface {
@@ -28,6 +62,202 @@ type Libstore interface {
 	GetList(key string) ([]string, error)
 	AppendToList(key, newItem string) error
 	RemoveFromList(key, removeItem string) error
+
+	// PutWithTTL is Put of a key that expires after ttl, rounded up to a
+	// whole number of seconds, and AppendToListWithTTL is AppendToList that
+	// makes the whole list expire after ttl. Expired keys are never
+	// returned. A later Put without a TTL makes the key permanent, while
+	// list operations without a TTL leave the list's expiry as it was.
+	PutWithTTL(key, value string, ttl time.Duration) error
+	AppendToListWithTTL(key, newItem string, ttl time.Duration) error
+
+	// MultiGet and MultiGetList are Get and GetList of several keys at once.
+	// They return the values of the keys that exist, by key, or an error if
+	// any key could not be read. Keys not found in the lease cache are
+	// fetched with one RPC per storage server, sent in parallel.
+	MultiGet(keys []string) (map[string]string, error)
+	MultiGetList(keys []string) (map[string][]string, error)
+
+	// GetListRange returns up to count items of the list at key, starting
+	// start items from its first item, or, if reverse, from its last one, in
+	// which case the items come last first. Only those items are sent by the
+	// storage server, unless the whole list is in the lease cache already;
+	// a range read does not ask for a lease.
+	GetListRange(key string, start, count int, reverse bool) ([]string, error)
+
+	// MultiGetListRange is GetListRange of the same range of several lists
+	// at once. Like MultiGetList, it returns the ranges of the lists that
+	// exist, by key, fetching those not in the lease cache with one RPC per
+	// storage server, sent in parallel.
+	MultiGetListRange(keys []string, start, count int, reverse bool) (map[string][]string, error)
+
+	// GetVersion is Get without the lease cache, also returning the
+	// version of the value.
+	GetVersion(key string) (string, uint64, error)
+
+	// ConditionalPut, PutIfAbsent and CompareAndSwap are Puts that only take
+	// place if the key has the given version (0 meaning that it must not
+	// exist), does not exist, or holds oldValue, respectively. They return
+	// the key's new version, or ErrConflict along with its current version
+	// (0 if it does not exist) if the condition does not hold.
+	ConditionalPut(key, value string, version uint64) (uint64, error)
+	PutIfAbsent(key, value string) (uint64, error)
+	CompareAndSwap(key, oldValue, newValue string) (uint64, error)
+
+	// Scan returns, in key order, up to limit keys (all of them if limit is
+	// 0) that start with prefix and sort after startAfter. It also returns a
+	// continuation token to pass as startAfter to get the following keys,
+	// which is empty once no keys are left.
+	Scan(prefix, startAfter string, limit int) ([]string, string, error)
+
+	// WatchKey and WatchPrefix subscribe to the changes of key, or of every
+	// key that starts with prefix, made from the time they return. The
+	// changes arrive on the Events channel of the returned Watch, those of
+	// each key in the order they were made; changes to different keys may
+	// arrive in another order. A Watch must be closed once no longer used.
+	WatchKey(key string) (*Watch, error)
+	WatchPrefix(prefix string) (*Watch, error)
+
+	// Transact applies ops, writes to distinct keys that may be stored on
+	// different storage servers, atomically: either every op takes place or
+	// none does. It fails, applying none, if any op would fail on its own,
+	// and with ErrConflict if another transaction kept holding one of the
+	// keys. Storage servers running Raft, or keeping no data directory,
+	// refuse it with ErrTxnUnsupported.
+	Transact(ops []TxnOp) error
+
+	// The Context variants of the operations above give up once ctx is
+	// done, returning its error, and send the deadline of ctx along to the
+	// storage servers, which refuse requests that reach them after it.
+	// Values found in the lease cache are returned all the same.
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+	GetListContext(ctx context.Context, key string) ([]string, error)
+	AppendToListContext(ctx context.Context, key, newItem string) error
+	RemoveFromListContext(ctx context.Context, key, removeItem string) error
+	PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error
+	AppendToListWithTTLContext(ctx context.Context, key, newItem string, ttl time.Duration) error
+	MultiGetContext(ctx context.Context, keys []string) (map[string]string, error)
+	MultiGetListContext(ctx context.Context, keys []string) (map[string][]string, error)
+	GetListRangeContext(ctx context.Context, key string, start, count int, reverse bool) ([]string, error)
+	MultiGetListRangeContext(ctx context.Context, keys []string, start, count int, reverse bool) (map[string][]string, error)
+	GetVersionContext(ctx context.Context, key string) (string, uint64, error)
+	ConditionalPutContext(ctx context.Context, key, value string, version uint64) (uint64, error)
+	PutIfAbsentContext(ctx context.Context, key, value string) (uint64, error)
+	CompareAndSwapContext(ctx context.Context, key, oldValue, newValue string) (uint64, error)
+	ScanContext(ctx context.Context, prefix, startAfter string, limit int) ([]string, string, error)
+	TransactContext(ctx context.Context, ops []TxnOp) error
+
+	// CacheStats returns the counters of the lease cache.
+	CacheStats() CacheStats
+}
+
+// TxnOpType tells what a write of a transaction does.
+type TxnOpType int
+
+const (
+	TxnPut    TxnOpType = iota + 1 // Set the key to Value.
+	TxnDelete                      // Delete the key.
+	TxnAppend                      // Add Value to the list at the key.
+	TxnRemove                      // Remove Value from the list at the key.
+)
+
+// TxnOp is a write of a transaction.
+type TxnOp struct {
+	Type  TxnOpType
+	Key   string
+	Value string
+}
+
+// EventType tells what a change to a watched key did.
+type EventType int
+
+const (
+	PutEvent     EventType = iota + 1 // The key was set to Value.
+	DeleteEvent                       // The key was deleted.
+	AppendEvent                       // Value was added to the list at the key.
+	RemoveEvent                       // Value was removed from the list at the key.
+	ReplaceEvent                      // The key was set to Values, as a repair or while moving between servers.
+	LostEvent                         // Changes may have been missed, as the watcher fell behind or lost a storage server; the watched keys have to be read again.
+)
+
+// WatchEvent is a change to a watched key, which gave it Version. Key and
+// Version are not set in a LostEvent.
+type WatchEvent struct {
+	Type    EventType
+	Key     string
+	Value   string
+	Values  []string
+	Version uint64
+}
+
+// ErrConflict is returned by the conditional writes when their condition
+// does not hold.
+var ErrConflict = errors.New("the key was changed concurrently")
+
+// ErrTxnUnsupported is returned by Transact when the storage servers run
+// Raft, which leaves transactions out, or have no data directory to log
+// them in.
+var ErrTxnUnsupported = errors.New("transactions are not supported by the storage servers")
+
+// The errors of operations that find a key or list item missing or present
+// against their expectations, or cannot reach the storage servers. The
+// errors returned wrap them, naming the key, and are told apart with
+// errors.Is.
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrItemExists   = errors.New("item exists")
+	ErrItemNotFound = errors.New("item not found")
+	ErrUnavailable  = errors.New("no storage server available")
+)
+
+// keyError is an error of the kind err, described by msg.
+type keyError struct {
+	msg string
+	err error
+}
+
+func (e *keyError) Error() string {
+	return e.msg
+}
+
+func (e *keyError) Unwrap() error {
+	return e.err
+}
+
+// UnavailableError is returned when no storage server could carry out
+// Method for Key: none could be reached in time, or they kept replying
+// WrongServer while the ring was changing. Err is the last failure. It
+// counts as ErrUnavailable.
+type UnavailableError struct {
+	Method string
+	Key    string
+	Err    error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Method + " of " + e.Key + ": no storage server available: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// StatusError is returned when a storage server replies to Method for Key
+// with a status that the operation does not expect.
+type StatusError struct {
+	Method string
+	Key    string
+	Status storagerpc.Status
+}
+
+func (e *StatusError) Error() string {
+	return e.Method + " of " + e.Key + ": unexpected status " + strconv.Itoa(int(e.Status))
 }
 
 // LeaseCallbacks defines the set of methods that a StorageServer can call
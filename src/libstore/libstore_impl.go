@@ -1,57 +1,55 @@
 package libstore
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net/rpc"
 	"sync"
 	"time"
 
+	"hashring"
 	"rpc/librpc"
 	"rpc/storagerpc"
 )
 
-type record struct {
-	storagerpc.Lease
-	history []int64
-}
+// The lease cache is striped over numCacheShards shards by a hash of the
+// whole key, each with its own lock, so that reads of keys in different
+// shards never wait for each other.
+const numCacheShards = 32
 
 type libstore struct {
 	hostPort string
 	mode     LeaseMode
-	ring     []uint32
+	policy   LeasePolicy // decides which reads ask for leases in Normal mode
+	ring     *hashring.Ring
 	nodes    map[uint32]string
+	replicas int // number of backups of each key range
+	vnodes   int // points on the ring per unit of weight
 	conns    map[uint32]*rpc.Client
-	cache    map[string][]string
-	records  map[string]*record
-	// keyLocks map[string]*sync.Mutex
-	lock     sync.Mutex
-}
-
-func binarySearchUint32(vals []uint32, val uint32) int {
-	i, j, mid := 0, len(vals)-1, 0
-	for i <= j {
-		mid = (i + j) / 2
-		if vals[mid] == val {
-			return mid
-		} else if vals[mid] < val {
-			i = mid + 1
-		} else {
-			j = mid - 1
-		}
-	}
-	return i
-}
+	down     map[uint32]time.Time // storage servers to skip until the given time
+	failures map[uint32]int       // failed calls in a row of the storage servers skipped
+	shards   [numCacheShards]*cacheShard
+	connLock sync.Mutex   // guards conns, down and failures
+	ringLock sync.RWMutex // guards ring, nodes, replicas and vnodes
 
-func searchHashRing(ring []uint32, key string) uint32 {
-	hash := StoreHash(key)
-	i := binarySearchUint32(ring, hash)
-	if i == len(ring) {
-		i = 0
-	}
-	return ring[i]
+	callTimeout time.Duration
+	master      string      // the master's host:port
+	masterCli   *rpc.Client // connection to the master, if any
+	masterLock  sync.Mutex  // guards masterCli
 }
 
+// How long a storage server that failed an RPC is skipped in favor of its
+// backups before the libstore tries it again.
+const downSeconds = 5
+
+// How many times an operation is retried when storage servers reply with
+// WrongServer while the ring is changing.
+const wrongServerRetries = 4
+
+// How often the libstore refreshes its view of the ring from the master.
+const refreshSeconds = 2
+
 // NewLibstore creates a new instance of a TribServer's libstore. masterServerHostPort
 // is the master storage server's host:port. myHostPort is this Libstore's host:port
 // (i.e. the callback address that the storage servers should use to send back
@@ -77,42 +75,57 @@ func searchHashRing(ring []uint32, key string) uint32 {
 // need to create a brand new HTTP handler to serve the requests (the Libstore may
 // simply reuse the TribServer's HTTP handler since the two run in the same process).
 func NewLibstore(masterServerHostPort, myHostPort string, mode LeaseMode) (Libstore, error) {
+	return NewLibstoreWithPolicy(masterServerHostPort, myHostPort, mode, nil)
+}
+
+// NewLibstoreWithPolicy is like NewLibstore but decides which reads ask for
+// leases in Normal mode with policy, or with DefaultLeasePolicy if policy
+// is nil.
+func NewLibstoreWithPolicy(masterServerHostPort, myHostPort string, mode LeaseMode, policy LeasePolicy) (Libstore, error) {
+	return NewLibstoreWithConfig(masterServerHostPort, myHostPort, mode, Config{Policy: policy})
+}
+
+// NewLibstoreWithConfig is like NewLibstore but with the settings in config.
+func NewLibstoreWithConfig(masterServerHostPort, myHostPort string, mode LeaseMode, config Config) (Libstore, error) {
+	policy := config.Policy
+	if policy == nil {
+		policy = DefaultLeasePolicy()
+	}
 	ls := &libstore{
 		hostPort: myHostPort,
 		mode:     mode,
-		ring:     make([]uint32, 0),
+		policy:   policy,
+		ring:     hashring.New(nil, 0),
 		nodes:    make(map[uint32]string),
 		conns:    make(map[uint32]*rpc.Client),
-		cache:    make(map[string][]string),
-		records:  make(map[string]*record),
-		// keyLocks: make(map[string]*sync.Mutex),
+		down:     make(map[uint32]time.Time),
+		failures: make(map[uint32]int),
+		shards:   newCacheShards(config),
+
+		callTimeout: callTimeoutOf(config),
+		master:      masterServerHostPort,
 	}
 
-	client, err := rpc.DialHTTP("tcp", masterServerHostPort)
+	client, err := dialHTTP(context.Background(), masterServerHostPort, dialTimeout)
 	if err != nil {
 		return nil, err
 	}
+	ls.masterCli = client
 	for re := 0; ; re++ {
 		if re >= 5 {
 			return nil, errors.New("Timeout when waiting StorageServer ready.")
 		}
 		args := storagerpc.GetServersArgs{}
 		reply := storagerpc.GetServersReply{}
-		err = client.Call("StorageServer.GetServers", args, &reply)
+		err = ls.callClient(context.Background(), client, "StorageServer.GetServers", args, &reply)
 		if err != nil {
-			log.Fatal("rpc error:", err)
+			client.Close()
+			return nil, err
 		}
 		if reply.Status == storagerpc.OK {
-			for _, node := range reply.Servers {
-				id := node.NodeID
-				addr := node.HostPort
-				i := binarySearchUint32(ls.ring, id)
-				temp := append(ls.ring, 0)
-				copy(temp[i+1:], ls.ring[i:])
-				temp[i] = id
-				ls.ring = temp
-				ls.nodes[id] = addr
-			}
+			ls.replicas = reply.Replicas
+			ls.vnodes = reply.VirtualNodes
+			ls.useServers(reply.Servers)
 			break
 		} else if reply.Status == storagerpc.NotReady {
 			time.Sleep(1 * time.Second)
@@ -125,113 +138,227 @@ func NewLibstore(masterServerHostPort, myHostPort string, mode LeaseMode) (Libst
 			return nil, err
 		}
 	}
-	go ls.cacheRecycler()
+	go ls.ringRefresher()
 	return ls, nil
 }
 
-// func (ls *libstore) lockKey(key string) {
-// 	ls.lock.Lock()
-// 	l, ok := ls.keyLocks[key]
-// 	if !ok {
-// 		l = new(sync.Mutex)
-// 		ls.keyLocks[key] = l
-// 	}
-// 	ls.lock.Unlock()
-// 	l.Lock()
-// }
-
-// func (ls *libstore) unlockKey(key string) {
-// 	ls.lock.Lock()
-// 	l, ok := ls.keyLocks[key]
-// 	if !ok {
-// 		log.Fatal("Lose reference to lock of key", key)
-// 	}
-// 	ls.lock.Unlock()
-// 	l.Unlock()
-// }
-
-func (ls *libstore) cacheRecycler() {
-	for {
-		if len(ls.cache)==0 {
-			time.Sleep(time.Duration(storagerpc.LeaseSeconds)*time.Second)
-			continue
+// shardOf returns the cache shard of key.
+func (ls *libstore) shardOf(key string) *cacheShard {
+	// 32-bit FNV-1a, inlined to keep lookups free of allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return ls.shards[h%numCacheShards]
+}
+
+// setRing replaces the ring with the one made of servers, dropping the
+// connections to servers that left it or moved.
+func (ls *libstore) setRing(servers []storagerpc.Node) {
+	points := make([]hashring.Node, 0, len(servers))
+	nodes := make(map[uint32]string)
+	for _, node := range servers {
+		points = append(points, hashring.Node{ID: node.NodeID, Weight: node.Weight})
+		nodes[node.NodeID] = node.HostPort
+	}
+	ls.ringLock.Lock()
+	old := ls.nodes
+	ls.ring, ls.nodes = hashring.New(points, ls.vnodes), nodes
+	ls.ringLock.Unlock()
+
+	ls.connLock.Lock()
+	defer ls.connLock.Unlock()
+	for id, cli := range ls.conns {
+		if hostport, ok := nodes[id]; !ok || hostport != old[id] {
+			cli.Close()
+			delete(ls.conns, id)
 		}
-		for key := range ls.cache {
-			ls.lock.Lock()
-			rec, ok := ls.records[key] 
-			if ok && (rec.history[len(rec.history)-1] < time.Now().Unix()-int64(rec.ValidSeconds) || rec.Granted == false) {
-				delete(ls.cache, key)
-				delete(ls.records, key)
-			}
-			ls.lock.Unlock()
-			var l int
-			if len(ls.cache) > 0 {
-				l = len(ls.cache)
-			} else {
-				l = 1
-			}
-			time.Sleep(time.Duration(storagerpc.LeaseSeconds/l)*time.Second)
+	}
+}
+
+// useServers adopts a GetServers view of the ring, skipping the servers it
+// reports dead.
+func (ls *libstore) useServers(servers []storagerpc.Node) {
+	if !ls.sameRing(servers) {
+		ls.setRing(servers)
+	}
+	for _, node := range servers {
+		if !node.Alive {
+			ls.markDown(node.NodeID)
 		}
 	}
 }
 
-func (ls *libstore) getStorageServer(key string) *rpc.Client {
-	id := searchHashRing(ls.ring, key)
-	cli, ok := ls.conns[id]
-	if !ok {
-		cli, err := rpc.DialHTTP("tcp", ls.nodes[id])
-		if err != nil {
-			log.Fatal("rpc error:", err)
+// sameRing reports whether servers describe the ring the libstore uses.
+func (ls *libstore) sameRing(servers []storagerpc.Node) bool {
+	ls.ringLock.RLock()
+	defer ls.ringLock.RUnlock()
+	if len(servers) != ls.ring.Len() {
+		return false
+	}
+	weights := make(map[uint32]int)
+	for _, node := range ls.ring.Nodes() {
+		weights[node.ID] = node.Weight
+	}
+	for _, node := range servers {
+		if hostport, ok := ls.nodes[node.NodeID]; !ok || hostport != node.HostPort {
+			return false
+		}
+		weight := node.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		if weights[node.NodeID] != weight {
+			return false
 		}
-		ls.conns[id] = cli
-		return cli
 	}
-	return cli
+	return true
 }
 
-func (ls *libstore) Get(key string) (string, error) {
-	ls.lock.Lock()
-	wantLease := false
-	rec, recExists := ls.records[key]
-	switch ls.mode {
-	case Never:
-		wantLease = false
-	case Always:
-		wantLease = true
-	default:
-		if recExists {
-			if rec.history[len(rec.history)-1] < time.Now().Unix()-int64(rec.ValidSeconds) {
-				rec.Granted = false
-				// delete(ls.cache, key)
+// replicaSet returns the storage servers holding key, primary first.
+func (ls *libstore) replicaSet(key string) []uint32 {
+	ls.ringLock.RLock()
+	defer ls.ringLock.RUnlock()
+	return ls.ring.ReplicaSet(StoreHash(key), ls.replicas)
+}
+
+// call invokes method for key, following ring changes: when the server
+// replies with WrongServer, the libstore switches to the ring carried by the
+// reply, or else asks the master for the ring, and tries again. Idempotent
+// methods are also tried again when no server of key can be reached. Errors
+// returned by a server itself are passed through, and other failures, as
+// well as writes that too few replicas applied, are returned as an
+// *UnavailableError. Once ctx is done, its error is returned.
+func (ls *libstore) call(ctx context.Context, key, method string, args, reply interface{}) error {
+	for retry, round := 0, 0; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ls.callReplicas(ctx, key, method, args, reply); err != nil {
+			if _, ok := err.(rpc.ServerError); ok || isContextError(err) {
+				return err
+			}
+			if !idempotent[method] || round == callRetries {
+				return &UnavailableError{Method: method, Key: key, Err: err}
 			}
-			if rec.Granted {
-				rec.history = append(rec.history, time.Now().Unix())
-				if len(rec.history) > storagerpc.QueryCacheThresh {
-					rec.history = rec.history[len(rec.history)-storagerpc.QueryCacheThresh:]
-				}
-				values, ok := ls.cache[key]
-				if !ok {
-					log.Fatal("Cache inconsistent at key", key)
-				}
-				result := make([]string, len(values))
-				copy(result, values)
-				ls.lock.Unlock()
-				return result[0], nil
-			} else {
-				if len(rec.history) >= storagerpc.QueryCacheThresh && rec.history[0] > time.Now().Unix()-int64(storagerpc.QueryCacheSeconds) {
-					wantLease = true
-				}
+			if err := sleep(ctx, callRetryPause<<uint(round)); err != nil {
+				return err
+			}
+			round++
+			continue
+		}
+		if notReplicated(reply) {
+			return &UnavailableError{Method: method, Key: key, Err: errUnreplicated}
+		}
+		servers, wrong := wrongServer(reply)
+		if !wrong {
+			return nil
+		}
+		if retry == wrongServerRetries {
+			return &UnavailableError{Method: method, Key: key, Err: errRingMoving}
+		}
+		if len(servers) > 0 && !ls.sameRing(servers) {
+			ls.setRing(servers)
+		} else if !ls.refreshRing() {
+			// The servers are still moving keys around; give them time.
+			if err := sleep(ctx, time.Duration(retry+1)*100*time.Millisecond); err != nil {
+				return err
 			}
 		}
+		retry++
+	}
+}
+
+// wrongServer extracts the ring carried by a WrongServer reply.
+func wrongServer(reply interface{}) ([]storagerpc.Node, bool) {
+	switch r := reply.(type) {
+	case *storagerpc.GetReply:
+		return r.Servers, r.Status == storagerpc.WrongServer
+	case *storagerpc.GetListReply:
+		return r.Servers, r.Status == storagerpc.WrongServer
+	case *storagerpc.PutReply:
+		return r.Servers, r.Status == storagerpc.WrongServer
+	case *storagerpc.DeleteReply:
+		return r.Servers, r.Status == storagerpc.WrongServer
+	case *storagerpc.ScanReply:
+		return r.Servers, r.Status == storagerpc.WrongServer
+	case *storagerpc.TransactReply:
+		return r.Servers, r.Status == storagerpc.WrongServer
+	case *storagerpc.MultiGetReply:
+		// A batch of a single key, as multiGet sends to retry a key.
+		if len(r.Replies) == 1 {
+			return r.Replies[0].Servers, r.Replies[0].Status == storagerpc.WrongServer
+		}
+	case *storagerpc.MultiGetListReply:
+		if len(r.Replies) == 1 {
+			return r.Replies[0].Servers, r.Replies[0].Status == storagerpc.WrongServer
+		}
+	}
+	return nil, false
+}
+
+// notReplicated reports whether reply is to a write that its server applied
+// but could not get enough of the key's replicas to apply.
+func notReplicated(reply interface{}) bool {
+	switch r := reply.(type) {
+	case *storagerpc.PutReply:
+		return r.Status == storagerpc.NotReplicated
+	case *storagerpc.DeleteReply:
+		return r.Status == storagerpc.NotReplicated
+	}
+	return false
+}
+
+// callReplicas invokes method on the first reachable member of key's replica
+// set, failing over to the backups when the primary cannot be reached. Errors
+// returned by a server itself are passed through without failing over.
+func (ls *libstore) callReplicas(ctx context.Context, key, method string, args, reply interface{}) error {
+	err := errNoServers
+	for _, id := range ls.liveReplicas(key) {
+		err = ls.invoke(ctx, id, method, args, reply)
+		if _, ok := err.(rpc.ServerError); err == nil || ok || isContextError(err) {
+			return err
+		}
+		log.Printf("Storage server %d failed, trying next replica: %v", id, err)
+	}
+	return err
+}
+
+// liveReplicas returns the members of key's replica set that are not being
+// skipped, primary first, or the whole set if they all are.
+func (ls *libstore) liveReplicas(key string) []uint32 {
+	set := ls.replicaSet(key)
+	live := make([]uint32, 0, len(set))
+	ls.connLock.Lock()
+	defer ls.connLock.Unlock()
+	for _, id := range set {
+		if time.Now().After(ls.down[id]) {
+			live = append(live, id)
+		}
+	}
+	if len(live) == 0 {
+		return set
+	}
+	return live
+}
+
+func (ls *libstore) Get(key string) (string, error) {
+	return ls.GetContext(context.Background(), key)
+}
+
+func (ls *libstore) GetContext(ctx context.Context, key string) (string, error) {
+	values, cached, lease := ls.lookup(key)
+	if cached {
+		return values[0], nil
 	}
-	ls.lock.Unlock()
 
 	// not cached retrieve from remote server
-	cli := ls.getStorageServer(key)
-	args := &storagerpc.GetArgs{Key: key, WantLease: wantLease, HostPort: ls.hostPort}
+	args := &storagerpc.GetArgs{Key: key, WantLease: lease > 0, LeaseSeconds: lease, HostPort: ls.hostPort,
+		Timeout: storagerpc.TimeoutOf(ctx)}
 	var reply storagerpc.GetReply
 	t := time.Now()
-	err := cli.Call("StorageServer.Get", args, &reply)
+	err := ls.call(ctx, key, "StorageServer.Get", args, &reply)
 	if time.Now().Sub(t)>100*time.Millisecond {
 		log.Printf("Slow StorageServer.Get")
 	}
@@ -239,38 +366,74 @@ func (ls *libstore) Get(key string) (string, error) {
 		return "", err
 	}
 	if reply.Status == storagerpc.OK {
-		ls.lock.Lock()
-		if !recExists {
-			rec = &record{
-				storagerpc.Lease{false, storagerpc.LeaseSeconds},
-				make([]int64, 0),
-			}
-			ls.records[key] = rec
-		}
-		rec.history = append(rec.history, time.Now().Unix())
-		if len(rec.history) > storagerpc.QueryCacheThresh {
-			rec.history = rec.history[len(rec.history)-storagerpc.QueryCacheThresh:]
-		}
-		if wantLease {
-			rec.Granted = reply.Lease.Granted
-			rec.ValidSeconds = reply.Lease.ValidSeconds
-			ls.cache[key] = []string{reply.Value}
-		}
-		ls.lock.Unlock()
+		ls.remember(key, reply.Lease, []string{reply.Value}, t)
 		return reply.Value, nil
 	} else if reply.Status == storagerpc.KeyNotFound {
-		return "", errors.New("Key " + key + " not found")
+		return "", &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	}
+	return "", &StatusError{Method: "StorageServer.Get", Key: key, Status: reply.Status}
+}
+
+// lookup consults the lease cache before a read of key. It returns a copy of
+// the cached values if the libstore holds a valid lease on key, and otherwise
+// how long a lease the read should ask for, 0 for none.
+func (ls *libstore) lookup(key string) ([]string, bool, int) {
+	switch ls.mode {
+	case Never:
+		return nil, false, 0
+	case Always:
+		return nil, false, storagerpc.LeaseSeconds
+	}
+	ls.policy.Read(key)
+	sh := ls.shardOf(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if values, ok := sh.get(key); ok {
+		sh.read(key)
+		result := make([]string, len(values))
+		copy(result, values)
+		return result, true, 0
+	}
+	var reads []time.Time
+	if rec, ok := sh.records[key]; ok {
+		reads = append(reads, rec.history...)
+	}
+	return nil, false, ls.policy.LeaseSeconds(key, reads)
+}
+
+// remember records a read of key, sent at sent, that a storage server
+// answered, caching values until the lease it granted, if any, expires.
+func (ls *libstore) remember(key string, lease storagerpc.Lease, values []string, sent time.Time) {
+	sh := ls.shardOf(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	rec := sh.read(key)
+	if lease.Granted {
+		sh.put(key, rec, values, sent.Add(time.Duration(lease.ValidSeconds)*time.Second))
+	} else {
+		sh.drop(rec)
 	}
-	return "", errors.New("Should not be reached")
 }
 
 func (ls *libstore) Put(key, value string) error {
-	cli := ls.getStorageServer(key)
-	args := storagerpc.PutArgs{key, value}
+	return ls.PutWithTTLContext(context.Background(), key, value, 0)
+}
+
+func (ls *libstore) PutContext(ctx context.Context, key, value string) error {
+	return ls.PutWithTTLContext(ctx, key, value, 0)
+}
+
+func (ls *libstore) PutWithTTL(key, value string, ttl time.Duration) error {
+	return ls.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+func (ls *libstore) PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	ls.policy.Wrote(key)
+	args := storagerpc.PutArgs{Key: key, Value: value, TTLSeconds: ttlSeconds(ttl), Timeout: storagerpc.TimeoutOf(ctx)}
 	reply := storagerpc.PutReply{}
 
 	t := time.Now()
-	err := cli.Call("StorageServer.Put", &args, &reply)
+	err := ls.call(ctx, key, "StorageServer.Put", &args, &reply)
 	if time.Now().Sub(t)>100*time.Millisecond {
 		log.Println("Slow StorageServer.Put")
 	}
@@ -281,16 +444,20 @@ func (ls *libstore) Put(key, value string) error {
 	if reply.Status == storagerpc.OK {
 		return nil
 	}
-	return errors.New("Should not be reached")
+	return &StatusError{Method: "StorageServer.Put", Key: key, Status: reply.Status}
 }
 
 func (ls *libstore) Delete(key string) error {
-	cli := ls.getStorageServer(key)
-	args := storagerpc.DeleteArgs{key}
+	return ls.DeleteContext(context.Background(), key)
+}
+
+func (ls *libstore) DeleteContext(ctx context.Context, key string) error {
+	ls.policy.Wrote(key)
+	args := storagerpc.DeleteArgs{Key: key, Timeout: storagerpc.TimeoutOf(ctx)}
 	reply := storagerpc.DeleteReply{}
 
 	t := time.Now()
-	err := cli.Call("StorageServer.Delete", &args, &reply)
+	err := ls.call(ctx, key, "StorageServer.Delete", &args, &reply)
 	if time.Now().Sub(t)>100*time.Millisecond {
 		log.Println("Slow StorageServer.Delete")
 	}
@@ -301,58 +468,28 @@ func (ls *libstore) Delete(key string) error {
 	if reply.Status == storagerpc.OK {
 		return nil
 	} else if reply.Status == storagerpc.KeyNotFound {
-		return errors.New("Key " + key + " not found")
+		return &keyError{"Key " + key + " not found", ErrKeyNotFound}
 	}
-	return errors.New("Should not be reached")
+	return &StatusError{Method: "StorageServer.Delete", Key: key, Status: reply.Status}
 }
 
 func (ls *libstore) GetList(key string) ([]string, error) {
-	ls.lock.Lock()
-	wantLease := false
-	rec, recExists := ls.records[key]
-	switch ls.mode {
-	case Never:
-		wantLease = false
-	case Always:
-		wantLease = true
-	default:
-		if recExists {
-			if rec.history[len(rec.history)-1] < time.Now().Unix()-int64(rec.ValidSeconds) {
-				rec.Granted = false
-				// delete(ls.cache, key)
-			}
-			if rec.Granted {
-				rec.history = append(rec.history, time.Now().Unix())
-				if len(rec.history) > storagerpc.QueryCacheThresh {
-					rec.history = rec.history[len(rec.history)-storagerpc.QueryCacheThresh:]
-				}
-
-				values, ok := ls.cache[key]
-				if !ok {
-					log.Fatal("Cache inconsistent at key", key)
-				}
-
-				result := make([]string, len(values))
-				copy(result, values)
-				ls.lock.Unlock()
-				return result, nil
-			} else {
-				if len(rec.history) >= storagerpc.QueryCacheThresh && rec.history[0] > time.Now().Unix()-int64(storagerpc.QueryCacheSeconds) {
-					wantLease = true
-				}
-			}
-		}
+	return ls.GetListContext(context.Background(), key)
+}
+
+func (ls *libstore) GetListContext(ctx context.Context, key string) ([]string, error) {
+	values, cached, lease := ls.lookup(key)
+	if cached {
+		return values, nil
 	}
-	ls.lock.Unlock()
 	// not cached retrieve from remote server
-	cli := ls.getStorageServer(key)
-	
 
-	args := storagerpc.GetArgs{key, wantLease, ls.hostPort}
+	args := storagerpc.GetArgs{Key: key, WantLease: lease > 0, LeaseSeconds: lease, HostPort: ls.hostPort,
+		Timeout: storagerpc.TimeoutOf(ctx)}
 	reply := storagerpc.GetListReply{}
 
 	t := time.Now()
-	err := cli.Call("StorageServer.GetList", &args, &reply)
+	err := ls.call(ctx, key, "StorageServer.GetList", &args, &reply)
 	if time.Now().Sub(t)>100*time.Millisecond {
 		log.Println("Slow StorageServer.GetList")
 	}
@@ -361,39 +498,86 @@ func (ls *libstore) GetList(key string) ([]string, error) {
 		return nil, err
 	}
 	if reply.Status == storagerpc.OK {
-		ls.lock.Lock()
-		if !recExists {
-			rec = &record{
-				storagerpc.Lease{false, storagerpc.LeaseSeconds},
-				make([]int64, 0),
-			}
-			ls.records[key] = rec
-		}
-		rec.history = append(rec.history, time.Now().Unix())
-		if len(rec.history) > storagerpc.QueryCacheThresh {
-			rec.history = rec.history[len(rec.history)-storagerpc.QueryCacheThresh:]
-		}
-		if wantLease {
-			rec.Granted = reply.Lease.Granted
-			rec.ValidSeconds = reply.Lease.ValidSeconds
-			ls.cache[key] = reply.Value
-		}
+		ls.remember(key, reply.Lease, reply.Value, t)
 		result := make([]string, len(reply.Value))
 		copy(result, reply.Value)
-		ls.lock.Unlock()
 		return result, nil
 	} else if reply.Status == storagerpc.KeyNotFound {
-		return nil, errors.New("Key " + key + " not found")
+		return nil, &keyError{"Key " + key + " not found", ErrKeyNotFound}
 	}
-	return nil, errors.New("Unknown reply")
+	return nil, &StatusError{Method: "StorageServer.GetList", Key: key, Status: reply.Status}
+}
+
+func (ls *libstore) GetListRange(key string, start, count int, reverse bool) ([]string, error) {
+	return ls.GetListRangeContext(context.Background(), key, start, count, reverse)
+}
+
+func (ls *libstore) GetListRangeContext(ctx context.Context, key string, start, count int, reverse bool) ([]string, error) {
+	if values, ok := ls.cached(key); ok {
+		return listRange(values, start, count, reverse), nil
+	}
+	args := storagerpc.GetListRangeArgs{Key: key, Start: start, Count: count, Reverse: reverse,
+		Timeout: storagerpc.TimeoutOf(ctx)}
+	reply := storagerpc.GetListReply{}
+	if err := ls.call(ctx, key, "StorageServer.GetListRange", &args, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Status == storagerpc.OK {
+		if reply.Value == nil {
+			return make([]string, 0), nil
+		}
+		return reply.Value, nil
+	} else if reply.Status == storagerpc.KeyNotFound {
+		return nil, &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	}
+	return nil, &StatusError{Method: "StorageServer.GetListRange", Key: key, Status: reply.Status}
+}
+
+// cached returns the cached values of key, without copying them, if the
+// libstore holds a valid lease on key. Unlike lookup, it does not count as
+// a read of key.
+func (ls *libstore) cached(key string) ([]string, bool) {
+	if ls.mode == Never || ls.mode == Always {
+		return nil, false
+	}
+	sh := ls.shardOf(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	return sh.get(key)
+}
+
+// listRange copies the range of values that GetListRange asks for.
+func listRange(values []string, start, count int, reverse bool) []string {
+	if start < 0 {
+		start = 0
+	}
+	if count > len(values)-start {
+		count = len(values) - start
+	}
+	if count <= 0 {
+		return make([]string, 0)
+	}
+	result := make([]string, count)
+	if reverse {
+		for i := range result {
+			result[i] = values[len(values)-1-start-i]
+		}
+	} else {
+		copy(result, values[start:])
+	}
+	return result
 }
 
 func (ls *libstore) RemoveFromList(key, removeItem string) error {
-	cli := ls.getStorageServer(key)
-	args := storagerpc.PutArgs{key, removeItem}
+	return ls.RemoveFromListContext(context.Background(), key, removeItem)
+}
+
+func (ls *libstore) RemoveFromListContext(ctx context.Context, key, removeItem string) error {
+	ls.policy.Wrote(key)
+	args := storagerpc.PutArgs{Key: key, Value: removeItem, Timeout: storagerpc.TimeoutOf(ctx)}
 	reply := storagerpc.PutReply{}
 	t := time.Now()
-	err := cli.Call("StorageServer.RemoveFromList", &args, &reply)
+	err := ls.call(ctx, key, "StorageServer.RemoveFromList", &args, &reply)
 	if time.Now().Sub(t)>100*time.Millisecond {
 		log.Println("Slow StorageServer.RemoveFromList")
 	}
@@ -403,17 +587,29 @@ func (ls *libstore) RemoveFromList(key, removeItem string) error {
 	if reply.Status == storagerpc.OK {
 		return nil
 	} else if reply.Status == storagerpc.ItemNotFound {
-		return errors.New("Item " + removeItem + " not found under key " + key)
+		return &keyError{"Item " + removeItem + " not found under key " + key, ErrItemNotFound}
 	}
-	return errors.New("Unknown reply")
+	return &StatusError{Method: "StorageServer.RemoveFromList", Key: key, Status: reply.Status}
 }
 
 func (ls *libstore) AppendToList(key, newItem string) error {
-	cli := ls.getStorageServer(key)
-	args := storagerpc.PutArgs{key, newItem}
+	return ls.AppendToListWithTTLContext(context.Background(), key, newItem, 0)
+}
+
+func (ls *libstore) AppendToListContext(ctx context.Context, key, newItem string) error {
+	return ls.AppendToListWithTTLContext(ctx, key, newItem, 0)
+}
+
+func (ls *libstore) AppendToListWithTTL(key, newItem string, ttl time.Duration) error {
+	return ls.AppendToListWithTTLContext(context.Background(), key, newItem, ttl)
+}
+
+func (ls *libstore) AppendToListWithTTLContext(ctx context.Context, key, newItem string, ttl time.Duration) error {
+	ls.policy.Wrote(key)
+	args := storagerpc.PutArgs{Key: key, Value: newItem, TTLSeconds: ttlSeconds(ttl), Timeout: storagerpc.TimeoutOf(ctx)}
 	reply := storagerpc.PutReply{}
 	t := time.Now()
-	err := cli.Call("StorageServer.AppendToList", &args, &reply)
+	err := ls.call(ctx, key, "StorageServer.AppendToList", &args, &reply)
 	if time.Now().Sub(t)>100*time.Millisecond {
 		log.Println("Slow StorageServer.AppendToList")
 	}
@@ -423,18 +619,26 @@ func (ls *libstore) AppendToList(key, newItem string) error {
 	if reply.Status == storagerpc.OK {
 		return nil
 	} else if reply.Status == storagerpc.ItemExists {
-		return errors.New("Item " + newItem + " exists under key " + key)
+		return &keyError{"Item " + newItem + " exists under key " + key, ErrItemExists}
+	}
+	return &StatusError{Method: "StorageServer.AppendToList", Key: key, Status: reply.Status}
+}
+
+// ttlSeconds rounds ttl up to whole seconds.
+func ttlSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
 	}
-	return errors.New("Unknown reply")
+	return int((ttl + time.Second - 1) / time.Second)
 }
 
 func (ls *libstore) RevokeLease(args *storagerpc.RevokeLeaseArgs, reply *storagerpc.RevokeLeaseReply) error {
 	key := args.Key
-	ls.lock.Lock()
-	defer ls.lock.Unlock()
-	if _, ok := ls.cache[key]; ok {
-		delete(ls.cache, key)
-		ls.records[key].Granted = false
+	ls.policy.Wrote(key)
+	sh := ls.shardOf(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if rec, ok := sh.records[key]; ok && sh.drop(rec) {
 		reply.Status = storagerpc.OK
 	} else {
 		reply.Status = storagerpc.KeyNotFound
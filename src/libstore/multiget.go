@@ -0,0 +1,240 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+func (ls *libstore) MultiGet(keys []string) (map[string]string, error) {
+	return ls.MultiGetContext(context.Background(), keys)
+}
+
+func (ls *libstore) MultiGetContext(ctx context.Context, keys []string) (map[string]string, error) {
+	lists, err := ls.multiGet(ctx, keys, false)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(lists))
+	for key, list := range lists {
+		values[key] = list[0]
+	}
+	return values, nil
+}
+
+func (ls *libstore) MultiGetList(keys []string) (map[string][]string, error) {
+	return ls.multiGet(context.Background(), keys, true)
+}
+
+func (ls *libstore) MultiGetListContext(ctx context.Context, keys []string) (map[string][]string, error) {
+	return ls.multiGet(ctx, keys, true)
+}
+
+// multiGet reads keys, as single values or as lists. Keys cached under a
+// lease are answered locally and the others are sent in one batch per
+// primary, to all primaries at once. A key whose batch failed, or whose
+// server replied WrongServer, is read again on its own, failing over to its
+// backups and following ring changes like any other read.
+func (ls *libstore) multiGet(ctx context.Context, keys []string, list bool) (map[string][]string, error) {
+	method := "StorageServer.MultiGet"
+	if list {
+		method = "StorageServer.MultiGetList"
+	}
+	values := make(map[string][]string)
+	batches := make(map[uint32]*storagerpc.MultiGetArgs)
+	queued := make(map[string]bool)
+	for _, key := range keys {
+		if _, ok := values[key]; ok || queued[key] {
+			continue
+		}
+		cached, ok, lease := ls.lookup(key)
+		if ok {
+			values[key] = cached
+			continue
+		}
+		live := ls.liveReplicas(key)
+		if len(live) == 0 {
+			return nil, &UnavailableError{Method: method, Key: key, Err: errNoServers}
+		}
+		queued[key] = true
+		args, ok := batches[live[0]]
+		if !ok {
+			args = &storagerpc.MultiGetArgs{HostPort: ls.hostPort, Timeout: storagerpc.TimeoutOf(ctx)}
+			batches[live[0]] = args
+		}
+		args.Keys = append(args.Keys, key)
+		args.WantLease = append(args.WantLease, lease > 0)
+		args.LeaseSeconds = append(args.LeaseSeconds, lease)
+	}
+
+	var lock sync.Mutex // guards values and err
+	var err error
+	var wg sync.WaitGroup
+	for id, args := range batches {
+		wg.Add(1)
+		go func(id uint32, args *storagerpc.MultiGetArgs) {
+			defer wg.Done()
+			sent := time.Now()
+			replies := ls.batch(ctx, id, method, args, list)
+			for i, key := range args.Keys {
+				var reply storagerpc.GetListReply
+				var e error
+				if replies != nil && replies[i].Status != storagerpc.WrongServer {
+					reply = replies[i]
+				} else {
+					reply, e = ls.retry(ctx, key, args.LeaseSeconds[i], method, list)
+				}
+				if e == nil && reply.Status == storagerpc.OK {
+					ls.remember(key, reply.Lease, reply.Value, sent)
+				} else if e == nil && reply.Status != storagerpc.KeyNotFound {
+					e = &StatusError{Method: method, Key: key, Status: reply.Status}
+				}
+				lock.Lock()
+				if e != nil && err == nil {
+					err = e
+				} else if reply.Status == storagerpc.OK {
+					values[key] = append([]string{}, reply.Value...)
+				}
+				lock.Unlock()
+			}
+		}(id, args)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// batch sends a batched get to storage server id and returns the replies
+// for its keys, or nil if the batch failed.
+func (ls *libstore) batch(ctx context.Context, id uint32, method string, args *storagerpc.MultiGetArgs, list bool) []storagerpc.GetListReply {
+	reply := newMultiGetReply(list)
+	if err := ls.invoke(ctx, id, method, args, reply); err != nil {
+		return nil
+	}
+	if replies := listReplies(reply); len(replies) == len(args.Keys) {
+		return replies
+	}
+	return nil
+}
+
+// retry reads a single key with a batch of its own.
+func (ls *libstore) retry(ctx context.Context, key string, lease int, method string, list bool) (storagerpc.GetListReply, error) {
+	args := &storagerpc.MultiGetArgs{Keys: []string{key}, WantLease: []bool{lease > 0}, LeaseSeconds: []int{lease},
+		HostPort: ls.hostPort, Timeout: storagerpc.TimeoutOf(ctx)}
+	reply := newMultiGetReply(list)
+	if err := ls.call(ctx, key, method, args, reply); err != nil {
+		return storagerpc.GetListReply{}, err
+	}
+	replies := listReplies(reply)
+	if len(replies) != 1 {
+		return storagerpc.GetListReply{}, errors.New("Key " + key + " could not be read")
+	}
+	return replies[0], nil
+}
+
+func newMultiGetReply(list bool) interface{} {
+	if list {
+		return &storagerpc.MultiGetListReply{}
+	}
+	return &storagerpc.MultiGetReply{}
+}
+
+// listReplies returns the replies of a MultiGetReply or MultiGetListReply,
+// turning the values of the former into single-item lists.
+func listReplies(reply interface{}) []storagerpc.GetListReply {
+	switch r := reply.(type) {
+	case *storagerpc.MultiGetListReply:
+		return r.Replies
+	case *storagerpc.MultiGetReply:
+		replies := make([]storagerpc.GetListReply, len(r.Replies))
+		for i, get := range r.Replies {
+			replies[i] = storagerpc.GetListReply{Status: get.Status, Value: []string{get.Value},
+				Version: get.Version, Lease: get.Lease, Servers: get.Servers}
+		}
+		return replies
+	}
+	return nil
+}
+
+func (ls *libstore) MultiGetListRange(keys []string, start, count int, reverse bool) (map[string][]string, error) {
+	return ls.MultiGetListRangeContext(context.Background(), keys, start, count, reverse)
+}
+
+// MultiGetListRangeContext reads the same range of several lists as
+// multiGet reads whole lists: lists held under a lease are answered
+// locally and the others are sent in one batch per primary, to all
+// primaries at once, while a key whose batch failed, or whose server
+// replied WrongServer, is read again on its own.
+func (ls *libstore) MultiGetListRangeContext(ctx context.Context, keys []string, start, count int, reverse bool) (map[string][]string, error) {
+	method := "StorageServer.MultiGetListRange"
+	values := make(map[string][]string)
+	batches := make(map[uint32]*storagerpc.MultiGetListRangeArgs)
+	queued := make(map[string]bool)
+	for _, key := range keys {
+		if _, ok := values[key]; ok || queued[key] {
+			continue
+		}
+		if cached, ok := ls.cached(key); ok {
+			values[key] = listRange(cached, start, count, reverse)
+			continue
+		}
+		live := ls.liveReplicas(key)
+		if len(live) == 0 {
+			return nil, &UnavailableError{Method: method, Key: key, Err: errNoServers}
+		}
+		queued[key] = true
+		args, ok := batches[live[0]]
+		if !ok {
+			args = &storagerpc.MultiGetListRangeArgs{Start: start, Count: count, Reverse: reverse,
+				Timeout: storagerpc.TimeoutOf(ctx)}
+			batches[live[0]] = args
+		}
+		args.Keys = append(args.Keys, key)
+	}
+
+	var lock sync.Mutex // guards values and err
+	var err error
+	var wg sync.WaitGroup
+	for id, args := range batches {
+		wg.Add(1)
+		go func(id uint32, args *storagerpc.MultiGetListRangeArgs) {
+			defer wg.Done()
+			reply := &storagerpc.MultiGetListReply{}
+			if e := ls.invoke(ctx, id, method, args, reply); e != nil || len(reply.Replies) != len(args.Keys) {
+				reply.Replies = nil
+			}
+			for i, key := range args.Keys {
+				var list []string
+				var e error
+				if reply.Replies != nil && reply.Replies[i].Status != storagerpc.WrongServer {
+					switch r := reply.Replies[i]; r.Status {
+					case storagerpc.OK:
+						list = append([]string{}, r.Value...)
+					case storagerpc.KeyNotFound:
+					default:
+						e = &StatusError{Method: method, Key: key, Status: r.Status}
+					}
+				} else if list, e = ls.GetListRangeContext(ctx, key, start, count, reverse); errors.Is(e, ErrKeyNotFound) {
+					list, e = nil, nil
+				}
+				lock.Lock()
+				if e != nil && err == nil {
+					err = e
+				} else if list != nil {
+					values[key] = list
+				}
+				lock.Unlock()
+			}
+		}(id, args)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,109 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+func (ls *libstore) Scan(prefix, startAfter string, limit int) ([]string, string, error) {
+	return ls.ScanContext(context.Background(), prefix, startAfter, limit)
+}
+
+func (ls *libstore) ScanContext(ctx context.Context, prefix, startAfter string, limit int) ([]string, string, error) {
+	args := &storagerpc.ScanArgs{Prefix: prefix, StartAfter: startAfter, Limit: limit, Timeout: storagerpc.TimeoutOf(ctx)}
+	if strings.Contains(prefix, ":") {
+		// Every key with this prefix hashes like the prefix itself.
+		reply := &storagerpc.ScanReply{}
+		if err := ls.call(ctx, prefix, "StorageServer.Scan", args, reply); err != nil {
+			return nil, "", err
+		}
+		if reply.Status != storagerpc.OK {
+			return nil, "", errors.New("Scan of " + prefix + " was refused by the storage server")
+		}
+		return reply.Keys, token(reply.Keys, reply.More), nil
+	}
+	return ls.scanRing(ctx, args)
+}
+
+// scanRing asks every storage server for the matching keys of its key
+// ranges and merges the replies. A backup answers for the ranges of a
+// primary that cannot be reached, so the scan only fails if some key range
+// has no member that answered.
+func (ls *libstore) scanRing(ctx context.Context, args *storagerpc.ScanArgs) ([]string, string, error) {
+	ls.ringLock.RLock()
+	ring := ls.ring
+	ls.ringLock.RUnlock()
+	ids := ring.IDs()
+
+	replies := make([]*storagerpc.ScanReply, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		ls.connLock.Lock()
+		down := time.Now().Before(ls.down[id])
+		ls.connLock.Unlock()
+		if down {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id uint32) {
+			defer wg.Done()
+			reply := &storagerpc.ScanReply{}
+			if ls.invoke(ctx, id, "StorageServer.Scan", args, reply) == nil {
+				replies[i] = reply
+			}
+		}(i, id)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	covered := make(map[uint32]bool)
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	more := false
+	for _, reply := range replies {
+		if reply == nil || reply.Status != storagerpc.OK {
+			continue
+		}
+		for _, point := range reply.Ranges {
+			covered[point] = true
+		}
+		for _, key := range reply.Keys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		more = more || reply.More
+	}
+	for _, point := range ring.AllPoints() {
+		if !covered[point] {
+			return nil, "", &UnavailableError{Method: "StorageServer.Scan", Key: args.Prefix,
+				Err: errors.New("not every key range could be reached")}
+		}
+	}
+
+	// Each server returned its first keys in order, so up to the last key
+	// kept every key of every server has been seen.
+	sort.Strings(keys)
+	if args.Limit > 0 && len(keys) > args.Limit {
+		keys, more = keys[:args.Limit], true
+	}
+	return keys, token(keys, more), nil
+}
+
+// token returns the continuation token of a scan that returned keys: the
+// last key if more are left, or "" if the scan is complete.
+func token(keys []string, more bool) string {
+	if !more || len(keys) == 0 {
+		return ""
+	}
+	return keys[len(keys)-1]
+}
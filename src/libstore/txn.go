@@ -0,0 +1,100 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Transactions. A transaction is sent whole to a server of its first key,
+// which coordinates it with the servers of the other keys. A transaction
+// that finds one of its keys locked by another one is retried a few times,
+// after a growing pause, before ErrConflict is returned.
+const (
+	txnRetries    = 5
+	txnRetryPause = 50 * time.Millisecond
+)
+
+func (ls *libstore) Transact(ops []TxnOp) error {
+	return ls.TransactContext(context.Background(), ops)
+}
+
+func (ls *libstore) TransactContext(ctx context.Context, ops []TxnOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	muts, err := txnMutations(ops)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		ls.policy.Wrote(op.Key)
+	}
+	args := &storagerpc.TransactArgs{Ops: muts, Timeout: storagerpc.TimeoutOf(ctx)}
+
+	for retry := 0; ; retry++ {
+		reply := &storagerpc.TransactReply{}
+		if err := ls.call(ctx, ops[0].Key, "StorageServer.Transact", args, reply); err != nil {
+			return err
+		}
+		switch reply.Status {
+		case storagerpc.OK:
+			return nil
+		case storagerpc.Locked:
+			if retry < txnRetries {
+				if err := sleep(ctx, txnRetryPause<<uint(retry)); err != nil {
+					return err
+				}
+				continue
+			}
+			return ErrConflict
+		case storagerpc.TxnUnsupported:
+			return ErrTxnUnsupported
+		case storagerpc.KeyNotFound, storagerpc.ItemExists, storagerpc.ItemNotFound:
+			return txnError(reply.Status, reply.Key)
+		}
+		return &StatusError{Method: "StorageServer.Transact", Key: ops[0].Key, Status: reply.Status}
+	}
+}
+
+// txnMutations returns the writes of ops, which must be to distinct keys,
+// as the storage servers take them.
+func txnMutations(ops []TxnOp) ([]storagerpc.Mutation, error) {
+	muts := make([]storagerpc.Mutation, len(ops))
+	keys := make(map[string]bool, len(ops))
+	for i, op := range ops {
+		if keys[op.Key] {
+			return nil, errors.New("Key " + op.Key + " is written twice in the transaction")
+		}
+		keys[op.Key] = true
+		m := storagerpc.Mutation{Key: op.Key, Value: op.Value}
+		switch op.Type {
+		case TxnPut:
+			m.Op = storagerpc.PutOp
+		case TxnDelete:
+			m.Op = storagerpc.DeleteOp
+		case TxnAppend:
+			m.Op = storagerpc.AppendOp
+		case TxnRemove:
+			m.Op = storagerpc.RemoveOp
+		default:
+			return nil, errors.New("Invalid transaction op on key " + op.Key)
+		}
+		muts[i] = m
+	}
+	return muts, nil
+}
+
+// txnError returns the error of a transaction that failed with status, one
+// of KeyNotFound, ItemExists and ItemNotFound, because of its write to key.
+func txnError(status storagerpc.Status, key string) error {
+	switch status {
+	case storagerpc.KeyNotFound:
+		return &keyError{"Key " + key + " not found", ErrKeyNotFound}
+	case storagerpc.ItemExists:
+		return &keyError{"Item exists under key " + key, ErrItemExists}
+	}
+	return &keyError{"Item not found under key " + key, ErrItemNotFound}
+}
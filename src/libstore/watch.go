@@ -0,0 +1,295 @@
+package libstore
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Watches. A key's changes are applied by whichever member of its replica
+// set serves it at the time, and copied to the others, so a watch registers
+// with every storage server of the ring, each polled by a goroutine of its
+// own. Every member that applies a change reports it, with the same
+// version, so a change is passed on only if it gives its key a later version
+// than the last one passed on. Pollers of servers that leave the ring stop,
+// and servers that join it get pollers as the libstore refreshes its ring.
+
+// Changes buffered on a Watch's channel before the pollers wait for the
+// receiver, and eventually the storage servers drop them.
+const watchChannelSize = 100
+
+var errWatchClosed = errors.New("the watch was closed")
+
+// Watch is a subscription to the changes of some keys, made with WatchKey or
+// WatchPrefix.
+type Watch struct {
+	// Events delivers the changes. It is closed shortly after the Watch is.
+	Events <-chan WatchEvent
+
+	ls       *libstore
+	args     storagerpc.WatchArgs
+	events   chan WatchEvent
+	done     chan struct{}
+	lock     sync.Mutex        // serializes deliveries and guards versions
+	versions map[string]uint64 // version of the last change passed on, by key
+	pollLock sync.Mutex        // guards polled and closed
+	polled   map[uint32]bool   // storage servers with a poller
+	closed   bool
+	pollers  sync.WaitGroup
+}
+
+func (ls *libstore) WatchKey(key string) (*Watch, error) {
+	return ls.watch(storagerpc.WatchArgs{Prefix: key, Exact: true})
+}
+
+func (ls *libstore) WatchPrefix(prefix string) (*Watch, error) {
+	return ls.watch(storagerpc.WatchArgs{Prefix: prefix})
+}
+
+// watch registers a watch with every storage server, in parallel, and
+// starts polling them. It fails only if no server could be reached; a
+// server that could not be is retried by its poller.
+func (ls *libstore) watch(args storagerpc.WatchArgs) (*Watch, error) {
+	events := make(chan WatchEvent, watchChannelSize)
+	w := &Watch{Events: events, ls: ls, args: args, events: events, done: make(chan struct{}),
+		versions: make(map[string]uint64), polled: make(map[uint32]bool)}
+	ls.ringLock.RLock()
+	ids := ls.ring.IDs()
+	ls.ringLock.RUnlock()
+
+	watchIDs := make([]uint64, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id uint32) {
+			defer wg.Done()
+			watchIDs[i], _ = w.register(id)
+		}(i, id)
+	}
+	wg.Wait()
+	registered := false
+	for i, id := range ids {
+		registered = registered || watchIDs[i] != 0
+		w.startPoller(id, watchIDs[i])
+	}
+	if !registered {
+		w.Close()
+		return nil, &UnavailableError{Method: "StorageServer.Watch", Key: args.Prefix, Err: errNoServers}
+	}
+	go w.follow()
+	return w, nil
+}
+
+// Close cancels w. Its Events channel is closed once the pollers have
+// stopped, which may take a moment.
+func (w *Watch) Close() {
+	w.pollLock.Lock()
+	defer w.pollLock.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.done)
+	go func() {
+		w.pollers.Wait()
+		close(w.events)
+	}()
+}
+
+// startPoller starts polling storage server id, with which the watch is
+// registered as watchID, or not yet if watchID is 0, unless it is polled
+// already.
+func (w *Watch) startPoller(id uint32, watchID uint64) {
+	w.pollLock.Lock()
+	defer w.pollLock.Unlock()
+	if w.closed || w.polled[id] {
+		return
+	}
+	w.polled[id] = true
+	w.pollers.Add(1)
+	go w.poll(id, watchID)
+}
+
+// follow starts pollers for the servers that join the ring.
+func (w *Watch) follow() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(refreshSeconds * time.Second):
+		}
+		w.ls.ringLock.RLock()
+		ids := w.ls.ring.IDs()
+		w.ls.ringLock.RUnlock()
+		for _, id := range ids {
+			w.startPoller(id, 0)
+		}
+	}
+}
+
+// poll passes on the changes reported by storage server id until the watch
+// is closed or the server leaves the ring. If the server lost the watch, as
+// when it restarted, the watch registers again and passes on a LostEvent.
+func (w *Watch) poll(id uint32, watchID uint64) {
+	defer w.pollers.Done()
+	var after uint64
+	for {
+		w.ls.ringLock.RLock()
+		member := w.ls.ring.Contains(id)
+		w.ls.ringLock.RUnlock()
+		if !member {
+			w.pollLock.Lock()
+			delete(w.polled, id)
+			w.pollLock.Unlock()
+			return
+		}
+		if watchID == 0 {
+			var err error
+			if watchID, err = w.register(id); err != nil {
+				if !w.sleep() {
+					return
+				}
+				continue
+			}
+			after = 0
+			if !w.deliver(WatchEvent{Type: LostEvent}) {
+				w.cancel(id, watchID)
+				return
+			}
+		}
+
+		args := &storagerpc.PollWatchArgs{WatchID: watchID, After: after}
+		reply := &storagerpc.PollWatchReply{}
+		err := w.call(id, "StorageServer.PollWatch", args, reply, (storagerpc.WatchPollSeconds+5)*time.Second)
+		if err == errWatchClosed {
+			w.cancel(id, watchID)
+			return
+		}
+		if err != nil {
+			if !w.sleep() {
+				w.cancel(id, watchID)
+				return
+			}
+			continue
+		}
+		if reply.Status != storagerpc.OK {
+			watchID = 0
+			continue
+		}
+		if reply.Lost && !w.deliver(WatchEvent{Type: LostEvent}) {
+			w.cancel(id, watchID)
+			return
+		}
+		for _, e := range reply.Events {
+			if !w.deliver(newWatchEvent(e)) {
+				w.cancel(id, watchID)
+				return
+			}
+		}
+		after = reply.Last
+	}
+}
+
+// newWatchEvent converts a change reported by a storage server.
+func newWatchEvent(e storagerpc.WatchEvent) WatchEvent {
+	event := WatchEvent{Key: e.Key, Value: e.Value, Version: e.Version}
+	switch e.Op {
+	case storagerpc.PutOp:
+		event.Type = PutEvent
+	case storagerpc.DeleteOp:
+		event.Type = DeleteEvent
+	case storagerpc.AppendOp:
+		event.Type = AppendEvent
+	case storagerpc.RemoveOp:
+		event.Type = RemoveEvent
+	case storagerpc.StoreOp:
+		event.Type, event.Values = ReplaceEvent, e.Values
+	}
+	return event
+}
+
+// deliver passes e on, unless it is a change that was passed on already,
+// waiting for the receiver if needed. It returns false if the watch was
+// closed.
+func (w *Watch) deliver(e WatchEvent) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	if e.Type != LostEvent {
+		if e.Version <= w.versions[e.Key] {
+			return true
+		}
+		w.versions[e.Key] = e.Version
+	}
+	select {
+	case w.events <- e:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// register registers the watch with storage server id and returns the ID it
+// got there.
+func (w *Watch) register(id uint32) (uint64, error) {
+	reply := &storagerpc.WatchReply{}
+	if err := w.call(id, "StorageServer.Watch", &w.args, reply, downSeconds*time.Second); err != nil {
+		return 0, err
+	}
+	if reply.Status != storagerpc.OK {
+		return 0, errors.New("the storage server refused the watch")
+	}
+	return reply.WatchID, nil
+}
+
+// cancel cancels the watch registered as watchID with storage server id,
+// without waiting for the reply; the server drops it anyway if left idle.
+func (w *Watch) cancel(id uint32, watchID uint64) {
+	if cli, err := w.ls.getStorageServer(context.Background(), id); err == nil {
+		args := &storagerpc.CancelWatchArgs{WatchID: watchID}
+		cli.Go("StorageServer.CancelWatch", args, &storagerpc.CancelWatchReply{}, make(chan *rpc.Call, 1))
+	}
+}
+
+// call invokes method on storage server id, giving up after timeout or once
+// the watch is closed.
+func (w *Watch) call(id uint32, method string, args, reply interface{}, timeout time.Duration) error {
+	cli, err := w.ls.getStorageServer(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	call := cli.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(timeout):
+		err = rpc.ErrShutdown
+	case <-w.done:
+		return errWatchClosed
+	}
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			w.ls.markDown(id)
+		}
+	}
+	return err
+}
+
+// sleep waits a second before a failed call is retried. It returns false if
+// the watch was closed meanwhile.
+func (w *Watch) sleep() bool {
+	select {
+	case <-time.After(time.Second):
+		return true
+	case <-w.done:
+		return false
+	}
+}
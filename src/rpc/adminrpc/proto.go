@@ -0,0 +1,106 @@
+// This file contains constants and arguments used to perform the admin RPCs,
+// with which an operator looks inside a running storage server.
+
+package adminrpc
+
+import "strings"
+
+// Status represents the status of a RPC's reply.
+type Status int
+
+const (
+	OK       Status = iota + 1 // The RPC was a success.
+	NotReady                   // The storage servers are still getting ready.
+)
+
+// Prefix types. Keys are grouped by the part after their ':', the name of
+// what they hold for a user; a key of no known type counts as OtherKeys.
+const (
+	UserKeys     = "usrid"
+	SubListKeys  = "sublist"
+	PostKeys     = "post_" // Followed by the post's time.
+	PostListKeys = "postlist"
+	OtherKeys    = "other"
+)
+
+// PrefixType returns the prefix type of key.
+func PrefixType(key string) string {
+	i := strings.Index(key, ":")
+	if i < 0 {
+		return OtherKeys
+	}
+	switch name := key[i+1:]; {
+	case name == UserKeys, name == SubListKeys, name == PostListKeys:
+		return name
+	case strings.HasPrefix(name, PostKeys):
+		return PostKeys
+	}
+	return OtherKeys
+}
+
+type PrefixStatsArgs struct {
+	// Intentionally left empty.
+}
+
+// PrefixStats counts the unexpired keys of a prefix type and the bytes
+// their names and values take.
+type PrefixStats struct {
+	Prefix string
+	Keys   int
+	Bytes  int64
+}
+
+type PrefixStatsReply struct {
+	Status   Status
+	Prefixes []PrefixStats // One per prefix type, in the order of the constants above.
+}
+
+type TenantsArgs struct {
+	Key string // If non-empty, only the leases on Key are listed.
+}
+
+// Tenant is a lease granted on Key to the libstore at HostPort.
+type Tenant struct {
+	Key      string
+	HostPort string
+	Expires  int64 // Unix seconds after which the lease is no longer in use.
+}
+
+type TenantsReply struct {
+	Status  Status
+	Tenants []Tenant // Unexpired leases, by key and then by host:port.
+}
+
+type RangesArgs struct {
+	// Intentionally left empty.
+}
+
+// Range is the key range of the hashes after Start, up to and including
+// End, wrapping around the ring.
+type Range struct {
+	Start    uint32
+	End      uint32
+	Replicas []uint32 // NodeIDs of the range's replica set, primary first.
+	Served   bool     // Whether the server answering serves the range.
+}
+
+type RangesReply struct {
+	Status Status
+	Ranges []Range // In increasing order of End.
+}
+
+type ConnsArgs struct {
+	// Intentionally left empty.
+}
+
+// Peer is an open connection to another storage server.
+type Peer struct {
+	NodeID   uint32
+	HostPort string
+}
+
+type ConnsReply struct {
+	Status    Status
+	Libstores []string // Host:ports of the libstores connected to for lease revocations.
+	Peers     []Peer
+}
@@ -0,0 +1,23 @@
+// This file provides a type-safe wrapper that should be used to register a
+// storage server to receive admin RPCs from operators.
+
+package adminrpc
+
+type RemoteStorageAdmin interface {
+	GetPrefixStats(*PrefixStatsArgs, *PrefixStatsReply) error
+	GetTenants(*TenantsArgs, *TenantsReply) error
+	GetRanges(*RangesArgs, *RangesReply) error
+	GetConns(*ConnsArgs, *ConnsReply) error
+}
+
+type StorageAdmin struct {
+	// Embed all methods into the struct. See the Effective Go section about
+	// embedding for more details: golang.org/doc/effective_go.html#embedding
+	RemoteStorageAdmin
+}
+
+// Wrap wraps s in a type-safe wrapper struct to ensure that only the desired
+// StorageAdmin methods are exported to receive RPCs.
+func Wrap(s RemoteStorageAdmin) RemoteStorageAdmin {
+	return &StorageAdmin{s}
+}
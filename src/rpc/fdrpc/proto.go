@@ -0,0 +1,20 @@
+// This file contains constants and arguments used to perform RPCs between
+// the failure detectors of the servers in a cluster.
+
+package fdrpc
+
+// Status represents the status of a RPC's reply.
+type Status int
+
+const (
+	OK        Status = iota + 1 // The RPC was a success.
+	NotMember                   // The sender is not a member of the receiver's cluster.
+)
+
+type HeartbeatArgs struct {
+	HostPort string // The sender's host:port.
+}
+
+type HeartbeatReply struct {
+	Status Status
+}
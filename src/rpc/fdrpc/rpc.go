@@ -0,0 +1,20 @@
+// This file provides a type-safe wrapper that should be used to register a
+// failure detector to receive heartbeats from the rest of its cluster.
+
+package fdrpc
+
+type RemoteFailureDetector interface {
+	Heartbeat(*HeartbeatArgs, *HeartbeatReply) error
+}
+
+type FailureDetector struct {
+	// Embed all methods into the struct. See the Effective Go section about
+	// embedding for more details: golang.org/doc/effective_go.html#embedding
+	RemoteFailureDetector
+}
+
+// Wrap wraps f in a type-safe wrapper struct to ensure that only the desired
+// FailureDetector methods are exported to receive RPCs.
+func Wrap(f RemoteFailureDetector) RemoteFailureDetector {
+	return &FailureDetector{f}
+}
@@ -3,16 +3,26 @@
 
 package storagerpc
 
+import (
+	"context"
+	"time"
+)
+
 // Status represents the status of a RPC's reply.
 type Status int
 
 const (
-	OK           Status = iota + 1 // The RPC was a success.
-	KeyNotFound                    // The specified key does not exist.
-	ItemNotFound                   // The specified item does not exist.
-	WrongServer                    // The specified key does not fall in the server's hash range.
-	ItemExists                     // The item already exists in the list.
-	NotReady                       // The storage servers are still getting ready.
+	OK             Status = iota + 1 // The RPC was a success.
+	KeyNotFound                      // The specified key does not exist.
+	ItemNotFound                     // The specified item does not exist.
+	WrongServer                      // The specified key does not fall in the server's hash range.
+	ItemExists                       // The item already exists in the list.
+	NotReady                         // The storage servers are still getting ready.
+	NotLeader                        // The server does not lead the key's Raft group.
+	Conflict                         // The key's version or value did not match the condition of the write.
+	Locked                           // The key is locked by another transaction.
+	TxnUnsupported                   // The server does not take part in transactions.
+	NotReplicated                    // The write was applied but not by enough replicas.
 )
 
 // Lease constants.
@@ -23,6 +33,31 @@ const (
 	LeaseGuardSeconds = 2  // Additional seconds a server should wait before invalidating a lease.
 )
 
+// Timeouts. The Timeout of the arguments of a client read or write is how
+// long the caller still waits for the reply as it sends the request, or 0 if
+// it waits as long as it takes, and negative if its deadline has passed
+// already. Sending the time left rather than the deadline itself keeps the
+// clocks of the caller and the server from having to agree. A server
+// refuses a request that reaches it with no time left with the error
+// context.DeadlineExceeded instead of carrying it out.
+
+// TimeoutOf returns the time left until the deadline of ctx as a Timeout.
+func TimeoutOf(ctx context.Context) time.Duration {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if left := time.Until(d); left > 0 {
+		return left
+	}
+	return -1
+}
+
+// Expired reports whether timeout, a Timeout, has run out.
+func Expired(timeout time.Duration) bool {
+	return timeout < 0
+}
+
 // Lease stores information about a lease sent from the storage servers.
 type Lease struct {
 	Granted      bool
@@ -32,6 +67,40 @@ type Lease struct {
 type Node struct {
 	HostPort string // The host:port address of the storage server node.
 	NodeID   uint32 // The ID identifying this storage server node.
+	Alive    bool   // In GetServers replies: whether the replying server believes the node is alive.
+	Weight   int    // Relative capacity, scaling the node's share of virtual nodes.
+}
+
+// ReplicaSet lists the nodes holding copies of the key range that ends at
+// point End on the hash ring, which is Primary's NodeID unless virtual nodes
+// are used. Backups are the owners of the next points on the ring, skipping
+// nodes already listed, in the order in which they take over.
+type ReplicaSet struct {
+	Primary uint32
+	End     uint32
+	Backups []uint32
+}
+
+// ScanArgs selects the keys starting with Prefix that sort after StartAfter.
+// At most Limit keys are returned, or all of them if Limit is 0.
+type ScanArgs struct {
+	Prefix     string
+	StartAfter string
+	Limit      int
+	Timeout    time.Duration
+}
+
+// ScanReply lists matching keys in increasing order. More is set if Limit
+// cut the list short. A scan whose prefix names a single partition (it
+// contains the ':' that ends the hashed part of a key) is answered by the
+// partition's server; any other scan is answered by every server for the
+// key ranges listed in Ranges, each identified by the ring point it ends at.
+type ScanReply struct {
+	Status  Status
+	Keys    []string
+	More    bool
+	Ranges  []uint32
+	Servers []Node // With WrongServer: the ring as the replying server sees it.
 }
 
 type RegisterArgs struct {
@@ -39,8 +108,11 @@ type RegisterArgs struct {
 }
 
 type RegisterReply struct {
-	Status  Status
-	Servers []Node
+	Status       Status
+	Servers      []Node
+	ReplicaSets  []ReplicaSet
+	Raft         bool // Whether each replica set runs as a Raft group.
+	VirtualNodes int  // Points on the ring per unit of weight; 0 gives each node the single point NodeID.
 }
 
 type GetServersArgs struct {
@@ -48,43 +120,129 @@ type GetServersArgs struct {
 }
 
 type GetServersReply struct {
-	Status  Status
-	Servers []Node
+	Status       Status
+	Servers      []Node
+	ReplicaSets  []ReplicaSet
+	Replicas     int // Number of backups of each key range.
+	VirtualNodes int // Points on the ring per unit of weight; 0 gives each node the single point NodeID.
 }
 
 type GetArgs struct {
 	Key       string
 	WantLease bool
 	HostPort  string // The Libstore's callback host:port.
+
+	// LeaseSeconds is, with WantLease, the length of the lease asked for,
+	// at most LeaseSeconds. 0 asks for LeaseSeconds.
+	LeaseSeconds int
+
+	Timeout time.Duration
 }
 
+// Every stored key carries a version, which grows with each write to it.
+// Versions are never reused, even for a key that was deleted and created
+// again, so a version names a single value of the key.
+
 type GetReply struct {
-	Status Status
-	Value  string
-	Lease  Lease
+	Status  Status
+	Value   string
+	Version uint64
+	Lease   Lease
+	Servers []Node // With status WrongServer: the ring as the replying server knows it.
 }
 
 type GetListReply struct {
-	Status Status
-	Value  []string
-	Lease  Lease
+	Status  Status
+	Value   []string
+	Version uint64
+	Lease   Lease
+	Servers []Node // With status WrongServer: the ring as the replying server knows it.
+}
+
+// GetListRangeArgs asks for up to Count items of the list at Key, starting
+// Start items from its first item or, if Reverse is set, from its last one,
+// going backwards. It is answered with a GetListReply.
+type GetListRangeArgs struct {
+	Key     string
+	Start   int
+	Count   int
+	Reverse bool
+	Timeout time.Duration
+}
+
+// MultiGetArgs asks for several keys at once, WantLease[i] telling whether
+// a lease is wanted on Keys[i].
+type MultiGetArgs struct {
+	Keys         []string
+	WantLease    []bool
+	LeaseSeconds []int  // The GetArgs.LeaseSeconds of each key, if given.
+	HostPort     string // The Libstore's callback host:port.
+	Timeout      time.Duration
+}
+
+// MultiGetListRangeArgs asks for the same range, as in GetListRangeArgs, of
+// each of several lists at once. It is answered with a MultiGetListReply.
+type MultiGetListRangeArgs struct {
+	Keys    []string
+	Start   int
+	Count   int
+	Reverse bool
+	Timeout time.Duration
+}
+
+// MultiGetReply holds, for each requested key in order, the reply a Get of
+// it would have received.
+type MultiGetReply struct {
+	Replies []GetReply
 }
 
+// MultiGetListReply holds, for each requested key in order, the reply a
+// GetList of it would have received.
+type MultiGetListReply struct {
+	Replies []GetListReply
+}
+
+// PutArgs is also used by AppendToList and RemoveFromList, for which a TTL
+// applies to the whole list and a TTLSeconds of 0 leaves the list's expiry
+// time as it was. A Put or PutIfAbsent without a TTL makes the key permanent.
 type PutArgs struct {
-	Key   string
-	Value string
+	Key        string
+	Value      string
+	TTLSeconds int // If positive, the key expires this many seconds after the write.
+	Timeout    time.Duration
 }
 
 type PutReply struct {
-	Status Status
+	Status  Status
+	Version uint64 // With status OK: the key's new version. With status Conflict: its current version, 0 if it does not exist.
+	Servers []Node // With status WrongServer: the ring as the replying server knows it.
+}
+
+// ConditionalPutArgs stores Value under Key if the key's version is Version.
+// Version 0 requires the key not to exist.
+type ConditionalPutArgs struct {
+	Key     string
+	Value   string
+	Version uint64
+	Timeout time.Duration
+}
+
+// CompareAndSwapArgs stores NewValue under Key if the key holds OldValue.
+type CompareAndSwapArgs struct {
+	Key      string
+	OldValue string
+	NewValue string
+	Timeout  time.Duration
 }
 
 type DeleteArgs struct {
-	Key string
+	Key     string
+	Timeout time.Duration
 }
 
 type DeleteReply struct {
-	Status Status
+	Status  Status
+	Servers []Node // With status WrongServer: the ring as the replying server knows it.
 }
 
 type RevokeLeaseArgs struct {
@@ -94,3 +252,370 @@ type RevokeLeaseArgs struct {
 type RevokeLeaseReply struct {
 	Status Status
 }
+
+// MutationOp identifies the kind of write carried by a Mutation.
+type MutationOp int
+
+const (
+	PutOp MutationOp = iota + 1
+	DeleteOp
+	AppendOp
+	RemoveOp
+	StoreOp // Replaces the key's whole list with Values.
+)
+
+// Condition makes a PutOp conditional on the key's current state.
+type Condition int
+
+const (
+	Unconditional Condition = iota
+	IfVersion               // The key's version must be Expect, or the key must not exist if Expect is 0.
+	IfValue                 // The key must hold Old.
+	IfExpired               // The key must have expired by Time.
+)
+
+// Mutation is a single write, as applied by a storage server and shipped
+// from a primary to its backups. Version is the version the key gets and
+// Time the time at which the write takes place, which the primary, or the
+// Raft leader, assigns; a key whose expiry time is not after Time is gone
+// by the time the write is applied. Times are in Unix nanoseconds.
+type Mutation struct {
+	Op      MutationOp
+	Key     string
+	Value   string
+	Values  []string  `json:",omitempty"`
+	Version uint64    `json:",omitempty"`
+	Cond    Condition `json:",omitempty"`
+	Expect  uint64    `json:",omitempty"`
+	Old     string    `json:",omitempty"`
+	Time    int64     `json:",omitempty"`
+	Expires int64     `json:",omitempty"` // The key's new expiry time. 0 makes it permanent, but leaves lists as they were.
+}
+
+type ReplicateArgs struct {
+	Mutation Mutation
+}
+
+type ReplicateReply struct {
+	Status Status
+}
+
+// Raft RPCs. Every replica set of the ring is its own Raft group, named by
+// the NodeID of the set's primary.
+
+type LogEntry struct {
+	Term     int
+	Mutation Mutation
+}
+
+type RequestVoteArgs struct {
+	Group        uint32
+	Term         int
+	CandidateID  uint32
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Status      Status
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Group        uint32
+	Term         int
+	LeaderID     uint32
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Status        Status
+	Term          int
+	Success       bool
+	ConflictIndex int // On failure, the index the leader should retry from.
+}
+
+// A leader whose log no longer holds the entries a follower lacks, having
+// compacted them into a snapshot, sends the snapshot instead, a chunk at a
+// time, with InstallSnapshot.
+type InstallSnapshotArgs struct {
+	Group             uint32
+	Term              int
+	LeaderID          uint32
+	LastIncludedIndex int // Index of the last log entry the snapshot covers.
+	LastIncludedTerm  int
+	Offset            int64 // Byte offset of Data in the snapshot.
+	Data              []byte
+	Done              bool // Whether Data ends the snapshot.
+}
+
+type InstallSnapshotReply struct {
+	Status Status
+	Term   int
+}
+
+type ProposeArgs struct {
+	Mutation Mutation
+}
+
+type ProposeReply struct {
+	Status  Status
+	Version uint64 // The key's version after the write, or its current one on Conflict.
+}
+
+// Ring membership RPCs. Once the initial ring is complete, a server that
+// registers with the master joins the running ring, and UnregisterServer
+// removes one. The master moves every server to the new layout in two
+// rounds of UpdateRing: a Prepare round that announces it, then one server
+// at a time installing it and handing its keys over with Migrate.
+
+type UnregisterArgs struct {
+	NodeID uint32
+}
+
+type UnregisterReply struct {
+	Status Status
+}
+
+type UpdateRingArgs struct {
+	Servers      []Node
+	Replicas     int
+	VirtualNodes int
+	Prepare      bool
+}
+
+type UpdateRingReply struct {
+	Status Status
+}
+
+// KeyRecord is the full state of a key moved between storage servers: its
+// values and the lease records of the libstores caching it.
+type KeyRecord struct {
+	Key     string
+	Values  []string
+	Version uint64
+	Expires int64 // Unix nanoseconds, 0 if the key does not expire.
+	Tenants []string
+	Deleted bool // Anti-entropy only: the key was deleted by the write of Version.
+}
+
+type MigrateArgs struct {
+	Records []KeyRecord
+}
+
+type MigrateReply struct {
+	Status Status
+}
+
+// Anti-entropy RPCs. Now and then, the serving member of every key range
+// compares the range with each other live member of its replica set. Both
+// hash the keys of the range, with their versions, into a Merkle tree of the
+// same shape: MerkleFanout children per node and MerkleDepth levels below
+// the root, whose nodes at depth MerkleDepth are the leaves. Only subtrees
+// whose hashes differ are compared further, and only the keys of differing
+// leaves are listed and repaired.
+const (
+	MerkleFanout = 32
+	MerkleDepth  = 2
+)
+
+// DigestArgs asks for the hashes of the nodes numbered Nodes at depth Level
+// of the Merkle tree of the key range ending at point End. The nodes at each
+// depth are numbered from 0, and the children of node i are numbered from
+// i*MerkleFanout. With Keys set, Nodes are leaves, and the keys in them are
+// listed instead.
+type DigestArgs struct {
+	End   uint32
+	Level int
+	Nodes []int
+	Keys  bool
+}
+
+// DigestReply has status WrongServer if the replying server does not hold
+// the key range.
+type DigestReply struct {
+	Status Status
+	Hashes []uint64
+	Keys   []KeyVersion
+}
+
+// KeyVersion is the version of a key or, if Deleted, of the write that
+// removed it.
+type KeyVersion struct {
+	Key     string
+	Version uint64
+	Deleted bool
+}
+
+// RepairArgs sends Records, keys of the range ending at End of which the
+// receiver holds older versions, and asks for the records of the keys in
+// Want. A record is only applied if it is newer than the receiver's state.
+type RepairArgs struct {
+	End     uint32
+	Records []KeyRecord
+	Want    []string
+}
+
+type RepairReply struct {
+	Status  Status
+	Records []KeyRecord
+}
+
+// AntiEntropyArgs asks a storage server for its anti-entropy metrics,
+// running a round of comparisons first if Run is set.
+type AntiEntropyArgs struct {
+	Run bool
+}
+
+type AntiEntropyReply struct {
+	Status Status
+	Stats  AntiEntropyStats
+}
+
+// AntiEntropyStats counts the anti-entropy work of a storage server since it
+// started. A comparison is that of one key range with one other replica.
+type AntiEntropyStats struct {
+	Rounds         int
+	RangesChecked  int   // Comparisons made.
+	RangesRepaired int   // Comparisons that found differing keys.
+	KeysPushed     int   // Keys sent to a replica with an older version.
+	KeysPulled     int   // Keys taken from a replica with a newer version.
+	Failures       int   // Comparisons cut short by an error.
+	LastRound      int64 // Unix nanoseconds at which the last round ended, 0 before any did.
+	LastDuration   int64 // Nanoseconds the last round took.
+}
+
+// Export RPC. A backup reads a dump of every server's partition: the key
+// ranges it is the first live member of, in key order, a page at a time. The
+// first call, with ID 0, starts the dump and returns its first page, and
+// later calls return the page after StartAfter, the last key of the previous
+// page, with the ID returned; the dump is dropped once read to its end or
+// when left idle, after which calls for it fail with KeyNotFound. Pages are
+// read as the keys stand when they are, so a key written meanwhile may show
+// either version. Expired keys and lease records are left out of the dump.
+
+type ExportArgs struct {
+	ID         uint64
+	StartAfter string // Key after which the page starts, unless ID is 0.
+	Limit      int    // Maximum number of records to return, or 0 for all of them.
+}
+
+type ExportReply struct {
+	Status  Status
+	ID      uint64
+	Time    int64    // Unix nanoseconds when the dump was started.
+	Ranges  []uint32 // The key ranges dumped, each identified by the ring point it ends at.
+	Records []KeyRecord
+	More    bool // Whether records follow the ones returned.
+}
+
+// Watch RPCs. A client subscribes with Watch to the changes of a key, or of
+// the keys starting with a prefix, and then collects them with PollWatch,
+// which waits up to WatchPollSeconds for a change. Every server sends the
+// changes it applies, backups included, so a client watching every member of
+// a replica set sees each change once per member, with the same version.
+// The changes not yet collected are kept up to a limit; past it they are
+// dropped and the next poll reports them Lost. A watch not polled for a
+// while is cancelled, after which polls of it fail with KeyNotFound.
+
+const WatchPollSeconds = 10
+
+type WatchArgs struct {
+	Prefix string
+	Exact  bool // Whether Prefix is a whole key rather than a prefix.
+}
+
+type WatchReply struct {
+	Status  Status
+	WatchID uint64
+}
+
+// WatchEvent is a change to a watched key: a write of kind Op, which is
+// PutOp, DeleteOp, AppendOp, RemoveOp, or StoreOp when the key is replaced
+// by anti-entropy or by a move between servers, that gave the key Version.
+type WatchEvent struct {
+	Op      MutationOp
+	Key     string
+	Value   string
+	Values  []string // StoreOp only.
+	Version uint64
+}
+
+type PollWatchArgs struct {
+	WatchID uint64
+	After   uint64 // Sequence number of the last event received; earlier ones are dropped.
+}
+
+type PollWatchReply struct {
+	Status Status
+	Events []WatchEvent
+	Last   uint64 // Sequence number of the last event in Events, or After if there are none.
+	Lost   bool   // Whether events were dropped since the last poll.
+}
+
+type CancelWatchArgs struct {
+	WatchID uint64
+}
+
+type CancelWatchReply struct {
+	Status Status
+}
+
+// Transaction RPCs. A client sends a whole transaction with Transact to a
+// server of its first key, which coordinates it: the server serving each
+// key validates and locks it with Prepare, and applies or drops the write
+// with Decide. A participant that never heard the decision asks the
+// coordinator with TxnStatus. The ops of a transaction are puts, deletes,
+// appends and removes, given by the Op, Key and Value of a Mutation, each to
+// a different key.
+
+type TransactArgs struct {
+	Ops     []Mutation
+	Timeout time.Duration
+}
+
+// TransactReply has status OK if every op took place. Otherwise none did,
+// and Key is the key of an op that would have failed with Status, or that
+// was Locked.
+type TransactReply struct {
+	Status  Status
+	Key     string
+	Servers []Node // With WrongServer: the ring as the replying server sees it.
+}
+
+type PrepareArgs struct {
+	TxnID       string
+	Coordinator uint32
+	Ops         []Mutation
+}
+
+type PrepareReply struct {
+	Status Status
+	Key    string // Unless OK: the key of the op that failed.
+}
+
+type DecideArgs struct {
+	TxnID  string
+	Commit bool
+}
+
+type DecideReply struct {
+	Status Status
+}
+
+type TxnStatusArgs struct {
+	TxnID string
+}
+
+// TxnStatusReply tells whether the coordinator decided the transaction yet,
+// and if so whether it committed. A transaction the coordinator does not
+// know of did not commit.
+type TxnStatusReply struct {
+	Status  Status
+	Decided bool
+	Commit  bool
+}
@@ -6,12 +6,39 @@ package storagerpc
 type RemoteStorageServer interface {
 	RegisterServer(*RegisterArgs, *RegisterReply) error
 	GetServers(*GetServersArgs, *GetServersReply) error
+	UnregisterServer(*UnregisterArgs, *UnregisterReply) error
+	UpdateRing(*UpdateRingArgs, *UpdateRingReply) error
+	Migrate(*MigrateArgs, *MigrateReply) error
 	Get(*GetArgs, *GetReply) error
 	GetList(*GetArgs, *GetListReply) error
+	GetListRange(*GetListRangeArgs, *GetListReply) error
+	MultiGet(*MultiGetArgs, *MultiGetReply) error
+	MultiGetList(*MultiGetArgs, *MultiGetListReply) error
+	MultiGetListRange(*MultiGetListRangeArgs, *MultiGetListReply) error
 	Put(*PutArgs, *PutReply) error
 	Delete(*DeleteArgs, *DeleteReply) error
 	AppendToList(*PutArgs, *PutReply) error
 	RemoveFromList(*PutArgs, *PutReply) error
+	ConditionalPut(*ConditionalPutArgs, *PutReply) error
+	PutIfAbsent(*PutArgs, *PutReply) error
+	CompareAndSwap(*CompareAndSwapArgs, *PutReply) error
+	Replicate(*ReplicateArgs, *ReplicateReply) error
+	RequestVote(*RequestVoteArgs, *RequestVoteReply) error
+	AppendEntries(*AppendEntriesArgs, *AppendEntriesReply) error
+	InstallSnapshot(*InstallSnapshotArgs, *InstallSnapshotReply) error
+	Propose(*ProposeArgs, *ProposeReply) error
+	Scan(*ScanArgs, *ScanReply) error
+	GetDigests(*DigestArgs, *DigestReply) error
+	Repair(*RepairArgs, *RepairReply) error
+	AntiEntropy(*AntiEntropyArgs, *AntiEntropyReply) error
+	Export(*ExportArgs, *ExportReply) error
+	Watch(*WatchArgs, *WatchReply) error
+	PollWatch(*PollWatchArgs, *PollWatchReply) error
+	CancelWatch(*CancelWatchArgs, *CancelWatchReply) error
+	Transact(*TransactArgs, *TransactReply) error
+	Prepare(*PrepareArgs, *PrepareReply) error
+	Decide(*DecideArgs, *DecideReply) error
+	TxnStatus(*TxnStatusArgs, *TxnStatusReply) error
 }
 
 type StorageServer struct {
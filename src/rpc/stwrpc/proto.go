@@ -1,6 +1,9 @@
 package stwrpc
 
-//import "time"
+import (
+	"context"
+	"time"
+)
 
 type Status int
 
@@ -11,10 +14,12 @@ const (
 	NoSuchTargetUser                   // The specified TargerUserID does not exist.
 	Exists                             // The specified UserID or TargerUserID already exists.
 	NotReady                           // The app servers are still getting ready.
+	Unavailable                        // The storage servers could not be reached; the request may be retried.
 )
 
 type Node struct {
 	HostPort string // The host:port address of the storage server node.
+	Alive    bool   // In GetServers replies: whether the replying server believes the node is alive.
 }
 
 type RegisterArgs struct {
@@ -42,8 +47,41 @@ type Post struct {
 	Contents string
 }
 
+// The Timeout of the arguments of a request is how long the caller still
+// waits for the reply as it sends the request, or 0 if it waits as long as
+// it takes, and negative if its deadline has passed already. The app server
+// sets the deadline of the request that far from when it receives it, on
+// its own clock, gives up on the request at the deadline with the error
+// context.DeadlineExceeded, and passes the time left on to the storage
+// servers.
+
+// TimeoutHeader is the HTTP header that carries the Timeout of a request to
+// the web server, as a duration such as "1.5s".
+const TimeoutHeader = "X-Timeout"
+
+// TimeoutOf returns the time left until the deadline of ctx as a Timeout.
+func TimeoutOf(ctx context.Context) time.Duration {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if left := time.Until(d); left > 0 {
+		return left
+	}
+	return -1
+}
+
+// ContextOf returns a context that ends once timeout, a Timeout, has passed.
+func ContextOf(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
 type CreateUserArgs struct {
-	UserID string
+	UserID  string
+	Timeout time.Duration
 }
 
 type CreateUserReply struct {
@@ -53,6 +91,7 @@ type CreateUserReply struct {
 type SubscriptionArgs struct {
 	UserID       string
 	TargetUserID string
+	Timeout      time.Duration
 }
 
 type SubscriptionReply struct {
@@ -62,6 +101,7 @@ type SubscriptionReply struct {
 type PostArgs struct {
 	UserID   string
 	Contents string
+	Timeout  time.Duration
 }
 
 type PostReply struct {
@@ -72,6 +112,7 @@ type PostReply struct {
 type DeletePostArgs struct {
 	UserID  string
 	PostKey string
+	Timeout time.Duration
 }
 
 type DeletePostReply struct {
@@ -79,7 +120,8 @@ type DeletePostReply struct {
 }
 
 type TimelineArgs struct {
-	UserID string
+	UserID  string
+	Timeout time.Duration
 }
 
 type TimelineReply struct {
@@ -0,0 +1,285 @@
+// A program that backs up a running storage ring to a file and restores such
+// a file into another ring. A backup gathers a point-in-time dump of every
+// server's partition through Export; a restore sends every key to the
+// servers that replicate it on the new ring, found with libstore.StoreHash,
+// so the new ring may have a different number of servers.
+//
+// A backup file holds one JSON object per line: a header, then one record
+// per key in increasing key order.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"sort"
+	"time"
+
+	"hashring"
+	"libstore"
+	"rpc/storagerpc"
+)
+
+// backupFormat names the format of the files rbackup writes.
+const backupFormat = "simpletwitter-backup-1"
+
+const (
+	exportPageSize = 1000 // records asked for per Export call
+	restoreBatch   = 100  // records sent per Migrate call
+)
+
+var (
+	serverAddress = flag.String("host", "localhost", "master storage server host")
+	port          = flag.Int("port", 9009, "master storage server port number")
+)
+
+// backupHeader is the first line of a backup file.
+type backupHeader struct {
+	Format string
+	Time   int64 // Unix nanoseconds when the dumps were taken.
+	Keys   int
+}
+
+// backupRecord is a key of a backup file.
+type backupRecord struct {
+	Key     string
+	Values  []string
+	Version uint64
+	Expires int64 `json:",omitempty"` // Unix nanoseconds, 0 if the key does not expire.
+}
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "The rbackup program backs up a running storage ring to a file, or restores a")
+		fmt.Fprint(os.Stderr, "backup into a freshly started ring of any size.\n\n")
+		fmt.Fprintln(os.Stderr, "Usage:")
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Possible commands:")
+		fmt.Fprintln(os.Stderr, "  Backup:     backup file")
+		fmt.Fprintln(os.Stderr, "  Restore:    restore file")
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	ring := getServers()
+	switch flag.Arg(0) {
+	case "backup":
+		backup(ring, flag.Arg(1))
+	case "restore":
+		restore(ring, flag.Arg(1))
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// getServers returns the layout of the ring, as the master sees it.
+func getServers() *storagerpc.GetServersReply {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", *serverAddress, *port))
+	if err != nil {
+		log.Fatalln("Failed to connect to the master storage server:", err)
+	}
+	defer client.Close()
+	reply := &storagerpc.GetServersReply{}
+	if err := client.Call("StorageServer.GetServers", &storagerpc.GetServersArgs{}, reply); err != nil {
+		log.Fatalln("GetServers failed:", err)
+	}
+	if reply.Status != storagerpc.OK {
+		log.Fatalln("The ring is not ready yet")
+	}
+	return reply
+}
+
+// backup writes the dumps of every server of ring to path. Replicas of a key
+// range may both dump it, in which case the later version of each key wins.
+// A server that cannot be reached is skipped, as long as the others cover
+// its key ranges.
+func backup(ring *storagerpc.GetServersReply, path string) {
+	records := make(map[string]*backupRecord)
+	covered := make(map[uint32]bool)
+	var taken int64
+	for _, node := range ring.Servers {
+		ranges, t, err := exportServer(node.HostPort, records)
+		if err != nil {
+			log.Printf("Skipping storage server %d at %s: %v", node.NodeID, node.HostPort, err)
+			continue
+		}
+		for _, end := range ranges {
+			covered[end] = true
+		}
+		if t > taken {
+			taken = t
+		}
+	}
+	for _, set := range ring.ReplicaSets {
+		if !covered[set.End] {
+			log.Fatalf("No storage server exported the key range ending at %d\n", set.End)
+		}
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	err := writeFile(path, func(enc *json.Encoder) error {
+		if err := enc.Encode(backupHeader{Format: backupFormat, Time: taken, Keys: len(keys)}); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := enc.Encode(records[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalln("Failed to write the backup:", err)
+	}
+	fmt.Printf("Backed up %d keys from %d storage servers\n", len(keys), len(ring.Servers))
+}
+
+// exportServer reads the dump of the server at hostport into records. It
+// returns the key ranges the dump covers and the time it was taken.
+func exportServer(hostport string, records map[string]*backupRecord) ([]uint32, int64, error) {
+	client, err := rpc.DialHTTP("tcp", hostport)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Close()
+	args := &storagerpc.ExportArgs{Limit: exportPageSize}
+	for {
+		reply := &storagerpc.ExportReply{}
+		if err := client.Call("StorageServer.Export", args, reply); err != nil {
+			return nil, 0, err
+		}
+		switch reply.Status {
+		case storagerpc.OK:
+		case storagerpc.NotReady:
+			return nil, 0, errors.New("the server is not ready yet")
+		default:
+			return nil, 0, errors.New("the dump was dropped before it was read")
+		}
+		for _, rec := range reply.Records {
+			if old, ok := records[rec.Key]; !ok || rec.Version > old.Version {
+				records[rec.Key] = &backupRecord{Key: rec.Key, Values: rec.Values, Version: rec.Version,
+					Expires: rec.Expires}
+			}
+		}
+		if !reply.More {
+			return reply.Ranges, reply.Time, nil
+		}
+		args.ID = reply.ID
+		args.StartAfter = reply.Records[len(reply.Records)-1].Key
+	}
+}
+
+// writeFile writes the file at path with write, replacing it only once it
+// is complete.
+func writeFile(path string, write func(enc *json.Encoder) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = write(json.NewEncoder(w)); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restore loads the backup at path into ring, which should hold no keys yet:
+// a key already stored on a server is left alone. Keys that expired since
+// the backup was taken are skipped.
+func restore(ring *storagerpc.GetServersReply, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalln("Failed to open the backup:", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil || header.Format != backupFormat {
+		log.Fatalln("Not a backup file:", path)
+	}
+
+	nodes := make([]hashring.Node, 0, len(ring.Servers))
+	clients := make(map[uint32]*rpc.Client)
+	for _, node := range ring.Servers {
+		nodes = append(nodes, hashring.Node{ID: node.NodeID, Weight: node.Weight})
+		client, err := rpc.DialHTTP("tcp", node.HostPort)
+		if err != nil {
+			log.Fatalf("Failed to connect to storage server %d at %s: %v\n", node.NodeID, node.HostPort, err)
+		}
+		defer client.Close()
+		clients[node.NodeID] = client
+	}
+	hashRing := hashring.New(nodes, ring.VirtualNodes)
+
+	batches := make(map[uint32][]storagerpc.KeyRecord)
+	flush := func(id uint32) {
+		args := &storagerpc.MigrateArgs{Records: batches[id]}
+		reply := &storagerpc.MigrateReply{}
+		if err := clients[id].Call("StorageServer.Migrate", args, reply); err != nil {
+			log.Fatalf("Failed to restore keys to storage server %d: %v\n", id, err)
+		}
+		if reply.Status != storagerpc.OK {
+			log.Fatalf("Storage server %d refused the restored keys\n", id)
+		}
+		batches[id] = nil
+	}
+	restored, expired := 0, 0
+	now := time.Now().UnixNano()
+	for {
+		var rec backupRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalln("Failed to read the backup:", err)
+		}
+		if rec.Expires != 0 && rec.Expires <= now {
+			expired++
+			continue
+		}
+		for _, id := range hashRing.ReplicaSet(libstore.StoreHash(rec.Key), ring.Replicas) {
+			batches[id] = append(batches[id], storagerpc.KeyRecord{Key: rec.Key, Values: rec.Values,
+				Version: rec.Version, Expires: rec.Expires})
+			if len(batches[id]) == restoreBatch {
+				flush(id)
+			}
+		}
+		restored++
+	}
+	for id, batch := range batches {
+		if len(batch) > 0 {
+			flush(id)
+		}
+	}
+	fmt.Printf("Restored %d keys to %d storage servers (%d expired keys skipped)\n", restored,
+		len(ring.Servers), expired)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -13,9 +14,11 @@ import (
 	"net/rpc"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"libstore"
+	"rpc/storagerpc"
 )
 
 var (
@@ -24,6 +27,16 @@ var (
 	port          = flag.Int("port", 9009, "master storage server port number")
 	numTimes      = flag.Int("n", 1, "number of times to execute the command")
 	handleLeases  = flag.Bool("l", false, "run persistently, requesting leases, and reporting lease revocation requests")
+	ttl           = flag.Int("ttl", 0, "if positive, make the key written by p or la expire after this many seconds")
+	reverse       = flag.Bool("rev", false, "make lgr count from the end of the list, listing items last first")
+	policy        = flag.String("policy", "frequency", "the lease policy with -l: frequency, or adaptive to tune leases by the writes to each key prefix")
+	noLeases      = flag.String("noleases", "", "with -l, a comma-separated list of key prefixes never to ask leases for")
+	cacheEntries  = flag.Int("cacheentries", 0, "the most keys the lease cache holds (if 0 then no limit)")
+	cacheBytes    = flag.Int("cachebytes", 0, "the most bytes of keys and values the lease cache holds (if 0 then 64 MiB, if negative then no limit)")
+	callTimeout   = flag.Duration("calltimeout", 0, "how long a call to a storage server may take (if 0 then 30s, if negative then no bound)")
+	every         = flag.Duration("every", 0, "the pause between executions of the command with -n")
+	timeout       = flag.Duration("timeout", 0, "the deadline of each execution of the command, sent along to the storage servers (if 0 then none)")
+	showStats     = flag.Bool("stats", false, "print the counters of the lease cache once the commands are done, and with -l again after waiting")
 )
 
 func init() {
@@ -37,23 +50,73 @@ func init() {
 		fmt.Fprintln(os.Stderr, "Possible commands:")
 		fmt.Fprintln(os.Stderr, "  Put:            p  key value")
 		fmt.Fprintln(os.Stderr, "  Get:            g  key")
+		fmt.Fprintln(os.Stderr, "  Delete:         d  key")
 		fmt.Fprintln(os.Stderr, "  GetList:        lg key")
+		fmt.Fprintln(os.Stderr, "  GetListRange:   lgr key start count")
 		fmt.Fprintln(os.Stderr, "  AddToList:      la key value")
 		fmt.Fprintln(os.Stderr, "  RemoveFromList: lr key value")
+		fmt.Fprintln(os.Stderr, "  MultiGet:       mg key...")
+		fmt.Fprintln(os.Stderr, "  MultiGetList:   mgl key...")
+		fmt.Fprintln(os.Stderr, "  MultiGetListRange: mglr start count key...")
+		fmt.Fprintln(os.Stderr, "  Scan:           sc prefix startAfter limit")
+		fmt.Fprintln(os.Stderr, "  GetVersion:     gv key")
+		fmt.Fprintln(os.Stderr, "  ConditionalPut: cp key value version")
+		fmt.Fprintln(os.Stderr, "  PutIfAbsent:    pa key value")
+		fmt.Fprintln(os.Stderr, "  CompareAndSwap: cas key oldValue newValue")
+		fmt.Fprintln(os.Stderr, "  WatchKey:       wk key      (runs until killed)")
+		fmt.Fprintln(os.Stderr, "  WatchPrefix:    wp prefix   (runs until killed)")
+		fmt.Fprintln(os.Stderr, "  Transact:       tx op key [value]...   (op is p, d, la or lr)")
 	}
 }
 
+// leasePolicy returns the lease policy given by the -policy and -noleases
+// flags.
+func leasePolicy() libstore.LeasePolicy {
+	window := storagerpc.QueryCacheSeconds * time.Second
+	lease := storagerpc.LeaseSeconds * time.Second
+	var p libstore.LeasePolicy
+	switch *policy {
+	case "frequency":
+		p = libstore.DefaultLeasePolicy()
+	case "adaptive":
+		p = libstore.NewAdaptivePolicy(storagerpc.QueryCacheThresh, window, lease)
+	default:
+		log.Fatalln("Unknown lease policy:", *policy)
+	}
+	if *noLeases == "" {
+		return p
+	}
+	overrides := make(map[string]libstore.LeasePolicy)
+	for _, prefix := range strings.Split(*noLeases, ",") {
+		overrides[prefix] = libstore.NewFrequencyPolicy(0, window, lease)
+	}
+	return libstore.NewPrefixPolicy(overrides, p)
+}
+
 type cmdInfo struct {
 	cmdline string
 	nargs   int
 }
 
 var cmdList = map[string]int{
-	"p":  2,
-	"g":  1,
-	"la": 2,
-	"lr": 2,
-	"lg": 1,
+	"p":    2,
+	"g":    1,
+	"d":    1,
+	"la":   2,
+	"lr":   2,
+	"lg":   1,
+	"lgr":  3,
+	"mg":   1,
+	"mgl":  1,
+	"mglr": 3,
+	"sc":   3,
+	"gv":   1,
+	"cp":   3,
+	"pa":   2,
+	"cas":  3,
+	"wk":   1,
+	"wp":   1,
+	"tx":   2,
 }
 
 func main() {
@@ -105,22 +168,49 @@ func main() {
 	}
 
 	masterHostPort := net.JoinHostPort(*serverAddress, strconv.Itoa(*port))
-	ls, err := libstore.NewLibstore(masterHostPort, leaseCallbackAddr, leaseMode)
+	config := libstore.Config{Policy: leasePolicy(), CacheEntries: *cacheEntries, CacheBytes: *cacheBytes,
+		CallTimeout: *callTimeout}
+	ls, err := libstore.NewLibstoreWithConfig(masterHostPort, leaseCallbackAddr, leaseMode, config)
 	if err != nil {
 		log.Fatalln("Failed to create libstore:", err)
 	}
 
 	for i := 0; i < *numTimes; i++ {
+		if i > 0 {
+			time.Sleep(*every)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if *timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+		}
 		switch cmd {
 		case "g":
-			val, err := ls.Get(flag.Arg(1))
+			val, err := ls.GetContext(ctx, flag.Arg(1))
 			if err != nil {
 				fmt.Println("ERROR:", err)
 			} else {
 				fmt.Println(val)
 			}
+		case "d":
+			err := ls.DeleteContext(ctx, flag.Arg(1))
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				fmt.Println("OK")
+			}
 		case "lg":
-			val, err := ls.GetList(flag.Arg(1))
+			val, err := ls.GetListContext(ctx, flag.Arg(1))
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, i := range val {
+					fmt.Println(i)
+				}
+			}
+		case "lgr":
+			start, _ := strconv.Atoi(flag.Arg(2))
+			count, _ := strconv.Atoi(flag.Arg(3))
+			val, err := ls.GetListRangeContext(ctx, flag.Arg(1), start, count, *reverse)
 			if err != nil {
 				fmt.Println("ERROR:", err)
 			} else {
@@ -128,15 +218,121 @@ func main() {
 					fmt.Println(i)
 				}
 			}
+		case "mg":
+			keys := flag.Args()[1:]
+			vals, err := ls.MultiGetContext(ctx, keys)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, key := range keys {
+					if val, ok := vals[key]; ok {
+						fmt.Println(key, val)
+					}
+				}
+			}
+		case "mgl":
+			keys := flag.Args()[1:]
+			lists, err := ls.MultiGetListContext(ctx, keys)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, key := range keys {
+					for _, item := range lists[key] {
+						fmt.Println(key, item)
+					}
+				}
+			}
+		case "mglr":
+			start, _ := strconv.Atoi(flag.Arg(1))
+			count, _ := strconv.Atoi(flag.Arg(2))
+			keys := flag.Args()[3:]
+			lists, err := ls.MultiGetListRangeContext(ctx, keys, start, count, *reverse)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, key := range keys {
+					for _, item := range lists[key] {
+						fmt.Println(key, item)
+					}
+				}
+			}
+		case "sc":
+			limit, _ := strconv.Atoi(flag.Arg(3))
+			keys, next, err := ls.ScanContext(ctx, flag.Arg(1), flag.Arg(2), limit)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				for _, key := range keys {
+					fmt.Println(key)
+				}
+				if next != "" {
+					fmt.Println("NEXT:", next)
+				}
+			}
+		case "gv":
+			val, version, err := ls.GetVersionContext(ctx, flag.Arg(1))
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				fmt.Println(val, version)
+			}
+		case "cp", "pa", "cas":
+			var version uint64
+			var err error
+			switch cmd {
+			case "cp":
+				expect, _ := strconv.ParseUint(flag.Arg(3), 10, 64)
+				version, err = ls.ConditionalPutContext(ctx, flag.Arg(1), flag.Arg(2), expect)
+			case "pa":
+				version, err = ls.PutIfAbsentContext(ctx, flag.Arg(1), flag.Arg(2))
+			case "cas":
+				version, err = ls.CompareAndSwapContext(ctx, flag.Arg(1), flag.Arg(2), flag.Arg(3))
+			}
+			if err == libstore.ErrConflict {
+				fmt.Println("CONFLICT", version)
+			} else if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				fmt.Println("OK", version)
+			}
+		case "wk", "wp":
+			var w *libstore.Watch
+			if cmd == "wk" {
+				w, err = ls.WatchKey(flag.Arg(1))
+			} else {
+				w, err = ls.WatchPrefix(flag.Arg(1))
+			}
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				break
+			}
+			fmt.Println("WATCHING")
+			for e := range w.Events {
+				printEvent(e)
+			}
+		case "tx":
+			ops, ok := parseTxnOps(flag.Args()[1:])
+			if !ok {
+				flag.Usage()
+				os.Exit(1)
+			}
+			err := ls.TransactContext(ctx, ops)
+			if err == libstore.ErrConflict {
+				fmt.Println("CONFLICT")
+			} else if err != nil {
+				fmt.Println("ERROR:", err)
+			} else {
+				fmt.Println("OK")
+			}
 		case "p", "la", "lr":
 			var err error
 			switch cmd {
 			case "p":
-				err = ls.Put(flag.Arg(1), flag.Arg(2))
+				err = ls.PutWithTTLContext(ctx, flag.Arg(1), flag.Arg(2), time.Duration(*ttl)*time.Second)
 			case "la":
-				err = ls.AppendToList(flag.Arg(1), flag.Arg(2))
+				err = ls.AppendToListWithTTLContext(ctx, flag.Arg(1), flag.Arg(2), time.Duration(*ttl)*time.Second)
 			case "lr":
-				err = ls.RemoveFromList(flag.Arg(1), flag.Arg(2))
+				err = ls.RemoveFromListContext(ctx, flag.Arg(1), flag.Arg(2))
 			}
 			if err == nil {
 				fmt.Println("OK")
@@ -144,10 +340,65 @@ func main() {
 				fmt.Println("ERROR:", err)
 			}
 		}
+		cancel()
 	}
 
+	if *showStats {
+		printStats(ls)
+	}
 	if *handleLeases {
 		fmt.Println("Waiting 20 seconds for lease callbacks...")
 		time.Sleep(20 * time.Second)
+		if *showStats {
+			printStats(ls)
+		}
+	}
+}
+
+func printStats(ls libstore.Libstore) {
+	s := ls.CacheStats()
+	fmt.Printf("hits %d  misses %d  evictions %d  expirations %d  entries %d  bytes %d\n",
+		s.Hits, s.Misses, s.Evictions, s.Expirations, s.Entries, s.Bytes)
+}
+
+// parseTxnOps parses the ops of a transaction: each an op name and a key,
+// followed by a value unless it is a delete.
+func parseTxnOps(args []string) ([]libstore.TxnOp, bool) {
+	types := map[string]libstore.TxnOpType{"p": libstore.TxnPut, "d": libstore.TxnDelete,
+		"la": libstore.TxnAppend, "lr": libstore.TxnRemove}
+	var ops []libstore.TxnOp
+	for len(args) >= 2 {
+		t, ok := types[args[0]]
+		if !ok {
+			return nil, false
+		}
+		op := libstore.TxnOp{Type: t, Key: args[1]}
+		args = args[2:]
+		if t != libstore.TxnDelete {
+			if len(args) == 0 {
+				return nil, false
+			}
+			op.Value, args = args[0], args[1:]
+		}
+		ops = append(ops, op)
+	}
+	return ops, len(args) == 0
+}
+
+// printEvent prints a change to a watched key on a line.
+func printEvent(e libstore.WatchEvent) {
+	switch e.Type {
+	case libstore.PutEvent:
+		fmt.Println("PUT", e.Key, e.Value, e.Version)
+	case libstore.DeleteEvent:
+		fmt.Println("DELETE", e.Key, e.Version)
+	case libstore.AppendEvent:
+		fmt.Println("APPEND", e.Key, e.Value, e.Version)
+	case libstore.RemoveEvent:
+		fmt.Println("REMOVE", e.Key, e.Value, e.Version)
+	case libstore.ReplaceEvent:
+		fmt.Println("REPLACE", e.Key, e.Values, e.Version)
+	case libstore.LostEvent:
+		fmt.Println("LOST")
 	}
 }
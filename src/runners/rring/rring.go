@@ -0,0 +1,69 @@
+// A program that reports how the hash ring of a running storage cluster is
+// split between its storage servers: for every server, the number of points
+// it owns and the fraction of the hash space those points cover.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+
+	"hashring"
+	"rpc/storagerpc"
+)
+
+var (
+	serverAddress = flag.String("host", "localhost", "master storage server host")
+	port          = flag.Int("port", 9009, "master storage server port number")
+	vnodes        = flag.Int("vnodes", -1, "if non-negative, report the split the ring would have with this many virtual nodes per unit of weight instead")
+)
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "The rring program reports the fraction of the hash space that each storage")
+		fmt.Fprint(os.Stderr, "server of a running ring owns.\n\n")
+		fmt.Fprintln(os.Stderr, "Usage:")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", *serverAddress, *port))
+	if err != nil {
+		log.Fatalln("Failed to connect to the master storage server:", err)
+	}
+	defer client.Close()
+
+	args := &storagerpc.GetServersArgs{}
+	reply := &storagerpc.GetServersReply{}
+	if err := client.Call("StorageServer.GetServers", args, reply); err != nil {
+		log.Fatalln("GetServers failed:", err)
+	}
+	if reply.Status != storagerpc.OK {
+		log.Fatalln("The ring is not ready yet")
+	}
+
+	n := reply.VirtualNodes
+	if *vnodes >= 0 {
+		n = *vnodes
+	}
+	nodes := make([]hashring.Node, 0, len(reply.Servers))
+	hostports := make(map[uint32]string)
+	for _, node := range reply.Servers {
+		nodes = append(nodes, hashring.Node{ID: node.NodeID, Weight: node.Weight})
+		hostports[node.NodeID] = node.HostPort
+	}
+	ring := hashring.New(nodes, n)
+	shares := ring.Ownership()
+
+	fmt.Printf("%-10s  %-21s  %6s  %6s  %7s\n", "NodeID", "HostPort", "Weight", "Points", "Share")
+	for _, node := range ring.Nodes() {
+		fmt.Printf("%-10d  %-21s  %6d  %6d  %6.2f%%\n", node.ID, hostports[node.ID], node.Weight,
+			len(ring.Points(node.ID)), 100*shares[node.ID])
+	}
+}
@@ -5,11 +5,20 @@ package main
 import (
 	crand "crypto/rand"
 	"flag"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/big"
 	"math/rand"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"rpc/storagerpc"
 	"storageserver"
 )
 
@@ -18,8 +27,18 @@ const defaultMasterPort = 9009
 var (
 	port           = flag.Int("port", defaultMasterPort, "port number to listen on")
 	masterHostPort = flag.String("master", "", "master storage server host port (if non-empty then this storage server is a slave)")
-	numNodes       = flag.Int("N", 1, "the number of nodes in the ring (including the master)")
+	numNodes       = flag.Int("N", 1, "the number of nodes in the initial ring (including the master)")
 	nodeID         = flag.Uint("id", 0, "a 32-bit unsigned node ID to use for consistent hashing")
+	dataDir        = flag.String("datadir", "", "directory for the write-ahead log and snapshots (if empty then data is kept in memory only)")
+	replicas       = flag.Int("replicas", 0, "(master only) the number of successors that back up each key range")
+	raft           = flag.Bool("raft", false, "run each replica set as a Raft group (must be set on every node of the ring)")
+	vnodes         = flag.Int("vnodes", 0, "(master only) the number of points each node owns on the hash ring per unit of weight (if 0 then each node owns the single point given by its ID)")
+	weight         = flag.Int("weight", 1, "the relative capacity of this node, scaling its number of virtual nodes")
+	antiEntropy    = flag.Int("antientropy", 0, "seconds between anti-entropy rounds, which repair differences between replicas (if 0 then 60, if negative then only on demand)")
+	engine         = flag.String("engine", storageserver.MemoryEngine, "the storage engine: memory, or btree to keep keys in files on disk (inside -datadir if set)")
+	leaseWrites    = flag.Int("leasewrites", 0, "the number of writes to a key within 10 seconds above which its leases are shortened, and denied at twice as many (if 0 then leases ignore writes)")
+	writeQuorum    = flag.Int("writequorum", 0, "the number of replicas, counting the primary, that must apply a write before it is acknowledged (if 0 then every live replica)")
+	raftLogLimit   = flag.Int("raftlog", 0, "the number of applied entries a Raft log holds before they are compacted into a snapshot (if 0 then 1000)")
 )
 
 func init() {
@@ -33,20 +52,78 @@ func main() {
 		*port = defaultMasterPort
 	}
 
-	// If nodeID is 0, then assign a random 32-bit integer instead.
+	// If nodeID is 0, then reuse the ID saved in the data directory, or
+	// assign a random 32-bit integer instead.
 	randID := uint32(*nodeID)
+	if randID == 0 && *dataDir != "" {
+		randID = loadNodeID(*dataDir)
+	}
 	if randID == 0 {
 		randint, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
 		rand.Seed(randint.Int64())
 		randID = rand.Uint32()
 	}
+	if *dataDir != "" {
+		saveNodeID(*dataDir, randID)
+	}
 
 	// Create and start the StorageServer.
-	_, err := storageserver.NewStorageServer(*masterHostPort, *numNodes, *port, randID)
+	config := storageserver.Config{
+		DataDir:            *dataDir,
+		Replicas:           *replicas,
+		Raft:               *raft,
+		VirtualNodes:       *vnodes,
+		Weight:             *weight,
+		Engine:             *engine,
+		AntiEntropySeconds: *antiEntropy,
+		LeaseWriteLimit:    *leaseWrites,
+		WriteQuorum:        *writeQuorum,
+		RaftLogLimit:       *raftLogLimit,
+	}
+	_, err := storageserver.NewStorageServerWithConfig(*masterHostPort, *numNodes, *port, randID, config)
 	if err != nil {
 		log.Fatalln("Failed to create storage server:", err)
 	}
 
-	// Run the storage server forever.
-	select {}
+	// Run the storage server until it is interrupted. A slave leaves the
+	// ring on its way out, handing its keys over to the remaining servers.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if *masterHostPort != "" {
+		if err := leave(*masterHostPort, randID); err != nil {
+			log.Fatalln("Failed to leave the ring:", err)
+		}
+	}
+}
+
+func leave(masterHostPort string, id uint32) error {
+	client, err := rpc.DialHTTP("tcp", masterHostPort)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	args := &storagerpc.UnregisterArgs{NodeID: id}
+	return client.Call("StorageServer.UnregisterServer", args, &storagerpc.UnregisterReply{})
+}
+
+// The node ID decides which keys a server owns, so a server restarted on
+// the same data directory must come back with the same ID.
+func loadNodeID(dir string) uint32 {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "nodeid"))
+	if err != nil {
+		return 0
+	}
+	id, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	return uint32(id)
+}
+
+func saveNodeID(dir string, id uint32) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalln("Failed to create data directory:", err)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "nodeid"), []byte(strconv.FormatUint(uint64(id), 10)), 0644)
+	if err != nil {
+		log.Fatalln("Failed to save node ID:", err)
+	}
 }
@@ -0,0 +1,135 @@
+// A program for operating a single storage server of a running cluster:
+// it reports what the server holds through its admin RPCs, as well as its
+// anti-entropy metrics, and runs anti-entropy on demand.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"time"
+
+	"rpc/adminrpc"
+	"rpc/storagerpc"
+)
+
+var (
+	serverAddress = flag.String("host", "localhost", "storage server host")
+	port          = flag.Int("port", 9009, "storage server port number")
+	run           = flag.Bool("run", false, "make antientropy run a round of anti-entropy before reporting")
+)
+
+func init() {
+	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, "The rstoragectl program inspects and operates a single storage server.\n\n")
+		fmt.Fprintln(os.Stderr, "Usage:")
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Possible commands:")
+		fmt.Fprintln(os.Stderr, "  PrefixStats:    prefixes")
+		fmt.Fprintln(os.Stderr, "  Tenants:        tenants [key]")
+		fmt.Fprintln(os.Stderr, "  Ranges:         ranges")
+		fmt.Fprintln(os.Stderr, "  Conns:          conns")
+		fmt.Fprintln(os.Stderr, "  AntiEntropy:    antientropy")
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", *serverAddress, *port))
+	if err != nil {
+		log.Fatalln("Failed to connect to the storage server:", err)
+	}
+	defer client.Close()
+
+	switch flag.Arg(0) {
+	case "prefixes":
+		prefixStats(client)
+	case "tenants":
+		tenants(client, flag.Arg(1))
+	case "ranges":
+		ranges(client)
+	case "conns":
+		conns(client)
+	case "antientropy":
+		antiEntropy(client)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func antiEntropy(client *rpc.Client) {
+	args := &storagerpc.AntiEntropyArgs{Run: *run}
+	reply := &storagerpc.AntiEntropyReply{}
+	if err := client.Call("StorageServer.AntiEntropy", args, reply); err != nil {
+		log.Fatalln("AntiEntropy failed:", err)
+	}
+	stats := reply.Stats
+	fmt.Println("Rounds:         ", stats.Rounds)
+	fmt.Println("RangesChecked:  ", stats.RangesChecked)
+	fmt.Println("RangesRepaired: ", stats.RangesRepaired)
+	fmt.Println("KeysPushed:     ", stats.KeysPushed)
+	fmt.Println("KeysPulled:     ", stats.KeysPulled)
+	fmt.Println("Failures:       ", stats.Failures)
+	if stats.LastRound != 0 {
+		fmt.Println("LastRound:      ", time.Unix(0, stats.LastRound).Format(time.RFC3339))
+		fmt.Println("LastDuration:   ", time.Duration(stats.LastDuration))
+	}
+}
+
+// callAdmin calls an admin RPC, exiting if it fails or the server is not
+// ready.
+func callAdmin(client *rpc.Client, method string, args, reply interface{}, status *adminrpc.Status) {
+	if err := client.Call("StorageAdmin."+method, args, reply); err != nil {
+		log.Fatalln(method, "failed:", err)
+	}
+	if *status != adminrpc.OK {
+		log.Fatalln("The ring is not ready yet")
+	}
+}
+
+func prefixStats(client *rpc.Client) {
+	reply := &adminrpc.PrefixStatsReply{}
+	callAdmin(client, "GetPrefixStats", &adminrpc.PrefixStatsArgs{}, reply, &reply.Status)
+	fmt.Printf("%-10s  %8s  %12s\n", "Prefix", "Keys", "Bytes")
+	for _, p := range reply.Prefixes {
+		fmt.Printf("%-10s  %8d  %12d\n", p.Prefix, p.Keys, p.Bytes)
+	}
+}
+
+func tenants(client *rpc.Client, key string) {
+	reply := &adminrpc.TenantsReply{}
+	callAdmin(client, "GetTenants", &adminrpc.TenantsArgs{Key: key}, reply, &reply.Status)
+	for _, t := range reply.Tenants {
+		fmt.Printf("%s  %s  expires %s\n", t.Key, t.HostPort, time.Unix(t.Expires, 0).Format(time.RFC3339))
+	}
+}
+
+func ranges(client *rpc.Client) {
+	reply := &adminrpc.RangesReply{}
+	callAdmin(client, "GetRanges", &adminrpc.RangesArgs{}, reply, &reply.Status)
+	fmt.Printf("%-10s  %-10s  %-6s  %s\n", "Start", "End", "Served", "Replicas")
+	for _, r := range reply.Ranges {
+		fmt.Printf("%-10d  %-10d  %-6v  %v\n", r.Start, r.End, r.Served, r.Replicas)
+	}
+}
+
+func conns(client *rpc.Client) {
+	reply := &adminrpc.ConnsReply{}
+	callAdmin(client, "GetConns", &adminrpc.ConnsArgs{}, reply, &reply.Status)
+	for _, hostport := range reply.Libstores {
+		fmt.Println("libstore ", hostport)
+	}
+	for _, p := range reply.Peers {
+		fmt.Printf("peer      %s  (%d)\n", p.HostPort, p.NodeID)
+	}
+}
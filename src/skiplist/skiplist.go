@@ -0,0 +1,202 @@
+// Package skiplist implements a sorted set of strings as an indexable skip
+// list. Adding, removing and finding a string, as well as finding the
+// string at a given position, take logarithmic time on average.
+package skiplist
+
+// A node has each level above the bottom one with probability 1/4, given
+// the level below, and at most maxLevel levels.
+const maxLevel = 32
+
+// link is a node's link to the next node on one level, along with the
+// number of positions it skips: 1 on the bottom level. A nil next stands for
+// the position just past the last string.
+type link struct {
+	next  *node
+	width int
+}
+
+type node struct {
+	value string
+	links []link // one per level, bottom first
+}
+
+// List is a sorted set of strings. The zero value is an empty list. A List
+// is not safe for concurrent use, except for concurrent reads.
+type List struct {
+	head node // holds no string, at position 0; has as many levels as the tallest node
+	len  int
+	seed uint64
+}
+
+// New returns an empty list.
+func New() *List {
+	return &List{}
+}
+
+// FromSorted returns a list of values, which must be sorted and hold no
+// duplicates.
+func FromSorted(values []string) *List {
+	l := New()
+	for _, value := range values {
+		l.Insert(value)
+	}
+	return l
+}
+
+// Len returns the number of strings in l.
+func (l *List) Len() int {
+	return l.len
+}
+
+// Contains reports whether value is in l.
+func (l *List) Contains(value string) bool {
+	var update [maxLevel]*node
+	var rank [maxLevel]int
+	next := l.find(value, &update, &rank)
+	return next != nil && next.value == value
+}
+
+// Insert adds value to l, reporting whether it was missing.
+func (l *List) Insert(value string) bool {
+	var update [maxLevel]*node
+	var rank [maxLevel]int
+	if next := l.find(value, &update, &rank); next != nil && next.value == value {
+		return false
+	}
+	height := l.height()
+	for len(l.head.links) < height {
+		update[len(l.head.links)] = &l.head
+		l.head.links = append(l.head.links, link{width: l.len + 1})
+	}
+	// The new node takes the position after its predecessor's.
+	pos := rank[0] + 1
+	n := &node{value: value, links: make([]link, height)}
+	for i := range l.head.links {
+		prev := &update[i].links[i]
+		if i >= height {
+			prev.width++
+			continue
+		}
+		n.links[i] = link{next: prev.next, width: rank[i] + prev.width + 1 - pos}
+		*prev = link{next: n, width: pos - rank[i]}
+	}
+	l.len++
+	return true
+}
+
+// Remove removes value from l, reporting whether it was there.
+func (l *List) Remove(value string) bool {
+	var update [maxLevel]*node
+	var rank [maxLevel]int
+	n := l.find(value, &update, &rank)
+	if n == nil || n.value != value {
+		return false
+	}
+	for i := range l.head.links {
+		prev := &update[i].links[i]
+		if i < len(n.links) {
+			*prev = link{next: n.links[i].next, width: prev.width + n.links[i].width - 1}
+		} else {
+			prev.width--
+		}
+	}
+	for len(l.head.links) > 0 && l.head.links[len(l.head.links)-1].next == nil {
+		l.head.links = l.head.links[:len(l.head.links)-1]
+	}
+	l.len--
+	return true
+}
+
+// Range returns up to count strings of l, starting start strings from the
+// first one, in increasing order, or, if reverse, from the last one, in
+// decreasing order.
+func (l *List) Range(start, count int, reverse bool) []string {
+	if start < 0 {
+		start = 0
+	}
+	if count > l.len-start {
+		count = l.len - start
+	}
+	if count <= 0 {
+		return make([]string, 0)
+	}
+	first := start
+	if reverse {
+		first = l.len - start - count
+	}
+	values := make([]string, count)
+	n := l.at(first + 1)
+	for i := range values {
+		values[i] = n.value
+		n = n.links[0].next
+	}
+	if reverse {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	return values
+}
+
+// Values returns every string of l in increasing order.
+func (l *List) Values() []string {
+	return l.Range(0, l.len, false)
+}
+
+// Ascend calls fn with the strings of l at or after from, in increasing
+// order, until fn returns false. fn must not change l.
+func (l *List) Ascend(from string, fn func(value string) bool) {
+	var update [maxLevel]*node
+	var rank [maxLevel]int
+	for n := l.find(from, &update, &rank); n != nil; n = n.links[0].next {
+		if !fn(n.value) {
+			return
+		}
+	}
+}
+
+// find fills update with the last node before value on every level and rank
+// with the nodes' positions, and returns the first node at or after value
+// on the bottom level, if any.
+func (l *List) find(value string, update *[maxLevel]*node, rank *[maxLevel]int) *node {
+	n, pos := &l.head, 0
+	for i := len(l.head.links) - 1; i >= 0; i-- {
+		for n.links[i].next != nil && n.links[i].next.value < value {
+			pos += n.links[i].width
+			n = n.links[i].next
+		}
+		update[i], rank[i] = n, pos
+	}
+	if len(n.links) == 0 {
+		return nil
+	}
+	return n.links[0].next
+}
+
+// at returns the node at position pos, 1 being the first string's.
+func (l *List) at(pos int) *node {
+	n, p := &l.head, 0
+	for i := len(l.head.links) - 1; i >= 0; i-- {
+		for n.links[i].next != nil && p+n.links[i].width <= pos {
+			p += n.links[i].width
+			n = n.links[i].next
+		}
+	}
+	return n
+}
+
+// height picks the number of levels of a new node, using a xorshift
+// generator private to l so that lists need no shared random source.
+func (l *List) height() int {
+	if l.seed == 0 {
+		l.seed = 0x9e3779b97f4a7c15
+	}
+	l.seed ^= l.seed << 13
+	l.seed ^= l.seed >> 7
+	l.seed ^= l.seed << 17
+	h := 1
+	for x := l.seed; h < maxLevel && x&3 == 0; x >>= 2 {
+		h++
+	}
+	return h
+}
@@ -0,0 +1,121 @@
+package storageserver
+
+import (
+	"sort"
+	"time"
+
+	"rpc/adminrpc"
+	"util"
+)
+
+// Admin RPCs. Every storage server registers a second RPC service,
+// adminService, that lets an operator see what the server holds: its keys
+// by prefix type, the leases it granted, the key ranges of its ring and the
+// connections it keeps open. The replies are read under the same locks as
+// ordinary requests, one shard at a time, so they are not point-in-time.
+
+// The RPC name of the storage servers' admin service.
+const adminService = "StorageAdmin"
+
+// prefixTypes lists the prefix types of keys in the order they are reported.
+var prefixTypes = []string{adminrpc.UserKeys, adminrpc.SubListKeys, adminrpc.PostKeys, adminrpc.PostListKeys,
+	adminrpc.OtherKeys}
+
+func (ss *storageServer) GetPrefixStats(args *adminrpc.PrefixStatsArgs, reply *adminrpc.PrefixStatsReply) error {
+	stats := make(map[string]*adminrpc.PrefixStats)
+	for _, prefix := range prefixTypes {
+		stats[prefix] = &adminrpc.PrefixStats{Prefix: prefix}
+	}
+	now := time.Now().UnixNano()
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+		sh.storage.Keys(func(key string) bool {
+			if sh.expired(key, now) {
+				return true
+			}
+			s := stats[adminrpc.PrefixType(key)]
+			s.Keys++
+			s.Bytes += int64(len(key))
+			values, _ := sh.storage.Get(key)
+			for _, value := range values {
+				s.Bytes += int64(len(value))
+			}
+			return true
+		})
+		sh.lock.RUnlock()
+	}
+	for _, prefix := range prefixTypes {
+		reply.Prefixes = append(reply.Prefixes, *stats[prefix])
+	}
+	reply.Status = adminrpc.OK
+	return nil
+}
+
+func (ss *storageServer) GetTenants(args *adminrpc.TenantsArgs, reply *adminrpc.TenantsReply) error {
+	now := time.Now().Unix()
+	reply.Tenants = make([]adminrpc.Tenant, 0)
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+		for key, records := range sh.tenants {
+			if args.Key != "" && key != args.Key {
+				continue
+			}
+			for _, leaseRecord := range records {
+				if hostport, t := util.ParseLeaseRecord(leaseRecord); leaseExpiry(t) >= now {
+					reply.Tenants = append(reply.Tenants, adminrpc.Tenant{Key: key, HostPort: hostport,
+						Expires: leaseExpiry(t)})
+				}
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	sort.Slice(reply.Tenants, func(i, j int) bool {
+		a, b := reply.Tenants[i], reply.Tenants[j]
+		return a.Key < b.Key || a.Key == b.Key && a.HostPort < b.HostPort
+	})
+	reply.Status = adminrpc.OK
+	return nil
+}
+
+func (ss *storageServer) GetRanges(args *adminrpc.RangesArgs, reply *adminrpc.RangesReply) error {
+	if !ss.isReady() {
+		reply.Status = adminrpc.NotReady
+		return nil
+	}
+	ss.ringLock.RLock()
+	ring, replicas := ss.ring, ss.replicas
+	ss.ringLock.RUnlock()
+	served := ss.servedRanges(ring, replicas)
+	points := ring.AllPoints()
+	for i, end := range points {
+		start := points[(i+len(points)-1)%len(points)]
+		reply.Ranges = append(reply.Ranges, adminrpc.Range{Start: start, End: end,
+			Replicas: ring.ReplicaSet(end, replicas), Served: served[end]})
+	}
+	reply.Status = adminrpc.OK
+	return nil
+}
+
+func (ss *storageServer) GetConns(args *adminrpc.ConnsArgs, reply *adminrpc.ConnsReply) error {
+	reply.Libstores = make([]string, 0)
+	ss.connsLock.Lock()
+	for hostport := range ss.conns {
+		reply.Libstores = append(reply.Libstores, hostport)
+	}
+	ss.connsLock.Unlock()
+	sort.Strings(reply.Libstores)
+
+	var ids []uint32
+	ss.peers.lock.Lock()
+	for id := range ss.peers.conns {
+		ids = append(ids, id)
+	}
+	ss.peers.lock.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	reply.Peers = make([]adminrpc.Peer, 0, len(ids))
+	for _, id := range ids {
+		reply.Peers = append(reply.Peers, adminrpc.Peer{NodeID: id, HostPort: ss.hostPortOf(id)})
+	}
+	reply.Status = adminrpc.OK
+	return nil
+}
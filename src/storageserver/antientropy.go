@@ -0,0 +1,507 @@
+package storageserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"hashring"
+	"libstore"
+	"rpc/storagerpc"
+)
+
+// Anti-entropy. A replica misses the writes made while it is down or cut
+// off, and replication alone never gives them back to it. Every so often
+// the serving member of each key range, the first live member of its replica
+// set, compares the range with every other live member: both hash the keys
+// of the range and their versions into a Merkle tree, the subtrees whose
+// hashes differ are descended into down to the leaves, and the keys of the
+// differing leaves are compared one by one. For every key the newer version
+// wins and is copied to the replica that lacks it. Deleted keys leave a
+// tombstone behind for tombstoneLifetime, so that a delete wins over the
+// older value it removed; a replica that missed a delete for longer than
+// that gets the key back. Ranges are left alone in consensus mode, where
+// the Raft logs keep replicas in step, and while the ring is changing.
+const (
+	defaultAntiEntropyInterval = time.Minute
+	tombstoneLifetime          = 10 * time.Minute
+	digestTimeout              = 10 * time.Second
+	repairBatchSize            = 100 // keys sent or asked for per Repair
+)
+
+// tombstone records the version and time of the write that deleted a key.
+type tombstone struct {
+	version uint64
+	time    int64
+}
+
+type antiEntropyState struct {
+	round sync.Mutex // serializes rounds
+	lock  sync.Mutex // guards stats
+	stats storagerpc.AntiEntropyStats
+}
+
+var errRangeMoved = errors.New("key range is not held by the replica")
+
+// merkleTree holds the hashes of the nodes of the Merkle tree of a key
+// range, level by level from the root down to the leaves. A leaf hashes the
+// keys that fall in it along with their versions, and any other node the
+// hashes of its children.
+type merkleTree [storagerpc.MerkleDepth + 1][]uint64
+
+func newMerkleTree() *merkleTree {
+	t := new(merkleTree)
+	for level, n := 0, 1; level <= storagerpc.MerkleDepth; level, n = level+1, n*storagerpc.MerkleFanout {
+		t[level] = make([]uint64, n)
+	}
+	return t
+}
+
+// merkleLeaves is the number of leaves of a Merkle tree.
+var merkleLeaves = len(newMerkleTree()[storagerpc.MerkleDepth])
+
+// leafOf returns the leaf of the Merkle tree that key falls in.
+func leafOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(merkleLeaves))
+}
+
+// add hashes key, at version, into its leaf. Leaves combine their keys with
+// exclusive or, so that the order in which keys are added does not matter.
+func (t *merkleTree) add(key string, version uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], version)
+	h.Write(buf[:])
+	t[storagerpc.MerkleDepth][leafOf(key)] ^= h.Sum64()
+}
+
+// seal computes the hashes of the nodes above the leaves once every key has
+// been added.
+func (t *merkleTree) seal() {
+	var buf [8]byte
+	for level := storagerpc.MerkleDepth - 1; level >= 0; level-- {
+		for i := range t[level] {
+			h := fnv.New64a()
+			for _, child := range t[level+1][i*storagerpc.MerkleFanout : (i+1)*storagerpc.MerkleFanout] {
+				binary.BigEndian.PutUint64(buf[:], child)
+				h.Write(buf[:])
+			}
+			t[level][i] = h.Sum64()
+		}
+	}
+}
+
+// hashes returns the hashes of the given nodes at depth level.
+func (t *merkleTree) hashes(level int, nodes []int) ([]uint64, error) {
+	if level < 0 || level > storagerpc.MerkleDepth {
+		return nil, fmt.Errorf("no level %d in a Merkle tree", level)
+	}
+	hashes := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		if n < 0 || n >= len(t[level]) {
+			return nil, fmt.Errorf("no node %d at level %d of a Merkle tree", n, level)
+		}
+		hashes[i] = t[level][n]
+	}
+	return hashes, nil
+}
+
+// holdsRange returns the ring if this server is in the replica set of the
+// key range ending at point end, and nil otherwise.
+func (ss *storageServer) holdsRange(end uint32) *hashring.Ring {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	if ss.ring.Len() == 0 || ss.ring.Point(end) != end || !inReplicaSet(ss.ring.ReplicaSet(end, ss.replicas), ss.nodeID) {
+		return nil
+	}
+	return ss.ring
+}
+
+// merkleTrees builds the Merkle tree of every key range in trees, which
+// maps the ranges' end points on ring to empty trees. Expired keys are left
+// out.
+func (ss *storageServer) merkleTrees(ring *hashring.Ring, trees map[uint32]*merkleTree) {
+	now := time.Now().UnixNano()
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+		sh.storage.Keys(func(key string) bool {
+			if t, ok := trees[ring.Point(libstore.StoreHash(key))]; ok && !sh.expired(key, now) {
+				t.add(key, sh.meta(key).Version)
+			}
+			return true
+		})
+		sh.lock.RUnlock()
+	}
+	for _, t := range trees {
+		t.seal()
+	}
+}
+
+// rangeKeys returns, by key, the state of every key of the key range ending
+// at point end on ring that falls in one of leaves, including deleted and
+// expired keys that were not purged yet.
+func (ss *storageServer) rangeKeys(ring *hashring.Ring, end uint32, leaves map[int]bool) map[string]storagerpc.KeyVersion {
+	keys := make(map[string]storagerpc.KeyVersion)
+	now := time.Now().UnixNano()
+	include := func(key string) bool {
+		return ring.Point(libstore.StoreHash(key)) == end && leaves[leafOf(key)]
+	}
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+		sh.storage.Keys(func(key string) bool {
+			if include(key) {
+				keys[key] = sh.keyVersion(key, now)
+			}
+			return true
+		})
+		sh.storage.Tombstones(func(key string, _ tombstone) bool {
+			if _, ok := keys[key]; !ok && include(key) {
+				keys[key] = sh.keyVersion(key, now)
+			}
+			return true
+		})
+		sh.lock.RUnlock()
+	}
+	return keys
+}
+
+// keyVersion returns the state of key: its version, or the version of the
+// delete that removed it, an expired key counting as deleted at its last
+// version. The version of a key that was never seen is 0. The caller must
+// hold sh.lock.
+func (sh *shard) keyVersion(key string, now int64) storagerpc.KeyVersion {
+	if meta, ok := sh.storage.Meta(key); ok {
+		return storagerpc.KeyVersion{Key: key, Version: meta.Version, Deleted: meta.Expires != 0 && meta.Expires <= now}
+	}
+	if t, ok := sh.storage.Tombstone(key); ok {
+		return storagerpc.KeyVersion{Key: key, Version: t.version, Deleted: true}
+	}
+	return storagerpc.KeyVersion{Key: key}
+}
+
+// keyRecord returns the record of key that repairs a replica holding an
+// older version of it. The caller must hold sh.lock.
+func (sh *shard) keyRecord(key string, now int64) storagerpc.KeyRecord {
+	kv := sh.keyVersion(key, now)
+	rec := storagerpc.KeyRecord{Key: key, Version: kv.Version, Deleted: kv.Deleted}
+	if !kv.Deleted {
+		rec.Values, _ = sh.storage.Get(key)
+		rec.Expires = sh.meta(key).Expires
+	}
+	return rec
+}
+
+// repair applies rec, received from another replica, unless this server
+// holds the same or a newer version of the key. It reports whether rec was
+// applied.
+func (ss *storageServer) repair(rec *storagerpc.KeyRecord) (bool, error) {
+	ss.waitFence()
+	sh := ss.lockForWrite(rec.Key)
+	defer sh.lock.Unlock()
+	now := time.Now().UnixNano()
+	if rec.Version <= sh.keyVersion(rec.Key, now).Version {
+		return false, nil
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.StoreOp, Key: rec.Key, Values: rec.Values, Version: rec.Version,
+		Expires: rec.Expires, Time: now}
+	if rec.Deleted {
+		m = &storagerpc.Mutation{Op: storagerpc.DeleteOp, Key: rec.Key, Version: rec.Version, Time: now}
+	}
+	return true, ss.commit(m)
+}
+
+// pruneTombstones forgets the deletes made before tombstoneLifetime ago.
+func (ss *storageServer) pruneTombstones() {
+	limit := time.Now().Add(-tombstoneLifetime).UnixNano()
+	for _, sh := range ss.shards {
+		sh.lock.Lock()
+		var keys []string
+		sh.storage.Tombstones(func(key string, t tombstone) bool {
+			if t.time < limit {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			sh.storage.DeleteTombstone(key)
+		}
+		sh.lock.Unlock()
+	}
+}
+
+// antiEntropist runs a round of anti-entropy every interval, unless interval
+// is negative, and prunes tombstones.
+func (ss *storageServer) antiEntropist(interval time.Duration) {
+	period := interval
+	if period <= 0 {
+		period = defaultAntiEntropyInterval
+	}
+	for {
+		time.Sleep(period)
+		ss.pruneTombstones()
+		if interval >= 0 {
+			ss.runAntiEntropy()
+		}
+	}
+}
+
+// runAntiEntropy compares every key range that this server serves with the
+// range's other live replicas and repairs the differences.
+func (ss *storageServer) runAntiEntropy() {
+	ss.antiEntropy.round.Lock()
+	defer ss.antiEntropy.round.Unlock()
+	start := time.Now()
+	var round storagerpc.AntiEntropyStats
+	ss.ringLock.RLock()
+	ring, replicas, changing := ss.ring, ss.replicas, ss.pending != nil
+	ss.ringLock.RUnlock()
+
+	peers := make(map[uint32][]uint32)
+	trees := make(map[uint32]*merkleTree)
+	if !ss.raft && replicas > 0 && !changing && ss.isReady() {
+		for _, end := range ring.AllPoints() {
+			set := ring.ReplicaSet(end, replicas)
+			if !inReplicaSet(set, ss.nodeID) {
+				continue
+			}
+			var live []uint32
+			for _, id := range set {
+				if id == ss.nodeID || !ss.knownDown(id) {
+					live = append(live, id)
+				}
+			}
+			if live[0] == ss.nodeID && len(live) > 1 {
+				peers[end] = live[1:]
+				trees[end] = newMerkleTree()
+			}
+		}
+		ss.merkleTrees(ring, trees)
+	}
+
+	for end, ids := range peers {
+		for _, id := range ids {
+			round.RangesChecked++
+			pushed, pulled, err := ss.compareRange(ring, end, trees[end], id)
+			if err != nil {
+				log.Printf("Anti-entropy of key range %d with storage server %d failed: %v", end, id, err)
+				round.Failures++
+			}
+			if pushed+pulled > 0 {
+				round.RangesRepaired++
+			}
+			round.KeysPushed += pushed
+			round.KeysPulled += pulled
+		}
+	}
+	if round.RangesRepaired > 0 {
+		log.Printf("Anti-entropy repaired %d key ranges: %d keys pushed, %d pulled", round.RangesRepaired,
+			round.KeysPushed, round.KeysPulled)
+	}
+
+	ss.antiEntropy.lock.Lock()
+	defer ss.antiEntropy.lock.Unlock()
+	stats := &ss.antiEntropy.stats
+	stats.Rounds++
+	stats.RangesChecked += round.RangesChecked
+	stats.RangesRepaired += round.RangesRepaired
+	stats.KeysPushed += round.KeysPushed
+	stats.KeysPulled += round.KeysPulled
+	stats.Failures += round.Failures
+	stats.LastRound = time.Now().UnixNano()
+	stats.LastDuration = int64(time.Since(start))
+}
+
+// compareRange compares the key range ending at point end, whose Merkle tree
+// here is local, with its replica on peer id, and repairs the keys that
+// differ. It returns the numbers of keys sent to and taken from the peer.
+func (ss *storageServer) compareRange(ring *hashring.Ring, end uint32, local *merkleTree, id uint32) (int, int, error) {
+	// Descend from the root, keeping the nodes whose hashes differ.
+	nodes := []int{0}
+	for level := 0; level <= storagerpc.MerkleDepth && len(nodes) > 0; level++ {
+		if level > 0 {
+			children := make([]int, 0, len(nodes)*storagerpc.MerkleFanout)
+			for _, n := range nodes {
+				for i := 0; i < storagerpc.MerkleFanout; i++ {
+					children = append(children, n*storagerpc.MerkleFanout+i)
+				}
+			}
+			nodes = children
+		}
+		args := &storagerpc.DigestArgs{End: end, Level: level, Nodes: nodes}
+		reply := &storagerpc.DigestReply{}
+		if err := ss.callRangePeer(id, "StorageServer.GetDigests", args, reply, &reply.Status); err != nil {
+			return 0, 0, err
+		}
+		if len(reply.Hashes) != len(nodes) {
+			return 0, 0, errors.New("wrong number of hashes")
+		}
+		differing := make([]int, 0)
+		for i, n := range nodes {
+			if local[level][n] != reply.Hashes[i] {
+				differing = append(differing, n)
+			}
+		}
+		nodes = differing
+	}
+	if len(nodes) == 0 {
+		return 0, 0, nil
+	}
+
+	// nodes are the leaves that differ: compare their keys.
+	args := &storagerpc.DigestArgs{End: end, Level: storagerpc.MerkleDepth, Nodes: nodes, Keys: true}
+	reply := &storagerpc.DigestReply{}
+	if err := ss.callRangePeer(id, "StorageServer.GetDigests", args, reply, &reply.Status); err != nil {
+		return 0, 0, err
+	}
+	leaves := make(map[int]bool)
+	for _, n := range nodes {
+		leaves[n] = true
+	}
+	mine := ss.rangeKeys(ring, end, leaves)
+	var push, pull []string
+	for _, theirs := range reply.Keys {
+		if theirs.Version > mine[theirs.Key].Version {
+			pull = append(pull, theirs.Key)
+		}
+		if kv, ok := mine[theirs.Key]; ok && kv.Version > theirs.Version {
+			push = append(push, theirs.Key)
+		}
+		delete(mine, theirs.Key)
+	}
+	for key, kv := range mine {
+		if kv.Version > 0 {
+			push = append(push, key)
+		}
+	}
+	return ss.exchange(end, id, push, pull)
+}
+
+// exchange sends the records of the keys in push to peer id and applies
+// its records of the keys in pull, a batch at a time. It returns the
+// numbers of keys sent and applied.
+func (ss *storageServer) exchange(end, id uint32, push, pull []string) (int, int, error) {
+	pushed, pulled := 0, 0
+	for len(push) > 0 || len(pull) > 0 {
+		args := &storagerpc.RepairArgs{End: end}
+		for len(push) > 0 && len(args.Records) < repairBatchSize {
+			sh := ss.shardOf(push[0])
+			sh.lock.RLock()
+			args.Records = append(args.Records, sh.keyRecord(push[0], time.Now().UnixNano()))
+			sh.lock.RUnlock()
+			push = push[1:]
+		}
+		n := repairBatchSize
+		if n > len(pull) {
+			n = len(pull)
+		}
+		args.Want, pull = pull[:n], pull[n:]
+		reply := &storagerpc.RepairReply{}
+		if err := ss.callRangePeer(id, "StorageServer.Repair", args, reply, &reply.Status); err != nil {
+			return pushed, pulled, err
+		}
+		pushed += len(args.Records)
+		for i := range reply.Records {
+			applied, err := ss.repair(&reply.Records[i])
+			if err != nil {
+				return pushed, pulled, err
+			}
+			if applied {
+				pulled++
+			}
+		}
+	}
+	return pushed, pulled, nil
+}
+
+// callRangePeer calls an anti-entropy method on peer id, failing if the
+// peer does not hold the key range, as reported in *status.
+func (ss *storageServer) callRangePeer(id uint32, method string, args, reply interface{}, status *storagerpc.Status) error {
+	timeout := digestTimeout
+	if method == "StorageServer.Repair" {
+		// The peer may have to wait for its fence and for leases to expire.
+		timeout += 2 * (storagerpc.LeaseSeconds + storagerpc.LeaseGuardSeconds) * time.Second
+	}
+	err := ss.callPeer(id, method, args, reply, timeout)
+	if err == rpc.ErrShutdown || err == errPeerTimeout {
+		// The connection may have broken since the last round, when the peer
+		// restarted: try again on a new one. Both methods are idempotent.
+		err = ss.callPeer(id, method, args, reply, timeout)
+	}
+	if err != nil {
+		return err
+	}
+	if *status != storagerpc.OK {
+		return errRangeMoved
+	}
+	return nil
+}
+
+func (ss *storageServer) GetDigests(args *storagerpc.DigestArgs, reply *storagerpc.DigestReply) error {
+	ring := ss.holdsRange(args.End)
+	if ring == nil {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	if args.Keys {
+		leaves := make(map[int]bool)
+		for _, n := range args.Nodes {
+			leaves[n] = true
+		}
+		for _, kv := range ss.rangeKeys(ring, args.End, leaves) {
+			reply.Keys = append(reply.Keys, kv)
+		}
+		reply.Status = storagerpc.OK
+		return nil
+	}
+	t := newMerkleTree()
+	ss.merkleTrees(ring, map[uint32]*merkleTree{args.End: t})
+	hashes, err := t.hashes(args.Level, args.Nodes)
+	if err != nil {
+		return err
+	}
+	reply.Status = storagerpc.OK
+	reply.Hashes = hashes
+	return nil
+}
+
+func (ss *storageServer) Repair(args *storagerpc.RepairArgs, reply *storagerpc.RepairReply) error {
+	if ss.holdsRange(args.End) == nil {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	for i := range args.Records {
+		if _, err := ss.repair(&args.Records[i]); err != nil {
+			return err
+		}
+	}
+	for _, key := range args.Want {
+		sh := ss.shardOf(key)
+		sh.lock.RLock()
+		rec := sh.keyRecord(key, time.Now().UnixNano())
+		sh.lock.RUnlock()
+		if rec.Version > 0 {
+			reply.Records = append(reply.Records, rec)
+		}
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func (ss *storageServer) AntiEntropy(args *storagerpc.AntiEntropyArgs, reply *storagerpc.AntiEntropyReply) error {
+	if args.Run {
+		ss.runAntiEntropy()
+	}
+	ss.antiEntropy.lock.Lock()
+	reply.Stats = ss.antiEntropy.stats
+	ss.antiEntropy.lock.Unlock()
+	reply.Status = storagerpc.OK
+	return nil
+}
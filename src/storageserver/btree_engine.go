@@ -0,0 +1,484 @@
+package storageserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"btree"
+)
+
+// btreeEngine keeps a shard's keys in a B+tree file, one tree entry per key
+// and one per value, so that lists are changed an item at a time and only
+// the nodes in use are held in memory. An entry is named by keyTag and the
+// key, with its zero bytes escaped and a terminator appended so that
+// entries sort in the order of their keys, followed by keyMarker for the
+// key itself, whose value holds the key's version and expiry time, or by
+// itemMarker and the value; the entries of a key are thus adjacent, with
+// the values in order. Tombstones and an index of the keys that expire, by
+// expiry time, live in the same tree under tags of their own.
+//
+// A checkpoint syncs the tree, saving the clock and the number of keys
+// with it. An I/O error stops the server, which reopens the last
+// checkpoint and replays its write-ahead log on restart.
+type btreeEngine struct {
+	lock    sync.Mutex // the tree is not safe for concurrent reads
+	tree    *btree.Tree
+	keys    int
+	durable bool   // whether the tree is reopened on restart
+	clock   uint64 // clock of the checkpoint the tree was reopened from
+	synced  bool   // whether the tree was reopened from a checkpoint
+}
+
+const (
+	keyTag       = "k"
+	tombstoneTag = "t"
+	expiryTag    = "x" // followed by the expiry time in 8 big-endian bytes and the key
+
+	keyMarker  = "\x00"
+	itemMarker = "\x01"
+	endMarker  = "\x02" // sorts after every entry of a key
+)
+
+// newBTreeEngine returns an engine keeping its tree in the file at path,
+// which it reopens if reopen is set and recreates otherwise.
+func newBTreeEngine(path string, reopen bool) (*btreeEngine, error) {
+	if !reopen {
+		tree, err := btree.Create(path, btreeCacheNodes)
+		if err != nil {
+			return nil, err
+		}
+		return &btreeEngine{tree: tree}, nil
+	}
+	tree, err := btree.Open(path, btreeCacheNodes)
+	if err != nil {
+		return nil, err
+	}
+	e := &btreeEngine{tree: tree, durable: true}
+	if meta := tree.Meta(); meta != "" {
+		if _, err := fmt.Sscanf(meta, "%d %d", &e.clock, &e.keys); err != nil {
+			tree.Close()
+			return nil, fmt.Errorf("bad checkpoint in %s: %v", path, err)
+		}
+		e.synced = true
+	}
+	return e, nil
+}
+
+// entryPrefix returns the prefix shared by the tree entries of key: keyTag
+// and key with each zero byte written as "\x00\xff", followed by
+// "\x00\x01", which sorts before any byte of a longer key.
+func entryPrefix(key string) string {
+	b := make([]byte, 0, len(key)+3)
+	b = append(b, keyTag...)
+	for i := 0; i < len(key); i++ {
+		if key[i] == 0 {
+			b = append(b, 0, 0xff)
+		} else {
+			b = append(b, key[i])
+		}
+	}
+	return string(append(b, 0, 1))
+}
+
+// keyOfEntry returns the key of the tree entry named name, if name names the
+// entry of a key rather than of a value.
+func keyOfEntry(name string) (string, bool) {
+	if !strings.HasPrefix(name, keyTag) {
+		return "", false
+	}
+	b := make([]byte, 0, len(name))
+	for i := len(keyTag); i+1 < len(name); i++ {
+		if name[i] != 0 {
+			b = append(b, name[i])
+			continue
+		}
+		i++
+		switch name[i] {
+		case 0xff:
+			b = append(b, 0)
+		case 1:
+			return string(b), name[i+1:] == keyMarker
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func (e *btreeEngine) check(err error) {
+	if err != nil {
+		log.Fatalln("Storage engine failed:", err)
+	}
+}
+
+func (e *btreeEngine) Get(key string) ([]string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	prefix := entryPrefix(key)
+	_, ok, err := e.tree.Get(prefix + keyMarker)
+	e.check(err)
+	if !ok {
+		return nil, false
+	}
+	values := make([]string, 0)
+	items := prefix + itemMarker
+	c := e.tree.Seek(items)
+	for ; c.Valid() && len(c.Key()) >= len(items) && c.Key()[:len(items)] == items; c.Next() {
+		values = append(values, c.Key()[len(items):])
+	}
+	e.check(c.Err())
+	return values, true
+}
+
+func (e *btreeEngine) Range(key string, start, count int, reverse bool) ([]string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	prefix := entryPrefix(key)
+	_, ok, err := e.tree.Get(prefix + keyMarker)
+	e.check(err)
+	if !ok {
+		return nil, false
+	}
+	values := make([]string, 0)
+	items := prefix + itemMarker
+	var c *btree.Cursor
+	if reverse {
+		c = e.tree.Seek(prefix + endMarker)
+		c.Prev()
+	} else {
+		c = e.tree.Seek(items)
+	}
+	for ; c.Valid() && len(values) < count && len(c.Key()) >= len(items) && c.Key()[:len(items)] == items; start-- {
+		if start <= 0 {
+			values = append(values, c.Key()[len(items):])
+		}
+		if reverse {
+			c.Prev()
+		} else {
+			c.Next()
+		}
+	}
+	e.check(c.Err())
+	return values, true
+}
+
+func (e *btreeEngine) Exists(key string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, ok, err := e.tree.Get(entryPrefix(key) + keyMarker)
+	e.check(err)
+	return ok
+}
+
+func (e *btreeEngine) Contains(key, item string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, ok, err := e.tree.Get(entryPrefix(key) + itemMarker + item)
+	e.check(err)
+	return ok
+}
+
+func (e *btreeEngine) Set(key string, values []string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.deleteItems(key)
+	e.insert(key)
+	prefix := entryPrefix(key) + itemMarker
+	for _, item := range values {
+		_, err := e.tree.Put(prefix+item, "")
+		e.check(err)
+	}
+}
+
+func (e *btreeEngine) Insert(key, item string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.insert(key)
+	_, err := e.tree.Put(entryPrefix(key)+itemMarker+item, "")
+	e.check(err)
+}
+
+// insert adds the entry of key, if it is missing. The caller must hold
+// e.lock.
+func (e *btreeEngine) insert(key string) {
+	name := entryPrefix(key) + keyMarker
+	_, ok, err := e.tree.Get(name)
+	e.check(err)
+	if ok {
+		return
+	}
+	_, err = e.tree.Put(name, encodeMeta(keyMeta{}))
+	e.check(err)
+	e.keys++
+}
+
+func (e *btreeEngine) Remove(key, item string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.tree.Delete(entryPrefix(key) + itemMarker + item)
+	e.check(err)
+}
+
+func (e *btreeEngine) Delete(key string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	meta, ok := e.meta(key)
+	if !ok {
+		return
+	}
+	e.setExpiry(key, meta.Expires, 0)
+	e.deleteItems(key)
+	_, err := e.tree.Delete(entryPrefix(key) + keyMarker)
+	e.check(err)
+	e.keys--
+}
+
+// deleteItems removes the values of key. The caller must hold e.lock.
+func (e *btreeEngine) deleteItems(key string) {
+	items := entryPrefix(key) + itemMarker
+	for {
+		// Deleting invalidates the cursor, so seek again every time.
+		c := e.tree.Seek(items)
+		e.check(c.Err())
+		if !c.Valid() || len(c.Key()) < len(items) || c.Key()[:len(items)] != items {
+			return
+		}
+		_, err := e.tree.Delete(c.Key())
+		e.check(err)
+	}
+}
+
+// meta reads the entry of key. The caller must hold e.lock.
+func (e *btreeEngine) meta(key string) (keyMeta, bool) {
+	value, ok, err := e.tree.Get(entryPrefix(key) + keyMarker)
+	e.check(err)
+	if !ok {
+		return keyMeta{}, false
+	}
+	meta, err := decodeMeta(value)
+	e.check(err)
+	return meta, true
+}
+
+func (e *btreeEngine) Meta(key string) (keyMeta, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.meta(key)
+}
+
+func (e *btreeEngine) SetMeta(key string, meta keyMeta) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	old, ok := e.meta(key)
+	if !ok {
+		return
+	}
+	e.setExpiry(key, old.Expires, meta.Expires)
+	_, err := e.tree.Put(entryPrefix(key)+keyMarker, encodeMeta(meta))
+	e.check(err)
+}
+
+// setExpiry moves key in the expiry index from time old to time t, either
+// of which is 0 for none. The caller must hold e.lock.
+func (e *btreeEngine) setExpiry(key string, old, t int64) {
+	if old == t {
+		return
+	}
+	if old != 0 {
+		_, err := e.tree.Delete(expiryEntry(old, key))
+		e.check(err)
+	}
+	if t != 0 {
+		_, err := e.tree.Put(expiryEntry(t, key), "")
+		e.check(err)
+	}
+}
+
+// expiryEntry returns the name of the entry of key in the expiry index.
+func expiryEntry(t int64, key string) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t))
+	return expiryTag + string(b[:]) + key
+}
+
+func (e *btreeEngine) Expired(now int64, fn func(key string) bool) {
+	e.entries(expiryTag, expiryTag, func(name, _ string) bool {
+		rest := name[len(expiryTag):]
+		if len(rest) < 8 || int64(binary.BigEndian.Uint64([]byte(rest[:8]))) > now {
+			return false
+		}
+		return fn(rest[8:])
+	})
+}
+
+func (e *btreeEngine) Tombstone(key string) (tombstone, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	value, ok, err := e.tree.Get(tombstoneTag + key)
+	e.check(err)
+	if !ok {
+		return tombstone{}, false
+	}
+	t, err := decodeTombstone(value)
+	e.check(err)
+	return t, true
+}
+
+func (e *btreeEngine) SetTombstone(key string, t tombstone) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.tree.Put(tombstoneTag+key, encodeTombstone(t))
+	e.check(err)
+}
+
+func (e *btreeEngine) DeleteTombstone(key string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.tree.Delete(tombstoneTag + key)
+	e.check(err)
+}
+
+func (e *btreeEngine) Tombstones(fn func(key string, t tombstone) bool) {
+	e.entries(tombstoneTag, tombstoneTag, func(name, value string) bool {
+		t, err := decodeTombstone(value)
+		e.check(err)
+		return fn(name[len(tombstoneTag):], t)
+	})
+}
+
+// entries calls fn with the name and value of every entry at or after
+// start whose name begins with prefix, in order, until fn returns false.
+// Like Ascend, it reads the entries a batch at a time.
+func (e *btreeEngine) entries(prefix, start string, fn func(name, value string) bool) {
+	for {
+		var names, values []string
+		e.lock.Lock()
+		c := e.tree.Seek(start)
+		for ; c.Valid() && len(names) < keysBatchSize && strings.HasPrefix(c.Key(), prefix); c.Next() {
+			names = append(names, c.Key())
+			values = append(values, c.Value())
+		}
+		e.check(c.Err())
+		e.lock.Unlock()
+		for i, name := range names {
+			if !fn(name, values[i]) {
+				return
+			}
+		}
+		if len(names) < keysBatchSize {
+			return
+		}
+		start = names[len(names)-1] + "\x00"
+	}
+}
+
+func (e *btreeEngine) Keys(fn func(key string) bool) {
+	e.Ascend("", fn)
+}
+
+func (e *btreeEngine) Ascend(from string, fn func(key string) bool) {
+	// The keys are listed a batch at a time, with e.lock released while fn
+	// runs, so that fn can read the engine.
+	start := entryPrefix(from)
+	for {
+		keys := e.keysFrom(start, keysBatchSize)
+		for _, key := range keys {
+			if !fn(key) {
+				return
+			}
+		}
+		if len(keys) < keysBatchSize {
+			return
+		}
+		start = entryPrefix(keys[len(keys)-1]) + endMarker
+	}
+}
+
+// Ascend lists keys in batches of this many.
+const keysBatchSize = 256
+
+// keysFrom returns up to limit keys whose entries are at or after start.
+func (e *btreeEngine) keysFrom(start string, limit int) []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	keys := make([]string, 0)
+	c := e.tree.Seek(start)
+	for c.Valid() && len(keys) < limit && strings.HasPrefix(c.Key(), keyTag) {
+		key, ok := keyOfEntry(c.Key())
+		if !ok {
+			c.Next()
+			continue
+		}
+		keys = append(keys, key)
+		// Skip the values of key.
+		c = e.tree.Seek(entryPrefix(key) + endMarker)
+	}
+	e.check(c.Err())
+	return keys
+}
+
+func (e *btreeEngine) Len() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.keys
+}
+
+func (e *btreeEngine) Checkpoint(clock uint64) (bool, error) {
+	if !e.durable {
+		return false, nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return true, e.tree.Sync(fmt.Sprintf("%d %d", clock, e.keys))
+}
+
+func (e *btreeEngine) Checkpointed() (uint64, bool) {
+	return e.clock, e.synced
+}
+
+// Entry values: the version and expiry time of a key, and the version and
+// time of a tombstone, as varints.
+
+func encodeMeta(m keyMeta) string {
+	return encodePair(m.Version, m.Expires)
+}
+
+func decodeMeta(value string) (keyMeta, error) {
+	version, expires, err := decodePair(value)
+	return keyMeta{Version: version, Expires: expires}, err
+}
+
+func encodeTombstone(t tombstone) string {
+	return encodePair(t.version, t.time)
+}
+
+func decodeTombstone(value string) (tombstone, error) {
+	version, t, err := decodePair(value)
+	return tombstone{version: version, time: t}, err
+}
+
+func encodePair(x uint64, y int64) string {
+	var b [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	n += binary.PutVarint(b[n:], y)
+	return string(b[:n])
+}
+
+func decodePair(value string) (uint64, int64, error) {
+	b := []byte(value)
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, errBadEntry
+	}
+	y, m := binary.Varint(b[n:])
+	if m <= 0 {
+		return 0, 0, errBadEntry
+	}
+	return x, y, nil
+}
+
+var errBadEntry = errors.New("corrupt engine entry")
@@ -0,0 +1,303 @@
+package storageserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"skiplist"
+)
+
+// Storage engines. Every shard keeps its keys in an engine of its own, so
+// the shard's lock serializes writes to an engine with everything else, but
+// reads of an engine may run concurrently. Each key holds a sorted list of
+// values; a plain value is a list of one. Engines change a list an item at a
+// time, and read a range of it without going through the rest, in
+// logarithmic time, except that the btree engine walks past the values
+// before a range's start. They also list their keys in order from any key,
+// for scans. Along with its values, an engine keeps a key's version and
+// expiry time, the keys that expire in order of their expiry times, and the
+// tombstones of deleted keys. The btree engine in a data directory keeps
+// all that across restarts: Checkpoint saves it as it stands, and the
+// server reopens the checkpoint and replays the write-ahead log past it.
+// Other engines start empty, and the server reloads them from a snapshot.
+
+// Names of the storage engines Config.Engine selects.
+const (
+	MemoryEngine = "memory" // maps in memory, the default
+	BTreeEngine  = "btree"  // B+trees in files, caching a bounded number of nodes in memory
+)
+
+// Nodes of each shard's B+tree that the btree engine caches in memory.
+const btreeCacheNodes = 256
+
+// keyMeta is what an engine keeps about a key besides its values.
+type keyMeta struct {
+	Version uint64
+	Expires int64 // Unix nanoseconds, 0 if the key does not expire
+}
+
+// Engine stores the keys of a shard along with their sorted lists of values.
+type Engine interface {
+	// Get returns a copy of the values of key.
+	Get(key string) ([]string, bool)
+
+	// Range returns a copy of up to count values of key, starting start
+	// values from the first one, in increasing order, or, if reverse, from
+	// the last one, in decreasing order.
+	Range(key string, start, count int, reverse bool) ([]string, bool)
+
+	// Exists reports whether key is stored, even with no values.
+	Exists(key string) bool
+
+	// Contains reports whether item is among the values of key.
+	Contains(key, item string) bool
+
+	// Set stores key with values, which must be sorted, replacing any
+	// values it had.
+	Set(key string, values []string)
+
+	// Insert adds item to the values of key, creating the key if needed.
+	Insert(key, item string)
+
+	// Remove removes item from the values of key. The key stays even if no
+	// values are left.
+	Remove(key, item string)
+
+	// Delete removes key along with its values, version and expiry time.
+	Delete(key string)
+
+	// Meta returns the version and expiry time of key, if it is stored.
+	Meta(key string) (keyMeta, bool)
+
+	// SetMeta sets the version and expiry time of key, which must be
+	// stored.
+	SetMeta(key string, meta keyMeta)
+
+	// Expired calls fn with the keys whose expiry time is at or before now
+	// until fn returns false. fn must not change the engine.
+	Expired(now int64, fn func(key string) bool)
+
+	// Tombstone returns the tombstone of key, if it has one.
+	Tombstone(key string) (tombstone, bool)
+
+	// SetTombstone records t as the tombstone of key.
+	SetTombstone(key string, t tombstone)
+
+	// DeleteTombstone forgets the tombstone of key.
+	DeleteTombstone(key string)
+
+	// Tombstones calls fn with every tombstone and its key, in no particular
+	// order, until fn returns false. fn must not change the engine.
+	Tombstones(fn func(key string, t tombstone) bool)
+
+	// Keys calls fn with every key, in no particular order, until fn
+	// returns false. fn must not change the engine.
+	Keys(fn func(key string) bool)
+
+	// Ascend calls fn with the keys at or after from, in increasing order,
+	// until fn returns false. fn must not change the engine.
+	Ascend(from string, fn func(key string) bool)
+
+	// Len returns the number of keys.
+	Len() int
+
+	// Checkpoint saves everything the engine holds as it stands, along with
+	// clock, for the engine to be reopened from after a restart. It reports
+	// false if the engine cannot be reopened.
+	Checkpoint(clock uint64) (bool, error)
+
+	// Checkpointed returns the clock saved by the checkpoint the engine was
+	// reopened from, if it was.
+	Checkpointed() (uint64, bool)
+}
+
+// newEngines returns the engines of the shards of a server set up with
+// config.
+func newEngines(config Config) ([]Engine, error) {
+	engines := make([]Engine, numShards)
+	switch config.Engine {
+	case "", MemoryEngine:
+		for i := range engines {
+			engines[i] = newMemoryEngine()
+		}
+	case BTreeEngine:
+		dir, err := btreeDir(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		// In consensus mode the Raft logs are replayed from the start, into
+		// empty engines.
+		reopen := config.DataDir != "" && !config.Raft
+		for i := range engines {
+			if engines[i], err = newBTreeEngine(filepath.Join(dir, fmt.Sprintf("shard%02d.btree", i)), reopen); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", config.Engine)
+	}
+	return engines, nil
+}
+
+// btreeDir returns the directory for the files of the btree engine: inside
+// the data directory if there is one, and a new temporary directory
+// otherwise.
+func btreeDir(dataDir string) (string, error) {
+	if dataDir == "" {
+		return ioutil.TempDir("", "storageserver")
+	}
+	dir := filepath.Join(dataDir, "btree")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// memoryEngine keeps every key in a map, with its values in a skip list,
+// and the keys in order in a skip list of their own.
+type memoryEngine struct {
+	storage    map[string]*skiplist.List
+	order      *skiplist.List
+	meta       map[string]keyMeta
+	expiring   map[string]int64 // expiry times of the keys that expire
+	tombstones map[string]tombstone
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{
+		storage:    make(map[string]*skiplist.List),
+		order:      skiplist.New(),
+		meta:       make(map[string]keyMeta),
+		expiring:   make(map[string]int64),
+		tombstones: make(map[string]tombstone),
+	}
+}
+
+func (e *memoryEngine) Get(key string) ([]string, bool) {
+	values, ok := e.storage[key]
+	if !ok {
+		return nil, false
+	}
+	return values.Values(), true
+}
+
+func (e *memoryEngine) Range(key string, start, count int, reverse bool) ([]string, bool) {
+	values, ok := e.storage[key]
+	if !ok {
+		return nil, false
+	}
+	return values.Range(start, count, reverse), true
+}
+
+func (e *memoryEngine) Exists(key string) bool {
+	_, ok := e.storage[key]
+	return ok
+}
+
+func (e *memoryEngine) Contains(key, item string) bool {
+	values, ok := e.storage[key]
+	return ok && values.Contains(item)
+}
+
+func (e *memoryEngine) Set(key string, values []string) {
+	if _, ok := e.storage[key]; !ok {
+		e.order.Insert(key)
+	}
+	e.storage[key] = skiplist.FromSorted(values)
+}
+
+func (e *memoryEngine) Insert(key, item string) {
+	values, ok := e.storage[key]
+	if !ok {
+		values = skiplist.New()
+		e.storage[key] = values
+		e.order.Insert(key)
+	}
+	values.Insert(item)
+}
+
+func (e *memoryEngine) Remove(key, item string) {
+	if values, ok := e.storage[key]; ok {
+		values.Remove(item)
+	}
+}
+
+func (e *memoryEngine) Delete(key string) {
+	if _, ok := e.storage[key]; ok {
+		delete(e.storage, key)
+		delete(e.meta, key)
+		delete(e.expiring, key)
+		e.order.Remove(key)
+	}
+}
+
+func (e *memoryEngine) Meta(key string) (keyMeta, bool) {
+	if _, ok := e.storage[key]; !ok {
+		return keyMeta{}, false
+	}
+	return e.meta[key], true
+}
+
+func (e *memoryEngine) SetMeta(key string, meta keyMeta) {
+	if _, ok := e.storage[key]; !ok {
+		return
+	}
+	e.meta[key] = meta
+	if meta.Expires != 0 {
+		e.expiring[key] = meta.Expires
+	} else {
+		delete(e.expiring, key)
+	}
+}
+
+func (e *memoryEngine) Expired(now int64, fn func(key string) bool) {
+	for key, t := range e.expiring {
+		if t <= now && !fn(key) {
+			return
+		}
+	}
+}
+
+func (e *memoryEngine) Tombstone(key string) (tombstone, bool) {
+	t, ok := e.tombstones[key]
+	return t, ok
+}
+
+func (e *memoryEngine) SetTombstone(key string, t tombstone) {
+	e.tombstones[key] = t
+}
+
+func (e *memoryEngine) DeleteTombstone(key string) {
+	delete(e.tombstones, key)
+}
+
+func (e *memoryEngine) Tombstones(fn func(key string, t tombstone) bool) {
+	for key, t := range e.tombstones {
+		if !fn(key, t) {
+			return
+		}
+	}
+}
+
+func (e *memoryEngine) Keys(fn func(key string) bool) {
+	for key := range e.storage {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+func (e *memoryEngine) Ascend(from string, fn func(key string) bool) {
+	e.order.Ascend(from, fn)
+}
+
+func (e *memoryEngine) Len() int {
+	return len(e.storage)
+}
+
+func (e *memoryEngine) Checkpoint(clock uint64) (bool, error) {
+	return false, nil
+}
+
+func (e *memoryEngine) Checkpointed() (uint64, bool) {
+	return 0, false
+}
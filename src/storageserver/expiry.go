@@ -0,0 +1,87 @@
+package storageserver
+
+import (
+	"log"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Key expiry. A key written with a TTL gets an expiry time, carried by its
+// mutations so that every replica agrees on it. From then on reads treat
+// the key as missing, and so does any write applied at a later Time, while
+// the sweeper deletes it for good through the usual write path, which
+// reaches the backups and revokes leases. Keys that expire are never leased,
+// so no libstore can keep serving one from its cache.
+
+// How often the sweeper looks for expired keys.
+const sweepInterval = time.Second
+
+// expiresAt returns the expiry time of a key written now with a TTL of
+// ttlSeconds, or 0 if it has none.
+func expiresAt(ttlSeconds int) int64 {
+	if ttlSeconds <= 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(ttlSeconds) * time.Second).UnixNano()
+}
+
+// expiryOf returns the expiry time of rec's key once rec has been applied,
+// given the one it had before.
+func expiryOf(rec *storagerpc.Mutation, old int64) int64 {
+	switch rec.Op {
+	case storagerpc.PutOp, storagerpc.StoreOp:
+		return rec.Expires
+	case storagerpc.AppendOp, storagerpc.RemoveOp:
+		if rec.Expires != 0 {
+			return rec.Expires
+		}
+	}
+	return old
+}
+
+// sweeper periodically deletes the expired keys that this server is the
+// primary of or, in consensus mode, whose group it leads, and drops the
+// write counts that leases no longer need.
+func (ss *storageServer) sweeper() {
+	for {
+		time.Sleep(sweepInterval)
+		ss.pruneWrites()
+		now := time.Now().UnixNano()
+		keys := make([]string, 0)
+		for _, sh := range ss.shards {
+			sh.lock.RLock()
+			sh.storage.Expired(now, func(key string) bool {
+				keys = append(keys, key)
+				return true
+			})
+			sh.lock.RUnlock()
+		}
+		for _, key := range keys {
+			if !ss.sweeps(key) {
+				continue
+			}
+			// The condition keeps the key if it was written again since.
+			m := &storagerpc.Mutation{Op: storagerpc.DeleteOp, Key: key, Cond: storagerpc.IfExpired}
+			if _, err := ss.mutate(m); err != nil {
+				log.Printf("Failed to delete expired key %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// sweeps reports whether this server deletes key once it has expired.
+func (ss *storageServer) sweeps(key string) bool {
+	if !ss.keyRangeContains(key) {
+		return false
+	}
+	if ss.raft {
+		g := ss.groupOf(key)
+		if g == nil {
+			return false
+		}
+		leader, ok := g.currentLeader()
+		return ok && leader == ss.nodeID
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package storageserver
+
+import (
+	"sync"
+	"time"
+
+	"hashring"
+	"libstore"
+	"rpc/storagerpc"
+)
+
+// Exports. A backup reads every server's partition a page at a time: the
+// first Export call fixes the key ranges this server serves, and every call
+// reads the next page of their records in key order from the storage
+// engines, as they stand, the way a scan does. A key written while the dump
+// is read shows whichever version its page found. Replicas of a range that
+// each believe they serve it may both dump it; the backup keeps the later
+// version of every key. A dump is dropped once read to its end, or after
+// exportIdleTimeout without a call.
+
+const exportIdleTimeout = time.Minute
+
+// dump is the state of an export between its pages.
+type dump struct {
+	time   int64 // when the dump was started
+	ring   *hashring.Ring
+	ranges []uint32
+	serves map[uint32]bool // ranges, by end point
+	used   time.Time       // when the dump was last read
+}
+
+type exportState struct {
+	lock  sync.Mutex
+	last  uint64 // ID of the last dump taken
+	dumps map[uint64]*dump
+}
+
+// servedRanges returns the end points on ring of the key ranges this server
+// serves: the ones it is the first live member of, or in consensus mode the
+// ones whose group it leads.
+func (ss *storageServer) servedRanges(ring *hashring.Ring, replicas int) map[uint32]bool {
+	ranges := make(map[uint32]bool)
+	for _, point := range ring.AllPoints() {
+		set := ring.ReplicaSet(point, replicas)
+		if ss.raft {
+			if g, ok := ss.group(set[0]); ok && inReplicaSet(set, ss.nodeID) && g.readIndex() == nil {
+				ranges[point] = true
+			}
+			continue
+		}
+		for _, id := range set {
+			if id == ss.nodeID {
+				ranges[point] = true
+			}
+			if id == ss.nodeID || !ss.knownDown(id) {
+				break
+			}
+		}
+	}
+	return ranges
+}
+
+// startDump fixes the key ranges this server serves for a new dump.
+func (ss *storageServer) startDump() *dump {
+	ss.ringLock.RLock()
+	ring, replicas := ss.ring, ss.replicas
+	ss.ringLock.RUnlock()
+	d := &dump{time: time.Now().UnixNano(), ring: ring, ranges: make([]uint32, 0),
+		serves: ss.servedRanges(ring, replicas)}
+	for end := range d.serves {
+		d.ranges = append(d.ranges, end)
+	}
+	return d
+}
+
+// page returns the records of up to limit unexpired keys of the dump's key
+// ranges at or after key from, in increasing order, and whether any follow.
+// Keys deleted while they are read are passed over, but a page holds a
+// record unless none follow.
+func (ss *storageServer) page(d *dump, from string, limit int) ([]storagerpc.KeyRecord, bool) {
+	include := func(key string) bool {
+		return d.serves[d.ring.Point(libstore.StoreHash(key))]
+	}
+	records := make([]storagerpc.KeyRecord, 0)
+	for {
+		keys, more := ss.scanFrom("", from, limit, include)
+		now := time.Now().UnixNano()
+		for _, key := range keys {
+			sh := ss.shardOf(key)
+			sh.lock.RLock()
+			values, ok := sh.storage.Get(key)
+			meta := sh.meta(key)
+			sh.lock.RUnlock()
+			if ok && (meta.Expires == 0 || meta.Expires > now) {
+				records = append(records, storagerpc.KeyRecord{Key: key, Values: values, Version: meta.Version,
+					Expires: meta.Expires})
+			}
+		}
+		if len(records) > 0 || !more {
+			return records, more
+		}
+		from = keys[len(keys)-1] + "\x00"
+	}
+}
+
+func (ss *storageServer) Export(args *storagerpc.ExportArgs, reply *storagerpc.ExportReply) error {
+	var d *dump
+	if args.ID == 0 {
+		if !ss.isReady() {
+			reply.Status = storagerpc.NotReady
+			return nil
+		}
+		d = ss.startDump()
+	}
+
+	e := &ss.exports
+	e.lock.Lock()
+	now := time.Now()
+	for id, old := range e.dumps {
+		if now.Sub(old.used) > exportIdleTimeout {
+			delete(e.dumps, id)
+		}
+	}
+	id := args.ID
+	if d != nil {
+		e.last++
+		id = e.last
+		e.dumps[id] = d
+	} else if d = e.dumps[id]; d == nil {
+		e.lock.Unlock()
+		reply.Status = storagerpc.KeyNotFound
+		return nil
+	}
+	d.used = now
+	e.lock.Unlock()
+
+	from := ""
+	if args.ID != 0 {
+		from = args.StartAfter + "\x00" // the first key after StartAfter
+	}
+	reply.Records, reply.More = ss.page(d, from, args.Limit)
+	reply.Status = storagerpc.OK
+	reply.ID = id
+	reply.Time = d.time
+	reply.Ranges = d.ranges
+	if !reply.More {
+		e.lock.Lock()
+		delete(e.dumps, id)
+		e.lock.Unlock()
+	}
+	return nil
+}
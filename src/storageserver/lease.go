@@ -0,0 +1,220 @@
+package storageserver
+
+import (
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+	"util"
+)
+
+// Lease revocation. Before a key is written, every libstore holding an
+// unexpired lease on it is asked, all at once, to drop it. The key's shard
+// is not locked meanwhile, so other keys can be read and written; writes to
+// the key itself wait for the revocation to finish, and reads of it are
+// answered without a lease until then. A libstore that cannot be reached is
+// waited out until its lease expires.
+
+// clearLeases makes sure that no lease on key is outstanding before a write
+// to it. The caller must hold the write lock of sh, the key's shard. If
+// there are no leases to wait for, clearLeases returns true with sh.lock
+// still held. Otherwise it releases sh.lock, waits for the leases to be
+// revoked and returns false, and the caller has to take sh.lock and
+// validate the write again.
+func (ss *storageServer) clearLeases(sh *shard, key string) bool {
+	if done, ok := sh.revoking[key]; ok {
+		sh.lock.Unlock()
+		<-done
+		return false
+	}
+	now := time.Now().Unix()
+	var tenants []string
+	for _, leaseRecord := range sh.tenants[key] {
+		if _, t := util.ParseLeaseRecord(leaseRecord); leaseExpiry(t) >= now {
+			tenants = append(tenants, leaseRecord)
+		}
+	}
+	delete(sh.tenants, key)
+	if len(tenants) == 0 {
+		return true
+	}
+
+	done := make(chan struct{})
+	sh.revoking[key] = done
+	sh.lock.Unlock()
+	ss.revokeAll(key, tenants)
+	sh.lock.Lock()
+	delete(sh.revoking, key)
+	sh.lock.Unlock()
+	close(done)
+	return false
+}
+
+// leasable reports whether a lease on key may be granted: not while its
+// leases are being revoked, nor ever on a key that expires. The caller must
+// hold sh.lock.
+func (sh *shard) leasable(key string) bool {
+	_, revoking := sh.revoking[key]
+	return !revoking && sh.meta(key).Expires == 0
+}
+
+// Lease shortening. With a LeaseWriteLimit, each shard counts the writes to
+// its keys over windows of storagerpc.QueryCacheSeconds, and a key written
+// more than the limit within the current window gets shorter leases, since
+// every write to it has to revoke them first.
+
+// writeLoad counts the writes to a key since start, in Unix seconds.
+type writeLoad struct {
+	count int
+	start int64
+}
+
+// noteWrite counts a write to key at now, in Unix seconds. The caller must
+// hold sh.lock for writing.
+func (sh *shard) noteWrite(key string, now int64) {
+	w, ok := sh.writes[key]
+	if !ok || now-w.start >= storagerpc.QueryCacheSeconds {
+		w = &writeLoad{start: now}
+		sh.writes[key] = w
+	}
+	w.count++
+}
+
+// grantLease records and returns the lease granted to the read args, which
+// asked for one of a leasable key. The lease is as long as asked for, but
+// shortened in proportion to the writes to the key beyond the server's
+// limit, down to none at twice the limit. The caller must hold sh.lock for
+// writing.
+func (ss *storageServer) grantLease(sh *shard, args *storagerpc.GetArgs) storagerpc.Lease {
+	seconds := args.LeaseSeconds
+	if seconds <= 0 || seconds > storagerpc.LeaseSeconds {
+		seconds = storagerpc.LeaseSeconds
+	}
+	if limit := ss.leaseWrites; limit > 0 {
+		if w, ok := sh.writes[args.Key]; ok && time.Now().Unix()-w.start < storagerpc.QueryCacheSeconds && w.count > limit {
+			seconds = seconds * (2*limit - w.count) / limit
+		}
+	}
+	if seconds <= 0 {
+		return storagerpc.Lease{}
+	}
+	sh.recordLease(args.Key, args.HostPort, seconds)
+	return storagerpc.Lease{Granted: true, ValidSeconds: seconds}
+}
+
+// pruneWrites drops the write counts of windows that are over.
+func (ss *storageServer) pruneWrites() {
+	if ss.leaseWrites <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	for _, sh := range ss.shards {
+		sh.lock.Lock()
+		for key, w := range sh.writes {
+			if now-w.start >= storagerpc.QueryCacheSeconds {
+				delete(sh.writes, key)
+			}
+		}
+		sh.lock.Unlock()
+	}
+}
+
+// lockForWrite takes the write lock of key's shard once no lease on key is
+// outstanding, and returns the shard. It is meant for writes that need no
+// validation beyond what they do under the lock.
+func (ss *storageServer) lockForWrite(key string) *shard {
+	sh := ss.shardOf(key)
+	sh.lock.Lock()
+	for !ss.clearLeases(sh, key) {
+		sh.lock.Lock()
+	}
+	return sh
+}
+
+// leaseExpiry returns the time, in Unix seconds, after which a lease
+// granted at grantTime may no longer be in use.
+func leaseExpiry(grantTime int64) int64 {
+	return grantTime + storagerpc.LeaseSeconds + storagerpc.LeaseGuardSeconds
+}
+
+// revokeAll revokes the leases on key described by the lease records in
+// tenants, in parallel, and returns once every one of them has been
+// revoked or has expired.
+func (ss *storageServer) revokeAll(key string, tenants []string) {
+	var wg sync.WaitGroup
+	for _, leaseRecord := range tenants {
+		host, t := util.ParseLeaseRecord(leaseRecord)
+		wg.Add(1)
+		go func(host string, expiry time.Time) {
+			defer wg.Done()
+			ss.revokeFrom(host, key, expiry)
+		}(host, time.Unix(leaseExpiry(t), 0))
+	}
+	wg.Wait()
+}
+
+// revokeFrom asks the libstore at host to drop its lease on key, giving up
+// at expiry, when the lease is no longer valid anyway.
+func (ss *storageServer) revokeFrom(host, key string, expiry time.Time) {
+	timeout := time.After(expiry.Sub(time.Now()))
+	done := make(chan error, 1)
+	go func() {
+		args := &storagerpc.RevokeLeaseArgs{Key: key}
+		reply := &storagerpc.RevokeLeaseReply{}
+		done <- ss.callAppServer(host, "LeaseCallbacks.RevokeLease", args, reply)
+	}()
+	select {
+	case <-timeout:
+	case err := <-done:
+		if err != nil {
+			log.Printf("Failed to revoke the lease of %s on %s: %v", host, key, err)
+			<-timeout
+		}
+	}
+}
+
+// callAppServer invokes method on the libstore at hostPort, dropping the
+// connection if it fails.
+func (ss *storageServer) callAppServer(hostPort, method string, args, reply interface{}) error {
+	cli, err := ss.getAppServer(hostPort)
+	if err != nil {
+		return err
+	}
+	if err = cli.Call(method, args, reply); err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			ss.connsLock.Lock()
+			if ss.conns[hostPort] == cli {
+				delete(ss.conns, hostPort)
+			}
+			ss.connsLock.Unlock()
+			cli.Close()
+		}
+	}
+	return err
+}
+
+// getAppServer returns a connection to the libstore at hostPort, dialing it
+// if needed.
+func (ss *storageServer) getAppServer(hostPort string) (*rpc.Client, error) {
+	ss.connsLock.Lock()
+	cli, ok := ss.conns[hostPort]
+	ss.connsLock.Unlock()
+	if ok {
+		return cli, nil
+	}
+	cli, err := rpc.DialHTTP("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	ss.connsLock.Lock()
+	defer ss.connsLock.Unlock()
+	if existing, ok := ss.conns[hostPort]; ok {
+		// Another revocation dialed it first.
+		cli.Close()
+		return existing, nil
+	}
+	ss.conns[hostPort] = cli
+	return cli, nil
+}
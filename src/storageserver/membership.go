@@ -0,0 +1,368 @@
+package storageserver
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"hashring"
+	"rpc/storagerpc"
+	"util"
+)
+
+// Ring membership changes. The master serializes joins and leaves and drives
+// every affected server through them with UpdateRing: first a Prepare round,
+// after which servers accept replicated and migrated keys of the new layout,
+// then an install round. Leaving servers install first so that they hand
+// their keys over before anyone takes over their ranges, and joining servers
+// install last, once every key they are going to serve has reached them.
+const (
+	migrateBatchSize  = 500
+	migrateTimeout    = 10 * time.Second
+	updateRingTimeout = 5 * time.Minute
+)
+
+var errRaftMembership = errors.New("ring membership cannot change in consensus mode")
+
+// servers returns the nodes of the ring. A server that is still joining
+// reports the layout it is preparing for.
+func (ss *storageServer) servers() []storagerpc.Node {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	ring := ss.ring
+	if ring.Len() == 0 && ss.pending != nil {
+		ring = ss.pending
+	}
+	servers := make([]storagerpc.Node, 0, ring.Len())
+	for _, node := range ring.Nodes() {
+		servers = append(servers, storagerpc.Node{HostPort: ss.nodes[node.ID], NodeID: node.ID, Weight: node.Weight})
+	}
+	return servers
+}
+
+// setRing installs the ring made of servers.
+func (ss *storageServer) setRing(servers []storagerpc.Node) {
+	ss.ringLock.Lock()
+	ring, nodes := buildRing(servers, ss.vnodes)
+	ss.ring, ss.nodes, ss.pending, ss.ready = ring, nodes, nil, true
+	ss.ringLock.Unlock()
+	ss.watchRing()
+}
+
+// watchRing points the failure detector at the servers of the ring.
+func (ss *storageServer) watchRing() {
+	servers := ss.servers()
+	hostports := make([]string, 0, len(servers))
+	for _, node := range servers {
+		hostports = append(hostports, node.HostPort)
+	}
+	ss.fd.SetMembers(hostports)
+}
+
+func buildRing(servers []storagerpc.Node, vnodes int) (*hashring.Ring, map[uint32]string) {
+	ring := make([]hashring.Node, 0, len(servers))
+	nodes := make(map[uint32]string)
+	for _, node := range servers {
+		ring = append(ring, hashring.Node{ID: node.NodeID, Weight: node.Weight})
+		nodes[node.NodeID] = node.HostPort
+	}
+	return hashring.New(ring, vnodes), nodes
+}
+
+func (ss *storageServer) isReady() bool {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	return ss.ready
+}
+
+// holds reports whether key belongs to this server's replica sets on the
+// installed ring.
+func (ss *storageServer) holds(key string) bool {
+	return inReplicaSet(ss.replicaSet(key), ss.nodeID)
+}
+
+// accepts reports whether this server takes writes to key from its peers:
+// it holds the key now or will hold it once a prepared ring is installed.
+func (ss *storageServer) accepts(key string) bool {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	return inReplicaSet(replicaSetOn(ss.ring, key, ss.replicas), ss.nodeID) ||
+		inReplicaSet(replicaSetOn(ss.pending, key, ss.replicas), ss.nodeID)
+}
+
+// join adds node to the running ring on behalf of RegisterServer.
+func (ss *storageServer) join(node storagerpc.Node, reply *storagerpc.RegisterReply) error {
+	if ss.raft {
+		return errRaftMembership
+	}
+	ss.ringChange.Lock()
+	defer ss.ringChange.Unlock()
+	servers := ss.servers()
+	if !containsNode(servers, node.NodeID) {
+		log.Printf("Storage server %d (%s) is joining the ring", node.NodeID, node.HostPort)
+		if err := ss.changeRing(append(servers, node)); err != nil {
+			return err
+		}
+	}
+	reply.Status = storagerpc.OK
+	reply.Servers = ss.servers()
+	reply.ReplicaSets = ss.replicaSets()
+	reply.Raft = ss.raft
+	return nil
+}
+
+func (ss *storageServer) UnregisterServer(args *storagerpc.UnregisterArgs, reply *storagerpc.UnregisterReply) error {
+	if !ss.isMaster {
+		return errors.New("only the master storage server can change the ring")
+	} else if ss.raft {
+		return errRaftMembership
+	} else if args.NodeID == ss.nodeID {
+		return errors.New("the master storage server cannot leave the ring")
+	}
+	ss.ringChange.Lock()
+	defer ss.ringChange.Unlock()
+	servers := ss.servers()
+	if containsNode(servers, args.NodeID) {
+		log.Printf("Storage server %d is leaving the ring", args.NodeID)
+		remaining := make([]storagerpc.Node, 0, len(servers)-1)
+		for _, node := range servers {
+			if node.NodeID != args.NodeID {
+				remaining = append(remaining, node)
+			}
+		}
+		if err := ss.changeRing(remaining); err != nil {
+			return err
+		}
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func containsNode(servers []storagerpc.Node, id uint32) bool {
+	for _, node := range servers {
+		if node.NodeID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// changeRing moves every server of the current ring and of servers to the
+// layout given by servers. The caller must hold ss.ringChange.
+func (ss *storageServer) changeRing(servers []storagerpc.Node) error {
+	current := ss.servers()
+	var leaving, staying, joining []storagerpc.Node
+	for _, node := range current {
+		if containsNode(servers, node.NodeID) {
+			staying = append(staying, node)
+		} else {
+			leaving = append(leaving, node)
+		}
+	}
+	for _, node := range servers {
+		if !containsNode(current, node.NodeID) {
+			joining = append(joining, node)
+		}
+	}
+	order := append(append(leaving, staying...), joining...)
+
+	// A server that misses the Prepare round only refuses replicated writes
+	// for its new keys until it installs the ring, so failures there are
+	// tolerated, except on the servers joining: without them the change is
+	// pointless. Servers left accepting a prepared ring that never comes are
+	// harmless, as accepting writes from peers only widens.
+	args := &storagerpc.UpdateRingArgs{Servers: servers, Replicas: ss.replicas, VirtualNodes: ss.vnodes, Prepare: true}
+	for _, node := range order {
+		if err := ss.updateRing(node, args); err != nil {
+			if containsNode(joining, node.NodeID) {
+				return err
+			}
+			log.Printf("Storage server %d did not prepare the new ring: %v", node.NodeID, err)
+		}
+	}
+	args = &storagerpc.UpdateRingArgs{Servers: servers, Replicas: ss.replicas, VirtualNodes: ss.vnodes}
+	for _, node := range order {
+		if err := ss.updateRing(node, args); err != nil {
+			log.Printf("Storage server %d did not install the new ring: %v", node.NodeID, err)
+		}
+	}
+	return nil
+}
+
+func (ss *storageServer) updateRing(node storagerpc.Node, args *storagerpc.UpdateRingArgs) error {
+	reply := &storagerpc.UpdateRingReply{}
+	if node.NodeID == ss.nodeID {
+		return ss.UpdateRing(args, reply)
+	}
+	return ss.callPeer(node.NodeID, "StorageServer.UpdateRing", args, reply, updateRingTimeout)
+}
+
+func (ss *storageServer) UpdateRing(args *storagerpc.UpdateRingArgs, reply *storagerpc.UpdateRingReply) error {
+	if ss.raft {
+		return errRaftMembership
+	}
+	ring, nodes := buildRing(args.Servers, args.VirtualNodes)
+	if args.Prepare {
+		ss.ringLock.Lock()
+		ss.pending = ring
+		ss.replicas = args.Replicas
+		ss.vnodes = args.VirtualNodes
+		for id, hostport := range nodes {
+			ss.nodes[id] = hostport
+		}
+		ss.ringLock.Unlock()
+		reply.Status = storagerpc.OK
+		return nil
+	}
+
+	// Install the ring and take the records to hand over in one step, so
+	// that no write slips in between; from here on writes to the keys
+	// changing hands are refused with WrongServer.
+	ss.lockAll()
+	ss.ringLock.Lock()
+	old := ss.ring
+	ss.replicas, ss.vnodes = args.Replicas, args.VirtualNodes
+	ss.ringLock.Unlock()
+	batches := ss.handover(old, ring)
+	ss.setRing(args.Servers)
+	ss.unlockAll()
+
+	ss.peers.lock.Lock()
+	for id, cli := range ss.peers.conns {
+		if _, ok := nodes[id]; !ok {
+			cli.Close()
+			delete(ss.peers.conns, id)
+		}
+	}
+	ss.peers.lock.Unlock()
+
+	// Keys that could not be handed over are kept, so that a failed
+	// migration costs space rather than data.
+	kept := make(map[string]bool)
+	for id, records := range batches {
+		for i := 0; i < len(records); i += migrateBatchSize {
+			j := i + migrateBatchSize
+			if j > len(records) {
+				j = len(records)
+			}
+			args := &storagerpc.MigrateArgs{Records: records[i:j]}
+			if err := ss.callPeer(id, "StorageServer.Migrate", args, &storagerpc.MigrateReply{}, migrateTimeout); err != nil {
+				log.Printf("Migrating %d keys to storage server %d failed: %v", j-i, id, err)
+				for _, rec := range records[i:j] {
+					kept[rec.Key] = true
+				}
+			}
+		}
+	}
+
+	ss.lockAll()
+	defer ss.unlockAll()
+	dropped := 0
+	for _, sh := range ss.shards {
+		var drop []string
+		sh.storage.Keys(func(key string) bool {
+			set := ss.replicaSet(key)
+			if len(set) > 0 && set[0] != ss.nodeID {
+				delete(sh.tenants, key)
+			}
+			if !inReplicaSet(set, ss.nodeID) && !kept[key] {
+				drop = append(drop, key)
+			}
+			return true
+		})
+		for _, key := range drop {
+			if err := ss.commit(&storagerpc.Mutation{Op: storagerpc.DeleteOp, Key: key}); err != nil {
+				return err
+			}
+			dropped++
+		}
+	}
+	log.Printf("Installed a ring of %d storage servers, %d keys handed off", ring.Len(), dropped)
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+// handover returns, by destination, the records that moving from ring old to
+// ring next requires this server to send: every key it holds goes to the
+// members its replica set gains, and, if this server was the key's primary,
+// to the new primary along with the key's lease records. The caller must
+// hold every shard's lock.
+func (ss *storageServer) handover(old, next *hashring.Ring) map[uint32][]storagerpc.KeyRecord {
+	batches := make(map[uint32][]storagerpc.KeyRecord)
+	for _, sh := range ss.shards {
+		sh.storage.Keys(func(key string) bool {
+			values, _ := sh.storage.Get(key)
+			oldSet := replicaSetOn(old, key, ss.replicas)
+			newSet := replicaSetOn(next, key, ss.replicas)
+			primary := len(oldSet) > 0 && oldSet[0] == ss.nodeID
+			meta := sh.meta(key)
+			rec := storagerpc.KeyRecord{Key: key, Values: values, Version: meta.Version, Expires: meta.Expires}
+			if primary {
+				rec.Tenants = append([]string{}, sh.tenants[key]...)
+			}
+			for i, id := range newSet {
+				if id == ss.nodeID {
+					continue
+				}
+				if !inReplicaSet(oldSet, id) || (primary && i == 0) {
+					batches[id] = append(batches[id], rec)
+				}
+			}
+			return true
+		})
+	}
+	return batches
+}
+
+func (ss *storageServer) Migrate(args *storagerpc.MigrateArgs, reply *storagerpc.MigrateReply) error {
+	for i := range args.Records {
+		if err := ss.migrate(&args.Records[i]); err != nil {
+			return err
+		}
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+// migrate stores a record handed over by another server, unless this
+// server holds the same or a newer version of the key, as a stale copy left
+// from an earlier stay in the key's replica set must not win, and merges in
+// its lease records.
+func (ss *storageServer) migrate(rec *storagerpc.KeyRecord) error {
+	sh := ss.shardOf(rec.Key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	now := time.Now().UnixNano()
+	if local := sh.keyVersion(rec.Key, now).Version; local == 0 || rec.Version > local {
+		m := &storagerpc.Mutation{Op: storagerpc.StoreOp, Key: rec.Key, Values: rec.Values, Version: rec.Version,
+			Expires: rec.Expires, Time: now}
+		if err := ss.commit(m); err != nil {
+			return err
+		}
+	}
+	sh.mergeTenants(rec.Key, rec.Tenants)
+	return nil
+}
+
+// mergeTenants adds the lease records handed over with key to the ones kept
+// here, keeping the later grant for a libstore found in both. The caller
+// must hold sh.lock for writing.
+func (sh *shard) mergeTenants(key string, records []string) {
+	for _, leaseRecord := range records {
+		tlist := sh.tenants[key]
+		host, t := util.ParseLeaseRecord(leaseRecord)
+		i := util.BinarySearchLeaseRecord(tlist, leaseRecord)
+		if i < len(tlist) {
+			if tar, old := util.ParseLeaseRecord(tlist[i]); tar == host {
+				if t > old {
+					tlist[i] = leaseRecord
+				}
+				continue
+			}
+		}
+		tlist = append(tlist, "")
+		copy(tlist[i+1:], tlist[i:])
+		tlist[i] = leaseRecord
+		sh.tenants[key] = tlist
+	}
+}
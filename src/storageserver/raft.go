@@ -0,0 +1,1125 @@
+package storageserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Consensus mode: every replica set of the ring is a Raft group. The group's
+// leader appends writes to a replicated log and applies them once a majority
+// of the members store them; reads are served by the leader after it has
+// confirmed its leadership (the read-index protocol). Followers forward
+// requests to the leader, so libstores may contact any member.
+//
+// Leases are never granted in consensus mode: a lease handed out by one
+// leader would not be known to the next one.
+//
+// Once a group's log holds Config.RaftLogLimit applied entries, the applier
+// writes the group's keys as they stand to a snapshot, in the data
+// directory or else a temporary one, and drops the entries it covers. A
+// restarted member loads its snapshot and replays the log past it, and a
+// follower that lacks entries the leader dropped is sent the leader's
+// snapshot with InstallSnapshot. AppendEntries carries at most
+// maxAppendEntries entries, so a follower far behind catches up over
+// several calls.
+const (
+	heartbeatInterval     = 100 * time.Millisecond
+	electionTimeoutMin    = 500 * time.Millisecond
+	electionTimeoutSpread = 500 * time.Millisecond
+	raftRPCTimeout        = 500 * time.Millisecond
+	proposalTimeout       = 5 * time.Second
+	defaultRaftLogLimit   = 1000
+	maxAppendEntries      = 100
+	snapshotChunkSize     = 256 << 10 // bytes of a snapshot sent per InstallSnapshot
+	snapshotRPCTimeout    = 10 * time.Second
+)
+
+type raftRole int
+
+const (
+	follower raftRole = iota
+	candidate
+	leader
+)
+
+var (
+	errNotLeader     = errors.New("not the Raft leader")
+	errSnapshotChunk = errors.New("Raft snapshot chunk out of order")
+)
+
+type raftWaiter struct {
+	term int
+	done chan raftOutcome
+}
+
+// raftOutcome is the result of applying a proposed write.
+type raftOutcome struct {
+	status  storagerpc.Status
+	version uint64 // The key's version after the write, or its current one on Conflict.
+}
+
+// raftSnapshotHeader is the first line of a Raft group's snapshot, which
+// holds the group's keys once the entries up to Index are applied.
+type raftSnapshotHeader struct {
+	Index int
+	Term  int
+}
+
+type raftGroup struct {
+	ss           *storageServer
+	id           uint32 // NodeID of the replica set's primary, which names the group.
+	members      []uint32
+	store        *raftStore // nil without a data directory
+	snapshotPath string
+
+	// applyLock is held by the applier while it applies an entry or takes a
+	// snapshot, and while a snapshot is installed, which keeps the group's
+	// keys in step with lastApplied. It is taken before lock.
+	applyLock sync.Mutex
+
+	lock        sync.Mutex
+	applied     *sync.Cond // Signalled whenever lastApplied advances.
+	role        raftRole
+	term        int
+	votedFor    int64                 // -1 if no vote was cast in term.
+	leader      int64                 // -1 if the leader of term is unknown.
+	log         []storagerpc.LogEntry // log[i] is the entry at index base+i; log[0] only holds its term.
+	base        int                   // Index of the last entry the snapshot covers.
+	commitIndex int
+	lastApplied int
+	nextIndex   map[uint32]int
+	matchIndex  map[uint32]int
+	deadline    time.Time // When to start an election if no leader is heard from.
+	lastBeat    time.Time
+	waiters     map[int]*raftWaiter
+	commitCh    chan struct{}
+	sending     map[uint32]bool // Followers being sent the snapshot.
+}
+
+// startRaft creates a Raft group for every replica set this server belongs
+// to, restoring its snapshot and log from dataDir if set.
+func (ss *storageServer) startRaft(dataDir string) error {
+	snapshotDir := dataDir
+	if snapshotDir == "" {
+		dir, err := ioutil.TempDir("", "raft")
+		if err != nil {
+			return err
+		}
+		snapshotDir = dir
+	}
+	groups := make(map[uint32]*raftGroup)
+	for _, primary := range ss.ring.IDs() {
+		members := ss.replicasOf(primary)
+		if !inReplicaSet(members, ss.nodeID) {
+			continue
+		}
+		g := &raftGroup{
+			ss:           ss,
+			id:           primary,
+			members:      members,
+			votedFor:     -1,
+			leader:       -1,
+			log:          []storagerpc.LogEntry{{}},
+			waiters:      make(map[int]*raftWaiter),
+			commitCh:     make(chan struct{}, 1),
+			sending:      make(map[uint32]bool),
+			snapshotPath: filepath.Join(snapshotDir, fmt.Sprintf("raft-%d.snapshot", primary)),
+		}
+		g.applied = sync.NewCond(&g.lock)
+		if dataDir != "" {
+			if err := g.restoreSnapshot(); err != nil {
+				return err
+			}
+			store, err := openRaftStore(dataDir, primary)
+			if err != nil {
+				return err
+			}
+			g.store = store
+			if g.term, g.votedFor, err = store.loadState(); err != nil {
+				return err
+			}
+			if err = store.loadLog(&g.log, g.base); err != nil {
+				return err
+			}
+		}
+		g.resetDeadline()
+		groups[primary] = g
+	}
+	ss.groupsLock.Lock()
+	ss.groups = groups
+	ss.groupsLock.Unlock()
+	for _, g := range groups {
+		go g.ticker()
+		go g.applier()
+	}
+	return nil
+}
+
+func (ss *storageServer) group(id uint32) (*raftGroup, bool) {
+	ss.groupsLock.RLock()
+	defer ss.groupsLock.RUnlock()
+	g, ok := ss.groups[id]
+	return g, ok
+}
+
+// groupOf returns the Raft group of key, which this server must belong to.
+func (ss *storageServer) groupOf(key string) *raftGroup {
+	g, _ := ss.group(ss.replicaSet(key)[0])
+	return g
+}
+
+func (g *raftGroup) resetDeadline() {
+	spread := time.Duration(rand.Int63n(int64(electionTimeoutSpread)))
+	g.deadline = time.Now().Add(electionTimeoutMin + spread)
+}
+
+// lastLog returns the index and term of the last entry of the log. The
+// caller must hold g.lock.
+func (g *raftGroup) lastLog() (index, term int) {
+	return g.base + len(g.log) - 1, g.log[len(g.log)-1].Term
+}
+
+// entry returns the entry at index, which must not be before g.base. The
+// caller must hold g.lock.
+func (g *raftGroup) entry(index int) *storagerpc.LogEntry {
+	return &g.log[index-g.base]
+}
+
+// becomeFollower moves to term as a follower. The caller must hold g.lock.
+func (g *raftGroup) becomeFollower(term int) {
+	if term > g.term {
+		g.term, g.votedFor, g.leader = term, -1, -1
+		g.persistState()
+	}
+	g.role = follower
+}
+
+func (g *raftGroup) persistState() {
+	if g.store == nil {
+		return
+	}
+	if err := g.store.saveState(g.term, g.votedFor); err != nil {
+		log.Fatalln("Failed to persist Raft state:", err)
+	}
+}
+
+// persistLog makes log entries from index on durable.
+func (g *raftGroup) persistLog(from int) {
+	if g.store == nil {
+		return
+	}
+	if err := g.store.appendLog(from, g.log[from-g.base:]); err != nil {
+		log.Fatalln("Failed to persist Raft log:", err)
+	}
+}
+
+func (g *raftGroup) ticker() {
+	for {
+		time.Sleep(heartbeatInterval / 4)
+		g.lock.Lock()
+		switch {
+		case g.role == leader && time.Now().Sub(g.lastBeat) >= heartbeatInterval:
+			g.lastBeat = time.Now()
+			g.broadcast()
+		case g.role != leader && time.Now().After(g.deadline):
+			g.startElection()
+		}
+		g.lock.Unlock()
+	}
+}
+
+// startElection campaigns for leadership of the next term. The caller must
+// hold g.lock.
+func (g *raftGroup) startElection() {
+	g.role = candidate
+	g.term++
+	g.votedFor = int64(g.ss.nodeID)
+	g.leader = -1
+	g.persistState()
+	g.resetDeadline()
+
+	term := g.term
+	lastIndex, lastTerm := g.lastLog()
+	votes := 1
+	if votes*2 > len(g.members) {
+		g.becomeLeader()
+		return
+	}
+	for _, id := range g.members {
+		if id == g.ss.nodeID {
+			continue
+		}
+		go func(id uint32) {
+			args := &storagerpc.RequestVoteArgs{
+				Group:        g.id,
+				Term:         term,
+				CandidateID:  g.ss.nodeID,
+				LastLogIndex: lastIndex,
+				LastLogTerm:  lastTerm,
+			}
+			reply := &storagerpc.RequestVoteReply{}
+			if err := g.ss.callPeer(id, "StorageServer.RequestVote", args, reply, raftRPCTimeout); err != nil {
+				return
+			}
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			if reply.Term > g.term {
+				g.becomeFollower(reply.Term)
+				return
+			}
+			if g.role != candidate || g.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes*2 > len(g.members) {
+				g.becomeLeader()
+			}
+		}(id)
+	}
+}
+
+// becomeLeader takes over the group. A no-op entry is appended so that
+// entries from earlier terms get committed and reads can be served. The
+// caller must hold g.lock.
+func (g *raftGroup) becomeLeader() {
+	log.Printf("Leading Raft group %d in term %d", g.id, g.term)
+	g.role = leader
+	g.leader = int64(g.ss.nodeID)
+	g.nextIndex = make(map[uint32]int)
+	g.matchIndex = make(map[uint32]int)
+	last, _ := g.lastLog()
+	for _, id := range g.members {
+		g.nextIndex[id] = last + 1
+	}
+	g.log = append(g.log, storagerpc.LogEntry{Term: g.term})
+	g.persistLog(last + 1)
+	g.matchIndex[g.ss.nodeID] = last + 1
+	g.advanceCommit()
+	g.lastBeat = time.Now()
+	g.broadcast()
+}
+
+// broadcast sends AppendEntries to every follower. The caller must hold g.lock.
+func (g *raftGroup) broadcast() {
+	for _, id := range g.members {
+		if id != g.ss.nodeID {
+			go g.replicateTo(id, g.term, nil)
+		}
+	}
+}
+
+// replicateTo sends follower id up to maxAppendEntries of the entries it is
+// missing, and the snapshot if the log no longer holds them. If acked is
+// not nil, it receives whether the follower accepted this server as leader
+// of term.
+func (g *raftGroup) replicateTo(id uint32, term int, acked chan<- bool) {
+	g.lock.Lock()
+	if g.role != leader || g.term != term {
+		g.lock.Unlock()
+		if acked != nil {
+			acked <- false
+		}
+		return
+	}
+	next := g.nextIndex[id]
+	if next <= g.base {
+		// The entries were compacted. The follower may still hold them, so
+		// the ones that follow are sent all the same.
+		go g.sendSnapshot(id, term)
+		next = g.base + 1
+	}
+	prev := next - 1
+	last, _ := g.lastLog()
+	if last > prev+maxAppendEntries {
+		last = prev + maxAppendEntries
+	}
+	args := &storagerpc.AppendEntriesArgs{
+		Group:        g.id,
+		Term:         term,
+		LeaderID:     g.ss.nodeID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  g.entry(prev).Term,
+		Entries:      append([]storagerpc.LogEntry(nil), g.log[prev+1-g.base:last+1-g.base]...),
+		LeaderCommit: g.commitIndex,
+	}
+	g.lock.Unlock()
+
+	reply := &storagerpc.AppendEntriesReply{}
+	err := g.ss.callPeer(id, "StorageServer.AppendEntries", args, reply, raftRPCTimeout)
+	ok := err == nil && reply.Status == storagerpc.OK && reply.Term == term
+	if acked != nil {
+		acked <- ok
+	}
+	if err != nil || reply.Status != storagerpc.OK {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if reply.Term > g.term {
+		g.becomeFollower(reply.Term)
+		return
+	}
+	if g.role != leader || g.term != term {
+		return
+	}
+	if reply.Success {
+		match := prev + len(args.Entries)
+		if match > g.matchIndex[id] {
+			g.matchIndex[id] = match
+			g.nextIndex[id] = match + 1
+			g.advanceCommit()
+		}
+		if last, _ := g.lastLog(); match < last {
+			go g.replicateTo(id, term, nil)
+		}
+	} else if reply.ConflictIndex > 0 {
+		g.nextIndex[id] = reply.ConflictIndex
+		if reply.ConflictIndex > g.base {
+			// Otherwise the snapshot, once sent, moves nextIndex on.
+			go g.replicateTo(id, term, nil)
+		}
+	}
+}
+
+// sendSnapshot sends follower id the group's snapshot, a chunk at a time,
+// unless it is being sent already, and then the entries that follow it.
+func (g *raftGroup) sendSnapshot(id uint32, term int) {
+	g.lock.Lock()
+	if g.sending[id] {
+		g.lock.Unlock()
+		return
+	}
+	g.sending[id] = true
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		delete(g.sending, id)
+		g.lock.Unlock()
+	}()
+
+	// A newer snapshot may replace the file meanwhile; the one opened stays
+	// readable.
+	f, err := os.Open(g.snapshotPath)
+	if err != nil {
+		log.Printf("Failed to open the snapshot of Raft group %d: %v", g.id, err)
+		return
+	}
+	defer f.Close()
+	var header raftSnapshotHeader
+	if err := json.NewDecoder(f).Decode(&header); err != nil {
+		log.Printf("Failed to read the snapshot of Raft group %d: %v", g.id, err)
+		return
+	}
+	args := &storagerpc.InstallSnapshotArgs{
+		Group:             g.id,
+		Term:              term,
+		LeaderID:          g.ss.nodeID,
+		LastIncludedIndex: header.Index,
+		LastIncludedTerm:  header.Term,
+	}
+	buf := make([]byte, snapshotChunkSize)
+	for !args.Done {
+		n, err := f.ReadAt(buf, args.Offset)
+		if err != nil && err != io.EOF {
+			log.Printf("Failed to read the snapshot of Raft group %d: %v", g.id, err)
+			return
+		}
+		args.Data, args.Done = buf[:n], err == io.EOF
+		reply := &storagerpc.InstallSnapshotReply{}
+		if err := g.ss.callPeer(id, "StorageServer.InstallSnapshot", args, reply, snapshotRPCTimeout); err != nil ||
+			reply.Status != storagerpc.OK {
+			return
+		}
+		g.lock.Lock()
+		if reply.Term > g.term {
+			g.becomeFollower(reply.Term)
+		}
+		leading := g.role == leader && g.term == term
+		g.lock.Unlock()
+		if !leading {
+			return
+		}
+		args.Offset += int64(n)
+	}
+
+	g.lock.Lock()
+	if g.role == leader && g.term == term && header.Index > g.matchIndex[id] {
+		g.matchIndex[id] = header.Index
+		g.nextIndex[id] = header.Index + 1
+	}
+	g.lock.Unlock()
+	go g.replicateTo(id, term, nil)
+}
+
+// advanceCommit commits the highest entry of the current term that a
+// majority stores. The caller must hold g.lock.
+func (g *raftGroup) advanceCommit() {
+	last, _ := g.lastLog()
+	for n := last; n > g.commitIndex && g.entry(n).Term == g.term; n-- {
+		count := 0
+		for _, id := range g.members {
+			if g.matchIndex[id] >= n {
+				count++
+			}
+		}
+		if count*2 > len(g.members) {
+			g.commitIndex = n
+			g.signalCommit()
+			return
+		}
+	}
+}
+
+func (g *raftGroup) signalCommit() {
+	select {
+	case g.commitCh <- struct{}{}:
+	default:
+	}
+}
+
+// applier applies committed entries to the storage in log order and hands
+// their outcome to the proposers waiting for them, compacting the log once
+// it holds ss.raftLogLimit applied entries.
+func (g *raftGroup) applier() {
+	for range g.commitCh {
+		for {
+			g.applyLock.Lock()
+			g.lock.Lock()
+			if g.lastApplied >= g.commitIndex {
+				g.lock.Unlock()
+				g.applyLock.Unlock()
+				break
+			}
+			index := g.lastApplied + 1
+			entry := *g.entry(index)
+			g.lock.Unlock()
+
+			m := &entry.Mutation
+			status := storagerpc.OK
+			if m.Op != 0 {
+				sh := g.ss.shardOf(m.Key)
+				sh.lock.Lock()
+				if status = g.ss.check(m); status == storagerpc.OK {
+					g.ss.apply(m)
+				}
+				sh.lock.Unlock()
+			}
+
+			g.lock.Lock()
+			g.lastApplied = index
+			if w, ok := g.waiters[index]; ok {
+				delete(g.waiters, index)
+				if w.term != entry.Term {
+					status = storagerpc.NotLeader
+				}
+				w.done <- raftOutcome{status, m.Version}
+			}
+			g.applied.Broadcast()
+			compact := index-g.base >= g.ss.raftLogLimit
+			g.lock.Unlock()
+			if compact {
+				g.compact(index, entry.Term)
+			}
+			g.applyLock.Unlock()
+		}
+	}
+}
+
+// owner returns a function that reports whether a key belongs to the group.
+func (g *raftGroup) owner() func(key string) bool {
+	g.ss.ringLock.RLock()
+	ring, replicas := g.ss.ring, g.ss.replicas
+	g.ss.ringLock.RUnlock()
+	return func(key string) bool {
+		set := replicaSetOn(ring, key, replicas)
+		return len(set) > 0 && set[0] == g.id
+	}
+}
+
+// compact writes the group's keys, as they stand once the entry at index,
+// of term, is applied, to the snapshot, and drops the entries up to index
+// from the log. The caller must hold g.applyLock.
+func (g *raftGroup) compact(index, term int) {
+	err := writeSnapshot(g.snapshotPath, raftSnapshotHeader{Index: index, Term: term}, g.ss.eachRecord(g.owner()))
+	if err == nil {
+		err = syncDir(filepath.Dir(g.snapshotPath))
+	}
+	if err != nil {
+		log.Printf("Snapshot of Raft group %d failed: %v", g.id, err)
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.log = append([]storagerpc.LogEntry{{Term: term}}, g.log[index+1-g.base:]...)
+	g.base = index
+	if g.store != nil {
+		if err := g.store.rewriteLog(index+1, g.log[1:]); err != nil {
+			log.Fatalln("Failed to compact Raft log:", err)
+		}
+	}
+}
+
+// restoreSnapshot loads the group's snapshot, if it has one, into the
+// storage, which holds none of the group's keys, and moves the log past
+// it.
+func (g *raftGroup) restoreSnapshot() error {
+	f, err := os.Open(g.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var header raftSnapshotHeader
+	if err := readSnapshot(f, &header, g.ss.restoreRecord); err != nil {
+		return err
+	}
+	g.log = []storagerpc.LogEntry{{Term: header.Term}}
+	g.base, g.commitIndex, g.lastApplied = header.Index, header.Index, header.Index
+	return nil
+}
+
+// restoreRecord stores the key of a snapshot record.
+func (ss *storageServer) restoreRecord(rec *snapshotRecord) {
+	sh := ss.shardOf(rec.Key)
+	sh.lock.Lock()
+	sh.storage.Set(rec.Key, rec.Values)
+	sh.storage.SetMeta(rec.Key, keyMeta{Version: rec.Version, Expires: rec.Expires})
+	sh.lock.Unlock()
+	ss.observe(rec.Version)
+}
+
+// receiveChunk writes a chunk of a snapshot sent by the leader to a file of
+// its own. The caller must hold g.lock.
+func (g *raftGroup) receiveChunk(args *storagerpc.InstallSnapshotArgs) error {
+	flags := os.O_CREATE | os.O_WRONLY
+	if args.Offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(g.snapshotPath+".part", flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.Size() != args.Offset {
+		return errSnapshotChunk
+	}
+	if _, err = f.WriteAt(args.Data, args.Offset); err == nil && args.Done {
+		err = f.Sync()
+	}
+	return err
+}
+
+// installSnapshot replaces the group's keys with the ones of the snapshot
+// received in full, covering the entries up to index, of term, unless they
+// are applied already. The log keeps the entries that follow index if it
+// holds the entry at index.
+func (g *raftGroup) installSnapshot(index, term int) error {
+	part := g.snapshotPath + ".part"
+	g.applyLock.Lock()
+	defer g.applyLock.Unlock()
+	g.lock.Lock()
+	stale := index <= g.lastApplied
+	g.lock.Unlock()
+	if stale {
+		return os.Remove(part)
+	}
+	if err := os.Rename(part, g.snapshotPath); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(g.snapshotPath)); err != nil {
+		return err
+	}
+
+	owns := g.owner()
+	for _, sh := range g.ss.shards {
+		sh.lock.Lock()
+		var keys []string
+		sh.storage.Keys(func(key string) bool {
+			if owns(key) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			sh.storage.Delete(key)
+		}
+		sh.lock.Unlock()
+	}
+	f, err := os.Open(g.snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var header raftSnapshotHeader
+	if err := readSnapshot(f, &header, g.ss.restoreRecord); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if last, _ := g.lastLog(); index <= last && g.entry(index).Term == term {
+		g.log = append([]storagerpc.LogEntry{{Term: term}}, g.log[index+1-g.base:]...)
+	} else {
+		g.log = []storagerpc.LogEntry{{Term: term}}
+	}
+	g.base, g.lastApplied = index, index
+	if g.commitIndex < index {
+		g.commitIndex = index
+	}
+	for i, w := range g.waiters {
+		if i <= index {
+			delete(g.waiters, i)
+			w.done <- raftOutcome{status: storagerpc.NotLeader}
+		}
+	}
+	g.applied.Broadcast()
+	if g.store != nil {
+		return g.store.rewriteLog(index+1, g.log[1:])
+	}
+	return nil
+}
+
+// propose appends m to the log and waits until it is applied, leaving the
+// key's resulting version in m.Version. It fails with errNotLeader if this
+// server does not lead the group.
+func (g *raftGroup) propose(m *storagerpc.Mutation) (storagerpc.Status, error) {
+	// The version and time are assigned here rather than when the entry is
+	// applied, as the members' clocks differ.
+	if m.Version <= atomic.LoadUint64(&g.ss.clock) {
+		m.Version = atomic.AddUint64(&g.ss.clock, 1)
+	}
+	m.Time = time.Now().UnixNano()
+	g.lock.Lock()
+	if g.role != leader {
+		g.lock.Unlock()
+		return 0, errNotLeader
+	}
+	g.log = append(g.log, storagerpc.LogEntry{Term: g.term, Mutation: *m})
+	index, _ := g.lastLog()
+	g.persistLog(index)
+	g.matchIndex[g.ss.nodeID] = index
+	w := &raftWaiter{term: g.term, done: make(chan raftOutcome, 1)}
+	g.waiters[index] = w
+	g.advanceCommit()
+	g.lastBeat = time.Now()
+	g.broadcast()
+	g.lock.Unlock()
+
+	select {
+	case outcome := <-w.done:
+		if outcome.status == storagerpc.NotLeader {
+			return 0, errNotLeader
+		}
+		m.Version = outcome.version
+		return outcome.status, nil
+	case <-time.After(proposalTimeout):
+		return 0, errors.New("timed out waiting for Raft commit")
+	}
+}
+
+// readIndex makes sure that a read served by this server right after it
+// returns reflects every write committed before it was called.
+func (g *raftGroup) readIndex() error {
+	g.lock.Lock()
+	if g.role != leader || g.entry(g.commitIndex).Term != g.term {
+		// Until its no-op entry commits, a new leader does not know how
+		// far the log is committed.
+		g.lock.Unlock()
+		return errNotLeader
+	}
+	term, index := g.term, g.commitIndex
+	acked := make(chan bool, len(g.members))
+	for _, id := range g.members {
+		if id != g.ss.nodeID {
+			go g.replicateTo(id, term, acked)
+		}
+	}
+	g.lock.Unlock()
+
+	acks := 1
+	for i := 1; i < len(g.members) && acks*2 <= len(g.members); i++ {
+		if <-acked {
+			acks++
+		}
+	}
+	if acks*2 <= len(g.members) {
+		return errNotLeader
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for g.lastApplied < index && g.term == term {
+		g.applied.Wait()
+	}
+	if g.term != term {
+		return errNotLeader
+	}
+	return nil
+}
+
+func (g *raftGroup) currentLeader() (uint32, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return uint32(g.leader), g.leader >= 0
+}
+
+func (ss *storageServer) RequestVote(args *storagerpc.RequestVoteArgs, reply *storagerpc.RequestVoteReply) error {
+	g, ok := ss.group(args.Group)
+	if !ok {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	reply.Status = storagerpc.OK
+	if args.Term > g.term {
+		g.becomeFollower(args.Term)
+	}
+	reply.Term = g.term
+	if args.Term < g.term || (g.votedFor >= 0 && g.votedFor != int64(args.CandidateID)) {
+		return nil
+	}
+	lastIndex, lastTerm := g.lastLog()
+	if args.LastLogTerm < lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex < lastIndex) {
+		return nil
+	}
+	g.votedFor = int64(args.CandidateID)
+	g.persistState()
+	g.resetDeadline()
+	reply.VoteGranted = true
+	return nil
+}
+
+func (ss *storageServer) AppendEntries(args *storagerpc.AppendEntriesArgs, reply *storagerpc.AppendEntriesReply) error {
+	g, ok := ss.group(args.Group)
+	if !ok {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	reply.Status = storagerpc.OK
+	if args.Term < g.term {
+		reply.Term = g.term
+		return nil
+	}
+	g.becomeFollower(args.Term)
+	g.leader = int64(args.LeaderID)
+	g.resetDeadline()
+	reply.Term = g.term
+
+	if args.PrevLogIndex < g.base {
+		// The entries up to g.base are committed, and in the snapshot.
+		skip := g.base - args.PrevLogIndex
+		if skip > len(args.Entries) {
+			skip = len(args.Entries)
+		}
+		args.Entries = args.Entries[skip:]
+		args.PrevLogIndex += skip
+		if args.PrevLogIndex < g.base {
+			reply.Success = true
+			return nil
+		}
+		args.PrevLogTerm = g.log[0].Term
+	}
+	last, _ := g.lastLog()
+	if args.PrevLogIndex > last {
+		reply.ConflictIndex = last + 1
+		return nil
+	}
+	if g.entry(args.PrevLogIndex).Term != args.PrevLogTerm {
+		// Skip back over the whole conflicting term at once.
+		conflict := args.PrevLogIndex
+		for conflict > g.base+1 && g.entry(conflict-1).Term == g.entry(args.PrevLogIndex).Term {
+			conflict--
+		}
+		reply.ConflictIndex = conflict
+		return nil
+	}
+
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index <= last {
+			if g.entry(index).Term == entry.Term {
+				continue
+			}
+			g.log = g.log[:index-g.base]
+		}
+		g.log = append(g.log, args.Entries[i:]...)
+		g.persistLog(index)
+		break
+	}
+	reply.Success = true
+
+	// A delayed AppendEntries may vouch for a shorter log than an earlier
+	// one did, so the commit index only ever moves forward.
+	last = args.PrevLogIndex + len(args.Entries)
+	commit := args.LeaderCommit
+	if last < commit {
+		commit = last
+	}
+	if commit > g.commitIndex {
+		g.commitIndex = commit
+		g.signalCommit()
+	}
+	return nil
+}
+
+func (ss *storageServer) InstallSnapshot(args *storagerpc.InstallSnapshotArgs, reply *storagerpc.InstallSnapshotReply) error {
+	g, ok := ss.group(args.Group)
+	if !ok {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	g.lock.Lock()
+	reply.Status = storagerpc.OK
+	if args.Term < g.term {
+		reply.Term = g.term
+		g.lock.Unlock()
+		return nil
+	}
+	g.becomeFollower(args.Term)
+	g.leader = int64(args.LeaderID)
+	g.resetDeadline()
+	reply.Term = g.term
+	err := g.receiveChunk(args)
+	g.lock.Unlock()
+	if err != nil || !args.Done {
+		return err
+	}
+	return g.installSnapshot(args.LastIncludedIndex, args.LastIncludedTerm)
+}
+
+func (ss *storageServer) Propose(args *storagerpc.ProposeArgs, reply *storagerpc.ProposeReply) error {
+	if !ss.raft || !ss.keyRangeContains(args.Mutation.Key) || ss.groupOf(args.Mutation.Key) == nil {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	status, err := ss.groupOf(args.Mutation.Key).propose(&args.Mutation)
+	if err == errNotLeader {
+		reply.Status = storagerpc.NotLeader
+		return nil
+	}
+	reply.Status = status
+	reply.Version = args.Mutation.Version
+	return err
+}
+
+// proposeWrite commits m through the Raft group of its key, forwarding it
+// to the group's leader if necessary, and returns the write's outcome. It
+// tries again only while m has surely not been appended to the log, as
+// when the server asked was not the leader; once m may have been, it
+// returns the error, since m may still commit and appends and removes
+// must not be applied twice.
+func (ss *storageServer) proposeWrite(m *storagerpc.Mutation) (storagerpc.Status, error) {
+	g := ss.groupOf(m.Key)
+	deadline := time.Now().Add(proposalTimeout)
+	for time.Now().Before(deadline) {
+		status, err := g.propose(m)
+		if err != errNotLeader {
+			return status, err
+		}
+		if id, ok := g.currentLeader(); ok && id != ss.nodeID {
+			args := &storagerpc.ProposeArgs{Mutation: *m}
+			reply := &storagerpc.ProposeReply{}
+			err = ss.callPeer(id, "StorageServer.Propose", args, reply, proposalTimeout)
+			if err == nil && reply.Status != storagerpc.NotLeader {
+				m.Version = reply.Version
+				return reply.Status, nil
+			}
+			if err != nil && !unsent(err) {
+				return 0, err
+			}
+		}
+		time.Sleep(heartbeatInterval)
+	}
+	return 0, fmt.Errorf("no Raft leader for key %s", m.Key)
+}
+
+// leaderRead prepares a linearizable read of key. If this server leads the
+// key's group, it returns once the local storage may be read. Otherwise it
+// forwards the read RPC to the leader, fills in reply and returns true.
+func (ss *storageServer) leaderRead(key, method string, args, reply interface{}) (bool, error) {
+	g := ss.groupOf(key)
+	deadline := time.Now().Add(proposalTimeout)
+	for time.Now().Before(deadline) {
+		if err := g.readIndex(); err == nil {
+			return false, nil
+		}
+		if id, ok := g.currentLeader(); ok && id != ss.nodeID {
+			if err := ss.callPeer(id, method, args, reply, proposalTimeout); err == nil {
+				return true, nil
+			}
+		}
+		time.Sleep(heartbeatInterval)
+	}
+	return false, fmt.Errorf("no Raft leader for key %s", key)
+}
+
+// raftStore keeps a group's term, vote and log in a data directory. The
+// log file is append-only: each record carries its index, and a record
+// whose index is not past the end of the log replaces the log from there.
+// Once a snapshot covers a prefix of the log, the file is rewritten without
+// it.
+type raftStore struct {
+	statePath string
+	logFile   *os.File
+}
+
+type raftState struct {
+	Term     int
+	VotedFor int64
+}
+
+type raftRecord struct {
+	Index int
+	Entry storagerpc.LogEntry
+}
+
+func openRaftStore(dir string, group uint32) (*raftStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("raft-%d.log", group))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &raftStore{statePath: filepath.Join(dir, fmt.Sprintf("raft-%d.state", group)), logFile: f}, nil
+}
+
+func (s *raftStore) loadState() (int, int64, error) {
+	b, err := ioutil.ReadFile(s.statePath)
+	if os.IsNotExist(err) {
+		return 0, -1, nil
+	} else if err != nil {
+		return 0, -1, err
+	}
+	var state raftState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return 0, -1, err
+	}
+	return state.Term, state.VotedFor, nil
+}
+
+func (s *raftStore) saveState(term int, votedFor int64) error {
+	b, err := json.Marshal(&raftState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.statePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.statePath))
+}
+
+// loadLog rebuilds the log past index base, which the snapshot covers, from
+// the records on disk, ignoring a torn record at the end of the file and
+// the records the snapshot covers.
+func (s *raftStore) loadLog(entries *[]storagerpc.LogEntry, base int) error {
+	reader := bufio.NewReader(s.logFile)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var rec raftRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Println("Discarding corrupt Raft log record:", err)
+			return nil
+		}
+		if rec.Index <= base {
+			continue
+		}
+		if rec.Index > base+len(*entries) {
+			return fmt.Errorf("Raft log record %d out of order", rec.Index)
+		}
+		*entries = append((*entries)[:rec.Index-base], rec.Entry)
+	}
+}
+
+func (s *raftStore) appendLog(from int, entries []storagerpc.LogEntry) error {
+	return writeLogRecords(s.logFile, from, entries)
+}
+
+// rewriteLog replaces the log file with the records of entries, the first of
+// which is at index from.
+func (s *raftStore) rewriteLog(from int, entries []storagerpc.LogEntry) error {
+	path := s.logFile.Name()
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = writeLogRecords(f, from, entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.logFile.Close()
+	s.logFile = file
+	return nil
+}
+
+// writeLogRecords appends the records of entries, the first of which is at
+// index from, to f and waits until they reach disk.
+func writeLogRecords(f *os.File, from int, entries []storagerpc.LogEntry) error {
+	w := bufio.NewWriter(f)
+	for i := range entries {
+		b, err := json.Marshal(&raftRecord{Index: from + i, Entry: entries[i]})
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
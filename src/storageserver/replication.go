@@ -0,0 +1,279 @@
+package storageserver
+
+import (
+	"errors"
+	"log"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"failuredetector"
+	"hashring"
+	"libstore"
+	"rpc/storagerpc"
+	"util"
+)
+
+// Primary/backup replication: the key range ending at each point on the
+// ring is copied to the owners of the next points, up to ss.replicas other
+// nodes. The first live
+// member of a range's replica set serves it and forwards every write to the
+// remaining live members before acknowledging it, replying NotReplicated
+// instead if any of them, or with a write quorum too many, failed to apply
+// it. Which members are live is
+// decided by the failure detector, confirmed with a direct probe when the
+// detector only suspects a member.
+const probeTimeout = 1 * time.Second
+
+type peerSet struct {
+	lock  sync.Mutex
+	conns map[uint32]*rpc.Client
+}
+
+// replicaSetOn returns the replica set of key on ring, the primary followed
+// by its backups in takeover order, or nil if there is no ring.
+func replicaSetOn(ring *hashring.Ring, key string, replicas int) []uint32 {
+	if ring == nil {
+		return nil
+	}
+	return ring.ReplicaSet(libstore.StoreHash(key), replicas)
+}
+
+// replicasOf returns the replica set of the key range ending at the given
+// point, such as the ID of a node.
+func (ss *storageServer) replicasOf(point uint32) []uint32 {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	return ss.ring.ReplicaSet(point, ss.replicas)
+}
+
+// backsUp reports whether this server backs up any key range of node id.
+func (ss *storageServer) backsUp(id uint32) bool {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	for _, point := range ss.ring.Points(id) {
+		if inReplicaSet(ss.ring.ReplicaSet(point, ss.replicas), ss.nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ss *storageServer) replicaSet(key string) []uint32 {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	return replicaSetOn(ss.ring, key, ss.replicas)
+}
+
+func (ss *storageServer) replicaSets() []storagerpc.ReplicaSet {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	var sets []storagerpc.ReplicaSet
+	for _, id := range ss.ring.IDs() {
+		for _, point := range ss.ring.Points(id) {
+			set := ss.ring.ReplicaSet(point, ss.replicas)
+			sets = append(sets, storagerpc.ReplicaSet{Primary: id, End: point, Backups: set[1:]})
+		}
+	}
+	return sets
+}
+
+func inReplicaSet(set []uint32, id uint32) bool {
+	for _, i := range set {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// errPeerTimeout is returned by callPeer when the peer did not reply in time.
+var errPeerTimeout = errors.New("timed out waiting for the peer")
+
+// getPeer returns a connection to the storage server with the given ID.
+func (ss *storageServer) getPeer(id uint32) (*rpc.Client, error) {
+	ss.peers.lock.Lock()
+	defer ss.peers.lock.Unlock()
+	if cli, ok := ss.peers.conns[id]; ok {
+		return cli, nil
+	}
+	ss.ringLock.RLock()
+	hostport := ss.nodes[id]
+	ss.ringLock.RUnlock()
+	cli, err := util.DialHTTPTimeout(hostport, probeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ss.peers.conns[id] = cli
+	return cli, nil
+}
+
+// dialError is the error of a call to a peer that could not be dialed.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return e.err.Error()
+}
+
+// unsent reports whether err, returned by callPeer, means that the call
+// never reached the peer: it could not be dialed, or the connection had
+// already broken.
+func unsent(err error) bool {
+	_, dial := err.(*dialError)
+	return dial || err == rpc.ErrShutdown
+}
+
+// callPeer calls method on peer id, giving up after timeout. A broken
+// connection is dropped so that the next call redials.
+func (ss *storageServer) callPeer(id uint32, method string, args, reply interface{}, timeout time.Duration) error {
+	cli, err := ss.getPeer(id)
+	if err != nil {
+		return &dialError{err}
+	}
+	call := cli.Go(method, args, reply, nil)
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(timeout):
+		err = errPeerTimeout
+	}
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			ss.peers.lock.Lock()
+			if ss.peers.conns[id] == cli {
+				delete(ss.peers.conns, id)
+				cli.Close()
+			}
+			ss.peers.lock.Unlock()
+		}
+	}
+	return err
+}
+
+func (ss *storageServer) hostPortOf(id uint32) string {
+	ss.ringLock.RLock()
+	defer ss.ringLock.RUnlock()
+	return ss.nodes[id]
+}
+
+// markPeer reports the outcome of talking to peer id to the failure
+// detector.
+func (ss *storageServer) markPeer(id uint32, down bool) {
+	if down {
+		ss.fd.Failed(ss.hostPortOf(id))
+	} else {
+		ss.fd.Heard(ss.hostPortOf(id))
+	}
+}
+
+// peerChanged is called by the failure detector when a peer dies or comes
+// back. When a peer that this server backs up dies, its lease tenants are
+// unknown here, so writes are fenced off until any lease it may have
+// granted has expired.
+func (ss *storageServer) peerChanged(hostport string, alive bool) {
+	if alive {
+		return
+	}
+	ss.ringLock.RLock()
+	var id uint32
+	found := false
+	for i, h := range ss.nodes {
+		if h == hostport {
+			id, found = i, true
+		}
+	}
+	ss.ringLock.RUnlock()
+	if found && ss.backsUp(id) {
+		ss.extendFence()
+	}
+}
+
+// knownDown reports whether the failure detector considers peer id dead.
+func (ss *storageServer) knownDown(id uint32) bool {
+	return ss.fd.State(ss.hostPortOf(id)) == failuredetector.Dead
+}
+
+// peerDown reports whether peer id is down. A peer the failure detector
+// only suspects is probed directly, so that a backup can take over a dead
+// primary's range without waiting for it to be declared dead.
+func (ss *storageServer) peerDown(id uint32) bool {
+	switch ss.fd.State(ss.hostPortOf(id)) {
+	case failuredetector.Alive:
+		return false
+	case failuredetector.Dead:
+		return true
+	}
+	args := &storagerpc.GetServersArgs{}
+	reply := &storagerpc.GetServersReply{}
+	err := ss.callPeer(id, "StorageServer.GetServers", args, reply, probeTimeout)
+	ss.markPeer(id, err != nil)
+	return err != nil
+}
+
+// replicate forwards m to every other live member of its key's replica set,
+// waits for them to apply it and reports whether enough of them did: every
+// one, or, with a write quorum, as many as make up the quorum along with
+// this server. Members that cannot be reached are marked down. The caller
+// must hold the write lock of the key's shard, which keeps the mutations of
+// a key in the same order on the backups as on this server.
+func (ss *storageServer) replicate(m *storagerpc.Mutation) bool {
+	var wg sync.WaitGroup
+	acks, live := int32(1), 1
+	set := ss.replicaSet(m.Key)
+	for _, id := range set {
+		if id == ss.nodeID || ss.knownDown(id) {
+			continue
+		}
+		live++
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			args := &storagerpc.ReplicateArgs{Mutation: *m}
+			reply := &storagerpc.ReplicateReply{}
+			timeout := (storagerpc.LeaseSeconds + storagerpc.LeaseGuardSeconds) * time.Second
+			if err := ss.callPeer(id, "StorageServer.Replicate", args, reply, timeout); err != nil {
+				ss.markPeer(id, true)
+			} else if reply.Status != storagerpc.OK {
+				log.Printf("Replica %d rejected %s with status %d", id, m.Key, reply.Status)
+			} else {
+				atomic.AddInt32(&acks, 1)
+			}
+		}(id)
+	}
+	wg.Wait()
+	if ss.writeQuorum > 0 {
+		return int(acks) >= ss.writeQuorum
+	}
+	return int(acks) == live
+}
+
+// write commits m locally and then waits until the backups have it. It
+// returns NotReplicated if too few of them acknowledged m, which stays
+// applied here all the same.
+func (ss *storageServer) write(m *storagerpc.Mutation) (storagerpc.Status, error) {
+	if err := ss.commit(m); err != nil {
+		return 0, err
+	}
+	if !ss.replicate(m) {
+		return storagerpc.NotReplicated, nil
+	}
+	return storagerpc.OK, nil
+}
+
+func (ss *storageServer) Replicate(args *storagerpc.ReplicateArgs, reply *storagerpc.ReplicateReply) error {
+	m := &args.Mutation
+	if !ss.accepts(m.Key) {
+		reply.Status = storagerpc.WrongServer
+		return nil
+	}
+	sh := ss.lockForWrite(m.Key)
+	defer sh.lock.Unlock()
+	if err := ss.commit(m); err != nil {
+		return err
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
@@ -0,0 +1,156 @@
+package storageserver
+
+import (
+	"strings"
+	"time"
+
+	"libstore"
+	"rpc/storagerpc"
+)
+
+// Scans. Keys are hashed on the part before their first ':', so a prefix
+// that contains a ':' names a single partition and is served like a Get of
+// the prefix. Any other prefix may match keys anywhere on the ring: every
+// server then lists the keys of the key ranges it can answer for, and the
+// libstore merges the replies.
+
+func (ss *storageServer) Scan(args *storagerpc.ScanArgs, reply *storagerpc.ScanReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	if !strings.Contains(args.Prefix, ":") {
+		ss.scanRanges(args, reply)
+		return nil
+	}
+	if !ss.keyRangeContains(args.Prefix) {
+		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
+		return nil
+	}
+	if ss.raft {
+		if forwarded, err := ss.leaderRead(args.Prefix, "StorageServer.Scan", args, reply); forwarded || err != nil {
+			return err
+		}
+	}
+	if !ss.holds(args.Prefix) {
+		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
+		return nil
+	}
+	reply.Status = storagerpc.OK
+	reply.Keys, reply.More = ss.scan(args, nil)
+	return nil
+}
+
+// scanRanges answers a scan for the key ranges this server belongs to. In
+// consensus mode those are only the ranges whose group it leads, as a
+// follower may be behind.
+func (ss *storageServer) scanRanges(args *storagerpc.ScanArgs, reply *storagerpc.ScanReply) {
+	ss.ringLock.RLock()
+	ring, replicas := ss.ring, ss.replicas
+	ss.ringLock.RUnlock()
+	ranges := make(map[uint32]bool)
+	for _, point := range ring.AllPoints() {
+		set := ring.ReplicaSet(point, replicas)
+		if !inReplicaSet(set, ss.nodeID) {
+			continue
+		}
+		if ss.raft {
+			if g, ok := ss.group(set[0]); !ok || g.readIndex() != nil {
+				continue
+			}
+		}
+		ranges[point] = true
+		reply.Ranges = append(reply.Ranges, point)
+	}
+
+	reply.Status = storagerpc.OK
+	reply.Keys, reply.More = ss.scan(args, func(key string) bool {
+		return ranges[ring.Point(libstore.StoreHash(key))]
+	})
+}
+
+// scan returns the unexpired keys matching args, in increasing order, for
+// which include returns true, and whether args.Limit left any out. A nil
+// include takes every key.
+func (ss *storageServer) scan(args *storagerpc.ScanArgs, include func(string) bool) ([]string, bool) {
+	from := args.Prefix
+	if args.StartAfter >= from {
+		from = args.StartAfter + "\x00" // the first key after StartAfter
+	}
+	return ss.scanFrom(args.Prefix, from, args.Limit, include)
+}
+
+// scanFrom returns up to limit unexpired keys with prefix at or after from,
+// in increasing order, for which include returns true, and whether the
+// limit left any out. A limit of 0 takes every key. Every shard's engine is
+// read in key order from from, a batch at a time, and the shards are merged
+// until the limit is reached.
+func (ss *storageServer) scanFrom(prefix, from string, limit int, include func(string) bool) ([]string, bool) {
+	batch := scanBatchSize
+	if limit > 0 && limit < batch {
+		batch = limit + 1
+	}
+	cursors := make([]*scanCursor, len(ss.shards))
+	for i, sh := range ss.shards {
+		cursors[i] = &scanCursor{sh: sh, from: from}
+	}
+	keys := make([]string, 0)
+	now := time.Now().UnixNano()
+	for {
+		var next *scanCursor
+		for _, c := range cursors {
+			if c.fill(prefix, batch, now) && (next == nil || c.keys[0] < next.keys[0]) {
+				next = c
+			}
+		}
+		if next == nil {
+			return keys, false
+		}
+		key := next.keys[0]
+		next.keys = next.keys[1:]
+		if include != nil && !include(key) {
+			continue
+		}
+		if limit > 0 && len(keys) == limit {
+			return keys, true
+		}
+		keys = append(keys, key)
+	}
+}
+
+// scan reads the keys of a shard in batches of up to this many.
+const scanBatchSize = 256
+
+// scanCursor reads the keys of a shard in order for scan.
+type scanCursor struct {
+	sh   *shard
+	from string   // the key to read on from
+	keys []string // keys read but not merged yet
+	done bool     // whether the shard has no more keys to read
+}
+
+// fill reads up to n more unexpired keys with prefix into c, if c has
+// none left, and reports whether c has any.
+func (c *scanCursor) fill(prefix string, n int, now int64) bool {
+	if len(c.keys) > 0 || c.done {
+		return len(c.keys) > 0
+	}
+	c.done = true
+	c.sh.lock.RLock()
+	c.sh.storage.Ascend(c.from, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if len(c.keys) == n {
+			c.from, c.done = key, false
+			return false
+		}
+		if !c.sh.expired(key, now) {
+			c.keys = append(c.keys, key)
+		}
+		return true
+	})
+	c.sh.lock.RUnlock()
+	return len(c.keys) > 0
+}
@@ -0,0 +1,138 @@
+package storageserver
+
+import (
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+	"util"
+)
+
+// Lock striping. The keys are spread over numShards shards by a hash of the
+// whole key, each with its own maps and lock, so that requests for keys of
+// different shards never wait for each other. Reads take their shard's read
+// lock and only reads granting a lease, which records a tenant, take the
+// write lock. A write holds its key's shard from validation until its
+// backups have it, which keeps the writes to a key in the same order on
+// every replica. Work that spans every key, such as a snapshot or a ring
+// change, takes the shards' locks in index order.
+const numShards = 64
+
+type shard struct {
+	lock     sync.RWMutex
+	storage  Engine                   // keys with their values, versions and expiry times, and tombstones
+	tenants  map[string][]string      // lease records of every leased key
+	revoking map[string]chan struct{} // keys whose leases are being revoked, closed once they are
+	writes   map[string]*writeLoad    // recent writes of keys, to shorten their leases
+}
+
+func newShard(storage Engine) *shard {
+	return &shard{
+		storage:  storage,
+		tenants:  make(map[string][]string),
+		revoking: make(map[string]chan struct{}),
+		writes:   make(map[string]*writeLoad),
+	}
+}
+
+// shardOf returns the shard holding key.
+func (ss *storageServer) shardOf(key string) *shard {
+	// 32-bit FNV-1a, inlined to keep lookups free of allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return ss.shards[h%numShards]
+}
+
+// lockAll takes the write lock of every shard.
+func (ss *storageServer) lockAll() {
+	for _, sh := range ss.shards {
+		sh.lock.Lock()
+	}
+}
+
+func (ss *storageServer) unlockAll() {
+	for _, sh := range ss.shards {
+		sh.lock.Unlock()
+	}
+}
+
+// rlockAll takes the read lock of every shard, which holds off every write.
+func (ss *storageServer) rlockAll() {
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+	}
+}
+
+func (ss *storageServer) runlockAll() {
+	for _, sh := range ss.shards {
+		sh.lock.RUnlock()
+	}
+}
+
+// lockRead takes the lock a read of the shard needs: the write lock if the
+// read may grant a lease and the read lock otherwise. It returns the
+// matching unlock.
+func (sh *shard) lockRead(wantLease bool) func() {
+	if wantLease {
+		sh.lock.Lock()
+		return sh.lock.Unlock
+	}
+	sh.lock.RLock()
+	return sh.lock.RUnlock
+}
+
+// meta returns the version and expiry time of key, both 0 if it is not
+// stored. The caller must hold sh.lock.
+func (sh *shard) meta(key string) keyMeta {
+	meta, _ := sh.storage.Meta(key)
+	return meta
+}
+
+// expired reports whether key has expired by now, in Unix nanoseconds. The
+// caller must hold sh.lock.
+func (sh *shard) expired(key string, now int64) bool {
+	t := sh.meta(key).Expires
+	return t != 0 && t <= now
+}
+
+// recordLease records a lease on key of the given length, in seconds,
+// granted now to the libstore at hostport. A record holds the time a lease
+// of storagerpc.LeaseSeconds would have been granted to expire at the same
+// time, and of two records for the same libstore the later one is kept.
+// The caller must hold sh.lock for writing.
+func (sh *shard) recordLease(key, hostport string, seconds int) {
+	tlist, exists := sh.tenants[key]
+	if !exists {
+		tlist = make([]string, 0)
+	}
+	grantTime := time.Now().Unix() - int64(storagerpc.LeaseSeconds-seconds)
+	leaseRecord := util.FormatLeaseRecord(hostport, grantTime)
+	i := util.BinarySearchLeaseRecord(tlist, leaseRecord)
+	var tar string
+	var t int64
+	if i < len(tlist) {
+		tar, t = util.ParseLeaseRecord(tlist[i])
+	}
+	if i >= len(tlist) || tar != hostport {
+		tlist = append(tlist, "")
+		copy(tlist[i+1:], tlist[i:])
+		tlist[i] = leaseRecord
+		sh.tenants[key] = tlist
+	} else if t < grantTime {
+		tlist[i] = leaseRecord
+	}
+}
+
+// size returns the number of keys stored on this server.
+func (ss *storageServer) size() int {
+	n := 0
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+		n += sh.storage.Len()
+		sh.lock.RUnlock()
+	}
+	return n
+}
@@ -4,19 +4,76 @@ package storageserver
 
 import "rpc/storagerpc"
 
+// Config holds the optional settings of a storage server. The zero value
+// gives a purely in-memory server.
+type Config struct {
+	DataDir  string // Directory for the write-ahead log and snapshots. Empty disables persistence.
+	Replicas int    // Number of successors that back up each key range. Only the master's setting is used.
+	Raft     bool   // Run each replica set as a Raft group instead of primary/backup. Only the master's setting is used.
+
+	// VirtualNodes is the number of points each server owns on the hash ring
+	// per unit of weight. 0 gives each server the single point equal to its
+	// ID. Only the master's setting is used, and it cannot be combined with Raft.
+	VirtualNodes int
+	Weight       int // This server's relative capacity when virtual nodes are used. Values below 1 count as 1.
+
+	// AntiEntropySeconds is the time between rounds of anti-entropy, which
+	// compare the key ranges this server serves with their other replicas
+	// and repair any differences. 0 means 60 seconds, and a negative value
+	// leaves rounds to be run on demand only.
+	AntiEntropySeconds int
+
+	// Engine names the storage engine holding the keys: MemoryEngine, the
+	// default, or BTreeEngine, which keeps them in files inside DataDir, or
+	// in a temporary directory if DataDir is empty.
+	Engine string
+
+	// LeaseWriteLimit is the number of writes to a key within
+	// storagerpc.QueryCacheSeconds above which the leases granted on it are
+	// shortened in proportion, and none are granted once it is written twice
+	// as often. 0 or a negative value grants leases regardless of writes.
+	LeaseWriteLimit int
+
+	// WriteQuorum is the number of members of a key's replica set, the
+	// primary included, that must apply a write before it is acknowledged.
+	// 0 requires every member not known to be down.
+	WriteQuorum int
+
+	// RaftLogLimit is the number of applied entries a Raft log holds before
+	// they are compacted into a snapshot of the group's keys. 0 means 1000.
+	RaftLogLimit int
+}
+
 // StorageServer defines the set of methods that can be invoked remotely via RPCs.
 type StorageServer interface {
 
 	// RegisterServer adds a storage server to the ring. It replies with
 	// status NotReady if not all nodes in the ring have joined. Once
 	// all nodes have joined, it should reply with status OK and a list
-	// of all connected nodes in the ring.
+	// of all connected nodes in the ring. A server registering after that
+	// joins the running ring, and the reply comes once the keys it takes
+	// over have been migrated to it.
 	RegisterServer(*storagerpc.RegisterArgs, *storagerpc.RegisterReply) error
 
 	// GetServers retrieves a list of all connected nodes in the ring. It
 	// replies with status NotReady if not all nodes in the ring have joined.
 	GetServers(*storagerpc.GetServersArgs, *storagerpc.GetServersReply) error
 
+	// UnregisterServer removes a storage server from the running ring once
+	// its keys have been handed over to their new owners. Only the master
+	// handles it, and the master itself cannot leave.
+	UnregisterServer(*storagerpc.UnregisterArgs, *storagerpc.UnregisterReply) error
+
+	// UpdateRing moves this server to a new ring layout. With Prepare set it
+	// only starts accepting keys of the new layout; otherwise it installs the
+	// layout and migrates the keys whose replica set gained members.
+	UpdateRing(*storagerpc.UpdateRingArgs, *storagerpc.UpdateRingReply) error
+
+	// Migrate stores keys handed over by another server during a ring
+	// change. Keys this server already has are left as they are, but their
+	// lease records are merged.
+	Migrate(*storagerpc.MigrateArgs, *storagerpc.MigrateReply) error
+
 	// Get retrieves the specified key from the data store and replies with
 	// the key's value and a lease if one was requested. If the key does not
 	// fall within the storage server's range, it should reply with status
@@ -37,6 +94,23 @@ type StorageServer interface {
 	// KeyNotFound.
 	GetList(*storagerpc.GetArgs, *storagerpc.GetListReply) error
 
+	// GetListRange is GetList of part of a list: it replies with up to Count
+	// items of the list, starting Start items from its first item, or from
+	// its last one if Reverse is set, in which case the items come last
+	// first. No lease is granted on a range.
+	GetListRange(*storagerpc.GetListRangeArgs, *storagerpc.GetListReply) error
+
+	// MultiGet and MultiGetList reply to each of several Gets or GetLists
+	// in turn, as if they had been sent one by one. Keys that do not fall
+	// within the storage server's range get replies with status WrongServer
+	// without failing the others.
+	MultiGet(*storagerpc.MultiGetArgs, *storagerpc.MultiGetReply) error
+	MultiGetList(*storagerpc.MultiGetArgs, *storagerpc.MultiGetListReply) error
+
+	// MultiGetListRange replies to a GetListRange of the same range of each
+	// of several lists in turn, like MultiGetList.
+	MultiGetListRange(*storagerpc.MultiGetListRangeArgs, *storagerpc.MultiGetListReply) error
+
 	// Put inserts the specified key/value pair into the data store. If
 	// the key does not fall within the storage server's range, it should
 	// reply with status WrongServer.
@@ -55,4 +129,92 @@ type StorageServer interface {
 	// the specified value is not already contained in the list, it should reply
 	// with status ItemNotFound.
 	RemoveFromList(*storagerpc.PutArgs, *storagerpc.PutReply) error
+
+	// ConditionalPut inserts the specified key/value pair into the data
+	// store if the key's version is the specified one, or, for version 0,
+	// if the key does not exist. Otherwise it should reply with status
+	// Conflict and the key's current version. If the key does not fall
+	// within the storage server's range, it should reply with status
+	// WrongServer.
+	ConditionalPut(*storagerpc.ConditionalPutArgs, *storagerpc.PutReply) error
+
+	// PutIfAbsent is ConditionalPut for a key that must not exist yet.
+	PutIfAbsent(*storagerpc.PutArgs, *storagerpc.PutReply) error
+
+	// CompareAndSwap replaces the value of the specified key if it is the
+	// specified old value. Otherwise, or if the key does not exist, it
+	// should reply with status Conflict and the key's current version. If
+	// the key does not fall within the storage server's range, it should
+	// reply with status WrongServer.
+	CompareAndSwap(*storagerpc.CompareAndSwapArgs, *storagerpc.PutReply) error
+
+	// Replicate applies a mutation that a primary has already applied to
+	// a key range this server backs up. If this server is not in the key's
+	// replica set, on the current ring or on one being prepared, it should
+	// reply with status WrongServer.
+	Replicate(*storagerpc.ReplicateArgs, *storagerpc.ReplicateReply) error
+
+	// RequestVote, AppendEntries and InstallSnapshot are the Raft RPCs
+	// exchanged by the members of a replica set in consensus mode.
+	RequestVote(*storagerpc.RequestVoteArgs, *storagerpc.RequestVoteReply) error
+	AppendEntries(*storagerpc.AppendEntriesArgs, *storagerpc.AppendEntriesReply) error
+	InstallSnapshot(*storagerpc.InstallSnapshotArgs, *storagerpc.InstallSnapshotReply) error
+
+	// Propose appends a mutation to the log of the key's Raft group and
+	// replies with its outcome once it is committed and applied. If this
+	// server is not the group's leader, it should reply with status NotLeader.
+	Propose(*storagerpc.ProposeArgs, *storagerpc.ProposeReply) error
+
+	// Scan lists, in key order, the keys starting with a prefix. If the
+	// prefix names a single partition and it does not fall within the
+	// storage server's range, it should reply with status WrongServer.
+	// Otherwise it lists the matching keys of every key range this server
+	// can answer for and names those ranges in the reply.
+	Scan(*storagerpc.ScanArgs, *storagerpc.ScanReply) error
+
+	// GetDigests and Repair are exchanged by the members of a replica set
+	// comparing a key range during anti-entropy: GetDigests replies with
+	// hashes of the Merkle tree of the range, or with the keys of some of
+	// its leaves, and Repair stores the records it is sent that are newer
+	// than this server's and replies with the records asked for. If this
+	// server does not hold the range, they should reply with status
+	// WrongServer.
+	GetDigests(*storagerpc.DigestArgs, *storagerpc.DigestReply) error
+	Repair(*storagerpc.RepairArgs, *storagerpc.RepairReply) error
+
+	// AntiEntropy replies with this server's anti-entropy metrics, after
+	// running a round of comparisons of every key range it serves if asked
+	// to.
+	AntiEntropy(*storagerpc.AntiEntropyArgs, *storagerpc.AntiEntropyReply) error
+
+	// Export replies with a page of a dump of the key ranges this server
+	// serves, starting the dump if args.ID is 0. If the dump with args.ID was
+	// dropped, it should reply with status KeyNotFound.
+	Export(*storagerpc.ExportArgs, *storagerpc.ExportReply) error
+
+	// Watch subscribes to the changes of a key or of the keys with a prefix
+	// and replies with the ID of the watch. PollWatch replies with the
+	// changes made since the last one received, waiting a while for one if
+	// there are none, and CancelWatch ends the watch. If the watch is
+	// unknown, PollWatch and CancelWatch should reply with status
+	// KeyNotFound.
+	Watch(*storagerpc.WatchArgs, *storagerpc.WatchReply) error
+	PollWatch(*storagerpc.PollWatchArgs, *storagerpc.PollWatchReply) error
+	CancelWatch(*storagerpc.CancelWatchArgs, *storagerpc.CancelWatchReply) error
+
+	// Transact applies the ops of a transaction atomically, coordinating
+	// the servers of their keys. If the transaction's first key does not
+	// fall within this storage server's range, or a server of its keys
+	// cannot be reached, it should reply with status WrongServer; if an op
+	// would fail, or its key is locked by another transaction, it replies
+	// with that op's status and key and no op takes place.
+	Transact(*storagerpc.TransactArgs, *storagerpc.TransactReply) error
+
+	// Prepare validates the ops of a transaction whose keys this server
+	// serves and locks the keys until Decide applies or drops them.
+	// TxnStatus replies with the decision on a transaction this server
+	// coordinates.
+	Prepare(*storagerpc.PrepareArgs, *storagerpc.PrepareReply) error
+	Decide(*storagerpc.DecideArgs, *storagerpc.DecideReply) error
+	TxnStatus(*storagerpc.TxnStatusArgs, *storagerpc.TxnStatusReply) error
 }
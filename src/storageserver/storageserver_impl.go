@@ -1,29 +1,60 @@
 package storageserver
 
 import (
-	//"errors"
+	"context"
+	"errors"
 	"sync"
 	"fmt"
 	"net"
 	"net/rpc"
 	"net/http"
+	"sync/atomic"
 	"time"
 	"log"
 
+	"failuredetector"
+	"hashring"
+	"rpc/adminrpc"
+	"rpc/fdrpc"
 	"rpc/storagerpc"
-	"util"
 )
 
+// The RPC name of the storage servers' failure detectors.
+const detectorService = "StorageFailureDetector"
+
 type storageServer struct {
+	clock uint64 // highest version assigned or seen; accessed atomically, and first for alignment
 	nodeID uint32
-	ring []uint32
+	isMaster bool
+	ring *hashring.Ring
 	nodes map[uint32]string
-	conns map[string]*rpc.Client
+	pending *hashring.Ring // ring layout being prepared by a membership change
+	ready bool         // whether the initial ring is complete
+	vnodes int         // points on the ring per unit of weight
+	weight int         // this server's weight on the ring
+	ringLock sync.RWMutex // guards ring, nodes, pending, ready, vnodes and replicas
+	ringChange sync.Mutex // serializes membership changes on the master
+	conns map[string]*rpc.Client // connections to the libstores holding leases
+	connsLock sync.Mutex          // guards conns
 	numNodes int
-	storage map[string][]string
-	tenants map[string][]string
-	// keyLocks map[string]*sync.Mutex
-	lock sync.RWMutex
+	shards [numShards]*shard
+	wal *writeAheadLog // nil when persistence is disabled
+	snapshots chan struct{} // asks the snapshotter for a snapshot before its time
+	fence time.Time    // writes are held back until leases granted elsewhere expire
+	fenceLock sync.Mutex
+	replicas int
+	peers peerSet
+	fd failuredetector.FailureDetector
+	raft bool
+	groups map[uint32]*raftGroup // Raft groups this server belongs to, by primary NodeID
+	groupsLock sync.RWMutex
+	antiEntropy antiEntropyState
+	exports exportState
+	watches watchState
+	txns txnState
+	leaseWrites int // Config.LeaseWriteLimit
+	writeQuorum int // Config.WriteQuorum
+	raftLogLimit int // Config.RaftLogLimit, or its default
 }
 
 // NewStorageServer creates and starts a new StorageServer. masterServerHostPort
@@ -35,21 +66,71 @@ type storageServer struct {
 // This function should return only once all storage servers have joined the ring,
 // and should return a non-nil error if the storage server could not be started.
 func NewStorageServer(masterServerHostPort string, numNodes, port int, nodeID uint32) (StorageServer, error) {
+	return NewStorageServerWithConfig(masterServerHostPort, numNodes, port, nodeID, Config{})
+}
+
+// NewStorageServerWithConfig is like NewStorageServer but takes the optional
+// settings in config. If config.DataDir is set, the server recovers its state
+// from the snapshot and write-ahead log found there before joining the ring.
+func NewStorageServerWithConfig(masterServerHostPort string, numNodes, port int, nodeID uint32, config Config) (StorageServer, error) {
 	ss := &storageServer{
 		nodeID: nodeID,
-		ring: make([]uint32, 0),
+		isMaster: masterServerHostPort == "",
+		ring: hashring.New(nil, config.VirtualNodes),
 		nodes: make(map[uint32]string),
 		conns: make(map[string]*rpc.Client),
 		numNodes: numNodes,
-		storage: make(map[string][]string),
-		tenants: make(map[string][]string),
-		// keyLocks: make(map[string]*sync.Mutex),
+		snapshots: make(chan struct{}, 1),
+		replicas: config.Replicas,
+		raft: config.Raft,
+		vnodes: config.VirtualNodes,
+		weight: config.Weight,
+		peers: peerSet{
+			conns: make(map[uint32]*rpc.Client),
+		},
+		exports: exportState{
+			dumps: make(map[uint64]*dump),
+		},
+		watches: watchState{
+			watches: make(map[uint64]*watch),
+		},
+		txns: newTxnState(),
+		leaseWrites: config.LeaseWriteLimit,
+		writeQuorum: config.WriteQuorum,
+		raftLogLimit: config.RaftLogLimit,
+	}
+	if ss.raftLogLimit <= 0 {
+		ss.raftLogLimit = defaultRaftLogLimit
+	}
+
+	engines, err := newEngines(config)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ss.shards {
+		ss.shards[i] = newShard(engines[i])
+	}
+
+	if config.Raft && config.VirtualNodes > 0 && ss.isMaster {
+		return nil, errors.New("virtual nodes cannot be used in consensus mode")
+	}
+
+	// In consensus mode the Raft logs replace the write-ahead log.
+	if config.DataDir != "" && !config.Raft {
+		if err := ss.recover(config.DataDir); err != nil {
+			return nil, err
+		}
+		if err := ss.recoverTxns(config.DataDir); err != nil {
+			return nil, err
+		}
+		go ss.snapshotter()
 	}
 
 	hostport := fmt.Sprintf("localhost:%d", port)
 	if masterServerHostPort == "" {
-		ss.ring = append(ss.ring, ss.nodeID)
+		ss.ring = hashring.New([]hashring.Node{{ID: nodeID, Weight: ss.weight}}, ss.vnodes)
     	ss.nodes[nodeID] = hostport
+    	ss.ready = ss.ring.Len() >= numNodes
 	}
 
 	listener, err := net.Listen("tcp", hostport)
@@ -58,6 +139,16 @@ func NewStorageServer(masterServerHostPort string, numNodes, port int, nodeID ui
     }
 
     err = rpc.RegisterName("StorageServer", storagerpc.Wrap(ss))
+    if err != nil {
+        return nil, err
+    }
+    ss.fd = failuredetector.NewFailureDetector(hostport, detectorService)
+    ss.fd.Notify(ss.peerChanged)
+    err = rpc.RegisterName(detectorService, fdrpc.Wrap(ss.fd))
+    if err != nil {
+        return nil, err
+    }
+    err = rpc.RegisterName(adminService, adminrpc.Wrap(ss))
     if err != nil {
         return nil, err
     }
@@ -66,9 +157,10 @@ func NewStorageServer(masterServerHostPort string, numNodes, port int, nodeID ui
     go http.Serve(listener, nil)
     
     if masterServerHostPort=="" {
-    	for ;len(ss.ring)<numNodes; {
+    	for ;!ss.isReady(); {
     		time.Sleep(100 * time.Millisecond)
     	}
+    	ss.watchRing()
 	} else {
 		count := 0
 		var client *rpc.Client
@@ -86,24 +178,22 @@ func NewStorageServer(masterServerHostPort string, numNodes, port int, nodeID ui
 		}
 		count = 0 
 		for {
-			args := storagerpc.RegisterArgs{storagerpc.Node{hostport, ss.nodeID}}
+			args := storagerpc.RegisterArgs{storagerpc.Node{HostPort: hostport, NodeID: ss.nodeID, Weight: ss.weight}}
 			reply := storagerpc.RegisterReply{}
 			err = client.Call("StorageServer.RegisterServer", args, &reply)
 			if err != nil {
 				log.Fatal("rpc error:", err)
 			}
 			if reply.Status == storagerpc.OK {
-				for _, node := range reply.Servers {
-					id := node.NodeID
-					addr := node.HostPort
-					i := util.BinarySearchUint32(ss.ring, id)
-					temp := append(ss.ring, 0)
-					copy(temp[i+1:], ss.ring[i:])
-					temp[i] = id
-					ss.ring = temp
-					ss.nodes[id] = addr
-				}
 				ss.numNodes = len(reply.Servers)
+				if len(reply.ReplicaSets) > 0 {
+					ss.replicas = len(reply.ReplicaSets[0].Backups)
+				}
+				ss.vnodes = reply.VirtualNodes
+				ss.setRing(reply.Servers)
+				if reply.Raft != ss.raft {
+					return nil, errors.New("consensus mode does not match the master's")
+				}
 				break
 			} else if reply.Status == storagerpc.NotReady {
 				time.Sleep(1 * time.Second)
@@ -112,47 +202,48 @@ func NewStorageServer(masterServerHostPort string, numNodes, port int, nodeID ui
 			log.Println("Connect to master retry:", count)
 		}
 	}
+
+	if ss.raft {
+		if err := ss.startRaft(config.DataDir); err != nil {
+			return nil, err
+		}
+	}
+	go ss.sweeper()
+	if !ss.raft {
+		go ss.txnResolver()
+	}
+	antiEntropyInterval := time.Duration(config.AntiEntropySeconds) * time.Second
+	if antiEntropyInterval == 0 {
+		antiEntropyInterval = defaultAntiEntropyInterval
+	}
+	go ss.antiEntropist(antiEntropyInterval)
     return ss, nil
 }
 
-// func (ss *storageServer) lock(key string) {
-// 	ss.locklock.Lock()
-// 	lock, ok := ss.keyLocks[key]
-// 	if !ok {
-// 		lock = new(sync.Mutex)
-// 		ss.keyLocks[key] = lock
-// 	}
-// 	ss.locklock.Unlock()
-// 	lock.Lock()
-// }
-
-// func (ss *storageServer) unlock(key string) {
-// 	ss.locklock.Lock()
-// 	lock, ok := ss.keyLocks[key]
-// 	if !ok {
-// 		log.Fatal("Lose reference to lock of key", key)
-// 	}
-// 	ss.locklock.Unlock()
-// 	lock.Unlock()
-// }
-
 func (ss *storageServer) RegisterServer(args *storagerpc.RegisterArgs, reply *storagerpc.RegisterReply) error {
 	addr, id := args.ServerInfo.HostPort, args.ServerInfo.NodeID
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	if _, ok := ss.nodes[id]; !ok {
-		i := util.BinarySearchUint32(ss.ring, id)
-		temp := append(ss.ring, 0)
-		copy(temp[i+1:], ss.ring[i:])
-		temp[i] = id
-		ss.ring = temp
+	ss.ringLock.Lock()
+	_, known := ss.nodes[id]
+	if ss.ready && !known {
+		ss.ringLock.Unlock()
+		return ss.join(args.ServerInfo, reply)
+	}
+	if !known {
+		node := hashring.Node{ID: id, Weight: args.ServerInfo.Weight}
+		ss.ring = hashring.New(append(ss.ring.Nodes(), node), ss.vnodes)
 		ss.nodes[id] = addr
 	}
-	if len(ss.ring)>=ss.numNodes {
+	if ss.ring.Len()>=ss.numNodes {
+		ss.ready = true
+	}
+	ready := ss.ready
+	ss.ringLock.Unlock()
+	if ready {
 		reply.Status = storagerpc.OK
-		for i, h := range ss.nodes {
-			reply.Servers = append(reply.Servers, storagerpc.Node{h, i})
-		}
+		reply.Servers = ss.servers()
+		reply.ReplicaSets = ss.replicaSets()
+		reply.Raft = ss.raft
+		reply.VirtualNodes = ss.vnodes
 		return nil
 	} else {
 		reply.Status = storagerpc.NotReady
@@ -161,11 +252,17 @@ func (ss *storageServer) RegisterServer(args *storagerpc.RegisterArgs, reply *st
 }
 
 func (ss *storageServer) GetServers(args *storagerpc.GetServersArgs, reply *storagerpc.GetServersReply) error {
-	if len(ss.ring)>=ss.numNodes {
+	if ss.isReady() {
 		reply.Status = storagerpc.OK
-		for i, h := range ss.nodes {
-			reply.Servers = append(reply.Servers, storagerpc.Node{h, i})
+		reply.Servers = ss.servers()
+		for i := range reply.Servers {
+			reply.Servers[i].Alive = ss.fd.Alive(reply.Servers[i].HostPort)
 		}
+		reply.ReplicaSets = ss.replicaSets()
+		ss.ringLock.RLock()
+		reply.Replicas = ss.replicas
+		reply.VirtualNodes = ss.vnodes
+		ss.ringLock.RUnlock()
 		return nil
 	} else {
 		reply.Status = storagerpc.NotReady
@@ -173,50 +270,62 @@ func (ss *storageServer) GetServers(args *storagerpc.GetServersArgs, reply *stor
 	return nil
 }
 
+// keyRangeContains reports whether this server should serve key: either it
+// is the key's primary, or it backs the key up and every replica ahead of it
+// in the replica set is down.
+//
+// In consensus mode every member of the key's replica set serves it.
 func (ss *storageServer) keyRangeContains(key string) bool {
-	id := util.SearchHashRing(ss.ring, key)
-	if ss.nodeID != id {
+	set := ss.replicaSet(key)
+	if !inReplicaSet(set, ss.nodeID) {
 		return false
 	}
-	return true
-}
-
-func (ss *storageServer) recordLease(key, hostport string) {
-	tlist, exists := ss.tenants[key]
-	if !exists {
-		tlist = make([]string, 0)
+	if ss.raft {
+		return true
 	}
-	leaseRecord := util.FormatLeaseRecord(hostport, time.Now().Unix())
-	i := util.BinarySearchLeaseRecord(tlist, leaseRecord)
-	var tar string
-	if i<len(tlist) {
-		tar, _ = util.ParseLeaseRecord(tlist[i])
+	for _, id := range set {
+		if id == ss.nodeID {
+			return true
+		}
+		if !ss.peerDown(id) {
+			return false
+		}
 	}
-	if i >= len(tlist) || tar!=hostport {
-		tlist = append(tlist, "")
-		copy(tlist[i+1:], tlist[i:])
-		tlist[i]=leaseRecord
-		ss.tenants[key]=tlist
-	}	
+	return false
 }
 
 func (ss *storageServer) Get(args *storagerpc.GetArgs, reply *storagerpc.GetReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
 	key := args.Key
-	wantLease := args.WantLease
 	if !ss.keyRangeContains(key) {
 		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
 		return nil
 	}
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	if values, ok := ss.storage[key]; ok {
+	if ss.raft {
+		args.WantLease = false
+		if forwarded, err := ss.leaderRead(key, "StorageServer.Get", args, reply); forwarded || err != nil {
+			return err
+		}
+	}
+	wantLease := args.WantLease
+	sh := ss.shardOf(key)
+	defer sh.lockRead(wantLease)()
+	if !ss.holds(key) {
+		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
+		return nil
+	}
+	if values, ok := sh.storage.Get(key); ok && !sh.expired(key, time.Now().UnixNano()) {
 		reply.Status = storagerpc.OK
 		if len(values)>0 {
 			reply.Value = values[0]
 		}
-		if wantLease {
-			reply.Lease = storagerpc.Lease{true, storagerpc.LeaseSeconds}
-			ss.recordLease(key, args.HostPort)
+		reply.Version = sh.meta(key).Version
+		if wantLease && sh.leasable(key) {
+			reply.Lease = ss.grantLease(sh, args)
 		}
 	} else {
 		reply.Status = storagerpc.KeyNotFound
@@ -224,188 +333,548 @@ func (ss *storageServer) Get(args *storagerpc.GetArgs, reply *storagerpc.GetRepl
 	return nil
 }
 
-func (ss *storageServer) getAppServer(hostPort string) *rpc.Client {
-	cli, ok := ss.conns[hostPort]
-	if !ok {
-		cli, err := rpc.DialHTTP("tcp", hostPort)
-		if err != nil {
-			log.Fatal("rpc error:", err)
-		}
-		ss.conns[hostPort] = cli
-		return cli
-	}
-	return cli
-}
-
-func (ss *storageServer) revokeLease(key string) {
-	tenants, ok := ss.tenants[key]
-	if !ok {
-		return
+func (ss *storageServer) Delete(args *storagerpc.DeleteArgs, reply *storagerpc.DeleteReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
 	}
-	for _, leaseRecord := range tenants {
-		host, t := util.ParseLeaseRecord(leaseRecord)
-		expire_t := t+storagerpc.LeaseSeconds+storagerpc.LeaseGuardSeconds
-		if expire_t < time.Now().Unix() {
-			continue
-		}
-
-		cli := ss.getAppServer(host)
-	
-		args := &storagerpc.RevokeLeaseArgs{key}
-		reply := &storagerpc.RevokeLeaseReply{}
-		revokeCall := cli.Go("LeaseCallbacks.RevokeLease", args, reply, nil)
-		timeout := time.After(time.Duration(expire_t-time.Now().Unix())*time.Second)
-		select {
-		case <- timeout:
-			continue
-		case <- revokeCall.Done:
-			continue
-		}
+	status, err := ss.mutate(&storagerpc.Mutation{Op: storagerpc.DeleteOp, Key: args.Key})
+	reply.Status = status
+	if status == storagerpc.WrongServer {
+		reply.Servers = ss.servers()
 	}
-	delete(ss.tenants, key)
+	return err
 }
 
-func (ss *storageServer) Delete(args *storagerpc.DeleteArgs, reply *storagerpc.DeleteReply) error {
+func (ss *storageServer) GetList(args *storagerpc.GetArgs, reply *storagerpc.GetListReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
 	key := args.Key
 	if !ss.keyRangeContains(key) {
 		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
+		return nil
+	}
+	if ss.raft {
+		args.WantLease = false
+		if forwarded, err := ss.leaderRead(key, "StorageServer.GetList", args, reply); forwarded || err != nil {
+			return err
+		}
+	}
+	wantLease := args.WantLease
+	sh := ss.shardOf(key)
+	defer sh.lockRead(wantLease)()
+	if !ss.holds(key) {
+		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
 		return nil
 	}
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	_, ok := ss.storage[key]
-	
-	if ok {
-		ss.revokeLease(key)
-		delete(ss.storage, key)
+	if values, ok := sh.storage.Get(key); ok && !sh.expired(key, time.Now().UnixNano()) {
 		reply.Status = storagerpc.OK
+		if len(values)>0 {
+			reply.Value = values
+		}
+		reply.Version = sh.meta(key).Version
+		if wantLease && sh.leasable(key) {
+			reply.Lease = ss.grantLease(sh, args)
+		}
 	} else {
 		reply.Status = storagerpc.KeyNotFound
 	}
 	return nil
 }
 
-func (ss *storageServer) GetList(args *storagerpc.GetArgs, reply *storagerpc.GetListReply) error {
+func (ss *storageServer) GetListRange(args *storagerpc.GetListRangeArgs, reply *storagerpc.GetListReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
 	key := args.Key
 	if !ss.keyRangeContains(key) {
 		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
 		return nil
 	}
-	wantLease := args.WantLease
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	if values, ok := ss.storage[key]; ok {
-		reply.Status = storagerpc.OK
-		if len(values)>0 {
-			reply.Value = make([]string, len(values))
-			copy(reply.Value, values)
+	if ss.raft {
+		if forwarded, err := ss.leaderRead(key, "StorageServer.GetListRange", args, reply); forwarded || err != nil {
+			return err
 		}
-		if wantLease {
-			reply.Lease = storagerpc.Lease{true, storagerpc.LeaseSeconds}
-			ss.recordLease(key, args.HostPort)
+	}
+	sh := ss.shardOf(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	if !ss.holds(key) {
+		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
+		return nil
+	}
+	if values, ok := sh.storage.Range(key, args.Start, args.Count, args.Reverse); ok && !sh.expired(key, time.Now().UnixNano()) {
+		reply.Status = storagerpc.OK
+		if len(values) > 0 {
+			reply.Value = values
 		}
+		reply.Version = sh.meta(key).Version
 	} else {
 		reply.Status = storagerpc.KeyNotFound
 	}
 	return nil
 }
 
+func (ss *storageServer) MultiGet(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	reply.Replies = make([]storagerpc.GetReply, len(args.Keys))
+	for i := range args.Keys {
+		if err := ss.Get(getArgs(args, i), &reply.Replies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *storageServer) MultiGetList(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetListReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	reply.Replies = make([]storagerpc.GetListReply, len(args.Keys))
+	for i := range args.Keys {
+		if err := ss.GetList(getArgs(args, i), &reply.Replies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *storageServer) MultiGetListRange(args *storagerpc.MultiGetListRangeArgs, reply *storagerpc.MultiGetListReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	reply.Replies = make([]storagerpc.GetListReply, len(args.Keys))
+	for i, key := range args.Keys {
+		rangeArgs := &storagerpc.GetListRangeArgs{Key: key, Start: args.Start, Count: args.Count,
+			Reverse: args.Reverse, Timeout: args.Timeout}
+		if err := ss.GetListRange(rangeArgs, &reply.Replies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getArgs returns the GetArgs of the i-th key of a MultiGet.
+func getArgs(args *storagerpc.MultiGetArgs, i int) *storagerpc.GetArgs {
+	wantLease := i < len(args.WantLease) && args.WantLease[i]
+	leaseSeconds := 0
+	if i < len(args.LeaseSeconds) {
+		leaseSeconds = args.LeaseSeconds[i]
+	}
+	return &storagerpc.GetArgs{Key: args.Keys[i], WantLease: wantLease, LeaseSeconds: leaseSeconds,
+		HostPort: args.HostPort, Timeout: args.Timeout}
+}
+
 func (ss *storageServer) Put(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
-	key := args.Key
-	if !ss.keyRangeContains(key) {
-		reply.Status = storagerpc.WrongServer
-		return nil
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: args.Key, Value: args.Value,
+		Expires: expiresAt(args.TTLSeconds)}
+	return ss.put(m, reply)
+}
+
+func (ss *storageServer) ConditionalPut(args *storagerpc.ConditionalPutArgs, reply *storagerpc.PutReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: args.Key, Value: args.Value,
+		Cond: storagerpc.IfVersion, Expect: args.Version}
+	return ss.put(m, reply)
+}
+
+func (ss *storageServer) PutIfAbsent(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: args.Key, Value: args.Value, Cond: storagerpc.IfVersion,
+		Expires: expiresAt(args.TTLSeconds)}
+	return ss.put(m, reply)
+}
+
+func (ss *storageServer) CompareAndSwap(args *storagerpc.CompareAndSwapArgs, reply *storagerpc.PutReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.PutOp, Key: args.Key, Value: args.NewValue,
+		Cond: storagerpc.IfValue, Old: args.OldValue}
+	return ss.put(m, reply)
+}
+
+// checkTimeout returns context.DeadlineExceeded if timeout, the Timeout of
+// the arguments of a request, has run out.
+func checkTimeout(timeout time.Duration) error {
+	if storagerpc.Expired(timeout) {
+		return context.DeadlineExceeded
 	}
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	ss.revokeLease(key)
-	
-	ss.storage[key] = []string{args.Value}
-	
-	reply.Status = storagerpc.OK
 	return nil
 }
 
+// put performs a write on behalf of a handler replying with a PutReply.
+func (ss *storageServer) put(m *storagerpc.Mutation, reply *storagerpc.PutReply) error {
+	status, err := ss.mutate(m)
+	reply.Status = status
+	switch status {
+	case storagerpc.WrongServer:
+		reply.Servers = ss.servers()
+	case storagerpc.OK, storagerpc.Conflict:
+		reply.Version = m.Version
+	}
+	return err
+}
+
 func (ss *storageServer) AppendToList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
-	key := args.Key
-	if !ss.keyRangeContains(key) {
-		reply.Status = storagerpc.WrongServer
-		return nil
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	m := &storagerpc.Mutation{Op: storagerpc.AppendOp, Key: args.Key, Value: args.Value,
+		Expires: expiresAt(args.TTLSeconds)}
+	return ss.put(m, reply)
+}
+
+func (ss *storageServer) RemoveFromList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
 	}
-	val := args.Value
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	values, ok := ss.storage[key]
-	
-	if ok {
-		if len(values) < 1 {
-			ss.storage[key] = append(values, val)
-			reply.Status = storagerpc.OK
-			return nil
-		}
-		if values[len(values)-1] < val {
-			ss.revokeLease(key)
-			ss.storage[key] = append(values, val)
-			reply.Status = storagerpc.OK
-			return nil
-		}
-		
-		i := util.BinarySearchString(values, val)
-		if values[i]==val {
-			reply.Status = storagerpc.ItemExists
-			return nil
-		}
-
-		ss.revokeLease(key)
-		// insert value at index i
-		values = append(values, "")
-		copy(values[i+1:], values[i:])
-		values[i] = val
-		ss.storage[key] = values
+	m := &storagerpc.Mutation{Op: storagerpc.RemoveOp, Key: args.Key, Value: args.Value,
+		Expires: expiresAt(args.TTLSeconds)}
+	return ss.put(m, reply)
+}
 
-		reply.Status = storagerpc.OK
-		return nil
+// mutate performs a client write. In consensus mode it goes through the
+// key's Raft group; otherwise m waits for any transaction holding its key,
+// is validated, leases on its key are revoked and it is written to the log
+// and the backups. On return m.Version holds the key's version after the
+// write, or its current one on Conflict.
+func (ss *storageServer) mutate(m *storagerpc.Mutation) (storagerpc.Status, error) {
+	return ss.mutateAs(m, nil)
+}
+
+// mutateAs is mutate on behalf of transaction t, whose keys it need not
+// wait for.
+func (ss *storageServer) mutateAs(m *storagerpc.Mutation, t *preparedTxn) (storagerpc.Status, error) {
+	if !ss.keyRangeContains(m.Key) {
+		return storagerpc.WrongServer, nil
+	}
+	if ss.raft {
+		return ss.proposeWrite(m)
+	}
+	ss.waitFence()
+	sh := ss.shardOf(m.Key)
+	for {
+		sh.lock.Lock()
+		if !ss.holds(m.Key) {
+			// The ring changed while this write was waiting.
+			sh.lock.Unlock()
+			return storagerpc.WrongServer, nil
+		}
+		if holder := ss.lockedBy(m.Key); holder != nil && holder != t {
+			sh.lock.Unlock()
+			<-holder.released
+			continue
+		}
+		m.Time = time.Now().UnixNano()
+		if status := ss.check(m); status != storagerpc.OK {
+			sh.lock.Unlock()
+			return status, nil
+		}
+		if ss.clearLeases(sh, m.Key) {
+			break
+		}
+	}
+	defer sh.lock.Unlock()
+	if ss.leaseWrites > 0 {
+		sh.noteWrite(m.Key, time.Now().Unix())
+	}
+	m.Version = atomic.AddUint64(&ss.clock, 1)
+	return ss.write(m)
+}
+
+// check returns the status that applying m would reply with: a delete needs
+// the key to exist, an append needs the item to be missing from the list, a
+// remove needs it to be present and a conditional put needs its condition
+// to hold. A key that has expired by m.Time counts as missing. On Conflict
+// it sets m.Version to the key's current version. The caller must hold the
+// lock of the key's shard.
+func (ss *storageServer) check(m *storagerpc.Mutation) storagerpc.Status {
+	sh := ss.shardOf(m.Key)
+	expired := sh.expired(m.Key, m.Time)
+	if m.Cond == storagerpc.IfExpired {
+		if !expired {
+			m.Version = sh.meta(m.Key).Version
+			return storagerpc.Conflict
+		}
+		return storagerpc.OK
+	}
+	ok := sh.storage.Exists(m.Key) && !expired
+	version := sh.meta(m.Key).Version
+	if expired {
+		version = 0
+	}
+	switch m.Cond {
+	case storagerpc.IfVersion:
+		if version != m.Expect {
+			m.Version = version
+			return storagerpc.Conflict
+		}
+	case storagerpc.IfValue:
+		var values []string
+		if ok {
+			values, _ = sh.storage.Get(m.Key)
+		}
+		if len(values) != 1 || values[0] != m.Old {
+			m.Version = version
+			return storagerpc.Conflict
+		}
+	}
+	switch m.Op {
+	case storagerpc.DeleteOp:
+		if !ok {
+			return storagerpc.KeyNotFound
+		}
+	case storagerpc.AppendOp:
+		if ok && sh.storage.Contains(m.Key, m.Value) {
+			return storagerpc.ItemExists
+		}
+	case storagerpc.RemoveOp:
+		if !ok || !sh.storage.Contains(m.Key, m.Value) {
+			return storagerpc.ItemNotFound
+		}
+	}
+	return storagerpc.OK
+}
+
+// apply performs rec on the storage engine. It is shared by the RPC
+// handlers, which have already validated rec, by backups and by log replay.
+// The key's new version is rec.Version, unless that would not exceed its
+// current version, and is stored back in rec.Version. The caller must hold
+// the write lock of the key's shard.
+func (ss *storageServer) apply(rec *storagerpc.Mutation) {
+	sh := ss.shardOf(rec.Key)
+	sh.settleVersion(rec)
+	old := sh.meta(rec.Key)
+	if old.Expires != 0 && old.Expires <= rec.Time {
+		sh.storage.Delete(rec.Key)
+		old = keyMeta{}
+	}
+	ss.observe(rec.Version)
+	sh.applyOp(rec)
+	if sh.storage.Exists(rec.Key) {
+		sh.storage.SetMeta(rec.Key, keyMeta{Version: rec.Version, Expires: expiryOf(rec, old.Expires)})
+		sh.storage.DeleteTombstone(rec.Key)
 	} else {
-		ss.storage[key] = []string{val}
-		reply.Status = storagerpc.OK
+		sh.storage.SetTombstone(rec.Key, tombstone{version: rec.Version, time: rec.Time})
+	}
+	ss.notifyWatches(rec)
+}
+
+// settleVersion raises rec.Version past the current version of its key if
+// it does not exceed it. The caller must hold sh.lock.
+func (sh *shard) settleVersion(rec *storagerpc.Mutation) {
+	if current := sh.meta(rec.Key).Version; rec.Version <= current {
+		rec.Version = current + 1
+	}
+}
+
+// applied reports whether rec, replayed from the write-ahead log, is
+// already part of the storage engine, which holds the same or a later
+// version of its key. Records logged before versions existed never are.
+// The caller must hold sh.lock.
+func (sh *shard) applied(rec *storagerpc.Mutation) bool {
+	if rec.Version == 0 {
+		return false
 	}
+	if meta, ok := sh.storage.Meta(rec.Key); ok {
+		return rec.Version <= meta.Version
+	}
+	t, ok := sh.storage.Tombstone(rec.Key)
+	return ok && rec.Version <= t.version
+}
+
+// observe raises the clock to version if it is behind.
+func (ss *storageServer) observe(version uint64) {
+	for {
+		clock := atomic.LoadUint64(&ss.clock)
+		if version <= clock || atomic.CompareAndSwapUint64(&ss.clock, clock, version) {
+			return
+		}
+	}
+}
+
+func (sh *shard) applyOp(rec *storagerpc.Mutation) {
+	key, val := rec.Key, rec.Value
+	switch rec.Op {
+	case storagerpc.PutOp:
+		sh.storage.Set(key, []string{val})
+	case storagerpc.DeleteOp:
+		sh.storage.Delete(key)
+	case storagerpc.AppendOp:
+		sh.storage.Insert(key, val)
+	case storagerpc.RemoveOp:
+		sh.storage.Remove(key, val)
+	case storagerpc.StoreOp:
+		sh.storage.Set(key, rec.Values)
+	}
+}
+
+// commit makes rec durable in the write-ahead log, if there is one, and then
+// applies it locally. The record is logged with the version apply gives it,
+// which tells a replay whether a checkpoint or snapshot already holds it.
+// The caller must hold the write lock of the key's shard.
+func (ss *storageServer) commit(rec *storagerpc.Mutation) error {
+	ss.shardOf(rec.Key).settleVersion(rec)
+	if ss.wal != nil {
+		if err := ss.wal.append(rec); err != nil {
+			return err
+		}
+		if ss.wal.size() >= snapshotThreshold {
+			select {
+			case ss.snapshots <- struct{}{}:
+			default:
+			}
+		}
+	}
+	ss.apply(rec)
 	return nil
 }
 
-func (ss *storageServer) RemoveFromList(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
-	key := args.Key
-	if !ss.keyRangeContains(key) {
-		reply.Status = storagerpc.WrongServer
-		return nil
+// recover reopens the storage engines' checkpoints, loads the latest
+// snapshot in dataDir into the engines that have none, and replays the
+// write-ahead log on top, skipping the records the engines already hold.
+// Lease tenants are not persisted, so if any data was recovered, writes are
+// fenced off until every lease that the previous incarnation may have
+// granted has expired.
+func (ss *storageServer) recover(dataDir string) error {
+	for _, sh := range ss.shards {
+		if clock, ok := sh.storage.Checkpointed(); ok {
+			ss.observe(clock)
+		}
 	}
-	val := args.Value
-	ss.lock.Lock()
-	defer ss.lock.Unlock()
-	values, ok := ss.storage[key]
-	
-	if ok {
-		if len(values) < 1 {
-			reply.Status = storagerpc.ItemNotFound
-			return nil
-		}
-		mid := util.BinarySearchString(values, val)
-		exists := false
-		if mid<len(values) && values[mid]==val {
-			exists = true
-		}
-		if exists {
-			// remove value at index mid
-			ss.revokeLease(key)
-			copy(values[mid:], values[mid+1:])
-			ss.storage[key] = values[:len(values)-1]
-			reply.Status = storagerpc.OK
-			return nil
-		}
-
-		reply.Status = storagerpc.ItemNotFound
-		return nil
-	} else {
-		reply.Status = storagerpc.ItemNotFound
+	clock, err := loadSnapshot(dataDir, func(rec *snapshotRecord) {
+		sh := ss.shardOf(rec.Key)
+		if _, ok := sh.storage.Checkpointed(); ok {
+			return
+		}
+		sh.storage.Set(rec.Key, rec.Values)
+		sh.storage.SetMeta(rec.Key, keyMeta{Version: rec.Version, Expires: rec.Expires})
+		ss.observe(rec.Version)
+	})
+	if err != nil {
+		return err
+	}
+	ss.observe(clock)
+	ss.wal, err = openWAL(dataDir)
+	if err != nil {
+		return err
+	}
+	err = ss.wal.replay(func(rec *storagerpc.Mutation) {
+		if ss.shardOf(rec.Key).applied(rec) {
+			ss.observe(rec.Version)
+			return
+		}
+		ss.apply(rec)
+	})
+	if err != nil {
+		return err
+	}
+	if n := ss.size(); n > 0 {
+		ss.extendFence()
+		log.Printf("Recovered %d keys from %s", n, dataDir)
 	}
 	return nil
 }
+
+// snapshotter saves the keys periodically, or sooner once commit finds the
+// log long, and drops the log records the save covers.
+func (ss *storageServer) snapshotter() {
+	for {
+		select {
+		case <-time.After(snapshotInterval):
+		case <-ss.snapshots:
+		}
+		// Writes log and apply under their shard's write lock, so once every
+		// read lock is held, every record logged before the mark has been
+		// applied. The shards are then saved one at a time while writes go
+		// on; what a shard holds past the mark is skipped by a replay.
+		ss.rlockAll()
+		if ss.wal.size() == 0 {
+			ss.runlockAll()
+			continue
+		}
+		mark := ss.wal.mark()
+		ss.runlockAll()
+		if err := ss.checkpoint(mark); err != nil {
+			log.Println("Snapshot failed:", err)
+		}
+	}
+}
+
+// checkpoint saves the keys of every shard, a shard at a time under its
+// read lock, in the engines' checkpoints or, for engines that have none, in
+// a snapshot, and then drops the records before m from the log.
+func (ss *storageServer) checkpoint(m walMark) error {
+	for _, sh := range ss.shards {
+		sh.lock.RLock()
+		ok, err := sh.storage.Checkpoint(atomic.LoadUint64(&ss.clock))
+		sh.lock.RUnlock()
+		if err != nil {
+			return err
+		} else if !ok {
+			return ss.wal.snapshot(atomic.LoadUint64(&ss.clock), ss.eachRecord(nil), m)
+		}
+	}
+	return ss.wal.checkpointed(m)
+}
+
+// eachRecord returns a function that calls write with the snapshot record
+// of every key for which include returns true, or of every key if include
+// is nil, a shard at a time under its read lock, until write fails.
+func (ss *storageServer) eachRecord(include func(key string) bool) func(write func(rec *snapshotRecord) error) error {
+	return func(write func(rec *snapshotRecord) error) error {
+		for _, sh := range ss.shards {
+			var err error
+			sh.lock.RLock()
+			sh.storage.Keys(func(key string) bool {
+				if include != nil && !include(key) {
+					return true
+				}
+				values, _ := sh.storage.Get(key)
+				meta := sh.meta(key)
+				err = write(&snapshotRecord{Key: key, Values: values, Version: meta.Version, Expires: meta.Expires})
+				return err == nil
+			})
+			sh.lock.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// extendFence holds back writes until any lease granted by a previous
+// incarnation of this server, or by a failed primary, has expired.
+func (ss *storageServer) extendFence() {
+	ss.fenceLock.Lock()
+	defer ss.fenceLock.Unlock()
+	fence := time.Now().Add((storagerpc.LeaseSeconds + storagerpc.LeaseGuardSeconds) * time.Second)
+	if fence.After(ss.fence) {
+		ss.fence = fence
+	}
+}
+
+// waitFence blocks until writes are allowed.
+func (ss *storageServer) waitFence() {
+	ss.fenceLock.Lock()
+	d := ss.fence.Sub(time.Now())
+	ss.fenceLock.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,580 @@
+package storageserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Transactions, by two-phase commit. The server a transaction is sent to
+// coordinates it: it hands each op to the server that serves its key, a
+// participant, in a Prepare call. A participant locks the keys of its ops,
+// validates the ops as the write path would, and logs them before it
+// agrees; a locked key makes ordinary writes to it wait, and a second
+// transaction on it fail with Locked. If every participant agrees, the
+// coordinator logs the commit decision and sends it out with Decide, upon
+// which the participants apply their ops through the usual write path;
+// otherwise it tells them to drop their ops. Only commits are logged by the
+// coordinator, so a transaction it knows nothing about did not commit: a
+// participant left prepared by a lost Decide asks the coordinator with
+// TxnStatus, and a coordinator retries the Decide calls that failed. Both
+// logs live in txnFileName in the data directory, so a server without one,
+// or in consensus mode, replies TxnUnsupported to Transact and Prepare
+// rather than risk forgetting a decision in a restart.
+const (
+	txnFileName      = "txn.log"
+	txnRetryInterval = time.Second     // how often stuck transactions are retried
+	txnResolveDelay  = 2 * time.Second // how long a participant waits for a Decide before asking
+	txnTimeout       = 2 * (storagerpc.LeaseSeconds + storagerpc.LeaseGuardSeconds) * time.Second
+)
+
+// The states of the records of a transaction log.
+const (
+	txnPrepared  = "prepared"  // a participant agreed to Ops
+	txnFinished  = "finished"  // the participant applied or dropped them
+	txnCommitted = "committed" // the coordinator decided to commit
+	txnEnded     = "ended"     // every participant applied its ops
+)
+
+// txnRecord is a line of a transaction log.
+type txnRecord struct {
+	Txn          string
+	State        string
+	Coordinator  uint32                `json:",omitempty"`
+	Ops          []storagerpc.Mutation `json:",omitempty"`
+	Participants []uint32              `json:",omitempty"`
+}
+
+// preparedTxn is the part of a transaction a participant agreed to.
+type preparedTxn struct {
+	id          string
+	coordinator uint32
+	ops         []storagerpc.Mutation
+	time        time.Time     // when it was prepared
+	released    chan struct{} // closed once its keys are unlocked
+	lock        sync.Mutex    // serializes decisions
+	applied     int           // ops applied so far
+	done        bool
+}
+
+type txnState struct {
+	last      uint64                  // sequence number of the last transaction coordinated; accessed atomically
+	lock      sync.Mutex              // guards the maps and file
+	locks     map[string]*preparedTxn // the transaction holding each locked key
+	prepared  map[string]*preparedTxn
+	active    map[string]bool     // transactions being coordinated, not decided yet
+	committed map[string][]uint32 // committed transactions, with the participants yet to apply them
+	file      *os.File            // nil when persistence is disabled
+}
+
+func newTxnState() txnState {
+	return txnState{
+		last:      uint64(time.Now().UnixNano()),
+		locks:     make(map[string]*preparedTxn),
+		prepared:  make(map[string]*preparedTxn),
+		active:    make(map[string]bool),
+		committed: make(map[string][]uint32),
+	}
+}
+
+// logTxn appends rec to the transaction log and waits until it reaches
+// disk. The caller must hold ss.txns.lock.
+func (ss *storageServer) logTxn(rec txnRecord) error {
+	if ss.txns.file == nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = ss.txns.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return ss.txns.file.Sync()
+}
+
+// trimTxnLog empties the transaction log once no record in it is needed.
+// The caller must hold ss.txns.lock.
+func (ss *storageServer) trimTxnLog() {
+	if ss.txns.file == nil || len(ss.txns.prepared) > 0 || len(ss.txns.committed) > 0 {
+		return
+	}
+	if err := ss.txns.file.Truncate(0); err != nil {
+		log.Println("Failed to trim the transaction log:", err)
+		return
+	}
+	ss.txns.file.Seek(0, io.SeekStart)
+}
+
+// recoverTxns reloads the transactions left undecided or unfinished in
+// dataDir, locking the keys of the prepared ones again, and rewrites the
+// log with only their records.
+func (ss *storageServer) recoverTxns(dataDir string) error {
+	path := filepath.Join(dataDir, txnFileName)
+	var pending []txnRecord
+	if f, err := os.Open(path); err == nil {
+		byTxn := make(map[string]int)
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return err
+			}
+			var rec txnRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				log.Println("Discarding corrupt transaction log record:", err)
+				break
+			}
+			switch rec.State {
+			case txnPrepared, txnCommitted:
+				byTxn[rec.State+rec.Txn] = len(pending)
+				pending = append(pending, rec)
+			case txnFinished, txnEnded:
+				state := txnPrepared
+				if rec.State == txnEnded {
+					state = txnCommitted
+				}
+				if i, ok := byTxn[state+rec.Txn]; ok {
+					pending[i].State = ""
+				}
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	ss.txns.file = f
+	for _, rec := range pending {
+		switch rec.State {
+		case txnPrepared:
+			t := &preparedTxn{id: rec.Txn, coordinator: rec.Coordinator, ops: rec.Ops, time: time.Now(),
+				released: make(chan struct{})}
+			ss.txns.prepared[t.id] = t
+			for _, op := range t.ops {
+				ss.txns.locks[op.Key] = t
+			}
+		case txnCommitted:
+			ss.txns.committed[rec.Txn] = rec.Participants
+		default:
+			continue
+		}
+		if err := ss.logTxn(rec); err != nil {
+			return err
+		}
+	}
+	if n := len(ss.txns.prepared) + len(ss.txns.committed); n > 0 {
+		log.Printf("Recovered %d unfinished transactions from %s", n, dataDir)
+	}
+	return os.Rename(tmp, path)
+}
+
+// lockedBy returns the transaction holding key, if any.
+func (ss *storageServer) lockedBy(key string) *preparedTxn {
+	ss.txns.lock.Lock()
+	defer ss.txns.lock.Unlock()
+	return ss.txns.locks[key]
+}
+
+// release forgets t and unlocks its keys.
+func (ss *storageServer) release(t *preparedTxn) {
+	ss.txns.lock.Lock()
+	for _, op := range t.ops {
+		if ss.txns.locks[op.Key] == t {
+			delete(ss.txns.locks, op.Key)
+		}
+	}
+	delete(ss.txns.prepared, t.id)
+	ss.trimTxnLog()
+	ss.txns.lock.Unlock()
+	close(t.released)
+}
+
+// servingMember returns the member of key's replica set that serves it as
+// far as this server knows: the first one not known to be down.
+func (ss *storageServer) servingMember(key string) (uint32, bool) {
+	set := ss.replicaSet(key)
+	for _, id := range set {
+		if id == ss.nodeID || !ss.knownDown(id) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// txnsSupported reports whether the server takes part in transactions:
+// only one logging them to disk, and not in consensus mode.
+func (ss *storageServer) txnsSupported() bool {
+	return !ss.raft && ss.txns.file != nil
+}
+
+func (ss *storageServer) Transact(args *storagerpc.TransactArgs, reply *storagerpc.TransactReply) error {
+	if !ss.txnsSupported() {
+		reply.Status = storagerpc.TxnUnsupported
+		return nil
+	}
+	if err := checkTimeout(args.Timeout); err != nil {
+		return err
+	}
+	if err := checkTxnOps(args.Ops); err != nil {
+		return err
+	}
+	if !ss.keyRangeContains(args.Ops[0].Key) {
+		reply.Status = storagerpc.WrongServer
+		reply.Servers = ss.servers()
+		return nil
+	}
+	parts := make(map[uint32][]storagerpc.Mutation)
+	for _, op := range args.Ops {
+		id, ok := ss.servingMember(op.Key)
+		if !ok {
+			reply.Status = storagerpc.WrongServer
+			reply.Servers = ss.servers()
+			return nil
+		}
+		parts[id] = append(parts[id], op)
+	}
+	id := fmt.Sprintf("%d-%d", ss.nodeID, atomic.AddUint64(&ss.txns.last, 1))
+	ss.txns.lock.Lock()
+	ss.txns.active[id] = true
+	ss.txns.lock.Unlock()
+
+	// Phase one: every participant validates and locks its keys.
+	type vote struct {
+		id    uint32
+		reply storagerpc.PrepareReply
+		err   error
+	}
+	votes := make(chan vote, len(parts))
+	for pid, ops := range parts {
+		go func(pid uint32, ops []storagerpc.Mutation) {
+			v := vote{id: pid}
+			args := &storagerpc.PrepareArgs{TxnID: id, Coordinator: ss.nodeID, Ops: ops}
+			v.err = ss.callParticipant(pid, "StorageServer.Prepare", args, &v.reply)
+			votes <- v
+		}(pid, ops)
+	}
+	reply.Status = storagerpc.OK
+	var participants []uint32
+	for range parts {
+		v := <-votes
+		participants = append(participants, v.id)
+		if v.err != nil {
+			log.Printf("Transaction %s: participant %d failed to prepare: %v", id, v.id, v.err)
+			if _, ok := v.err.(rpc.ServerError); !ok && v.id != ss.nodeID {
+				ss.markPeer(v.id, true)
+			}
+			if reply.Status == storagerpc.OK {
+				reply.Status = storagerpc.WrongServer
+				reply.Servers = ss.servers()
+			}
+		} else if v.reply.Status != storagerpc.OK && reply.Status == storagerpc.OK {
+			reply.Status, reply.Key = v.reply.Status, v.reply.Key
+			if reply.Status == storagerpc.WrongServer {
+				reply.Servers = ss.servers()
+			}
+		}
+	}
+
+	// Phase two: the decision is logged, if it is a commit, and sent out.
+	commit := reply.Status == storagerpc.OK
+	ss.txns.lock.Lock()
+	delete(ss.txns.active, id)
+	var err error
+	if commit {
+		if err = ss.logTxn(txnRecord{Txn: id, State: txnCommitted, Participants: participants}); err == nil {
+			ss.txns.committed[id] = participants
+		}
+	}
+	ss.txns.lock.Unlock()
+	if err != nil {
+		commit = false
+	}
+	left := ss.decideAll(id, commit, participants)
+	if commit {
+		ss.endTxn(id, left)
+	}
+	return err
+}
+
+// decideAll sends the decision on transaction id to participants in
+// parallel and returns the ones that could not be told.
+func (ss *storageServer) decideAll(id string, commit bool, participants []uint32) []uint32 {
+	failed := make(chan uint32, len(participants))
+	var wg sync.WaitGroup
+	for _, pid := range participants {
+		wg.Add(1)
+		go func(pid uint32) {
+			defer wg.Done()
+			args := &storagerpc.DecideArgs{TxnID: id, Commit: commit}
+			reply := &storagerpc.DecideReply{}
+			if err := ss.callParticipant(pid, "StorageServer.Decide", args, reply); err != nil {
+				log.Printf("Transaction %s: failed to tell participant %d: %v", id, pid, err)
+				failed <- pid
+			}
+		}(pid)
+	}
+	wg.Wait()
+	close(failed)
+	var left []uint32
+	for pid := range failed {
+		left = append(left, pid)
+	}
+	return left
+}
+
+// endTxn records that only the participants left still have to apply the
+// committed transaction id, and forgets it if none does.
+func (ss *storageServer) endTxn(id string, left []uint32) {
+	ss.txns.lock.Lock()
+	defer ss.txns.lock.Unlock()
+	if len(left) > 0 {
+		ss.txns.committed[id] = left
+		return
+	}
+	if err := ss.logTxn(txnRecord{Txn: id, State: txnEnded}); err != nil {
+		log.Printf("Transaction %s: failed to log its end: %v", id, err)
+		return
+	}
+	delete(ss.txns.committed, id)
+	ss.trimTxnLog()
+}
+
+// checkTxnOps makes sure that ops is a valid transaction: at least one
+// put, delete, append or remove, each to a different key.
+func checkTxnOps(ops []storagerpc.Mutation) error {
+	if len(ops) == 0 {
+		return errors.New("empty transaction")
+	}
+	keys := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		switch op.Op {
+		case storagerpc.PutOp, storagerpc.DeleteOp, storagerpc.AppendOp, storagerpc.RemoveOp:
+		default:
+			return fmt.Errorf("invalid transaction op %d", op.Op)
+		}
+		if keys[op.Key] {
+			return errors.New("the transaction writes " + op.Key + " twice")
+		}
+		keys[op.Key] = true
+	}
+	return nil
+}
+
+// callParticipant calls method on participant id, which may be this server.
+func (ss *storageServer) callParticipant(id uint32, method string, args, reply interface{}) error {
+	if id != ss.nodeID {
+		return ss.callPeer(id, method, args, reply, txnTimeout)
+	}
+	switch method {
+	case "StorageServer.Prepare":
+		return ss.Prepare(args.(*storagerpc.PrepareArgs), reply.(*storagerpc.PrepareReply))
+	case "StorageServer.Decide":
+		return ss.Decide(args.(*storagerpc.DecideArgs), reply.(*storagerpc.DecideReply))
+	}
+	return errors.New("unknown transaction method " + method)
+}
+
+func (ss *storageServer) Prepare(args *storagerpc.PrepareArgs, reply *storagerpc.PrepareReply) error {
+	if !ss.txnsSupported() {
+		reply.Status = storagerpc.TxnUnsupported
+		return nil
+	}
+	t := &preparedTxn{id: args.TxnID, coordinator: args.Coordinator, ops: args.Ops, time: time.Now(),
+		released: make(chan struct{})}
+	ss.txns.lock.Lock()
+	if _, ok := ss.txns.prepared[t.id]; ok {
+		ss.txns.lock.Unlock()
+		reply.Status = storagerpc.OK
+		return nil
+	}
+	for _, op := range t.ops {
+		if _, ok := ss.txns.locks[op.Key]; ok {
+			ss.txns.lock.Unlock()
+			reply.Status, reply.Key = storagerpc.Locked, op.Key
+			return nil
+		}
+	}
+	for _, op := range t.ops {
+		ss.txns.locks[op.Key] = t
+	}
+	ss.txns.prepared[t.id] = t
+	ss.txns.lock.Unlock()
+
+	// Writes that got past the lock finish under their shard's lock, so
+	// the ops are validated against their outcome.
+	ss.waitFence()
+	for _, op := range t.ops {
+		m := op
+		status := storagerpc.WrongServer
+		if ss.keyRangeContains(m.Key) {
+			sh := ss.shardOf(m.Key)
+			sh.lock.Lock()
+			if ss.holds(m.Key) {
+				m.Time = time.Now().UnixNano()
+				status = ss.check(&m)
+			}
+			sh.lock.Unlock()
+		}
+		if status != storagerpc.OK {
+			ss.release(t)
+			reply.Status, reply.Key = status, m.Key
+			return nil
+		}
+	}
+	ss.txns.lock.Lock()
+	err := ss.logTxn(txnRecord{Txn: t.id, State: txnPrepared, Coordinator: t.coordinator, Ops: t.ops})
+	ss.txns.lock.Unlock()
+	if err != nil {
+		ss.release(t)
+		return err
+	}
+	reply.Status = storagerpc.OK
+	return nil
+}
+
+func (ss *storageServer) Decide(args *storagerpc.DecideArgs, reply *storagerpc.DecideReply) error {
+	ss.txns.lock.Lock()
+	t, ok := ss.txns.prepared[args.TxnID]
+	ss.txns.lock.Unlock()
+	reply.Status = storagerpc.OK
+	if !ok {
+		// Decided already, or never prepared.
+		return nil
+	}
+	return ss.decide(t, args.Commit)
+}
+
+// decide applies the ops of t, if commit, and then unlocks its keys. An op
+// that fails validation now, as when a key expired since t was prepared, or
+// when t is applied again after a crash, is skipped. An op on a key that
+// moved to another server is sent there; if no server takes it, t stays
+// prepared and the error is returned, so that the coordinator's retried
+// Decide, or the txnResolver, applies the rest of t later.
+func (ss *storageServer) decide(t *preparedTxn, commit bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return nil
+	}
+	for commit && t.applied < len(t.ops) {
+		m := t.ops[t.applied]
+		status, err := ss.mutateAs(&m, t)
+		if err == nil && status == storagerpc.WrongServer {
+			// The key moved to another server since t was prepared.
+			status, err = ss.forwardOp(m)
+		}
+		if err != nil {
+			return err
+		}
+		if status == storagerpc.WrongServer {
+			return fmt.Errorf("transaction %s: no server takes the write to %s", t.id, m.Key)
+		}
+		if status != storagerpc.OK {
+			log.Printf("Transaction %s: skipped the write to %s with status %d", t.id, m.Key, status)
+		}
+		t.applied++
+	}
+	ss.txns.lock.Lock()
+	err := ss.logTxn(txnRecord{Txn: t.id, State: txnFinished})
+	ss.txns.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	t.done = true
+	ss.release(t)
+	return nil
+}
+
+// forwardOp applies m, an op of a committed transaction on a key this
+// server no longer serves, through the ordinary write RPC of the member
+// that serves the key now.
+func (ss *storageServer) forwardOp(m storagerpc.Mutation) (storagerpc.Status, error) {
+	id, ok := ss.servingMember(m.Key)
+	if !ok || id == ss.nodeID {
+		return storagerpc.WrongServer, nil
+	}
+	if m.Op == storagerpc.DeleteOp {
+		reply := &storagerpc.DeleteReply{}
+		err := ss.callPeer(id, "StorageServer.Delete", &storagerpc.DeleteArgs{Key: m.Key}, reply, txnTimeout)
+		return reply.Status, err
+	}
+	method := map[storagerpc.MutationOp]string{
+		storagerpc.PutOp:    "StorageServer.Put",
+		storagerpc.AppendOp: "StorageServer.AppendToList",
+		storagerpc.RemoveOp: "StorageServer.RemoveFromList",
+	}[m.Op]
+	reply := &storagerpc.PutReply{}
+	err := ss.callPeer(id, method, &storagerpc.PutArgs{Key: m.Key, Value: m.Value}, reply, txnTimeout)
+	return reply.Status, err
+}
+
+func (ss *storageServer) TxnStatus(args *storagerpc.TxnStatusArgs, reply *storagerpc.TxnStatusReply) error {
+	ss.txns.lock.Lock()
+	defer ss.txns.lock.Unlock()
+	reply.Status = storagerpc.OK
+	if ss.txns.active[args.TxnID] {
+		return nil
+	}
+	_, reply.Commit = ss.txns.committed[args.TxnID]
+	reply.Decided = true
+	return nil
+}
+
+// txnResolver finishes the transactions left stuck by a failed call: it
+// retries the Decide calls of committed transactions that failed and asks
+// the coordinators of transactions prepared a while ago what they decided.
+func (ss *storageServer) txnResolver() {
+	for {
+		time.Sleep(txnRetryInterval)
+		ss.txns.lock.Lock()
+		committed := make(map[string][]uint32, len(ss.txns.committed))
+		for id, left := range ss.txns.committed {
+			committed[id] = left
+		}
+		var prepared []*preparedTxn
+		for _, t := range ss.txns.prepared {
+			if time.Since(t.time) > txnResolveDelay {
+				prepared = append(prepared, t)
+			}
+		}
+		ss.txns.lock.Unlock()
+
+		for id, left := range committed {
+			ss.endTxn(id, ss.decideAll(id, true, left))
+		}
+		for _, t := range prepared {
+			args := &storagerpc.TxnStatusArgs{TxnID: t.id}
+			reply := &storagerpc.TxnStatusReply{}
+			if t.coordinator == ss.nodeID {
+				ss.TxnStatus(args, reply)
+			} else if err := ss.callPeer(t.coordinator, "StorageServer.TxnStatus", args, reply, txnTimeout); err != nil {
+				continue
+			}
+			if reply.Status == storagerpc.OK && reply.Decided {
+				if err := ss.decide(t, reply.Commit); err != nil {
+					log.Printf("Transaction %s: failed to apply the decision: %v", t.id, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package storageserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Persistence layout inside a data directory: every mutation is appended to
+// walFileName and fsync'd before it is applied. Periodically the keys are
+// saved, in the storage engines' checkpoints or else in a snapshot written
+// to snapshotFileName, and the records logged before the save started are
+// dropped from the log, so a restart only has to reopen the checkpoints or
+// load the snapshot and replay the log tail. A snapshot is streamed from
+// the engines: a line of JSON holding the clock, then a snapshotRecord per
+// line. Snapshots of earlier versions, in oldSnapshotFileName, are a JSON
+// object of every key's values followed by a versionState, missing from
+// those taken before versions existed; they are still loaded.
+const (
+	walFileName         = "wal.log"
+	snapshotFileName    = "snapshot.jsonl"
+	oldSnapshotFileName = "snapshot.json"
+	snapshotInterval    = 30 * time.Second
+	snapshotThreshold   = 10000 // Take a snapshot once the log holds this many records.
+)
+
+// snapshotHeader is the first line of a snapshot.
+type snapshotHeader struct {
+	Clock uint64
+}
+
+// snapshotRecord is a key in a snapshot.
+type snapshotRecord struct {
+	Key     string
+	Values  []string
+	Version uint64
+	Expires int64 `json:",omitempty"`
+}
+
+// versionState is the part of an old snapshot that holds the keys' versions
+// and expiry times.
+type versionState struct {
+	Versions map[string]uint64
+	Clock    uint64
+	Expires  map[string]int64 `json:",omitempty"`
+}
+
+type writeAheadLog struct {
+	dir     string
+	lock    sync.Mutex // guards file, records and offset against writes to different shards
+	file    *os.File
+	records int
+	offset  int64 // size of the log in bytes
+}
+
+// walMark is a position in the log: the number of records before it and
+// their size in bytes.
+type walMark struct {
+	records int
+	offset  int64
+}
+
+// openWAL opens (creating if needed) the write-ahead log inside dir.
+func openWAL(dir string) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{dir: dir, file: f}, nil
+}
+
+// append writes rec to the end of the log and waits until it reaches disk.
+func (w *writeAheadLog) append(rec *storagerpc.Mutation) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err = w.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err = w.file.Sync(); err != nil {
+		return err
+	}
+	w.records++
+	w.offset += int64(len(b) + 1)
+	return nil
+}
+
+// mark returns the current end of the log.
+func (w *writeAheadLog) mark() walMark {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return walMark{records: w.records, offset: w.offset}
+}
+
+// size returns the number of records in the log.
+func (w *writeAheadLog) size() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.records
+}
+
+// replay calls fn for every complete record in the log, in order. A torn
+// record at the end of the file (left by a crash in the middle of a write)
+// is discarded, but a record that cannot be read followed by others is
+// corruption, which fails the replay and leaves the file as it is.
+func (w *writeAheadLog) replay(fn func(*storagerpc.Mutation)) error {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(w.file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Println("Discarding torn write-ahead log record")
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		rec := &storagerpc.Mutation{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+				return fmt.Errorf("corrupt write-ahead log record at byte %d: %v", valid, err)
+			}
+			log.Println("Discarding torn write-ahead log record:", err)
+			break
+		}
+		fn(rec)
+		w.records++
+		valid += int64(len(line))
+	}
+	w.offset = valid
+	return w.file.Truncate(valid)
+}
+
+// snapshot atomically replaces the snapshot file with clock and the records
+// that each passes to its argument, and then drops the records before m,
+// which the new snapshot covers, from the log. Records may be appended
+// meanwhile; they are kept.
+func (w *writeAheadLog) snapshot(clock uint64, each func(write func(rec *snapshotRecord) error) error, m walMark) error {
+	if err := writeSnapshot(filepath.Join(w.dir, snapshotFileName), snapshotHeader{Clock: clock}, each); err != nil {
+		return err
+	}
+	if err := removeFile(filepath.Join(w.dir, oldSnapshotFileName)); err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+	return w.compact(m)
+}
+
+// writeSnapshot atomically replaces the file at path with a snapshot made
+// of header and the records that each passes to its argument, one JSON line
+// each.
+func writeSnapshot(path string, header interface{}, each func(write func(rec *snapshotRecord) error) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	enc := json.NewEncoder(buf)
+	err = enc.Encode(header)
+	if err == nil {
+		err = each(func(rec *snapshotRecord) error {
+			return enc.Encode(rec)
+		})
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkpointed drops the records before m from the log once the storage
+// engines' checkpoints cover them, along with any snapshot, which they
+// replace.
+func (w *writeAheadLog) checkpointed(m walMark) error {
+	for _, name := range []string{snapshotFileName, oldSnapshotFileName} {
+		if err := removeFile(filepath.Join(w.dir, name)); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+	return w.compact(m)
+}
+
+// removeFile removes the file at path, if there is one.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// compact drops the records before m from the log, copying the ones after
+// it to a new file that replaces the log. Appends wait meanwhile.
+func (w *writeAheadLog) compact(m walMark) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	tmp := filepath.Join(w.dir, walFileName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.Seek(m.offset, io.SeekStart); err == nil {
+		_, err = io.Copy(f, w.file)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(w.dir, walFileName)); err != nil {
+		return err
+	}
+	if err = syncDir(w.dir); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(w.dir, walFileName), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.records -= m.records
+	w.offset -= m.offset
+	return nil
+}
+
+// loadSnapshot reads the latest snapshot in dir, passing every record in it
+// to load, and returns the clock saved with them. A missing snapshot holds
+// no keys.
+func loadSnapshot(dir string, load func(rec *snapshotRecord)) (uint64, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return loadOldSnapshot(dir, load)
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var header snapshotHeader
+	if err = readSnapshot(f, &header, load); err != nil {
+		return 0, err
+	}
+	return header.Clock, nil
+}
+
+// readSnapshot reads a snapshot written by writeSnapshot from r, decoding
+// its header into header and passing every record to load.
+func readSnapshot(r io.Reader, header interface{}, load func(rec *snapshotRecord)) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if err := dec.Decode(header); err != nil {
+		return err
+	}
+	for {
+		rec := &snapshotRecord{}
+		if err := dec.Decode(rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		load(rec)
+	}
+}
+
+// loadOldSnapshot reads a snapshot of an earlier version in dir, if there
+// is one. It goes through the file twice, for the versions follow the keys.
+// Keys of a snapshot taken before versions existed get version 1.
+func loadOldSnapshot(dir string, load func(rec *snapshotRecord)) (uint64, error) {
+	f, err := os.Open(filepath.Join(dir, oldSnapshotFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	state := versionState{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if err = loadKeys(dec, func(string, []string) {}); err != nil {
+		return 0, err
+	}
+	if err = dec.Decode(&state); err != nil && err != io.EOF {
+		return 0, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	err = loadKeys(json.NewDecoder(bufio.NewReader(f)), func(key string, values []string) {
+		rec := &snapshotRecord{Key: key, Values: values, Version: state.Versions[key], Expires: state.Expires[key]}
+		if rec.Version == 0 {
+			rec.Version = 1
+		}
+		load(rec)
+	})
+	return state.Clock, err
+}
+
+// loadKeys reads the JSON object of keys at the start of a snapshot a key
+// at a time.
+func loadKeys(dec *json.Decoder, load func(key string, values []string)) error {
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t == nil {
+		return nil
+	} else if t != json.Delim('{') {
+		return errors.New("snapshot does not start with an object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return errors.New("snapshot holds a key that is not a string")
+		}
+		var values []string
+		if err = dec.Decode(&values); err != nil {
+			return err
+		}
+		load(key, values)
+	}
+	_, err := dec.Token()
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,168 @@
+package storageserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"rpc/storagerpc"
+)
+
+// Watches. Every change a server applies, as a primary, a backup or a Raft
+// member, is appended to the watches it matches, under the lock of the
+// key's shard, so the changes of a key are queued in the order of their
+// versions. A client collects them with PollWatch, acknowledging the ones
+// it received with the next poll.
+
+const (
+	watchBufferSize  = 1000        // changes kept per watch until collected
+	watchIdleTimeout = time.Minute // a watch not polled for this long is cancelled
+)
+
+type watch struct {
+	prefix string
+	exact  bool
+	lock   sync.Mutex
+	events []storagerpc.WatchEvent // not acknowledged yet, the first one numbered first
+	first  uint64
+	lost   bool          // whether events were dropped since the last poll
+	wake   chan struct{} // signalled when an event is added
+	used   time.Time     // when the watch was last polled
+}
+
+type watchState struct {
+	lock    sync.RWMutex
+	last    uint64 // ID of the last watch created
+	watches map[uint64]*watch
+}
+
+// matches reports whether w watches key.
+func (w *watch) matches(key string) bool {
+	if w.exact {
+		return key == w.prefix
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
+
+// add queues event, dropping every queued event instead if the queue is
+// full. The caller must hold w.lock.
+func (w *watch) add(event storagerpc.WatchEvent) {
+	if len(w.events) >= watchBufferSize {
+		w.first += uint64(len(w.events))
+		w.events = w.events[:0]
+		w.lost = true
+	}
+	w.events = append(w.events, event)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ack drops the queued events numbered up to after. The caller must hold
+// w.lock.
+func (w *watch) ack(after uint64) {
+	if after < w.first {
+		return
+	}
+	n := after - w.first + 1
+	if n > uint64(len(w.events)) {
+		n = uint64(len(w.events))
+	}
+	w.events = append(w.events[:0], w.events[n:]...)
+	w.first += n
+}
+
+// notifyWatches queues the change rec, just applied, on the watches of its
+// key. The caller holds the write lock of the key's shard.
+func (ss *storageServer) notifyWatches(rec *storagerpc.Mutation) {
+	ss.watches.lock.RLock()
+	defer ss.watches.lock.RUnlock()
+	for _, w := range ss.watches.watches {
+		if !w.matches(rec.Key) {
+			continue
+		}
+		event := storagerpc.WatchEvent{Op: rec.Op, Key: rec.Key, Value: rec.Value, Version: rec.Version}
+		if rec.Op == storagerpc.StoreOp {
+			event.Values = rec.Values
+		}
+		w.lock.Lock()
+		w.add(event)
+		w.lock.Unlock()
+	}
+}
+
+// reapWatches cancels the watches left idle for watchIdleTimeout. The
+// caller must hold ss.watches.lock for writing.
+func (ss *storageServer) reapWatches() {
+	now := time.Now()
+	for id, w := range ss.watches.watches {
+		w.lock.Lock()
+		idle := now.Sub(w.used) > watchIdleTimeout
+		w.lock.Unlock()
+		if idle {
+			delete(ss.watches.watches, id)
+		}
+	}
+}
+
+// getWatch returns the watch with id, if there is one.
+func (ss *storageServer) getWatch(id uint64) (*watch, bool) {
+	ss.watches.lock.RLock()
+	defer ss.watches.lock.RUnlock()
+	w, ok := ss.watches.watches[id]
+	return w, ok
+}
+
+func (ss *storageServer) Watch(args *storagerpc.WatchArgs, reply *storagerpc.WatchReply) error {
+	ss.watches.lock.Lock()
+	defer ss.watches.lock.Unlock()
+	ss.reapWatches()
+	ss.watches.last++
+	ss.watches.watches[ss.watches.last] = &watch{prefix: args.Prefix, exact: args.Exact, first: 1,
+		wake: make(chan struct{}, 1), used: time.Now()}
+	reply.Status = storagerpc.OK
+	reply.WatchID = ss.watches.last
+	return nil
+}
+
+func (ss *storageServer) PollWatch(args *storagerpc.PollWatchArgs, reply *storagerpc.PollWatchReply) error {
+	w, ok := ss.getWatch(args.WatchID)
+	if !ok {
+		reply.Status = storagerpc.KeyNotFound
+		return nil
+	}
+	deadline := time.After(storagerpc.WatchPollSeconds * time.Second)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.ack(args.After)
+	for expired := false; len(w.events) == 0 && !w.lost && !expired; {
+		w.used = time.Now()
+		w.lock.Unlock()
+		select {
+		case <-w.wake:
+		case <-deadline:
+			expired = true
+		}
+		w.lock.Lock()
+	}
+	w.used = time.Now()
+	reply.Status = storagerpc.OK
+	reply.Events = append([]storagerpc.WatchEvent(nil), w.events...)
+	reply.Last = w.first + uint64(len(w.events)) - 1
+	reply.Lost = w.lost
+	w.lost = false
+	return nil
+}
+
+func (ss *storageServer) CancelWatch(args *storagerpc.CancelWatchArgs, reply *storagerpc.CancelWatchReply) error {
+	ss.watches.lock.Lock()
+	defer ss.watches.lock.Unlock()
+	if _, ok := ss.watches.watches[args.WatchID]; !ok {
+		reply.Status = storagerpc.KeyNotFound
+		return nil
+	}
+	delete(ss.watches.watches, args.WatchID)
+	reply.Status = storagerpc.OK
+	return nil
+}
@@ -1,6 +1,7 @@
 package stwclient
 
 import (
+	"context"
 	"net"
 	"net/rpc"
 	"strconv"
@@ -20,63 +21,107 @@ func NewStwClient(serverHost string, serverPort int) (StwClient, error) {
 	return &stwClient{client: cli}, nil
 }
 
+// call calls method on the app server, giving up once ctx is done. The app
+// server's refusal of a call past its deadline is returned as
+// context.DeadlineExceeded.
+func (tc *stwClient) call(ctx context.Context, method string, args, reply interface{}) error {
+	call := tc.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ServerError(context.DeadlineExceeded.Error()) {
+			return context.DeadlineExceeded
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (tc *stwClient) CreateUser(userID string) (stwrpc.Status, error) {
-	args := &stwrpc.CreateUserArgs{UserID: userID}
+	return tc.CreateUserContext(context.Background(), userID)
+}
+
+func (tc *stwClient) CreateUserContext(ctx context.Context, userID string) (stwrpc.Status, error) {
+	args := &stwrpc.CreateUserArgs{UserID: userID, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.CreateUserReply
-	if err := tc.client.Call("StwServer.CreateUser", args, &reply); err != nil {
+	if err := tc.call(ctx, "StwServer.CreateUser", args, &reply); err != nil {
 		return 0, err
 	}
 	return reply.Status, nil
 }
 
 func (tc *stwClient) Subscribe(userID, targetUserID string) (stwrpc.Status, error) {
-	return tc.doSub("StwServer.Subscribe", userID, targetUserID)
+	return tc.doSub(context.Background(), "StwServer.Subscribe", userID, targetUserID)
+}
+
+func (tc *stwClient) SubscribeContext(ctx context.Context, userID, targetUserID string) (stwrpc.Status, error) {
+	return tc.doSub(ctx, "StwServer.Subscribe", userID, targetUserID)
 }
 
 func (tc *stwClient) Unsubscribe(userID, targetUserID string) (stwrpc.Status, error) {
-	return tc.doSub("StwServer.Unsubscribe", userID, targetUserID)
+	return tc.doSub(context.Background(), "StwServer.Unsubscribe", userID, targetUserID)
+}
+
+func (tc *stwClient) UnsubscribeContext(ctx context.Context, userID, targetUserID string) (stwrpc.Status, error) {
+	return tc.doSub(ctx, "StwServer.Unsubscribe", userID, targetUserID)
 }
 
-func (tc *stwClient) doSub(funcName, userID, targetUserID string) (stwrpc.Status, error) {
-	args := &stwrpc.SubscriptionArgs{UserID: userID, TargetUserID: targetUserID}
+func (tc *stwClient) doSub(ctx context.Context, funcName, userID, targetUserID string) (stwrpc.Status, error) {
+	args := &stwrpc.SubscriptionArgs{UserID: userID, TargetUserID: targetUserID, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.SubscriptionReply
-	if err := tc.client.Call(funcName, args, &reply); err != nil {
+	if err := tc.call(ctx, funcName, args, &reply); err != nil {
 		return 0, err
 	}
 	return reply.Status, nil
 }
 
 func (tc *stwClient) Timeline(userID string) ([]stwrpc.Post, stwrpc.Status, error) {
-	args := &stwrpc.TimelineArgs{UserID: userID}
+	return tc.TimelineContext(context.Background(), userID)
+}
+
+func (tc *stwClient) TimelineContext(ctx context.Context, userID string) ([]stwrpc.Post, stwrpc.Status, error) {
+	args := &stwrpc.TimelineArgs{UserID: userID, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.TimelineReply
-	if err := tc.client.Call("StwServer.Timeline", args, &reply); err != nil {
+	if err := tc.call(ctx, "StwServer.Timeline", args, &reply); err != nil {
 		return nil, 0, err
 	}
 	return reply.Posts, reply.Status, nil
 }
 
 func (tc *stwClient) HomeTimeline(userID string) ([]stwrpc.Post, stwrpc.Status, error) {
-	args := &stwrpc.TimelineArgs{UserID: userID}
+	return tc.HomeTimelineContext(context.Background(), userID)
+}
+
+func (tc *stwClient) HomeTimelineContext(ctx context.Context, userID string) ([]stwrpc.Post, stwrpc.Status, error) {
+	args := &stwrpc.TimelineArgs{UserID: userID, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.TimelineReply
-	if err := tc.client.Call("StwServer.HomeTimeline", args, &reply); err != nil {
+	if err := tc.call(ctx, "StwServer.HomeTimeline", args, &reply); err != nil {
 		return nil, 0, err
 	}
 	return reply.Posts, reply.Status, nil
 }
 
 func (tc *stwClient) Post(userID, contents string) (stwrpc.PostReply, error) {
-	args := &stwrpc.PostArgs{UserID: userID, Contents: contents}
+	return tc.PostContext(context.Background(), userID, contents)
+}
+
+func (tc *stwClient) PostContext(ctx context.Context, userID, contents string) (stwrpc.PostReply, error) {
+	args := &stwrpc.PostArgs{UserID: userID, Contents: contents, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.PostReply
-	if err := tc.client.Call("StwServer.Post", args, &reply); err != nil {
+	if err := tc.call(ctx, "StwServer.Post", args, &reply); err != nil {
 		return reply, err
 	}
 	return reply, nil
 }
 
 func (tc *stwClient) DeletePost(userID, postKey string) (stwrpc.Status, error) {
-	args := &stwrpc.DeletePostArgs{UserID: userID, PostKey: postKey}
+	return tc.DeletePostContext(context.Background(), userID, postKey)
+}
+
+func (tc *stwClient) DeletePostContext(ctx context.Context, userID, postKey string) (stwrpc.Status, error) {
+	args := &stwrpc.DeletePostArgs{UserID: userID, PostKey: postKey, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.DeletePostReply
-	if err := tc.client.Call("StwServer.DeletePost", args, &reply); err != nil {
+	if err := tc.call(ctx, "StwServer.DeletePost", args, &reply); err != nil {
 		return 0, err
 	}
 	return reply.Status, nil
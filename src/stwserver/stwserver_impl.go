@@ -1,7 +1,8 @@
 package stwserver
 
 import (
-	//"errors"
+	"context"
+	"errors"
 	"net"
 	"net/rpc"
 	"net/http"
@@ -10,41 +11,80 @@ import (
 	"sort"
 	"log"
 	"strconv"
+	"sync"
 
+	"failuredetector"
+	"rpc/fdrpc"
 	"rpc/stwrpc"
 	"libstore"
 	"util"
 )
 
+// The RPC name of the app servers' failure detectors.
+const detectorService = "StwFailureDetector"
+
 type stwServer struct {
 	nodes []string
 	numNodes int
+	nodesLock sync.Mutex
 	storage libstore.Libstore
+	fd failuredetector.FailureDetector
 }
 
 func NewStwServer(myHostPort, masterServer, masterStorageServer string, numNodes int) (StwServer, error) {
-    ts := &stwServer{
-    	nodes: []string{myHostPort},
-    	numNodes: numNodes,
-    }
-
     storage, err := libstore.NewLibstore(
     	masterStorageServer, myHostPort, libstore.Normal,
     )
     if err != nil {
 		return nil, err
 	}
-	ts.storage = storage
+	return NewStwServerWithLibstore(myHostPort, masterServer, numNodes, storage)
+}
+
+// NewStwServerWithLibstore is NewStwServer keeping its data in storage, such
+// as a libstore.FakeLibstore, rather than in a libstore of its own.
+func NewStwServerWithLibstore(myHostPort, masterServer string, numNodes int, storage libstore.Libstore) (StwServer, error) {
+    ts := newStwServer(myHostPort, numNodes, storage)
+    if err := ts.serve(masterServer); err != nil {
+        return nil, err
+    }
+    return ts, nil
+}
+
+// newStwServer builds an app server for myHostPort keeping its data in
+// storage, without serving it, so that it can be called directly.
+func newStwServer(myHostPort string, numNodes int, storage libstore.Libstore) *stwServer {
+    return &stwServer{
+    	nodes: []string{myHostPort},
+    	numNodes: numNodes,
+    	storage: storage,
+    	fd: failuredetector.NewFailureDetector(myHostPort, detectorService),
+    }
+}
 
+// stop stops the heartbeats of an app server that is not served.
+func (ts *stwServer) stop() {
+    ts.fd.Close()
+}
+
+// serve starts serving ts over RPC, on the default RPC server, and joins
+// the cluster of masterServer, or waits for the cluster to form if it is
+// the master. Only one app server can be served by a process.
+func (ts *stwServer) serve(masterServer string) error {
+    myHostPort := ts.nodes[0]
     listener, err := net.Listen("tcp", myHostPort)
     if err != nil {
-        return nil, err
+        return err
     }
 
     // Wrap the stwServer before registering it for RPC.
     err = rpc.RegisterName("StwServer", stwrpc.Wrap(ts))
     if err != nil {
-        return nil, err
+        return err
+    }
+    err = rpc.RegisterName(detectorService, fdrpc.Wrap(ts.fd))
+    if err != nil {
+        return err
     }
 
     rpc.HandleHTTP()
@@ -53,7 +93,7 @@ func NewStwServer(myHostPort, masterServer, masterStorageServer string, numNodes
 
  	// forming cluster
  	if masterServer=="" {
-    	for ;len(ts.nodes)<numNodes; {
+    	for ;!ts.ready(); {
     		time.Sleep(100 * time.Millisecond)
     	}
 	} else {
@@ -73,21 +113,19 @@ func NewStwServer(myHostPort, masterServer, masterStorageServer string, numNodes
 		}
 		count = 0 
 		for {
-			args := stwrpc.RegisterArgs{stwrpc.Node{myHostPort}}
+			args := stwrpc.RegisterArgs{stwrpc.Node{HostPort: myHostPort}}
 			reply := stwrpc.RegisterReply{}
 			err = client.Call("StwServer.RegisterServer", args, &reply)
 			if err != nil {
 				log.Fatal("rpc error:", err)
 			}
 			if reply.Status == stwrpc.OK {
+				ts.nodesLock.Lock()
 				for _, node := range reply.Servers {
-					addr := node.HostPort
-					i := util.BinarySearchString(ts.nodes, addr)
-					temp := append(ts.nodes, "")
-					copy(temp[i+1:], ts.nodes[i:])
-					ts.nodes = temp
+					ts.addNode(node.HostPort)
 				}
 				ts.numNodes = len(reply.Servers)
+				ts.nodesLock.Unlock()
 				break
 			} else if reply.Status == stwrpc.NotReady {
 				time.Sleep(1 * time.Second)
@@ -97,12 +135,13 @@ func NewStwServer(myHostPort, masterServer, masterStorageServer string, numNodes
 		}
 	}
 
-    return ts, nil
+    ts.fd.SetMembers(ts.servers())
+    return nil
 }
 
-
-func (ts *stwServer) RegisterServer(args *stwrpc.RegisterArgs, reply *stwrpc.RegisterReply) error {
-	addr := args.ServerInfo.HostPort
+// addNode inserts addr into the sorted list of nodes. The caller must hold
+// ts.nodesLock.
+func (ts *stwServer) addNode(addr string) {
 	i := util.BinarySearchString(ts.nodes, addr)
 	if i >= len(ts.nodes) || ts.nodes[i]!=addr {
 		temp := append(ts.nodes, "")
@@ -110,11 +149,32 @@ func (ts *stwServer) RegisterServer(args *stwrpc.RegisterArgs, reply *stwrpc.Reg
 		temp[i] = addr
 		ts.nodes = temp
 	}
-	if len(ts.nodes)>=ts.numNodes {
+}
+
+func (ts *stwServer) ready() bool {
+	ts.nodesLock.Lock()
+	defer ts.nodesLock.Unlock()
+	return len(ts.nodes)>=ts.numNodes
+}
+
+func (ts *stwServer) servers() []string {
+	ts.nodesLock.Lock()
+	defer ts.nodesLock.Unlock()
+	return append([]string{}, ts.nodes...)
+}
+
+
+func (ts *stwServer) RegisterServer(args *stwrpc.RegisterArgs, reply *stwrpc.RegisterReply) error {
+	ts.nodesLock.Lock()
+	ts.addNode(args.ServerInfo.HostPort)
+	ts.nodesLock.Unlock()
+	if ts.ready() {
 		reply.Status = stwrpc.OK
-		for _, h := range ts.nodes {
-			reply.Servers = append(reply.Servers, stwrpc.Node{h})
+		for _, h := range ts.servers() {
+			reply.Servers = append(reply.Servers, stwrpc.Node{HostPort: h})
 		}
+		// Late registrations, such as a restarted server, are watched too.
+		ts.fd.SetMembers(ts.servers())
 		return nil
 	} else {
 		reply.Status = stwrpc.NotReady
@@ -123,10 +183,10 @@ func (ts *stwServer) RegisterServer(args *stwrpc.RegisterArgs, reply *stwrpc.Reg
 }
 
 func (ts *stwServer) GetServers(args *stwrpc.GetServersArgs, reply *stwrpc.GetServersReply) error {
-	if len(ts.nodes)>=ts.numNodes {
+	if ts.ready() {
 		reply.Status = stwrpc.OK
-		for _, h := range ts.nodes {
-			reply.Servers = append(reply.Servers, stwrpc.Node{h})
+		for _, h := range ts.servers() {
+			reply.Servers = append(reply.Servers, stwrpc.Node{HostPort: h, Alive: ts.fd.Alive(h)})
 		}
 		return nil
 	} else {
@@ -135,86 +195,118 @@ func (ts *stwServer) GetServers(args *stwrpc.GetServersArgs, reply *stwrpc.GetSe
 	return nil
 }
 
+// fail sets *status for err, an error of the libstore: to status if err is
+// one of expected, and to Unavailable if the storage servers could not be
+// reached. Any other error, such as the end of the request's context, is
+// returned, failing the call.
+func fail(status *stwrpc.Status, err error, s stwrpc.Status, expected ...error) error {
+	for _, e := range expected {
+		if errors.Is(err, e) {
+			*status = s
+			return nil
+		}
+	}
+	if errors.Is(err, libstore.ErrUnavailable) {
+		*status = stwrpc.Unavailable
+		return nil
+	}
+	return err
+}
+
 func (ts *stwServer) CreateUser(args *stwrpc.CreateUserArgs, reply *stwrpc.CreateUserReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	key := util.FormatUserKey(args.UserID)
-	_, err := ts.storage.Get(key)
-	if err == nil {
-		reply.Status = stwrpc.Exists
-		return nil
+	_, err := ts.storage.PutIfAbsentContext(ctx, key, "")
+	if err != nil {
+		return fail(&reply.Status, err, stwrpc.Exists, libstore.ErrConflict)
 	}
-	ts.storage.Put(key, "")
 	reply.Status = stwrpc.OK
 	return nil
 }
 
 func (ts *stwServer) Subscribe(args *stwrpc.SubscriptionArgs, reply *stwrpc.SubscriptionReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	sKey := util.FormatUserKey(args.UserID)
 	tKey := util.FormatUserKey(args.TargetUserID)
 	slistKey := util.FormatSubListKey(args.UserID)
-	_, err := ts.storage.Get(sKey)
+	_, err := ts.storage.GetContext(ctx, sKey)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchUser, libstore.ErrKeyNotFound)
 	}
-	_, err = ts.storage.Get(tKey)
+	_, err = ts.storage.GetContext(ctx, tKey)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchTargetUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchTargetUser, libstore.ErrKeyNotFound)
 	}
-	err = ts.storage.AppendToList(slistKey, args.TargetUserID)
+	err = ts.storage.AppendToListContext(ctx, slistKey, args.TargetUserID)
 	if err!=nil {
-		reply.Status = stwrpc.Exists
-	} else {
-		reply.Status = stwrpc.OK
+		return fail(&reply.Status, err, stwrpc.Exists, libstore.ErrItemExists)
 	}
+	reply.Status = stwrpc.OK
 	return nil
 }
 
 func (ts *stwServer) Unsubscribe(args *stwrpc.SubscriptionArgs, reply *stwrpc.SubscriptionReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	sKey := util.FormatUserKey(args.UserID)
 	tKey := util.FormatUserKey(args.TargetUserID)
 	slistKey := util.FormatSubListKey(args.UserID)
-	_, err := ts.storage.Get(sKey)
+	_, err := ts.storage.GetContext(ctx, sKey)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchUser, libstore.ErrKeyNotFound)
 	}
-	_, err = ts.storage.Get(tKey)
+	_, err = ts.storage.GetContext(ctx, tKey)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchTargetUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchTargetUser, libstore.ErrKeyNotFound)
 	}
-	err = ts.storage.RemoveFromList(slistKey, args.TargetUserID)
+	err = ts.storage.RemoveFromListContext(ctx, slistKey, args.TargetUserID)
 	if err!=nil {
-		reply.Status = stwrpc.NoSuchTargetUser
-	} else {
-		reply.Status = stwrpc.OK
+		return fail(&reply.Status, err, stwrpc.NoSuchTargetUser, libstore.ErrKeyNotFound, libstore.ErrItemNotFound)
 	}
+	reply.Status = stwrpc.OK
 	return nil
 }
 
 func (ts *stwServer) Post(args *stwrpc.PostArgs, reply *stwrpc.PostReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	key := util.FormatUserKey(args.UserID)
-	_, err := ts.storage.Get(key)
+	_, err := ts.storage.GetContext(ctx, key)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchUser, libstore.ErrKeyNotFound)
 	}
 	userPostListKey := util.FormatPostListKey(args.UserID)
 	postkey := util.FormatPostKey(args.UserID, time.Now().UnixNano())
-	ts.storage.Put(postkey, args.Contents)
-	ts.storage.AppendToList(userPostListKey, postkey)
+	// The post and its entry in the post list appear together. Without
+	// transactions, the post is written first, so that the list never
+	// names a missing post.
+	err = ts.storage.TransactContext(ctx, []libstore.TxnOp{
+		{Type: libstore.TxnPut, Key: postkey, Value: args.Contents},
+		{Type: libstore.TxnAppend, Key: userPostListKey, Value: postkey},
+	})
+	if errors.Is(err, libstore.ErrTxnUnsupported) {
+		err = ts.storage.PutContext(ctx, postkey, args.Contents)
+		if err == nil {
+			err = ts.storage.AppendToListContext(ctx, userPostListKey, postkey)
+		}
+	}
+	if err != nil {
+		return fail(&reply.Status, err, stwrpc.Unavailable)
+	}
 	reply.Status = stwrpc.OK
 	reply.PostKey = postkey
 	return nil
 }
 
 func (ts *stwServer) DeletePost(args *stwrpc.DeletePostArgs, reply *stwrpc.DeletePostReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	key := util.FormatUserKey(args.UserID)
-	_, err := ts.storage.Get(key)
+	_, err := ts.storage.GetContext(ctx, key)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchUser, libstore.ErrKeyNotFound)
 	}
 	post_uid, _, err := util.ParsePostKey(args.PostKey)
 	if err!=nil || post_uid != args.UserID {
@@ -222,20 +314,47 @@ func (ts *stwServer) DeletePost(args *stwrpc.DeletePostArgs, reply *stwrpc.Delet
 		return nil
 	}
 	userPostListKey := util.FormatPostListKey(args.UserID)
-	err1 := ts.storage.RemoveFromList(userPostListKey, args.PostKey)
-	if err1!=nil {
-		reply.Status = stwrpc.NoSuchPost
-		return nil
+	err = ts.storage.TransactContext(ctx, []libstore.TxnOp{
+		{Type: libstore.TxnRemove, Key: userPostListKey, Value: args.PostKey},
+		{Type: libstore.TxnDelete, Key: args.PostKey},
+	})
+	if errors.Is(err, libstore.ErrTxnUnsupported) {
+		// The post leaves the list before it is deleted.
+		err = ts.storage.RemoveFromListContext(ctx, userPostListKey, args.PostKey)
+		if err == nil {
+			err = ts.storage.DeleteContext(ctx, args.PostKey)
+		}
 	}
-	err2 := ts.storage.Delete(args.PostKey)
-	if err2!=nil {
-		reply.Status = stwrpc.NoSuchPost
-		return nil
+	if err!=nil {
+		return fail(&reply.Status, err, stwrpc.NoSuchPost, libstore.ErrKeyNotFound, libstore.ErrItemNotFound)
 	}
 	reply.Status = stwrpc.OK
 	return nil
 }
 
+// newestPosts returns the keys of the 100 newest posts of users, newest
+// first. Only the newest 100 keys of each post list are read, with one
+// batch per storage server. A user who never posted has no post list.
+func (ts *stwServer) newestPosts(ctx context.Context, users []string) ([]string, error) {
+	listKeys := make([]string, len(users))
+	for i, user := range users {
+		listKeys[i] = util.FormatPostListKey(user)
+	}
+	lists, err := ts.storage.MultiGetListRangeContext(ctx, listKeys, 0, 100, true)
+	if err != nil {
+		return nil, err
+	}
+	pKeys := make([]string, 0)
+	for _, list := range lists {
+		pKeys = append(pKeys, list...)
+	}
+	sort.Sort(ByRevChronological(pKeys))
+	if len(pKeys) > 100 {
+		pKeys = pKeys[:100]
+	}
+	return pKeys, nil
+}
+
 type ByRevChronological []string
 
 func (a ByRevChronological) Len() int { return len(a) }
@@ -247,87 +366,70 @@ func (a ByRevChronological) Less(i, j int) bool {
 }
 
 func (ts *stwServer) Timeline(args *stwrpc.TimelineArgs, reply *stwrpc.TimelineReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	key := util.FormatUserKey(args.UserID)
-	_, err := ts.storage.Get(key)
+	_, err := ts.storage.GetContext(ctx, key)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchUser, libstore.ErrKeyNotFound)
 	}
 	userPostListKey := util.FormatPostListKey(args.UserID)
-	postlist, err := ts.storage.GetList(userPostListKey)
+	// Post keys sort in chronological order, so the newest posts end the list.
+	postlist, err := ts.storage.GetListRangeContext(ctx, userPostListKey, 0, 100, true)
 	if err != nil {
-		reply.Status = stwrpc.OK
-		return nil
+		// A user who never posted has no post list.
+		return fail(&reply.Status, err, stwrpc.OK, libstore.ErrKeyNotFound)
 	}
+	err = ts.getPosts(ctx, postlist, reply)
+	if err != nil {
+		return fail(&reply.Status, err, stwrpc.Unavailable)
+	}
+	reply.Status = stwrpc.OK
+	return nil
+}
 
-	sort.Sort(ByRevChronological(postlist))
-
-	limit := 100
-	for _, pKey := range postlist {
-		if limit <= 0 { break }
-		post, err := ts.storage.Get(pKey)
-		if err!=nil {
-			log.Println("Can't find Post "+pKey+" of user "+args.UserID)
-			return err
-		}
+// getPosts fetches the posts with the given keys in one batch and appends
+// them to reply in the same order.
+func (ts *stwServer) getPosts(ctx context.Context, pKeys []string, reply *stwrpc.TimelineReply) error {
+	posts, err := ts.storage.MultiGetContext(ctx, pKeys)
+	if err != nil {
+		return err
+	}
+	for _, pKey := range pKeys {
 		userID, unixTime, _ := util.ParsePostKey(pKey)
-
-		// if unixTime > old_time {
-		// 	log.Println("2 out of order:", old_key, pKey)
-		// 	_, t1 := util.ParsePostKey(old_key)
-		// 	_, t2 := util.ParsePostKey(pKey)
-		// 	log.Println(t1, t2)
-		// 	log.Println(t1 > t2)
-		// }
-		// old_time = unixTime
-		// old_key = pKey
-
+		post, ok := posts[pKey]
+		if !ok {
+			log.Println("Can't find Post "+pKey+" of user "+userID)
+			return errors.New("Key " + pKey + " not found")
+		}
 		reply.Posts = append(reply.Posts, stwrpc.Post{userID, strconv.FormatInt(unixTime, 16), post})
-		limit--
 	}
-	reply.Status = stwrpc.OK
 	return nil
 }
 
 func (ts *stwServer) HomeTimeline(args *stwrpc.TimelineArgs, reply *stwrpc.TimelineReply) error {
+	ctx, cancel := stwrpc.ContextOf(args.Timeout)
+	defer cancel()
 	key := util.FormatUserKey(args.UserID)
-	_, err := ts.storage.Get(key)
+	_, err := ts.storage.GetContext(ctx, key)
 	if err != nil {
-		reply.Status = stwrpc.NoSuchUser
-		return nil
+		return fail(&reply.Status, err, stwrpc.NoSuchUser, libstore.ErrKeyNotFound)
 	}
 	subListKey := util.FormatSubListKey(args.UserID)
-	slist, err := ts.storage.GetList(subListKey)
-	if err!=nil {
+	slist, err := ts.storage.GetListContext(ctx, subListKey)
+	if errors.Is(err, libstore.ErrKeyNotFound) {
 		slist = []string{}
+	} else if err != nil {
+		return fail(&reply.Status, err, stwrpc.Unavailable)
 	}
 	//slist = append(slist, args.UserID)
-	pKeys := make([]string, 0)
-	for _, t := range slist {
-		tPostListKey := util.FormatPostListKey(t)
-		postlist, err := ts.storage.GetList(tPostListKey)
-		if err != nil {
-			continue
-		}
-		limit := 100
-		if len(postlist) < limit {
-			limit = len(postlist)
-		}
-		sort.Sort(ByRevChronological(postlist))
-		pKeys = append(pKeys, postlist[:limit]...)
+	pKeys, err := ts.newestPosts(ctx, slist)
+	if err != nil {
+		return fail(&reply.Status, err, stwrpc.Unavailable)
 	}
-	sort.Sort(ByRevChronological(pKeys))
-	limit := 100
-	for _, pKey := range pKeys {
-		if limit <= 0 { break }
-		userID, unixTime, _ := util.ParsePostKey(pKey)
-		post, err := ts.storage.Get(pKey)
-		if err!=nil {
-			log.Println("Can't find Post "+pKey+" of user "+userID)
-			return err
-		}
-		reply.Posts = append(reply.Posts, stwrpc.Post{userID, strconv.FormatInt(unixTime, 16), post})
-		limit--
+	err = ts.getPosts(ctx, pKeys, reply)
+	if err != nil {
+		return fail(&reply.Status, err, stwrpc.Unavailable)
 	}
 	reply.Status = stwrpc.OK
 	return nil
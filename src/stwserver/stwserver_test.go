@@ -0,0 +1,164 @@
+package stwserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"libstore"
+	"rpc/stwrpc"
+)
+
+// newTestServer returns an app server keeping its data in a fresh fake
+// libstore, and the fake. The server has to be stopped.
+func newTestServer() (*stwServer, *libstore.FakeLibstore) {
+	ls := libstore.NewFakeLibstore()
+	return newStwServer("localhost:9010", 1, ls), ls
+}
+
+func createUser(ts *stwServer, user string) (stwrpc.Status, error) {
+	var reply stwrpc.CreateUserReply
+	err := ts.CreateUser(&stwrpc.CreateUserArgs{UserID: user}, &reply)
+	return reply.Status, err
+}
+
+func subscribe(ts *stwServer, user, target string) (stwrpc.Status, error) {
+	var reply stwrpc.SubscriptionReply
+	err := ts.Subscribe(&stwrpc.SubscriptionArgs{UserID: user, TargetUserID: target}, &reply)
+	return reply.Status, err
+}
+
+func post(ts *stwServer, user, contents string) (stwrpc.Status, error) {
+	var reply stwrpc.PostReply
+	err := ts.Post(&stwrpc.PostArgs{UserID: user, Contents: contents}, &reply)
+	return reply.Status, err
+}
+
+func timeline(ts *stwServer, user string) ([]stwrpc.Post, stwrpc.Status, error) {
+	var reply stwrpc.TimelineReply
+	err := ts.Timeline(&stwrpc.TimelineArgs{UserID: user}, &reply)
+	return reply.Posts, reply.Status, err
+}
+
+func homeTimeline(ts *stwServer, user string) ([]stwrpc.Post, stwrpc.Status, error) {
+	var reply stwrpc.TimelineReply
+	err := ts.HomeTimeline(&stwrpc.TimelineArgs{UserID: user}, &reply)
+	return reply.Posts, reply.Status, err
+}
+
+// checkStatus fails t unless a call returned status expected and no error.
+func checkStatus(t *testing.T, call string, status stwrpc.Status, err error, expected stwrpc.Status) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", call, err)
+	}
+	if status != expected {
+		t.Fatalf("%s: status %d, expected %d", call, status, expected)
+	}
+}
+
+// Test an app server keeping its data in the fake.
+func TestStwServer(t *testing.T) {
+	ts, _ := newTestServer()
+	defer ts.stop()
+	status, err := createUser(ts, "alice")
+	checkStatus(t, "CreateUser(alice)", status, err, stwrpc.OK)
+	createUser(ts, "bob")
+	status, err = createUser(ts, "alice")
+	checkStatus(t, "CreateUser(alice) again", status, err, stwrpc.Exists)
+	status, err = subscribe(ts, "alice", "nobody")
+	checkStatus(t, "Subscribe(alice, nobody)", status, err, stwrpc.NoSuchTargetUser)
+	status, err = subscribe(ts, "alice", "bob")
+	checkStatus(t, "Subscribe(alice, bob)", status, err, stwrpc.OK)
+	status, err = post(ts, "bob", "hello")
+	checkStatus(t, "Post(bob)", status, err, stwrpc.OK)
+
+	posts, status, err := homeTimeline(ts, "alice")
+	checkStatus(t, "HomeTimeline(alice)", status, err, stwrpc.OK)
+	if len(posts) != 1 || posts[0].UserID != "bob" || posts[0].Contents != "hello" {
+		t.Fatalf("HomeTimeline(alice) = %v, expected bob's post", posts)
+	}
+	_, status, err = timeline(ts, "nobody")
+	checkStatus(t, "Timeline(nobody)", status, err, stwrpc.NoSuchUser)
+}
+
+// Test that posts are deleted from the timeline along with their keys.
+func TestDeletePost(t *testing.T) {
+	ts, ls := newTestServer()
+	defer ts.stop()
+	createUser(ts, "alice")
+	var reply stwrpc.PostReply
+	if err := ts.Post(&stwrpc.PostArgs{UserID: "alice", Contents: "hello"}, &reply); err != nil {
+		t.Fatal("Post:", err)
+	}
+	var dreply stwrpc.DeletePostReply
+	err := ts.DeletePost(&stwrpc.DeletePostArgs{UserID: "alice", PostKey: reply.PostKey}, &dreply)
+	checkStatus(t, "DeletePost", dreply.Status, err, stwrpc.OK)
+	err = ts.DeletePost(&stwrpc.DeletePostArgs{UserID: "alice", PostKey: reply.PostKey}, &dreply)
+	checkStatus(t, "DeletePost again", dreply.Status, err, stwrpc.NoSuchPost)
+
+	posts, status, err := timeline(ts, "alice")
+	checkStatus(t, "Timeline(alice)", status, err, stwrpc.OK)
+	if len(posts) != 0 {
+		t.Fatalf("Timeline(alice) = %v after the post was deleted", posts)
+	}
+	if _, err := ls.Get(reply.PostKey); !errors.Is(err, libstore.ErrKeyNotFound) {
+		t.Fatalf("Get of the deleted post: error %v, expected ErrKeyNotFound", err)
+	}
+}
+
+// Test that faults injected into the fake reach the app server as the
+// Unavailable status, for the keys they are injected for only.
+func TestFaults(t *testing.T) {
+	ts, ls := newTestServer()
+	defer ts.stop()
+	createUser(ts, "alice")
+	createUser(ts, "bob")
+
+	ls.SetFault(libstore.Unavailable)
+	status, err := createUser(ts, "carol")
+	checkStatus(t, "CreateUser(carol)", status, err, stwrpc.Unavailable)
+
+	ls.SetFault(func(method, key string) error {
+		if strings.HasPrefix(key, "bob:") {
+			return libstore.Unavailable(method, key)
+		}
+		return nil
+	})
+	_, status, err = timeline(ts, "bob")
+	checkStatus(t, "Timeline(bob)", status, err, stwrpc.Unavailable)
+	_, status, err = timeline(ts, "alice")
+	checkStatus(t, "Timeline(alice)", status, err, stwrpc.OK)
+}
+
+// Test that the app server gives up on a slow fake at the deadline of a
+// request.
+func TestDelay(t *testing.T) {
+	ts, ls := newTestServer()
+	defer ts.stop()
+	createUser(ts, "alice")
+	ls.SetDelay(2 * time.Second)
+	start := time.Now()
+	args := &stwrpc.TimelineArgs{UserID: "alice", Timeout: 500 * time.Millisecond}
+	var reply stwrpc.TimelineReply
+	err := ts.Timeline(args, &reply)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Timeline: error %v, expected the deadline to pass", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("Timeline gave up after", elapsed)
+	}
+}
+
+// Test that two app servers can be built in one process.
+func TestTwoServers(t *testing.T) {
+	ts1, _ := newTestServer()
+	defer ts1.stop()
+	ts2, _ := newTestServer()
+	defer ts2.stop()
+	createUser(ts1, "alice")
+	status, err := createUser(ts2, "alice")
+	checkStatus(t, "CreateUser(alice) on the second server", status, err, stwrpc.OK)
+}
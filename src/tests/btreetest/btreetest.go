@@ -0,0 +1,347 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"btree"
+)
+
+type testFunc struct {
+	name string
+	f    func()
+}
+
+var (
+	testRegex = flag.String("t", "", "test to run")
+	seed      = flag.Int64("seed", 1, "seed for the random operations")
+	passCount int
+	failCount int
+	dir       string
+)
+
+var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
+
+// newTree creates a tree caching cacheNodes nodes in a fresh file.
+func newTree(name string, cacheNodes int) *btree.Tree {
+	t, err := btree.Create(filepath.Join(dir, name), cacheNodes)
+	if err != nil {
+		LOGE.Fatalln("Failed to create a tree:", err)
+	}
+	return t
+}
+
+func fail(format string, args ...interface{}) {
+	LOGE.Printf("FAIL: "+format, args...)
+	failCount++
+}
+
+// checkTree compares every key of t, in both directions, with want.
+func checkTree(t *btree.Tree, want map[string]string) bool {
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if t.Len() != len(keys) {
+		fail("tree holds %d keys, expected %d\n", t.Len(), len(keys))
+		return false
+	}
+	c := t.Seek("")
+	for _, key := range keys {
+		if !c.Valid() {
+			fail("iteration stopped before %q: %v\n", key, c.Err())
+			return false
+		} else if c.Key() != key || c.Value() != want[key] {
+			fail("iteration found %q, expected %q\n", c.Key(), key)
+			return false
+		}
+		c.Next()
+	}
+	if c.Valid() {
+		fail("iteration found extra key %q\n", c.Key())
+		return false
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		c.Prev()
+		if !c.Valid() || c.Key() != keys[i] {
+			fail("reverse iteration did not find %q: %v\n", keys[i], c.Err())
+			return false
+		}
+	}
+	if c.Prev(); c.Valid() {
+		fail("reverse iteration found extra key %q\n", c.Key())
+		return false
+	}
+	return true
+}
+
+// randomValue returns a value that is occasionally larger than a page.
+func randomValue(rnd *rand.Rand) string {
+	if rnd.Intn(50) == 0 {
+		return strings.Repeat("v", 4096+rnd.Intn(8192))
+	}
+	return strings.Repeat("v", rnd.Intn(200))
+}
+
+func testEmpty() {
+	t := newTree("empty", 0)
+	defer t.Close()
+	if _, ok, err := t.Get("key"); ok || err != nil {
+		fail("Get on an empty tree found a key: %v\n", err)
+		return
+	}
+	if found, err := t.Delete("key"); found || err != nil {
+		fail("Delete on an empty tree found a key: %v\n", err)
+		return
+	}
+	if !checkTree(t, map[string]string{}) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+func testPutGetDelete() {
+	t := newTree("putgetdelete", 0)
+	defer t.Close()
+	if added, err := t.Put("key", "value"); !added || err != nil {
+		fail("Put of a new key was not added: %v\n", err)
+		return
+	}
+	if added, err := t.Put("key", "other"); added || err != nil {
+		fail("Put of an existing key was added: %v\n", err)
+		return
+	}
+	if value, ok, err := t.Get("key"); !ok || err != nil || value != "other" {
+		fail("Get returned %q, %v, %v\n", value, ok, err)
+		return
+	}
+	if found, err := t.Delete("key"); !found || err != nil {
+		fail("Delete did not find the key: %v\n", err)
+		return
+	}
+	if _, ok, _ := t.Get("key"); ok {
+		fail("Get found a deleted key\n")
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// testRandom applies random puts and deletes to a tree whose cache is much
+// smaller than the tree, and checks it against a map along the way.
+func testRandom() {
+	rnd := rand.New(rand.NewSource(*seed))
+	t := newTree("random", 8)
+	defer t.Close()
+	want := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		key := "key:" + strconv.Itoa(rnd.Intn(5000))
+		if rnd.Intn(3) == 0 {
+			found, err := t.Delete(key)
+			_, ok := want[key]
+			if err != nil || found != ok {
+				fail("Delete(%q) returned %v, %v, expected %v\n", key, found, err, ok)
+				return
+			}
+			delete(want, key)
+		} else {
+			value := randomValue(rnd)
+			added, err := t.Put(key, value)
+			_, ok := want[key]
+			if err != nil || added == ok {
+				fail("Put(%q) returned %v, %v, expected %v\n", key, added, err, !ok)
+				return
+			}
+			want[key] = value
+		}
+		if i%5000 == 4999 && !checkTree(t, want) {
+			return
+		}
+	}
+	for key, value := range want {
+		if got, ok, err := t.Get(key); !ok || err != nil || got != value {
+			fail("Get(%q) returned a wrong value: %v\n", key, err)
+			return
+		}
+	}
+	// Empty the tree again.
+	for key := range want {
+		if found, err := t.Delete(key); !found || err != nil {
+			fail("Delete(%q) did not find the key: %v\n", key, err)
+			return
+		}
+		delete(want, key)
+	}
+	if !checkTree(t, want) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// testSeek checks that cursors start at the first key at or after the one
+// sought, and can move both ways from there.
+func testSeek() {
+	t := newTree("seek", 4)
+	defer t.Close()
+	var keys []string
+	for i := 0; i < 3000; i += 2 {
+		key := fmt.Sprintf("key:%05d", i)
+		keys = append(keys, key)
+		if _, err := t.Put(key, strings.Repeat("v", 100)); err != nil {
+			fail("Put failed: %v\n", err)
+			return
+		}
+	}
+	rnd := rand.New(rand.NewSource(*seed))
+	for n := 0; n < 500; n++ {
+		target := fmt.Sprintf("key:%05d", rnd.Intn(3100))
+		i := sort.SearchStrings(keys, target)
+		c := t.Seek(target)
+		if i == len(keys) {
+			if c.Valid() {
+				fail("Seek(%q) found %q past the last key\n", target, c.Key())
+				return
+			}
+			c.Prev()
+			if !c.Valid() || c.Key() != keys[len(keys)-1] {
+				fail("Prev past the last key did not find the last key\n")
+				return
+			}
+			continue
+		}
+		if !c.Valid() || c.Key() != keys[i] {
+			fail("Seek(%q) did not find %q\n", target, keys[i])
+			return
+		}
+		if i > 0 {
+			c.Prev()
+			if !c.Valid() || c.Key() != keys[i-1] {
+				fail("Prev after Seek(%q) did not find %q\n", target, keys[i-1])
+				return
+			}
+			c.Next()
+		}
+		if i+1 < len(keys) {
+			c.Next()
+			if !c.Valid() || c.Key() != keys[i+1] {
+				fail("Next after Seek(%q) did not find %q\n", target, keys[i+1])
+				return
+			}
+		}
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// testReopen checks that a reopened tree is the one of the last Sync, even
+// though the changes made after it were written to the file by evictions.
+func testReopen() {
+	rnd := rand.New(rand.NewSource(*seed))
+	path := filepath.Join(dir, "reopen")
+	t := newTree("reopen", 8)
+	want := make(map[string]string)
+	var synced map[string]string
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 3000; i++ {
+			key := "key:" + strconv.Itoa(rnd.Intn(2000))
+			if rnd.Intn(3) == 0 {
+				if _, err := t.Delete(key); err != nil {
+					fail("Delete failed: %v\n", err)
+					return
+				}
+				delete(want, key)
+			} else {
+				value := randomValue(rnd)
+				if _, err := t.Put(key, value); err != nil {
+					fail("Put failed: %v\n", err)
+					return
+				}
+				want[key] = value
+			}
+		}
+		if round == 3 {
+			break
+		}
+		if err := t.Sync("round " + strconv.Itoa(round)); err != nil {
+			fail("Sync failed: %v\n", err)
+			return
+		}
+		synced = make(map[string]string, len(want))
+		for key, value := range want {
+			synced[key] = value
+		}
+	}
+	t.Close()
+	t, err := btree.Open(path, 8)
+	if err != nil {
+		fail("Open failed: %v\n", err)
+		return
+	}
+	defer func() { t.Close() }()
+	if t.Meta() != "round 2" {
+		fail("Open found meta %q, expected %q\n", t.Meta(), "round 2")
+		return
+	}
+	if !checkTree(t, synced) {
+		return
+	}
+	// The reopened tree must take changes and survive another Sync.
+	if _, err := t.Put("key:new", "value"); err != nil {
+		fail("Put on a reopened tree failed: %v\n", err)
+		return
+	}
+	synced["key:new"] = "value"
+	if err := t.Sync("round 3"); err != nil {
+		fail("Sync of a reopened tree failed: %v\n", err)
+		return
+	}
+	t.Close()
+	if t, err = btree.Open(path, 8); err != nil {
+		fail("Open failed: %v\n", err)
+		return
+	}
+	if !checkTree(t, synced) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+func main() {
+	tests := []testFunc{
+		{"testEmpty", testEmpty},
+		{"testPutGetDelete", testPutGetDelete},
+		{"testRandom", testRandom},
+		{"testSeek", testSeek},
+		{"testReopen", testReopen},
+	}
+
+	flag.Parse()
+	var err error
+	dir, err = ioutil.TempDir("", "btreetest")
+	if err != nil {
+		LOGE.Fatalln("Failed to create a temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, t := range tests {
+		if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+			fmt.Printf("Running %s:\n", t.name)
+			t.f()
+		}
+	}
+
+	fmt.Printf("Passed (%d/%d) tests\n", passCount, passCount+failCount)
+}
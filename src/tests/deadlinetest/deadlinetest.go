@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"libstore"
+	"rpc/stwrpc"
+	"stwclient"
+	"stwserver"
+)
+
+type testFunc struct {
+	name string
+	f    func()
+}
+
+var (
+	port       = flag.Int("port", 9010, "StwServer port number")
+	storagePid = flag.Int("storagepid", 0, "process ID of the storage server, which the tests stop and continue")
+	passCount  int
+	failCount  int
+	ls         libstore.Libstore
+	ts         stwserver.StwServer
+	cli        stwclient.StwClient
+)
+
+var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
+
+// freeze stops the storage server, which keeps accepting calls without
+// answering them, and thaw lets it go on. The signal takes a moment to stop
+// every thread of the server, so freeze waits before returning.
+func freeze() {
+	syscall.Kill(*storagePid, syscall.SIGSTOP)
+	time.Sleep(200 * time.Millisecond)
+}
+
+func thaw() {
+	syscall.Kill(*storagePid, syscall.SIGCONT)
+}
+
+// Check that err is context.DeadlineExceeded, returned no later than limit
+// after start
+func checkDeadline(err error, start time.Time, limit time.Duration) bool {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		LOGE.Println("FAIL: error", err, "instead of the deadline passing")
+		failCount++
+		return true
+	}
+	if elapsed := time.Since(start); elapsed > limit {
+		LOGE.Println("FAIL: gave up after", elapsed, "instead of", limit)
+		failCount++
+		return true
+	}
+	return false
+}
+
+func pass() {
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Test that a libstore read from a storage server that does not answer gives
+// up at the deadline of its context, though calls are not bounded otherwise.
+func testLibstoreDeadline() {
+	freeze()
+	defer thaw()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := ls.GetContext(ctx, "alice:usrid")
+	if checkDeadline(err, start, 2*time.Second) {
+		return
+	}
+	pass()
+}
+
+// Test that a storage server refuses a write that reaches it after its
+// deadline.
+func testLateWriteRefused() {
+	freeze()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := ls.PutContext(ctx, "late:key", "value")
+	late := checkDeadline(err, start, 1500*time.Millisecond)
+	time.Sleep(time.Second)
+	thaw()
+	if late {
+		return
+	}
+	// Let the storage server handle the write it has been sent.
+	time.Sleep(time.Second)
+	_, err = ls.Get("late:key")
+	if !errors.Is(err, libstore.ErrKeyNotFound) {
+		LOGE.Println("FAIL: the late write took place:", err)
+		failCount++
+		return
+	}
+	pass()
+}
+
+// Test that the app server gives up on a request at the deadline it
+// carries, and that a client gives up at the deadline of its context.
+func testStwDeadline() {
+	if status, err := cli.CreateUser("bob"); err != nil || status != stwrpc.OK {
+		LOGE.Println("FAIL: could not create user:", status, err)
+		failCount++
+		return
+	}
+	freeze()
+	defer thaw()
+	start := time.Now()
+	args := &stwrpc.TimelineArgs{UserID: "carol", Timeout: time.Second}
+	var reply stwrpc.TimelineReply
+	err := ts.Timeline(args, &reply)
+	if checkDeadline(err, start, 2*time.Second) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start = time.Now()
+	_, _, err = cli.HomeTimelineContext(ctx, "bob")
+	if checkDeadline(err, start, 2*time.Second) {
+		return
+	}
+	pass()
+}
+
+// Test that the app server refuses a request whose deadline has passed,
+// without carrying it out.
+func testExpiredRequest() {
+	args := &stwrpc.PostArgs{UserID: "bob", Contents: "too late", Timeout: -1}
+	var reply stwrpc.PostReply
+	err := ts.Post(args, &reply)
+	if checkDeadline(err, time.Now(), time.Second) {
+		return
+	}
+	posts, status, err := cli.Timeline("bob")
+	if err != nil || status != stwrpc.OK || len(posts) != 0 {
+		LOGE.Println("FAIL: the expired post took place:", posts, status, err)
+		failCount++
+		return
+	}
+	pass()
+}
+
+func main() {
+	tests := []testFunc{
+		{"testLibstoreDeadline", testLibstoreDeadline},
+		{"testLateWriteRefused", testLateWriteRefused},
+		{"testStwDeadline", testStwDeadline},
+		{"testExpiredRequest", testExpiredRequest},
+	}
+
+	flag.Parse()
+	if flag.NArg() < 1 || *storagePid == 0 {
+		LOGE.Fatal("Usage: deadlinetest -storagepid=<pid> <storage master host:port>")
+	}
+	master := flag.Arg(0)
+
+	var err error
+	ls, err = libstore.NewLibstoreWithConfig(master, "", libstore.Never, libstore.Config{CallTimeout: -1})
+	if err != nil {
+		LOGE.Fatalln("Failed to create Libstore:", err)
+	}
+	ts, err = stwserver.NewStwServer(net.JoinHostPort("localhost", strconv.Itoa(*port)), "", master, 1)
+	if err != nil {
+		LOGE.Fatalln("Failed to create StwServer:", err)
+	}
+	cli, err = stwclient.NewStwClient("localhost", *port)
+	if err != nil {
+		LOGE.Fatalln("Failed to create StwClient:", err)
+	}
+
+	for _, t := range tests {
+		fmt.Printf("Running %s:\n", t.name)
+		t.f()
+	}
+
+	fmt.Printf("Passed (%d/%d) tests\n", passCount, passCount+failCount)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"libstore"
+	"rpc/stwrpc"
+	"stwserver"
+)
+
+type testFunc struct {
+	name string
+	f    func()
+}
+
+var (
+	port      = flag.Int("port", 9010, "StwServer port number")
+	passCount int
+	failCount int
+	ls        libstore.Libstore
+	ts        stwserver.StwServer
+	master    string
+)
+
+var statusMap = map[stwrpc.Status]string{
+	stwrpc.OK:               "OK",
+	stwrpc.NoSuchUser:       "NoSuchUser",
+	stwrpc.NoSuchPost:       "NoSuchPost",
+	stwrpc.NoSuchTargetUser: "NoSuchTargetUser",
+	stwrpc.Exists:           "Exists",
+	stwrpc.Unavailable:      "Unavailable",
+	0:                       "Unknown",
+}
+
+var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
+
+// Check that err is of the kind target
+func checkErrorIs(err, target error) bool {
+	if !errors.Is(err, target) {
+		LOGE.Printf("FAIL: error %v, expected an error that is %q\n", err, target)
+		failCount++
+		return true
+	}
+	return false
+}
+
+// Check error and status
+func checkErrorStatus(err error, status, expectedStatus stwrpc.Status) bool {
+	if err != nil {
+		LOGE.Println("FAIL: unexpected error returned:", err)
+		failCount++
+		return true
+	}
+	if status != expectedStatus {
+		LOGE.Printf("FAIL: incorrect status %s, expected status %s\n", statusMap[status], statusMap[expectedStatus])
+		failCount++
+		return true
+	}
+	return false
+}
+
+func pass() {
+	fmt.Println("PASS")
+	passCount++
+}
+
+func createUser(user string) (error, stwrpc.Status) {
+	args := &stwrpc.CreateUserArgs{UserID: user}
+	var reply stwrpc.CreateUserReply
+	err := ts.CreateUser(args, &reply)
+	return err, reply.Status
+}
+
+func subscribe(user, target string) (error, stwrpc.Status) {
+	args := &stwrpc.SubscriptionArgs{UserID: user, TargetUserID: target}
+	var reply stwrpc.SubscriptionReply
+	err := ts.Subscribe(args, &reply)
+	return err, reply.Status
+}
+
+func unsubscribe(user, target string) (error, stwrpc.Status) {
+	args := &stwrpc.SubscriptionArgs{UserID: user, TargetUserID: target}
+	var reply stwrpc.SubscriptionReply
+	err := ts.Unsubscribe(args, &reply)
+	return err, reply.Status
+}
+
+func post(user, contents string) (error, stwrpc.Status) {
+	args := &stwrpc.PostArgs{UserID: user, Contents: contents}
+	var reply stwrpc.PostReply
+	err := ts.Post(args, &reply)
+	return err, reply.Status
+}
+
+func timeline(user string) (error, stwrpc.Status) {
+	args := &stwrpc.TimelineArgs{UserID: user}
+	var reply stwrpc.TimelineReply
+	err := ts.Timeline(args, &reply)
+	return err, reply.Status
+}
+
+func homeTimeline(user string) (error, stwrpc.Status) {
+	args := &stwrpc.TimelineArgs{UserID: user}
+	var reply stwrpc.TimelineReply
+	err := ts.HomeTimeline(args, &reply)
+	return err, reply.Status
+}
+
+// Test that the libstore errors of missing or present keys and items are
+// told apart with errors.Is, and keep their messages.
+func testLibstoreErrors() {
+	_, err := ls.Get("nobody:usrid")
+	if checkErrorIs(err, libstore.ErrKeyNotFound) {
+		return
+	}
+	if err.Error() != "Key nobody:usrid not found" {
+		LOGE.Println("FAIL: incorrect error message:", err)
+		failCount++
+		return
+	}
+	if err = ls.AppendToList("carol:sublist", "dave"); err != nil {
+		LOGE.Println("FAIL: unexpected error returned:", err)
+		failCount++
+		return
+	}
+	err = ls.AppendToList("carol:sublist", "dave")
+	if checkErrorIs(err, libstore.ErrItemExists) {
+		return
+	}
+	err = ls.RemoveFromList("carol:sublist", "erin")
+	if checkErrorIs(err, libstore.ErrItemNotFound) {
+		return
+	}
+	if errors.Is(err, libstore.ErrUnavailable) || errors.Is(err, libstore.ErrKeyNotFound) {
+		LOGE.Println("FAIL: error of more than one kind:", err)
+		failCount++
+		return
+	}
+	pass()
+}
+
+// Test the statuses of the app server when the storage servers answer.
+func testStatuses() {
+	createUser("alice")
+	createUser("bob")
+	if err, status := createUser("alice"); checkErrorStatus(err, status, stwrpc.Exists) {
+		return
+	}
+	if err, status := subscribe("nobody", "bob"); checkErrorStatus(err, status, stwrpc.NoSuchUser) {
+		return
+	}
+	if err, status := subscribe("alice", "nobody"); checkErrorStatus(err, status, stwrpc.NoSuchTargetUser) {
+		return
+	}
+	subscribe("alice", "bob")
+	if err, status := subscribe("alice", "bob"); checkErrorStatus(err, status, stwrpc.Exists) {
+		return
+	}
+	unsubscribe("alice", "bob")
+	if err, status := unsubscribe("alice", "bob"); checkErrorStatus(err, status, stwrpc.NoSuchTargetUser) {
+		return
+	}
+	if err, status := timeline("bob"); checkErrorStatus(err, status, stwrpc.OK) {
+		return
+	}
+	if err, status := timeline("nobody"); checkErrorStatus(err, status, stwrpc.NoSuchUser) {
+		return
+	}
+	pass()
+}
+
+// waitStorageDown waits until the storage master no longer accepts
+// connections.
+func waitStorageDown() bool {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", master)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		time.Sleep(200 * time.Millisecond)
+	}
+	LOGE.Println("FAIL: the storage server was not stopped")
+	failCount++
+	return false
+}
+
+// Test that the libstore fails with ErrUnavailable once the storage server
+// is down, rather than with an error of a missing key.
+func testLibstoreUnavailable() {
+	if !waitStorageDown() {
+		return
+	}
+	_, err := ls.Get("nobody:usrid")
+	if checkErrorIs(err, libstore.ErrUnavailable) {
+		return
+	}
+	var unavailable *libstore.UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Key != "nobody:usrid" {
+		LOGE.Println("FAIL: error does not name the key:", err)
+		failCount++
+		return
+	}
+	if errors.Is(err, libstore.ErrKeyNotFound) {
+		LOGE.Println("FAIL: unavailable error taken for a missing key:", err)
+		failCount++
+		return
+	}
+	err = ls.Put("carol:usrid", "")
+	if checkErrorIs(err, libstore.ErrUnavailable) {
+		return
+	}
+	pass()
+}
+
+// Test that the app server replies Unavailable, instead of NoSuchUser and
+// the like, once the storage server is down.
+func testStatusUnavailable() {
+	if !waitStorageDown() {
+		return
+	}
+	if err, status := createUser("frank"); checkErrorStatus(err, status, stwrpc.Unavailable) {
+		return
+	}
+	if err, status := subscribe("nobody", "bob"); checkErrorStatus(err, status, stwrpc.Unavailable) {
+		return
+	}
+	if err, status := post("alice", "hello"); checkErrorStatus(err, status, stwrpc.Unavailable) {
+		return
+	}
+	if err, status := timeline("nobody"); checkErrorStatus(err, status, stwrpc.Unavailable) {
+		return
+	}
+	if err, status := homeTimeline("alice"); checkErrorStatus(err, status, stwrpc.Unavailable) {
+		return
+	}
+	pass()
+}
+
+func main() {
+	up := []testFunc{
+		{"testLibstoreErrors", testLibstoreErrors},
+		{"testStatuses", testStatuses},
+	}
+	down := []testFunc{
+		{"testLibstoreUnavailable", testLibstoreUnavailable},
+		{"testStatusUnavailable", testStatusUnavailable},
+	}
+
+	flag.Parse()
+	if flag.NArg() < 1 {
+		LOGE.Fatal("Usage: errortest <storage master host:port>")
+	}
+	master = flag.Arg(0)
+
+	var err error
+	ls, err = libstore.NewLibstore(master, "", libstore.Never)
+	if err != nil {
+		LOGE.Fatalln("Failed to create Libstore:", err)
+	}
+	ts, err = stwserver.NewStwServer(net.JoinHostPort("localhost", strconv.Itoa(*port)), "", master, 1)
+	if err != nil {
+		LOGE.Fatalln("Failed to create StwServer:", err)
+	}
+
+	for _, t := range up {
+		fmt.Printf("Running %s:\n", t.name)
+		t.f()
+	}
+	// Tell the test script to stop the storage server.
+	fmt.Println("Storage server may stop")
+	for _, t := range down {
+		fmt.Printf("Running %s:\n", t.name)
+		t.f()
+	}
+
+	fmt.Printf("Passed (%d/%d) tests\n", passCount, passCount+failCount)
+}
@@ -1078,6 +1078,168 @@ func testRevokeGetListUpdate() {
 	passCount++
 }
 
+// Handle multiget error
+func testMultiGetError() {
+	pc.Reset()
+	pc.OverrideErr()
+	defer pc.OverrideOff()
+	_, err := ls.MultiGet([]string{"multigeterror:1", "multigeterror:2"})
+	if checkError(err, true) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid multiget with a single batched RPC
+func testMultiGetValid() {
+	keys := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("multiget%d:1", i)
+		ls.Put(key, fmt.Sprintf("value%d", i))
+		keys = append(keys, key)
+	}
+	pc.Reset()
+	values, err := ls.MultiGet(append(keys, "multigetmissing:1"))
+	if checkError(err, false) {
+		return
+	}
+	if len(values) != len(keys) {
+		LOGE.Println("FAIL: got wrong number of values")
+		failCount++
+		return
+	}
+	for i, key := range keys {
+		if values[key] != fmt.Sprintf("value%d", i) {
+			LOGE.Println("FAIL: got wrong value")
+			failCount++
+			return
+		}
+	}
+	if checkLimits(1, 300) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle valid multigetlist with a single batched RPC
+func testMultiGetListValid() {
+	ls.AppendToList("multigetlist:1", "value1")
+	ls.AppendToList("multigetlist:1", "value2")
+	ls.AppendToList("multigetlist:2", "value3")
+	pc.Reset()
+	lists, err := ls.MultiGetList([]string{"multigetlist:1", "multigetlist:2", "multigetlist:3"})
+	if checkError(err, false) {
+		return
+	}
+	if len(lists) != 2 || len(lists["multigetlist:1"]) != 2 || len(lists["multigetlist:2"]) != 1 ||
+		lists["multigetlist:1"][1] != "value2" || lists["multigetlist:2"][0] != "value3" {
+		LOGE.Println("FAIL: got wrong lists")
+		failCount++
+		return
+	}
+	if checkLimits(1, 100) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Handle ranged list reads that transfer only the items asked for
+func testGetListRangeValid() {
+	for i := 0; i < 50; i++ {
+		ls.AppendToList("listrange:1", fmt.Sprintf("item%02d", i))
+	}
+	pc.Reset()
+	items, err := ls.GetListRange("listrange:1", 0, 5, true)
+	if checkError(err, false) {
+		return
+	}
+	if len(items) != 5 || items[0] != "item49" || items[4] != "item45" {
+		LOGE.Println("FAIL: got wrong items from the end of the list")
+		failCount++
+		return
+	}
+	if checkLimits(1, 50) {
+		return
+	}
+	items, err = ls.GetListRange("listrange:1", 48, 5, false)
+	if checkError(err, false) {
+		return
+	}
+	if len(items) != 2 || items[0] != "item48" || items[1] != "item49" {
+		LOGE.Println("FAIL: got wrong items from the middle of the list")
+		failCount++
+		return
+	}
+	_, err = ls.GetListRange("listrange:missing", 0, 5, false)
+	if checkError(err, true) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Ranged list reads of a cached list are answered from the cache
+func testCacheGetListRange() {
+	forceCacheGetList("keycachelistrange:1", "item1")
+	ls.AppendToList("keycachelistrange:1", "item2")
+	forceCacheGetList("keycachelistrange:1", "item3")
+	pc.Reset()
+	items, err := ls.GetListRange("keycachelistrange:1", 1, 2, true)
+	if checkError(err, false) {
+		return
+	}
+	if len(items) != 2 || items[0] != "item2" || items[1] != "item1" {
+		LOGE.Println("FAIL: got wrong items from the cache")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not contact server when using cache")
+		failCount++
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// Multiget answers cached keys from the cache
+func testCacheMultiGet() {
+	forceCacheGet("keycachemultiget:1", "cached")
+	ls.Put("keycachemultiget:2", "fetched")
+	pc.Reset()
+	values, err := ls.MultiGet([]string{"keycachemultiget:1"})
+	if checkError(err, false) {
+		return
+	}
+	if values["keycachemultiget:1"] != "cached" {
+		LOGE.Println("FAIL: got wrong value from cache")
+		failCount++
+		return
+	}
+	if pc.GetRpcCount() > 0 {
+		LOGE.Println("FAIL: should not contact server when using cache")
+		failCount++
+		return
+	}
+	values, err = ls.MultiGet([]string{"keycachemultiget:1", "keycachemultiget:2"})
+	if checkError(err, false) {
+		return
+	}
+	if values["keycachemultiget:1"] != "cached" || values["keycachemultiget:2"] != "fetched" {
+		LOGE.Println("FAIL: got wrong value")
+		failCount++
+		return
+	}
+	if checkLimits(1, 50) {
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
 func main() {
 	initTests := []testFunc{
 		{"testNonexistentServer", testNonexistentServer},
@@ -1123,6 +1285,12 @@ func main() {
 		{"testRevokeGetListValid", testRevokeGetListValid},
 		{"testRevokeGetListNonexistent", testRevokeGetListNonexistent},
 		{"testRevokeGetListUpdate", testRevokeGetListUpdate},
+		{"testMultiGetError", testMultiGetError},
+		{"testMultiGetValid", testMultiGetValid},
+		{"testMultiGetListValid", testMultiGetListValid},
+		{"testCacheMultiGet", testCacheMultiGet},
+		{"testGetListRangeValid", testGetListRangeValid},
+		{"testCacheGetListRange", testCacheGetListRange},
 	}
 
 	flag.Parse()
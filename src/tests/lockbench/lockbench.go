@@ -0,0 +1,158 @@
+// lockbench measures how read and write throughput scales with the number of
+// goroutines issuing them. It starts a storage server in this process and
+// drives it directly, without RPC, so that the figures reflect its locking
+// rather than the network; it then does the same with a libstore whose
+// reads are all answered from its lease cache.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"libstore"
+	"rpc/storagerpc"
+	"storageserver"
+)
+
+var (
+	portnum    = flag.Int("port", 9019, "port # of the storage server started by the benchmark")
+	numKeys    = flag.Int("keys", 1000, "number of keys read and written")
+	writes     = flag.Int("writes", 10, "percentage of storage server operations that are writes")
+	duration   = flag.Duration("d", 2*time.Second, "how long each run lasts")
+	goroutines = flag.String("g", "1,2,4,8,16,32", "comma-separated goroutine counts to run with")
+)
+
+var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
+
+// op performs one operation on behalf of a goroutine, using rnd to pick it.
+type op func(rnd *rand.Rand) error
+
+// run calls f from n goroutines for the given duration and returns the
+// number of operations completed per second.
+func run(n int, f op) (float64, error) {
+	var ops int64
+	var failure atomic.Value
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for done := int64(0); ; done++ {
+				select {
+				case <-stop:
+					atomic.AddInt64(&ops, done)
+					return
+				default:
+				}
+				if err := f(rnd); err != nil {
+					failure.Store(err)
+					atomic.AddInt64(&ops, done)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	start := time.Now()
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+	if err, ok := failure.Load().(error); ok {
+		return 0, err
+	}
+	return float64(ops) / time.Since(start).Seconds(), nil
+}
+
+// bench runs f with every goroutine count and prints the throughput of each
+// run next to its speedup over the first.
+func bench(name string, counts []int, f op) {
+	fmt.Printf("%s:\n", name)
+	var base float64
+	for _, n := range counts {
+		rate, err := run(n, f)
+		if err != nil {
+			LOGE.Fatalf("FAIL: %s with %d goroutines: %v\n", name, n, err)
+		}
+		if base == 0 {
+			base = rate
+		}
+		fmt.Printf("  %3d goroutines %12.0f ops/s  x%.2f\n", n, rate, rate/base)
+	}
+}
+
+func key(rnd *rand.Rand) string {
+	return "bench:" + strconv.Itoa(rnd.Intn(*numKeys))
+}
+
+func main() {
+	flag.Parse()
+	var counts []int
+	for _, s := range strings.Split(*goroutines, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			LOGE.Fatalln("FAIL: invalid goroutine count", s)
+		}
+		counts = append(counts, n)
+	}
+
+	ss, err := storageserver.NewStorageServer("", 1, *portnum, 0)
+	if err != nil {
+		LOGE.Fatalln("FAIL: failed to start the storage server:", err)
+	}
+	for i := 0; i < *numKeys; i++ {
+		args := &storagerpc.PutArgs{Key: "bench:" + strconv.Itoa(i), Value: "value"}
+		if err := ss.Put(args, &storagerpc.PutReply{}); err != nil {
+			LOGE.Fatalln("FAIL: Put failed:", err)
+		}
+	}
+
+	bench(fmt.Sprintf("storage server, %d%% writes", *writes), counts, func(rnd *rand.Rand) error {
+		k := key(rnd)
+		if rnd.Intn(100) < *writes {
+			reply := &storagerpc.PutReply{}
+			if err := ss.Put(&storagerpc.PutArgs{Key: k, Value: "value"}, reply); err != nil {
+				return err
+			} else if reply.Status != storagerpc.OK {
+				return fmt.Errorf("Put of %s replied with status %d", k, reply.Status)
+			}
+			return nil
+		}
+		reply := &storagerpc.GetReply{}
+		if err := ss.Get(&storagerpc.GetArgs{Key: k}, reply); err != nil {
+			return err
+		} else if reply.Status != storagerpc.OK {
+			return fmt.Errorf("Get of %s replied with status %d", k, reply.Status)
+		}
+		return nil
+	})
+
+	// The libstore registers for lease revocations on the storage server's
+	// HTTP handler, which serves this whole process.
+	hostport := fmt.Sprintf("localhost:%d", *portnum)
+	ls, err := libstore.NewLibstore(hostport, hostport, libstore.Normal)
+	if err != nil {
+		LOGE.Fatalln("FAIL: failed to create the libstore:", err)
+	}
+	// Read every key often enough for the libstore to lease and cache it.
+	for i := 0; i < *numKeys; i++ {
+		for j := 0; j <= storagerpc.QueryCacheThresh; j++ {
+			if _, err := ls.Get("bench:" + strconv.Itoa(i)); err != nil {
+				LOGE.Fatalln("FAIL: Get failed:", err)
+			}
+		}
+	}
+
+	bench("libstore, cached reads", counts, func(rnd *rand.Rand) error {
+		_, err := ls.Get(key(rnd))
+		return err
+	})
+}
@@ -125,6 +125,18 @@ func (pc *proxyCounter) GetServers(args *storagerpc.GetServersArgs, reply *stora
 	return err
 }
 
+func (pc *proxyCounter) UnregisterServer(args *storagerpc.UnregisterArgs, reply *storagerpc.UnregisterReply) error {
+	return pc.srv.Call("StorageServer.UnregisterServer", args, reply)
+}
+
+func (pc *proxyCounter) UpdateRing(args *storagerpc.UpdateRingArgs, reply *storagerpc.UpdateRingReply) error {
+	return pc.srv.Call("StorageServer.UpdateRing", args, reply)
+}
+
+func (pc *proxyCounter) Migrate(args *storagerpc.MigrateArgs, reply *storagerpc.MigrateReply) error {
+	return pc.srv.Call("StorageServer.Migrate", args, reply)
+}
+
 func (pc *proxyCounter) Get(args *storagerpc.GetArgs, reply *storagerpc.GetReply) error {
 	if pc.override {
 		reply.Status = pc.overrideStatus
@@ -224,3 +236,249 @@ func (pc *proxyCounter) RemoveFromList(args *storagerpc.PutArgs, reply *storager
 	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
 	return err
 }
+
+func (pc *proxyCounter) Replicate(args *storagerpc.ReplicateArgs, reply *storagerpc.ReplicateReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Mutation.Key) + len(args.Mutation.Value)
+	err := pc.srv.Call("StorageServer.Replicate", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) RequestVote(args *storagerpc.RequestVoteArgs, reply *storagerpc.RequestVoteReply) error {
+	return pc.srv.Call("StorageServer.RequestVote", args, reply)
+}
+
+func (pc *proxyCounter) AppendEntries(args *storagerpc.AppendEntriesArgs, reply *storagerpc.AppendEntriesReply) error {
+	return pc.srv.Call("StorageServer.AppendEntries", args, reply)
+}
+
+func (pc *proxyCounter) InstallSnapshot(args *storagerpc.InstallSnapshotArgs, reply *storagerpc.InstallSnapshotReply) error {
+	return pc.srv.Call("StorageServer.InstallSnapshot", args, reply)
+}
+
+func (pc *proxyCounter) ConditionalPut(args *storagerpc.ConditionalPutArgs, reply *storagerpc.PutReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key) + len(args.Value)
+	err := pc.srv.Call("StorageServer.ConditionalPut", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) PutIfAbsent(args *storagerpc.PutArgs, reply *storagerpc.PutReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key) + len(args.Value)
+	err := pc.srv.Call("StorageServer.PutIfAbsent", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) CompareAndSwap(args *storagerpc.CompareAndSwapArgs, reply *storagerpc.PutReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key) + len(args.OldValue) + len(args.NewValue)
+	err := pc.srv.Call("StorageServer.CompareAndSwap", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) GetListRange(args *storagerpc.GetListRangeArgs, reply *storagerpc.GetListReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Key)
+	err := pc.srv.Call("StorageServer.GetListRange", args, reply)
+	for _, s := range reply.Value {
+		byteCount += len(s)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) MultiGet(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetReply) error {
+	if pc.override {
+		reply.Replies = make([]storagerpc.GetReply, len(args.Keys))
+		for i := range reply.Replies {
+			reply.Replies[i].Status = pc.overrideStatus
+		}
+		return pc.overrideErr
+	}
+	byteCount := pc.multiGetArgs(args)
+	err := pc.srv.Call("StorageServer.MultiGet", args, reply)
+	for i := range reply.Replies {
+		byteCount += len(reply.Replies[i].Value)
+		pc.leaseGranted(&reply.Replies[i].Lease)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) MultiGetList(args *storagerpc.MultiGetArgs, reply *storagerpc.MultiGetListReply) error {
+	if pc.override {
+		reply.Replies = make([]storagerpc.GetListReply, len(args.Keys))
+		for i := range reply.Replies {
+			reply.Replies[i].Status = pc.overrideStatus
+		}
+		return pc.overrideErr
+	}
+	byteCount := pc.multiGetArgs(args)
+	err := pc.srv.Call("StorageServer.MultiGetList", args, reply)
+	for i := range reply.Replies {
+		for _, s := range reply.Replies[i].Value {
+			byteCount += len(s)
+		}
+		pc.leaseGranted(&reply.Replies[i].Lease)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) MultiGetListRange(args *storagerpc.MultiGetListRangeArgs, reply *storagerpc.MultiGetListReply) error {
+	if pc.override {
+		reply.Replies = make([]storagerpc.GetListReply, len(args.Keys))
+		for i := range reply.Replies {
+			reply.Replies[i].Status = pc.overrideStatus
+		}
+		return pc.overrideErr
+	}
+	byteCount := 0
+	for _, key := range args.Keys {
+		byteCount += len(key)
+	}
+	err := pc.srv.Call("StorageServer.MultiGetListRange", args, reply)
+	for i := range reply.Replies {
+		for _, s := range reply.Replies[i].Value {
+			byteCount += len(s)
+		}
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+// multiGetArgs counts the lease requests of a batched get, dropping them if
+// leases are disabled, and returns the number of bytes of its keys.
+func (pc *proxyCounter) multiGetArgs(args *storagerpc.MultiGetArgs) int {
+	byteCount := 0
+	for i, key := range args.Keys {
+		byteCount += len(key)
+		if i < len(args.WantLease) && args.WantLease[i] {
+			atomic.AddUint32(&pc.leaseRequestCount, 1)
+			if pc.disableLease {
+				args.WantLease[i] = false
+			}
+		}
+	}
+	return byteCount
+}
+
+// leaseGranted counts a granted lease, overriding its duration if asked to.
+func (pc *proxyCounter) leaseGranted(lease *storagerpc.Lease) {
+	if lease.Granted {
+		if pc.overrideLeaseSeconds > 0 {
+			lease.ValidSeconds = pc.overrideLeaseSeconds
+		}
+		atomic.AddUint32(&pc.leaseGrantedCount, 1)
+	}
+}
+
+func (pc *proxyCounter) Scan(args *storagerpc.ScanArgs, reply *storagerpc.ScanReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Prefix) + len(args.StartAfter)
+	err := pc.srv.Call("StorageServer.Scan", args, reply)
+	for _, key := range reply.Keys {
+		byteCount += len(key)
+	}
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) GetDigests(args *storagerpc.DigestArgs, reply *storagerpc.DigestReply) error {
+	return pc.srv.Call("StorageServer.GetDigests", args, reply)
+}
+
+func (pc *proxyCounter) Repair(args *storagerpc.RepairArgs, reply *storagerpc.RepairReply) error {
+	return pc.srv.Call("StorageServer.Repair", args, reply)
+}
+
+func (pc *proxyCounter) AntiEntropy(args *storagerpc.AntiEntropyArgs, reply *storagerpc.AntiEntropyReply) error {
+	return pc.srv.Call("StorageServer.AntiEntropy", args, reply)
+}
+
+func (pc *proxyCounter) Export(args *storagerpc.ExportArgs, reply *storagerpc.ExportReply) error {
+	return pc.srv.Call("StorageServer.Export", args, reply)
+}
+
+func (pc *proxyCounter) Watch(args *storagerpc.WatchArgs, reply *storagerpc.WatchReply) error {
+	return pc.srv.Call("StorageServer.Watch", args, reply)
+}
+
+func (pc *proxyCounter) PollWatch(args *storagerpc.PollWatchArgs, reply *storagerpc.PollWatchReply) error {
+	return pc.srv.Call("StorageServer.PollWatch", args, reply)
+}
+
+func (pc *proxyCounter) CancelWatch(args *storagerpc.CancelWatchArgs, reply *storagerpc.CancelWatchReply) error {
+	return pc.srv.Call("StorageServer.CancelWatch", args, reply)
+}
+
+func (pc *proxyCounter) Transact(args *storagerpc.TransactArgs, reply *storagerpc.TransactReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := 0
+	for _, op := range args.Ops {
+		byteCount += len(op.Key) + len(op.Value)
+	}
+	err := pc.srv.Call("StorageServer.Transact", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
+
+func (pc *proxyCounter) Prepare(args *storagerpc.PrepareArgs, reply *storagerpc.PrepareReply) error {
+	return pc.srv.Call("StorageServer.Prepare", args, reply)
+}
+
+func (pc *proxyCounter) Decide(args *storagerpc.DecideArgs, reply *storagerpc.DecideReply) error {
+	return pc.srv.Call("StorageServer.Decide", args, reply)
+}
+
+func (pc *proxyCounter) TxnStatus(args *storagerpc.TxnStatusArgs, reply *storagerpc.TxnStatusReply) error {
+	return pc.srv.Call("StorageServer.TxnStatus", args, reply)
+}
+
+func (pc *proxyCounter) Propose(args *storagerpc.ProposeArgs, reply *storagerpc.ProposeReply) error {
+	if pc.override {
+		reply.Status = pc.overrideStatus
+		return pc.overrideErr
+	}
+	byteCount := len(args.Mutation.Key) + len(args.Mutation.Value)
+	err := pc.srv.Call("StorageServer.Propose", args, reply)
+	atomic.AddUint32(&pc.rpcCount, 1)
+	atomic.AddUint32(&pc.byteCount, uint32(byteCount))
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"skiplist"
+)
+
+type testFunc struct {
+	name string
+	f    func()
+}
+
+var (
+	testRegex = flag.String("t", "", "test to run")
+	seed      = flag.Int64("seed", 1, "seed for the random operations")
+	passCount int
+	failCount int
+)
+
+var LOGE = log.New(os.Stderr, "", log.Lshortfile|log.Lmicroseconds)
+
+func fail(format string, args ...interface{}) {
+	LOGE.Printf("FAIL: "+format, args...)
+	failCount++
+}
+
+// equal reports whether two lists of strings are the same.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reversed returns a reversed copy of values.
+func reversed(values []string) []string {
+	r := make([]string, len(values))
+	for i, value := range values {
+		r[len(values)-1-i] = value
+	}
+	return r
+}
+
+// checkRanges compares ranges of l, in both directions, with those of want,
+// a sorted slice.
+func checkRanges(rnd *rand.Rand, l *skiplist.List, want []string) bool {
+	if l.Len() != len(want) || !equal(l.Values(), want) {
+		fail("list holds %d values, expected %d\n", l.Len(), len(want))
+		return false
+	}
+	for n := 0; n < 50; n++ {
+		start, count := rnd.Intn(len(want)+2), rnd.Intn(120)
+		end := start + count
+		if start > len(want) {
+			start = len(want)
+		}
+		if end > len(want) {
+			end = len(want)
+		}
+		if got := l.Range(start, count, false); !equal(got, want[start:end]) {
+			fail("Range(%d, %d, false) returned %d values\n", start, count, len(got))
+			return false
+		}
+		if got := l.Range(start, count, true); !equal(got, reversed(want)[start:end]) {
+			fail("Range(%d, %d, true) returned %d values\n", start, count, len(got))
+			return false
+		}
+		from := "post_" + strconv.Itoa(rnd.Intn(3000))
+		got := make([]string, 0)
+		l.Ascend(from, func(value string) bool {
+			got = append(got, value)
+			return len(got) < count
+		})
+		i := sort.SearchStrings(want, from)
+		if end = i + count; end > len(want) {
+			end = len(want)
+		}
+		if count > 0 && !equal(got, want[i:end]) {
+			fail("Ascend(%q) returned %d values for %d\n", from, len(got), count)
+			return false
+		}
+	}
+	return true
+}
+
+func testEmpty() {
+	l := skiplist.New()
+	if l.Len() != 0 || l.Contains("a") || l.Remove("a") || len(l.Range(0, 10, true)) != 0 {
+		fail("empty list is not empty\n")
+		return
+	}
+	if !l.Insert("a") || l.Insert("a") || !l.Contains("a") || !l.Remove("a") || l.Len() != 0 {
+		fail("list of one value misbehaves\n")
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+// testRandom applies random inserts and removes to a list and checks it
+// against a sorted slice along the way.
+func testRandom() {
+	rnd := rand.New(rand.NewSource(*seed))
+	l := skiplist.New()
+	want := make([]string, 0)
+	for i := 0; i < 20000; i++ {
+		value := "post_" + strconv.Itoa(rnd.Intn(3000))
+		j := sort.SearchStrings(want, value)
+		present := j < len(want) && want[j] == value
+		if l.Contains(value) != present {
+			fail("Contains(%q) returned %v\n", value, !present)
+			return
+		}
+		if rnd.Intn(3) == 0 {
+			if l.Remove(value) != present {
+				fail("Remove(%q) returned %v\n", value, !present)
+				return
+			}
+			if present {
+				want = append(want[:j], want[j+1:]...)
+			}
+		} else {
+			if l.Insert(value) == present {
+				fail("Insert(%q) returned %v\n", value, present)
+				return
+			}
+			if !present {
+				want = append(want, "")
+				copy(want[j+1:], want[j:])
+				want[j] = value
+			}
+		}
+		if i%2000 == 1999 && !checkRanges(rnd, l, want) {
+			return
+		}
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+func testFromSorted() {
+	want := make([]string, 1000)
+	for i := range want {
+		want[i] = fmt.Sprintf("post_%04d", i)
+	}
+	l := skiplist.FromSorted(want)
+	if !checkRanges(rand.New(rand.NewSource(*seed)), l, want) {
+		return
+	}
+	if got := l.Range(0, 100, true); got[0] != "post_0999" || got[99] != "post_0900" {
+		fail("Range of the last 100 values returned %q to %q\n", got[0], got[99])
+		return
+	}
+	fmt.Println("PASS")
+	passCount++
+}
+
+func main() {
+	tests := []testFunc{
+		{"testEmpty", testEmpty},
+		{"testRandom", testRandom},
+		{"testFromSorted", testFromSorted},
+	}
+
+	flag.Parse()
+	for _, t := range tests {
+		if b, err := regexp.MatchString(*testRegex, t.name); b && err == nil {
+			fmt.Printf("Running %s:\n", t.name)
+			t.f()
+		}
+	}
+
+	fmt.Printf("Passed (%d/%d) tests\n", passCount, passCount+failCount)
+}
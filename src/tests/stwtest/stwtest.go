@@ -38,6 +38,7 @@ var statusMap = map[stwrpc.Status]string{
 	stwrpc.NoSuchPost:       "NoSuchPost",
 	stwrpc.NoSuchTargetUser: "NoSuchTargetUser",
 	stwrpc.Exists:           "Exists",
+	stwrpc.Unavailable:      "Unavailable",
 	0:                        "Unknown",
 }
 
@@ -1,8 +1,15 @@
 package util
 
 import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
 	"strconv"
 	"strings"
+	"time"
 	
 	"libstore"
 )
@@ -85,3 +92,24 @@ func BinarySearchLeaseRecord(vals []string, val string) int {
 	}
 	return i
 }
+
+// DialHTTPTimeout is rpc.DialHTTP with a bound on how long connecting may
+// take, so that an unreachable host cannot stall the caller.
+func DialHTTPTimeout(hostport string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", hostport, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == "200 Connected to Go RPC" {
+		conn.SetDeadline(time.Time{})
+		return rpc.NewClient(conn), nil
+	}
+	conn.Close()
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	return nil, err
+}
@@ -1,6 +1,7 @@
 package webserver
 
 import (
+	"context"
 	"fmt"
 	"errors"
 	//"net"
@@ -11,14 +12,29 @@ import (
  	"io/ioutil"
 	"encoding/json"
 	"strings"
+	"sync"
 
  	"rpc/stwrpc"
  	"github.com/willf/bloom"
 )
 
+// How long an app server that could not be reached is skipped, how often
+// the web server refreshes its view of the app servers, and how long it
+// waits for them on a request that does not carry a deadline.
+const (
+	deadSeconds    = 5
+	refreshSeconds = 2
+	requestSeconds = 10
+)
+
+// errNoAppServer is returned by callStw when no app server can be reached.
+var errNoAppServer = errors.New("no app server available")
+
 type webServer struct {
 	stwServers []string
 	stwConns map[string]*rpc.Client
+	dead map[string]time.Time // app servers to skip until the given time
+	lock sync.Mutex           // guards stwServers, stwConns and dead
 	mux *http.ServeMux
 	zombieFilter *bloom.BloomFilter
 	underHighLoad bool
@@ -35,21 +51,163 @@ func echoHandler(w http.ResponseWriter, r *http.Request){
     w.Write(body)
 }
 
-func (ws *webServer) getStwConn(key string) *rpc.Client {
-	host := ws.stwServers[RequestHash(key)%uint32(len(ws.stwServers))]
-	cli, ok := ws.stwConns[host]
-	if !ok {
+// getStwConn returns the app server that key is routed to and a connection
+// to it. Dead app servers are skipped in favor of the next one in the list.
+func (ws *webServer) getStwConn(key string) (string, *rpc.Client, error) {
+	ws.lock.Lock()
+	servers := ws.stwServers
+	ws.lock.Unlock()
+	if len(servers) == 0 {
+		return "", nil, errNoAppServer
+	}
+	start := int(RequestHash(key)%uint32(len(servers)))
+	for i := 0; i < len(servers); i++ {
+		host := servers[(start+i)%len(servers)]
+		ws.lock.Lock()
+		if time.Now().Before(ws.dead[host]) {
+			ws.lock.Unlock()
+			continue
+		}
+		cli, ok := ws.stwConns[host]
+		ws.lock.Unlock()
+		if ok {
+			return host, cli, nil
+		}
 		cli, err := rpc.DialHTTP("tcp", host)
 		if err != nil {
-			log.Fatal("rpc error:", err)
+			log.Println("rpc error:", err)
+			ws.markDead(host)
+			continue
+		}
+		ws.lock.Lock()
+		if existing, ok := ws.stwConns[host]; ok {
+			// Another request dialed host meanwhile; keep its connection.
+			ws.lock.Unlock()
+			cli.Close()
+			return host, existing, nil
 		}
 		ws.stwConns[host] = cli
-		return cli
+		ws.lock.Unlock()
+		return host, cli, nil
+	}
+	return "", nil, errNoAppServer
+}
+
+// markDead drops the connection to host and skips it for deadSeconds.
+func (ws *webServer) markDead(host string) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if cli, ok := ws.stwConns[host]; ok {
+		cli.Close()
+		delete(ws.stwConns, host)
+	}
+	ws.dead[host] = time.Now().Add(deadSeconds * time.Second)
+}
+
+// requestContext returns the context of an HTTP request, which ends once
+// the timeout in its stwrpc.TimeoutHeader header has passed, or
+// requestSeconds from now if it has none, or when the client goes away.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := requestSeconds * time.Second
+	if d, err := time.ParseDuration(r.Header.Get(stwrpc.TimeoutHeader)); err == nil && d != 0 {
+		timeout = d
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// callStw calls method on the app server that key is routed to, giving up
+// once ctx is done. If the app server cannot be reached, it is marked dead
+// and the call goes to the next live one, but only while the call has not
+// been sent: once it may have reached an app server, retrying could apply a
+// Post twice, so the error is returned instead. An app server's refusal of
+// a call past its deadline is returned as context.DeadlineExceeded.
+func (ws *webServer) callStw(ctx context.Context, key, method string, args, reply interface{}) error {
+	for {
+		host, cli, err := ws.getStwConn(key)
+		if err != nil {
+			return err
+		}
+		call := cli.Go(method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err == rpc.ServerError(context.DeadlineExceeded.Error()) {
+			return context.DeadlineExceeded
+		}
+		if _, ok := err.(rpc.ServerError); err == nil || ok {
+			return err
+		}
+		log.Printf("App server %s failed: %v", host, err)
+		ws.markDead(host)
+		if err != rpc.ErrShutdown {
+			// The connection broke after the call was sent.
+			return err
+		}
+	}
+}
+
+// stwRefresher periodically asks the master app server for the app servers
+// and skips the ones it reports dead.
+func (ws *webServer) stwRefresher(masterStwServer string, client *rpc.Client) {
+	for {
+		time.Sleep(refreshSeconds * time.Second)
+		if client == nil {
+			var err error
+			if client, err = rpc.DialHTTP("tcp", masterStwServer); err != nil {
+				continue
+			}
+		}
+		args := stwrpc.GetServersArgs{}
+		reply := stwrpc.GetServersReply{}
+		if err := client.Call("StwServer.GetServers", args, &reply); err != nil {
+			client.Close()
+			client = nil
+			continue
+		}
+		if reply.Status != stwrpc.OK {
+			continue
+		}
+		servers := make([]string, 0, len(reply.Servers))
+		for _, node := range reply.Servers {
+			servers = append(servers, node.HostPort)
+			if !node.Alive {
+				ws.markDead(node.HostPort)
+			}
+		}
+		ws.lock.Lock()
+		ws.stwServers = servers
+		ws.lock.Unlock()
+	}
+}
+
+// writeReply writes reply, with status 503 Service Unavailable if the app
+// server could not reach the storage servers.
+func writeReply(w http.ResponseWriter, status stwrpc.Status, reply interface{}) {
+	if status == stwrpc.Unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// writeError logs err, a failed call to the app servers, and writes status
+// 503 Service Unavailable if no app server could be reached, 504 Gateway
+// Timeout if the deadline of the request passed, or code.
+func writeError(w http.ResponseWriter, err error, code int) {
+	log.Println(err)
+	if errors.Is(err, errNoAppServer) {
+		code = http.StatusServiceUnavailable
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		code = http.StatusGatewayTimeout
 	}
-	return cli
+	w.WriteHeader(code)
 }
 
 func (ws *webServer) usersHandler(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := requestContext(r)
+	defer cancel()
 	switch r.Method {
 	case http.MethodGet:
 	    echoHandler(w,r)
@@ -64,18 +222,20 @@ func (ws *webServer) usersHandler(w http.ResponseWriter, r *http.Request){
 	    }
 
 	    uid := args.UserID
-	    cli := ws.getStwConn(uid)
 
-	    args2 := &stwrpc.CreateUserArgs{UserID: uid}
+	    args2 := &stwrpc.CreateUserArgs{UserID: uid, Timeout: stwrpc.TimeoutOf(ctx)}
 		var reply stwrpc.CreateUserReply
-		err = cli.Call("StwServer.CreateUser", args2, &reply)
+		err = ws.callStw(ctx, uid, "StwServer.CreateUser", args2, &reply)
 		if err!=nil {
-			log.Println(err)
+			writeError(w, err, http.StatusInternalServerError)
+			return
 		}
-		json.NewEncoder(w).Encode(reply)
+		writeReply(w, reply.Status, reply)
 	}
 }
 func (ws *webServer) subscriptionHandler(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := requestContext(r)
+	defer cancel()
 	ss, ok := r.URL.Query()["UserID"]
     if !ok {
     	w.WriteHeader(http.StatusBadRequest)
@@ -87,9 +247,8 @@ func (ws *webServer) subscriptionHandler(w http.ResponseWriter, r *http.Request)
 		return
     }
     s, t := ss[0], ts[0]
-    cli := ws.getStwConn(s)
 
-    args := &stwrpc.SubscriptionArgs{UserID: s, TargetUserID: t}
+    args := &stwrpc.SubscriptionArgs{UserID: s, TargetUserID: t, Timeout: stwrpc.TimeoutOf(ctx)}
 	var reply stwrpc.SubscriptionReply
 
 	switch r.Method {
@@ -97,18 +256,20 @@ func (ws *webServer) subscriptionHandler(w http.ResponseWriter, r *http.Request)
 	    echoHandler(w,r)
 	case http.MethodPost:
 	    // Create a new record.
-		err := cli.Call("StwServer.Subscribe", args, &reply)
+		err := ws.callStw(ctx, s, "StwServer.Subscribe", args, &reply)
 		if err!=nil {
-			log.Println(err)
+			writeError(w, err, http.StatusInternalServerError)
+			return
 		}
-		json.NewEncoder(w).Encode(reply)
+		writeReply(w, reply.Status, reply)
 	case http.MethodDelete:
 	    // Remove the record.
-		err := cli.Call("StwServer.Unsubscribe", args, &reply)
+		err := ws.callStw(ctx, s, "StwServer.Unsubscribe", args, &reply)
 		if err!=nil {
-			log.Println(err)
+			writeError(w, err, http.StatusInternalServerError)
+			return
 		}
-		json.NewEncoder(w).Encode(reply)
+		writeReply(w, reply.Status, reply)
 	default:
 	    w.WriteHeader(http.StatusBadRequest)
 	    echoHandler(w,r)
@@ -116,6 +277,8 @@ func (ws *webServer) subscriptionHandler(w http.ResponseWriter, r *http.Request)
 
 }
 func (ws *webServer) postsHandler(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := requestContext(r)
+	defer cancel()
 	switch r.Method {
 	case http.MethodPost:
 		decoder := json.NewDecoder(r.Body)
@@ -128,24 +291,23 @@ func (ws *webServer) postsHandler(w http.ResponseWriter, r *http.Request){
 	    }
 
 	    uid := args.UserID
-	    cli := ws.getStwConn(uid)
+	    args.Timeout = stwrpc.TimeoutOf(ctx)
 
 	    //create user without authorization for now
-	    args0 := &stwrpc.CreateUserArgs{UserID: uid}
+	    args0 := &stwrpc.CreateUserArgs{UserID: uid, Timeout: args.Timeout}
 		var reply0 stwrpc.CreateUserReply
-		err = cli.Call("StwServer.CreateUser", args0, &reply0)
+		err = ws.callStw(ctx, uid, "StwServer.CreateUser", args0, &reply0)
 		if err!=nil {
 			log.Println(err)
 		}
 
 		var reply stwrpc.PostReply
-		if err = cli.Call("StwServer.Post", &args, &reply); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if err = ws.callStw(ctx, uid, "StwServer.Post", &args, &reply); err != nil {
+			writeError(w, err, http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(reply)
+		writeReply(w, reply.Status, reply)
 	case http.MethodDelete:
 		uids, ok := r.URL.Query()["UserID"]
 	    if !ok {
@@ -158,16 +320,14 @@ func (ws *webServer) postsHandler(w http.ResponseWriter, r *http.Request){
 			return
 	    }
 	    uid, postKey := uids[0], postKeys[0]
-	    cli := ws.getStwConn(uid)
 
-	    args := &stwrpc.DeletePostArgs{UserID:uid, PostKey:postKey}
+	    args := &stwrpc.DeletePostArgs{UserID:uid, PostKey:postKey, Timeout: stwrpc.TimeoutOf(ctx)}
 	    var reply stwrpc.DeletePostReply
-	    if err := cli.Call("StwServer.DeletePost", args, &reply); err!=nil {
-	    	log.Println(err)
-	    	w.WriteHeader(http.StatusBadRequest)
+	    if err := ws.callStw(ctx, uid, "StwServer.DeletePost", args, &reply); err!=nil {
+	    	writeError(w, err, http.StatusBadRequest)
 			return
 	    }
-	    json.NewEncoder(w).Encode(reply)
+	    writeReply(w, reply.Status, reply)
 
 	default:
 		w.WriteHeader(http.StatusBadRequest)
@@ -175,6 +335,8 @@ func (ws *webServer) postsHandler(w http.ResponseWriter, r *http.Request){
 	}
 }
 func (ws *webServer) timelineHandler(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := requestContext(r)
+	defer cancel()
     uids, ok := r.URL.Query()["UserID"]
     if !ok {
     	w.WriteHeader(http.StatusBadRequest)
@@ -182,30 +344,30 @@ func (ws *webServer) timelineHandler(w http.ResponseWriter, r *http.Request){
 		return
     }
 
-    args := stwrpc.TimelineArgs{UserID: uids[0]}
+    args := stwrpc.TimelineArgs{UserID: uids[0], Timeout: stwrpc.TimeoutOf(ctx)}
 
     uid := args.UserID
-    cli := ws.getStwConn(uid)
 
     //create user without authorization for now
-    args0 := &stwrpc.CreateUserArgs{UserID: uid}
+    args0 := &stwrpc.CreateUserArgs{UserID: uid, Timeout: args.Timeout}
 	var reply0 stwrpc.CreateUserReply
-	err := cli.Call("StwServer.CreateUser", args0, &reply0)
+	err := ws.callStw(ctx, uid, "StwServer.CreateUser", args0, &reply0)
 	if err!=nil {
 		log.Println(err)
 	}
 
 	var reply stwrpc.TimelineReply
-	if err = cli.Call("StwServer.Timeline", &args, &reply); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err = ws.callStw(ctx, uid, "StwServer.Timeline", &args, &reply); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(reply)
+	writeReply(w, reply.Status, reply)
 }
 
 func (ws *webServer) homeHandler(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := requestContext(r)
+	defer cancel()
     uids, ok := r.URL.Query()["UserID"]
     if !ok {
     	w.WriteHeader(http.StatusBadRequest)
@@ -213,35 +375,33 @@ func (ws *webServer) homeHandler(w http.ResponseWriter, r *http.Request){
 		return
     }
 
-    args := stwrpc.TimelineArgs{UserID: uids[0]}
+    args := stwrpc.TimelineArgs{UserID: uids[0], Timeout: stwrpc.TimeoutOf(ctx)}
 
     uid := args.UserID
-    cli := ws.getStwConn(uid)
 
     //create user without authorization for now
-    args0 := &stwrpc.CreateUserArgs{UserID: uid}
+    args0 := &stwrpc.CreateUserArgs{UserID: uid, Timeout: args.Timeout}
 	var reply0 stwrpc.CreateUserReply
-	err := cli.Call("StwServer.CreateUser", args0, &reply0)
+	err := ws.callStw(ctx, uid, "StwServer.CreateUser", args0, &reply0)
 	if err!=nil {
 		log.Println(err)
 	}
 
 	//make user subscribe themselves
-	args1 := &stwrpc.SubscriptionArgs{UserID: uid, TargetUserID: uid}
+	args1 := &stwrpc.SubscriptionArgs{UserID: uid, TargetUserID: uid, Timeout: args.Timeout}
 	var reply1 stwrpc.SubscriptionReply
-	err = cli.Call("StwServer.Subscribe", args1, &reply1)
+	err = ws.callStw(ctx, uid, "StwServer.Subscribe", args1, &reply1)
 	if err!=nil {
 		log.Println(err)
 	}
 
 	var reply stwrpc.TimelineReply
-	if err = cli.Call("StwServer.HomeTimeline", &args, &reply); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err = ws.callStw(ctx, uid, "StwServer.HomeTimeline", &args, &reply); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(reply)
+	writeReply(w, reply.Status, reply)
 }
 
 func (ws *webServer) servePuzzle(w http.ResponseWriter, r *http.Request){
@@ -302,6 +462,7 @@ func NewWebServer(myHostPort, masterStwServer string) (WebServer, error) {
 	ws := &webServer{
 		stwServers: []string{},
 		stwConns: make(map[string]*rpc.Client),
+		dead: make(map[string]time.Time),
 		mux: http.NewServeMux(),
 		zombieFilter: bloom.New(20000, 1),
 	}
@@ -326,6 +487,7 @@ func NewWebServer(myHostPort, masterStwServer string) (WebServer, error) {
 					addr := node.HostPort
 					ws.stwServers = append(ws.stwServers, addr)
 				}
+				go ws.stwRefresher(masterStwServer, client)
 				break
 			} else if reply.Status == stwrpc.NotReady {
 				time.Sleep(1 * time.Second)
@@ -0,0 +1,143 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+go install runners/rstoragectl
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+CTL=$GOPATH/bin/rstoragectl
+STORAGE_ID=('3000000000' '1000000000')
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=1 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    SERVER_PORT[0]=${STORAGE_PORT}
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        SERVER_PORT[$i]=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${SERVER_PORT[$i]} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Prints the number of lines matching $2 in the output of the rstoragectl
+# command $1 on every storage server.
+function countLines {
+    COUNT=0
+    for i in `seq 0 $((${#STORAGE_ID[@]}-1))`
+    do
+        COUNT=$((COUNT + `${CTL} -port=${SERVER_PORT[$i]} $1 2> /dev/null | grep -E "$2" | wc -l`))
+    done
+    echo ${COUNT}
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing the key counts and sizes of every prefix type. Each server backs
+# up the other, so both hold every key.
+function testPrefixStats {
+    echo "Running testPrefixStats:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" 1 > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "alice:sublist" bob > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:post_0000000000000001" hello > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "alice:postlist" "alice:post_0000000000000001" > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "misc" other > /dev/null
+    PASS=`countLines prefixes "^(usrid +1 +12|sublist +1 +16|post_ +1 +32|postlist +1 +41|other +1 +9)$"`
+    checkResult ${PASS} 10
+}
+
+# Testing that the lease of a libstore is listed until a write revokes it,
+# after which the server keeps its connection to the libstore.
+function testTenantsAndConns {
+    echo "Running testTenantsAndConns:"
+    ${LRUNNER} -port=${STORAGE_PORT} -l -fl g "alice:usrid" > /dev/null 2>&1 &
+    HOLDER_PID=$!
+    sleep 1
+    LEASED=`countLines tenants "^alice:usrid "`
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" 2 > /dev/null
+    REVOKED=`countLines tenants "^alice:usrid "`
+    CONNECTED=`countLines conns "^libstore "`
+    PEERS=`countLines conns "^peer "`
+    kill -9 ${HOLDER_PID}
+    wait ${HOLDER_PID} 2> /dev/null
+    if [ "${REVOKED}" -eq 0 ] && [ "${CONNECTED}" -eq 1 ] && [ "${PEERS}" -ge 1 ]
+    then
+        checkResult ${LEASED} 1
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that both servers report the two key ranges of the ring, each
+# served by one of them.
+function testRanges {
+    echo "Running testRanges:"
+    PASS=`countLines ranges "^(1000000000 +3000000000 +true +\[3000000000 1000000000\]|3000000000 +1000000000 +true +\[1000000000 3000000000\])"`
+    PASS=$((PASS + `countLines ranges " false "`))
+    checkResult ${PASS} 4
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+testPrefixStats
+testTenantsAndConns
+testRanges
+stopStorageServers
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
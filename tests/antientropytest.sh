@@ -0,0 +1,194 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+go install runners/rstoragectl
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+CTL=$GOPATH/bin/rstoragectl
+STORAGE_ID=('3000000000' '1000000000' '2000000000')
+DATA_DIR=$(mktemp -d)
+NUM_KEYS=30
+
+# Starts storage server $1 with its own data directory. Anti-entropy only
+# runs on demand, so that the tests control when replicas are repaired.
+function startStorageServer {
+    if [ "$1" -eq 0 ]
+    then
+        ${STORAGE_SERVER} -N=${#STORAGE_ID[@]} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=2 \
+            -datadir=${DATA_DIR}/0 -antientropy=-1 2> /dev/null &
+    else
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$1]} -port=${SERVER_PORT[$1]} -master="localhost:${STORAGE_PORT}" \
+            -datadir=${DATA_DIR}/$1 -antientropy=-1 2> /dev/null &
+    fi
+    STORAGE_SERVER_PID[$1]=$!
+}
+
+function startStorageServers {
+    SERVER_PORT[0]=${STORAGE_PORT}
+    for i in `seq 0 $((${#STORAGE_ID[@]}-1))`
+    do
+        if [ "$i" -gt 0 ]
+        then
+            SERVER_PORT[$i]=$(((RANDOM % 10000) + 10000))
+        fi
+        mkdir -p ${DATA_DIR}/$i
+        startStorageServer $i
+    done
+    sleep 5
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+}
+
+function stopStorageServers {
+    for i in `seq 0 $((${#STORAGE_ID[@]}-1))`
+    do
+        killStorageServer $i
+    done
+}
+
+# Runs a round of anti-entropy on every storage server.
+function runAntiEntropy {
+    for i in `seq 0 $((${#STORAGE_ID[@]}-1))`
+    do
+        ${CTL} -port=${SERVER_PORT[$i]} -run antientropy > /dev/null
+    done
+}
+
+# Prints the number of keys that anti-entropy has pushed and pulled on every
+# storage server.
+function repairedKeys {
+    REPAIRED=0
+    for i in `seq 0 $((${#STORAGE_ID[@]}-1))`
+    do
+        for N in `${CTL} -port=${SERVER_PORT[$i]} antientropy | grep -E "^Keys(Pushed|Pulled):" | awk '{print $2}'`
+        do
+            REPAIRED=$((REPAIRED + N))
+        done
+    done
+    echo ${REPAIRED}
+}
+
+# Prints the number of keys ae_0 to ae_$1 that read back as value $2.
+function countKeys {
+    COUNT=0
+    for i in `seq 0 $(($1-1))`
+    do
+        COUNT=$((COUNT + `${LRUNNER} -port=${STORAGE_PORT} g "ae_$i:key" 2> /dev/null | grep -x "$2" | wc -l`))
+    done
+    echo ${COUNT}
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that a replica that was down while keys were written gets them back
+# from its peers: before anti-entropy runs, the restarted server misses the
+# keys it is the primary of.
+function testRepairMissedWrites {
+    echo "Running testRepairMissedWrites:"
+    killStorageServer 2
+    sleep 7
+    for i in `seq 0 $((NUM_KEYS-1))`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "ae_$i:key" value > /dev/null 2>&1
+    done
+    startStorageServer 2
+    sleep 5
+    BEFORE=`countKeys ${NUM_KEYS} value`
+    runAntiEntropy
+    AFTER=`countKeys ${NUM_KEYS} value`
+    if [ "${BEFORE}" -lt "${NUM_KEYS}" ]
+    then
+        checkResult ${AFTER} ${NUM_KEYS}
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that keys deleted while a replica was down stay deleted once it is
+# back.
+function testRepairMissedDeletes {
+    echo "Running testRepairMissedDeletes:"
+    killStorageServer 2
+    sleep 7
+    for i in `seq 0 $((NUM_KEYS-1))`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} d "ae_$i:key" > /dev/null 2>&1
+    done
+    startStorageServer 2
+    sleep 5
+    BEFORE=`countKeys ${NUM_KEYS} value`
+    runAntiEntropy
+    AFTER=`countKeys ${NUM_KEYS} value`
+    if [ "${BEFORE}" -gt 0 ]
+    then
+        checkResult ${AFTER} 0
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that once replicas agree, anti-entropy finds nothing to repair.
+function testConverged {
+    echo "Running testConverged:"
+    BEFORE=`repairedKeys`
+    runAntiEntropy
+    AFTER=`repairedKeys`
+    checkResult ${AFTER} ${BEFORE}
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+testRepairMissedWrites
+testRepairMissedDeletes
+testConverged
+stopStorageServers
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,153 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+go install runners/rbackup
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+BACKUP=$GOPATH/bin/rbackup
+BACKUP_DIR=$(mktemp -d)
+NUM_KEYS=20
+ITEMS=('alpha' 'beta' 'gamma' 'delta')
+
+# Starts a ring of the servers in STORAGE_ID, with $1 backups of every key
+# range and $2 virtual nodes per server.
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=$1 -vnodes=$2 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+function writeKeys {
+    for i in `seq 0 $((NUM_KEYS-1))`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "bk_$i:key" "value_$i" > /dev/null
+    done
+    for ITEM in "${ITEMS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} la "bk:list" ${ITEM} > /dev/null
+    done
+}
+
+# Prints the number of keys written by writeKeys that read back right.
+function countKeys {
+    COUNT=0
+    for i in `seq 0 $((NUM_KEYS-1))`
+    do
+        COUNT=$((COUNT + `${LRUNNER} -port=${STORAGE_PORT} g "bk_$i:key" 2> /dev/null | grep -x "value_$i" | wc -l`))
+    done
+    if [ "`${LRUNNER} -port=${STORAGE_PORT} lg "bk:list" 2> /dev/null | grep -xE "alpha|beta|gamma|delta" | wc -l`" -eq ${#ITEMS[@]} ]
+    then
+        COUNT=$((COUNT + 1))
+    fi
+    echo ${COUNT}
+}
+
+# Testing that a backup holds every key of the ring.
+function testBackup {
+    echo "Running testBackup:"
+    PASS=`${BACKUP} -port=${STORAGE_PORT} backup ${BACKUP_DIR}/first 2> /dev/null | grep -x "Backed up $((NUM_KEYS + 1)) keys from 3 storage servers" | wc -l`
+    checkResult ${PASS} 1
+}
+
+# Testing that a backup taken while a server is dead still holds every key,
+# dumped by the server's backups, and matches the first one.
+function testBackupAfterFailure {
+    echo "Running testBackupAfterFailure:"
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+    sleep 7
+    ${BACKUP} -port=${STORAGE_PORT} backup ${BACKUP_DIR}/second > /dev/null 2>&1
+    # The headers differ in the time the dumps were taken.
+    if cmp -s <(tail -n +2 ${BACKUP_DIR}/first) <(tail -n +2 ${BACKUP_DIR}/second)
+    then
+        checkResult 1 1
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that a backup restored into a ring with fewer servers and virtual
+# nodes reads back the same.
+function testRestoreResized {
+    echo "Running testRestoreResized:"
+    ${BACKUP} -port=${STORAGE_PORT} restore ${BACKUP_DIR}/second > /dev/null 2>&1
+    checkResult `countKeys` $((NUM_KEYS + 1))
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+STORAGE_ID=('3000000000' '1000000000' '2000000000')
+startStorageServers 1 0
+writeKeys
+testBackup
+testBackupAfterFailure
+stopStorageServers
+STORAGE_ID=('1500000000' '3500000000')
+startStorageServers 0 4
+testRestoreResized
+stopStorageServers
+rm -rf ${BACKUP_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
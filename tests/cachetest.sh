@@ -0,0 +1,143 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+OUT=/tmp/cachetest_$$.txt
+
+function startStorageServers {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 5
+}
+
+function stopStorageServers {
+    kill -9 ${STORAGE_SERVER_PID} 2> /dev/null
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+# Runs rlibstore holding leases with the flags and command $@, printing the
+# cache counters into OUT, and leaves it running as HOLDER_PID.
+function startReader {
+    ${LRUNNER} -port=${STORAGE_PORT} -l -stats "$@" > ${OUT} 2>&1 &
+    HOLDER_PID=$!
+    sleep 1
+}
+
+function stopReader {
+    kill -9 ${HOLDER_PID} 2> /dev/null
+    wait ${HOLDER_PID} 2> /dev/null
+}
+
+# Prints the counter $1 from the line $2 of the counters in OUT.
+function stat {
+    grep "^hits " ${OUT} | sed -n "$2p" | awk -v name=$1 '{for (i = 1; i < NF; i++) if ($i == name) print $(i+1)}'
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that the reads of a key are missed until one asks for a lease,
+# the fourth, and hit afterwards.
+function testHitsAndMisses {
+    echo "Running testHitsAndMisses:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "a:key" 1 > /dev/null
+    startReader -n=6 g "a:key"
+    PASS=$((`stat hits 1` == 2 && `stat misses 1` == 4 && `stat entries 1` == 1))
+    stopReader
+    checkResult ${PASS} 1
+}
+
+# Testing that a cache of 32 entries, one per shard, evicts the least
+# recently used keys to hold at most 32 of 64 leased keys.
+function testEntryLimit {
+    echo "Running testEntryLimit:"
+    KEYS=""
+    for i in `seq 1 64`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "b:key${i}" ${i} > /dev/null
+        KEYS="${KEYS} b:key${i}"
+    done
+    startReader -fl -cacheentries=32 mg ${KEYS}
+    ENTRIES=`stat entries 1`
+    EVICTIONS=`stat evictions 1`
+    stopReader
+    if [ "${ENTRIES}" -le 32 ] && [ "${ENTRIES}" -ge 1 ]
+    then
+        checkResult $((ENTRIES + EVICTIONS)) 64
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that a value bigger than a shard's share of the byte limit is
+# not cached.
+function testByteLimit {
+    echo "Running testByteLimit:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "c:key" "a value of more than ten bytes" > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "c:k" "v" > /dev/null
+    startReader -fl -cachebytes=320 mg "c:key" "c:k"
+    PASS=$((`stat entries 1` == 1 && `stat bytes 1` == 4))
+    stopReader
+    checkResult ${PASS} 1
+}
+
+# Testing that a cached key is dropped once its lease expires, without
+# being read again.
+function testExpiry {
+    echo "Running testExpiry:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "d:key" 1 > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} -l -fl -stats g "d:key" > ${OUT} 2>&1
+    PASS=$((`stat entries 1` == 1 && `stat entries 2` == 0 && `stat expirations 2` == 1))
+    checkResult ${PASS} 1
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+testHitsAndMisses
+testEntryLimit
+testByteLimit
+testExpiry
+stopStorageServers
+rm -f ${OUT}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
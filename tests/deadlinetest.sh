@@ -0,0 +1,45 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install tests/deadlinetest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random ports between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STW_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+DEADLINETEST=$GOPATH/bin/deadlinetest
+DATA_DIR=$(mktemp -d)
+
+${STORAGE_SERVER} -port=${STORAGE_PORT} -datadir=${DATA_DIR} 2> /dev/null &
+STORAGE_SERVER_PID=$!
+sleep 3
+
+# Run the tests, which stop and continue the storage server themselves.
+${DEADLINETEST} -port=${STW_PORT} -storagepid=${STORAGE_SERVER_PID} "localhost:${STORAGE_PORT}" 2> /dev/null
+
+kill -CONT ${STORAGE_SERVER_PID}
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+rm -rf ${DATA_DIR}
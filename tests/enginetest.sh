@@ -0,0 +1,166 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server, the lrunner binary used to talk to it and the
+# tests of the B+tree package behind the btree engine.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install tests/storagetest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install tests/btreetest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random ports between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+TESTER_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+STORAGE_TEST=$GOPATH/bin/storagetest
+BTREE_TEST=$GOPATH/bin/btreetest
+LRUNNER=$GOPATH/bin/rlibstore
+DATA_DIR=$(mktemp -d)
+
+##################################################
+
+# Test the B+tree itself.
+${BTREE_TEST}
+
+##################################################
+
+# Run the storage server tests against the btree engine.
+${STORAGE_SERVER} -port=${STORAGE_PORT} -engine=btree &
+STORAGE_SERVER_PID=$!
+sleep 5
+${STORAGE_TEST} -port=${TESTER_PORT} -type=2 "localhost:${STORAGE_PORT}"
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+
+##################################################
+
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} -engine=btree -datadir=${DATA_DIR} 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that the btree engine keeps its files inside the data directory.
+function testEngineFiles {
+    echo "Running testEngineFiles:"
+    startStorageServer
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" value > /dev/null
+    PASS=`ls ${DATA_DIR}/btree | grep -c "\.btree$"`
+    checkResult $((PASS > 0)) 1
+    killStorageServer
+}
+
+# Testing that values and lists kept by the btree engine, in order, survive
+# a crash.
+function testRecoverLists {
+    echo "Running testRecoverLists:"
+    startStorageServer
+    for user in dave bob erin carol alice; do
+        ${LRUNNER} -port=${STORAGE_PORT} la "frank:sublist" ${user} > /dev/null
+    done
+    ${LRUNNER} -port=${STORAGE_PORT} lr "frank:sublist" carol > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "frank:usrid" value > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "frank:usrid" newvalue > /dev/null
+    killStorageServer
+    startStorageServer
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} lg "frank:sublist" | grep -E "^(alice|bob|dave|erin)$" | tr '\n' ' '`
+    PASS=`[ "${PASS}" == "alice bob dave erin " ] && echo 1 || echo 0`
+    PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g "frank:usrid" | grep newvalue | wc -l`))
+    checkResult $PASS 2
+    killStorageServer
+}
+
+# Testing that the btree engine lists keys of different lengths in key
+# order for a scan that starts after a key.
+function testScanOrder {
+    echo "Running testScanOrder:"
+    startStorageServer
+    for key in b ab a aab; do
+        ${LRUNNER} -port=${STORAGE_PORT} p "gus:${key}" value > /dev/null
+    done
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} sc "gus:" "gus:a" 2 | tr '\n' ' '`
+    PASS=`[ "${PASS}" == "gus:aab gus:ab NEXT: gus:ab " ] && echo 1 || echo 0`
+    checkResult $PASS 1
+    killStorageServer
+}
+
+# Testing that the btree engine checkpoints its trees instead of writing
+# snapshots, and that a restarted server reopens them and replays the log
+# past the checkpoint.
+function testRecoverCheckpoint {
+    echo "Running testRecoverCheckpoint:"
+    startStorageServer
+    ${LRUNNER} -port=${STORAGE_PORT} p "henry:usrid" before > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "henry:sublist" ivy > /dev/null
+    # Wait for the snapshotter, which runs every 30 seconds.
+    sleep 32
+    ${LRUNNER} -port=${STORAGE_PORT} p "henry:usrid" after > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "ivy:usrid" after > /dev/null
+    killStorageServer
+    # Only the records after the checkpoint are left in the log.
+    PASS=`cat ${DATA_DIR}/wal.log | wc -l`
+    PASS=$((PASS == 2 && `ls ${DATA_DIR} | grep -c snapshot` == 0))
+    startStorageServer
+    PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g "henry:usrid" | grep after | wc -l`))
+    PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g "ivy:usrid" | grep after | wc -l`))
+    PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} lg "henry:sublist" | grep -c "^ivy$"`))
+    checkResult $PASS 4
+    killStorageServer
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+testEngineFiles
+testRecoverLists
+testScanOrder
+testRecoverCheckpoint
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,57 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install tests/errortest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random ports between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STW_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+ERRORTEST=$GOPATH/bin/errortest
+DATA_DIR=$(mktemp -d)
+OUT=/tmp/errortest_$$.txt
+
+${STORAGE_SERVER} -port=${STORAGE_PORT} -datadir=${DATA_DIR} 2> /dev/null &
+STORAGE_SERVER_PID=$!
+sleep 3
+
+# Run the tests, stopping the storage server once those that need it are
+# done.
+${ERRORTEST} -port=${STW_PORT} "localhost:${STORAGE_PORT}" > ${OUT} 2> /dev/null &
+ERRORTEST_PID=$!
+for i in `seq 1 60`
+do
+    if grep -q "Storage server may stop" ${OUT}
+    then
+        break
+    fi
+    sleep 0.5
+done
+kill -9 ${STORAGE_SERVER_PID}
+wait ${STORAGE_SERVER_PID} 2> /dev/null
+wait ${ERRORTEST_PID}
+grep -v "Storage server may stop" ${OUT}
+
+rm -rf ${DATA_DIR} ${OUT}
@@ -0,0 +1,146 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=${REPLICAS} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Kills storage server $1, waits $2 seconds and checks that every key can
+# still be written and read back through the survivors.
+function testWriteAfterFailure {
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} old > /dev/null
+    done
+    kill -9 ${STORAGE_SERVER_PID[$1]}
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    sleep $2
+    PASS=0
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} new > /dev/null 2>&1
+        PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g ${KEY} 2> /dev/null | grep new | wc -l`))
+    done
+    if [ "$PASS" -eq ${#KEYS[@]} ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing writes right after a slave dies, before it is declared dead.
+function testWriteWhileSuspected {
+    echo "Running testWriteWhileSuspected:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=1
+    testWriteAfterFailure 1 0
+}
+
+# Testing writes once the failure detector has declared a slave dead.
+function testWriteAfterDead {
+    echo "Running testWriteAfterDead:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=1
+    testWriteAfterFailure 1 7
+}
+
+# Testing writes once two of four servers are declared dead.
+function testWriteAfterTwoDead {
+    echo "Running testWriteAfterTwoDead:"
+    STORAGE_ID=('1000000000' '2000000000' '3000000000' '4000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=2
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} old > /dev/null
+    done
+    for i in 1 3
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]}
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+    sleep 7
+    PASS=0
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} new > /dev/null 2>&1
+        PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g ${KEY} 2> /dev/null | grep new | wc -l`))
+    done
+    if [ "$PASS" -eq ${#KEYS[@]} ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+testWriteWhileSuspected
+testWriteAfterDead
+testWriteAfterTwoDead
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
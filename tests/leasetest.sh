@@ -0,0 +1,174 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+go install runners/rstoragectl
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+CTL=$GOPATH/bin/rstoragectl
+
+# The server shortens the leases on keys written more than twice within 10
+# seconds, and denies them on keys written four times or more.
+function startStorageServers {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} -leasewrites=2 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 5
+}
+
+function stopStorageServers {
+    kill -9 ${STORAGE_SERVER_PID} 2> /dev/null
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+# Reads the key $1 four times with a libstore holding leases, started with
+# the extra flags $2, and leaves it running as HOLDER_PID.
+function readOften {
+    ${LRUNNER} -port=${STORAGE_PORT} -l -n=4 $2 g "$1" > /dev/null 2>&1 &
+    HOLDER_PID=$!
+    sleep 1
+}
+
+function stopReader {
+    kill -9 ${HOLDER_PID}
+    wait ${HOLDER_PID} 2> /dev/null
+}
+
+# Prints the number of leases on the key $1.
+function countLeases {
+    ${CTL} -port=${STORAGE_PORT} tenants "$1" 2> /dev/null | grep "^$1 " | wc -l
+}
+
+# Prints the number of seconds until the lease on the key $1 expires.
+function leaseRemaining {
+    EXPIRES=`${CTL} -port=${STORAGE_PORT} tenants "$1" 2> /dev/null | grep "^$1 " | awk '{print $4}'`
+    echo $((`date -d "${EXPIRES}" +%s` - `date +%s`))
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that a key read often gets a full lease.
+function testFrequentReads {
+    echo "Running testFrequentReads:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "a:key" 1 > /dev/null
+    readOften "a:key"
+    LEASES=`countLeases "a:key"`
+    REMAINING=`leaseRemaining "a:key"`
+    stopReader
+    if [ "${REMAINING}" -ge 10 ]
+    then
+        checkResult ${LEASES} 1
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that a key written three times gets a shorter lease.
+function testShortenedLease {
+    echo "Running testShortenedLease:"
+    for i in 1 2 3
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "b:key" ${i} > /dev/null
+    done
+    readOften "b:key"
+    LEASES=`countLeases "b:key"`
+    REMAINING=`leaseRemaining "b:key"`
+    stopReader
+    if [ "${REMAINING}" -lt 9 ]
+    then
+        checkResult ${LEASES} 1
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that a key written four times gets no lease.
+function testWriteHeavyKey {
+    echo "Running testWriteHeavyKey:"
+    for i in 1 2 3 4
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "c:key" ${i} > /dev/null
+    done
+    readOften "c:key"
+    LEASES=`countLeases "c:key"`
+    stopReader
+    checkResult ${LEASES} 0
+}
+
+# Testing that a prefix overridden to never lease gets no lease while other
+# prefixes still do.
+function testPrefixOverride {
+    echo "Running testPrefixOverride:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "d:key" 1 > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "e:key" 1 > /dev/null
+    readOften "d:key" "-noleases=d:"
+    LEASES=`countLeases "d:key"`
+    stopReader
+    readOften "e:key" "-noleases=d:"
+    LEASES=$((LEASES + 10 * `countLeases "e:key"`))
+    stopReader
+    checkResult ${LEASES} 10
+}
+
+# Testing that the adaptive policy leases a key that is only read.
+function testAdaptivePolicy {
+    echo "Running testAdaptivePolicy:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "f:key" 1 > /dev/null
+    readOften "f:key" "-policy=adaptive"
+    LEASES=`countLeases "f:key"`
+    stopReader
+    checkResult ${LEASES} 1
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+testFrequentReads
+testShortenedLease
+testWriteHeavyKey
+testPrefixOverride
+testAdaptivePolicy
+stopStorageServers
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,126 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server, the lrunner binary used to talk to it and the
+# tests of the skip lists behind the memory engine.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install tests/skiplisttest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+SKIPLIST_TEST=$GOPATH/bin/skiplisttest
+LRUNNER=$GOPATH/bin/rlibstore
+
+##################################################
+
+# Test the skip list itself.
+${SKIPLIST_TEST}
+
+##################################################
+
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} -engine=${ENGINE} 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Prints items $1 to $2 of the test list, one per line.
+function items {
+    for i in `seq -f "%03g" $1 $2`
+    do
+        echo "item${i}"
+    done
+}
+
+# Testing ranges from both ends of a list, including ones that run past
+# its end, with the storage engine named by ENGINE.
+function testGetListRange {
+    echo "Running testGetListRange (${ENGINE}):"
+    startStorageServer
+    for i in `seq -f "%03g" 120 -1 1`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} la "alice:postlist" "item${i}" > /dev/null
+    done
+    ${LRUNNER} -port=${STORAGE_PORT} lr "alice:postlist" item060 > /dev/null
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} lgr "alice:postlist" 0 3`
+    RESULT="${RESULT}"$'\n'`${LRUNNER} -port=${STORAGE_PORT} -rev lgr "alice:postlist" 0 3`
+    RESULT="${RESULT}"$'\n'`${LRUNNER} -port=${STORAGE_PORT} lgr "alice:postlist" 57 3`
+    RESULT="${RESULT}"$'\n'`${LRUNNER} -port=${STORAGE_PORT} -rev lgr "alice:postlist" 117 5`
+    EXPECTED="$(items 1 3)"$'\n'"$(items 118 120 | sort -r)"$'\n'"item058"$'\n'"item059"$'\n'"item061"$'\n'"$(items 1 2 | sort -r)"
+    checkResult "${RESULT}" "${EXPECTED}"
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} lgr "alice:postlist" 200 3`
+    RESULT="${RESULT}"`${LRUNNER} -port=${STORAGE_PORT} lgr "bob:postlist" 0 3`
+    checkResult "${RESULT}" "ERROR: Key bob:postlist not found"
+    killStorageServer
+}
+
+# Testing the same range of several lists at once, with a missing list
+# left out, with the storage engine named by ENGINE.
+function testMultiGetListRange {
+    echo "Running testMultiGetListRange (${ENGINE}):"
+    startStorageServer
+    for i in `seq -f "%03g" 1 5`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} la "alice:postlist" "item${i}" > /dev/null
+    done
+    ${LRUNNER} -port=${STORAGE_PORT} la "carol:postlist" item001 > /dev/null
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} -rev mglr 0 2 "alice:postlist" "bob:postlist" "carol:postlist"`
+    EXPECTED="alice:postlist item005"$'\n'"alice:postlist item004"$'\n'"carol:postlist item001"
+    checkResult "${RESULT}" "${EXPECTED}"
+    killStorageServer
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+for ENGINE in memory btree
+do
+    testGetListRange
+    testMultiGetListRange
+done
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,37 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the benchmark, which runs its own storage server and libstore.
+# Exit immediately if there was a compile-time error.
+go install tests/lockbench
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+LOCK_BENCH=$GOPATH/bin/lockbench
+
+# Throughput only grows with the goroutines while there are cores to run
+# them; GOMAXPROCS bounds how many are used.
+echo "Running lockbench on $(getconf _NPROCESSORS_ONLN) CPU(s):"
+${LOCK_BENCH} -port=${STORAGE_PORT} "$@" 2> /dev/null
+if [ $? -ne 0 ]; then
+    echo "FAIL: lockbench did not complete"
+    exit 1
+fi
+echo "Passed"
@@ -0,0 +1,163 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+STORAGE_ID=('1000000000' '2000000000' '3000000000' '4000000000')
+KEYS=()
+for i in `seq 1 20`
+do
+    KEYS+=("key${i}:")
+done
+
+# Starts storage server $1. Server 0 is the master; the initial ring has $N
+# servers and any server started after that joins the running ring.
+function startStorageServer {
+    if [ "$1" -eq 0 ]
+    then
+        ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=${REPLICAS} 2> /dev/null &
+    else
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$1]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+    fi
+    STORAGE_SERVER_PID[$1]=$!
+}
+
+function startStorageServers {
+    for i in `seq 0 $((N - 1))`
+    do
+        startStorageServer $i
+    done
+    sleep 5
+}
+
+# Asks storage server $1 to leave the ring and waits until it is gone.
+function leaveStorageServer {
+    kill ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+}
+
+function stopStorageServers {
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        killStorageServer $i
+    done
+}
+
+# Puts value $1 under every key.
+function putKeys {
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} $1 > /dev/null
+    done
+}
+
+# Counts the keys whose value is $1.
+function countKeys {
+    COUNT=0
+    for KEY in "${KEYS[@]}"
+    do
+        COUNT=$((COUNT + `${LRUNNER} -port=${STORAGE_PORT} g ${KEY} 2> /dev/null | grep "^$1$" | wc -l`))
+    done
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that a server joining the ring receives the keys it takes over.
+function testJoin {
+    echo "Running testJoin:"
+    N=2
+    REPLICAS=0
+    startStorageServers
+    putKeys value
+    startStorageServer 2
+    sleep 3
+    countKeys value
+    OLD=$COUNT
+    putKeys newvalue
+    countKeys newvalue
+    checkResult $((OLD + COUNT)) $((2 * ${#KEYS[@]}))
+    stopStorageServers
+}
+
+# Testing that a server leaving the ring hands its keys over.
+function testLeave {
+    echo "Running testLeave:"
+    N=3
+    REPLICAS=0
+    startStorageServers
+    putKeys value
+    leaveStorageServer 1
+    countKeys value
+    OLD=$COUNT
+    putKeys newvalue
+    countKeys newvalue
+    checkResult $((OLD + COUNT)) $((2 * ${#KEYS[@]}))
+    stopStorageServers
+}
+
+# Testing that backups are rebuilt after a server leaves, so that the ring
+# survives losing another server afterwards.
+function testLeaveWithReplicas {
+    echo "Running testLeaveWithReplicas:"
+    N=4
+    REPLICAS=1
+    startStorageServers
+    putKeys value
+    leaveStorageServer 1
+    killStorageServer 2
+    countKeys value
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+testJoin
+testLeave
+testLeaveWithReplicas
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
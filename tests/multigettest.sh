@@ -0,0 +1,122 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+STORAGE_ID=('3000000000' '4000000000' '2000000000')
+KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:' 'shell:' 'counting:')
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=${REPLICAS} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Prints what is expected of a MultiGet of every key, which holds its name.
+function expected {
+    for KEY in "${KEYS[@]}"
+    do
+        echo "${KEY}$1 ${KEY}"
+    done
+}
+
+# Testing that one MultiGet reads keys spread over every server, skipping
+# keys that do not exist.
+function testMultiGet {
+    echo "Running testMultiGet:"
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "${KEY}mg" ${KEY} > /dev/null
+    done
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} mg "${KEYS[@]/%/mg}" missing:mg 2> /dev/null`
+    checkResult "${RESULT}" "$(expected mg)"
+}
+
+# Testing that one MultiGetList reads lists spread over every server.
+function testMultiGetList {
+    echo "Running testMultiGetList:"
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} la "${KEY}mgl" ${KEY} > /dev/null
+    done
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} mgl "${KEYS[@]/%/mgl}" 2> /dev/null`
+    checkResult "${RESULT}" "$(expected mgl)"
+}
+
+# Testing that the keys of a dead server are read from its backups.
+function testMultiGetFailover {
+    echo "Running testMultiGetFailover:"
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} mg "${KEYS[@]/%/mg}" 2> /dev/null`
+    checkResult "${RESULT}" "$(expected mg)"
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+REPLICAS=1
+startStorageServers
+testMultiGet
+testMultiGetList
+testMultiGetFailover
+stopStorageServers
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,135 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+DATA_DIR=$(mktemp -d)
+
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} -datadir=${DATA_DIR} 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that values survive a crash.
+function testRecoverValues {
+    echo "Running testRecoverValues:"
+    startStorageServer
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" value > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "bob:usrid" value > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "bob:usrid" newvalue > /dev/null
+    killStorageServer
+    startStorageServer
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} g "alice:usrid" | grep value | wc -l`
+    PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g "bob:usrid" | grep newvalue | wc -l`))
+    checkResult $PASS 2
+    killStorageServer
+}
+
+# Testing that list updates survive a crash.
+function testRecoverLists {
+    echo "Running testRecoverLists:"
+    startStorageServer
+    ${LRUNNER} -port=${STORAGE_PORT} la "alice:sublist" bob > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "alice:sublist" carol > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "alice:sublist" dave > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} lr "alice:sublist" carol > /dev/null
+    killStorageServer
+    startStorageServer
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} lg "alice:sublist" | grep -E "^(bob|dave)$" | wc -l`
+    FAIL=`${LRUNNER} -port=${STORAGE_PORT} lg "alice:sublist" | grep carol | wc -l`
+    checkResult $((PASS - FAIL)) 2
+    killStorageServer
+}
+
+# Testing that writes made before and after a snapshot survive a crash.
+function testRecoverSnapshot {
+    echo "Running testRecoverSnapshot:"
+    startStorageServer
+    ${LRUNNER} -port=${STORAGE_PORT} p "carol:usrid" before > /dev/null
+    # Wait for the snapshotter, which runs every 30 seconds.
+    sleep 32
+    ${LRUNNER} -port=${STORAGE_PORT} p "dave:usrid" after > /dev/null
+    killStorageServer
+    startStorageServer
+    PASS=`${LRUNNER} -port=${STORAGE_PORT} g "carol:usrid" | grep before | wc -l`
+    PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g "dave:usrid" | grep after | wc -l`))
+    checkResult $PASS 2
+    killStorageServer
+}
+
+# Testing that a corrupt record followed by others in the write-ahead log
+# stops the server from starting, rather than being cut off along with them.
+function testCorruptLog {
+    echo "Running testCorruptLog:"
+    startStorageServer
+    ${LRUNNER} -port=${STORAGE_PORT} p "erin:usrid" value > /dev/null
+    killStorageServer
+    LINES=`cat ${DATA_DIR}/wal.log | wc -l`
+    echo "corrupt" >> ${DATA_DIR}/wal.log
+    head -n 1 ${DATA_DIR}/wal.log >> ${DATA_DIR}/wal.log
+    startStorageServer
+    PASS=0
+    if ! kill -0 ${STORAGE_SERVER_PID} 2> /dev/null
+    then
+        PASS=1
+    fi
+    killStorageServer 2> /dev/null
+    PASS=$((PASS + `cat ${DATA_DIR}/wal.log | wc -l` - LINES - 1))
+    checkResult $PASS 2
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+testRecoverValues
+testRecoverLists
+testRecoverSnapshot
+testCorruptLog
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,217 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install tests/stwtest
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+STWTEST=$GOPATH/bin/stwtest
+STW_PORT=$(((RANDOM % 10000) + 20000))
+STORAGE_ID=('3000000000' '4000000000' '2000000000')
+KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+DATA_DIR=$(mktemp -d)
+RAFT_FLAGS="-raft"
+
+# Starts storage server $1 of the Raft ring on localhost.
+function startStorageServer {
+    if [ "$1" -eq 0 ]
+    then
+        ${STORAGE_SERVER} -N=${#STORAGE_ID[@]} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=2 ${RAFT_FLAGS} -datadir=${DATA_DIR}/0 2> /dev/null &
+    else
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$1]} -port=${STORAGE_SLAVE_PORT[$1]} -master="localhost:${STORAGE_PORT}" ${RAFT_FLAGS} -datadir=${DATA_DIR}/$1 2> /dev/null &
+    fi
+    STORAGE_SERVER_PID[$1]=$!
+}
+
+function startStorageServers {
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        STORAGE_SLAVE_PORT[$i]=$(((RANDOM % 10000) + 10000))
+        startStorageServer $i
+    done
+    sleep 5
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+}
+
+function stopStorageServers {
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        killStorageServer $i
+    done
+    rm -rf ${DATA_DIR}/*
+}
+
+# Puts value $1 under every key.
+function putKeys {
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} $1 > /dev/null
+    done
+}
+
+# Counts the keys whose value is $1.
+function countKeys {
+    COUNT=0
+    for KEY in "${KEYS[@]}"
+    do
+        COUNT=$((COUNT + `${LRUNNER} -port=${STORAGE_PORT} g ${KEY} 2> /dev/null | grep "^$1$" | wc -l`))
+    done
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing reads and writes through the Raft groups.
+function testRaftReadWrite {
+    echo "Running testRaftReadWrite:"
+    startStorageServers
+    putKeys value
+    ${LRUNNER} -port=${STORAGE_PORT} la "list:" item > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "list:" item2 > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} lr "list:" item > /dev/null
+    countKeys value
+    LIST=`${LRUNNER} -port=${STORAGE_PORT} lg "list:" | grep -E "^item2?$" | wc -l`
+    checkResult $((COUNT + LIST)) $((${#KEYS[@]} + 1))
+    stopStorageServers
+}
+
+# Testing that a ring keeps working with one server down.
+function testRaftServerFailure {
+    echo "Running testRaftServerFailure:"
+    startStorageServers
+    putKeys value
+    killStorageServer 1
+    putKeys newvalue
+    countKeys newvalue
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+}
+
+# Testing that a restarted server catches up on the writes it missed.
+function testRaftCatchUp {
+    echo "Running testRaftCatchUp:"
+    startStorageServers
+    putKeys value
+    killStorageServer 1
+    putKeys newvalue
+    startStorageServer 1
+    sleep 3
+    killStorageServer 2
+    countKeys newvalue
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+}
+
+# Testing that a restarted server that missed compacted writes is sent a
+# snapshot.
+function testRaftSnapshotCatchUp {
+    echo "Running testRaftSnapshotCatchUp:"
+    RAFT_FLAGS="-raft -raftlog=10"
+    startStorageServers
+    putKeys value
+    killStorageServer 1
+    for i in `seq 1 12`
+    do
+        putKeys value$i
+    done
+    startStorageServer 1
+    sleep 5
+    killStorageServer 2
+    countKeys value12
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+    RAFT_FLAGS="-raft"
+}
+
+# Testing that a restarted ring recovers its keys from the snapshots and the
+# rest of the logs.
+function testRaftSnapshotRestart {
+    echo "Running testRaftSnapshotRestart:"
+    RAFT_FLAGS="-raft -raftlog=10"
+    startStorageServers
+    for i in `seq 1 12`
+    do
+        putKeys value$i
+    done
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        killStorageServer $i
+    done
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        startStorageServer $i
+    done
+    sleep 5
+    countKeys value12
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+    RAFT_FLAGS="-raft"
+}
+
+# Testing that an app server posts and deletes posts on the Raft ring,
+# which leaves transactions out.
+function testRaftPost {
+    echo "Running testRaftPost:"
+    startStorageServers
+    RESULT=`${STWTEST} -port=${STW_PORT} -t "Post" "localhost:${STORAGE_PORT}" 2> /dev/null | grep "^Passed"`
+    PASSED=`echo ${RESULT} | sed -E 's/Passed \(([0-9]+)\/([0-9]+)\) tests/\1/'`
+    TOTAL=`echo ${RESULT} | sed -E 's/Passed \(([0-9]+)\/([0-9]+)\) tests/\2/'`
+    checkResult ${PASSED:-0} ${TOTAL:--1}
+    stopStorageServers
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+testRaftReadWrite
+testRaftServerFailure
+testRaftCatchUp
+testRaftSnapshotCatchUp
+testRaftSnapshotRestart
+testRaftPost
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,140 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=${REPLICAS} \
+        -writequorum=${QUORUM} 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" \
+            -writequorum=${QUORUM} 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Writes every key, kills storage server $1 and checks that every key can
+# still be read from the survivors.
+function testFailover {
+    startStorageServers
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} value > /dev/null
+    done
+    kill -9 ${STORAGE_SERVER_PID[$1]}
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    PASS=0
+    for KEY in "${KEYS[@]}"
+    do
+        PASS=$((PASS + `${LRUNNER} -port=${STORAGE_PORT} g ${KEY} 2> /dev/null | grep value | wc -l`))
+    done
+    if [ "$PASS" -eq ${#KEYS[@]} ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+    stopStorageServers
+}
+
+# Testing reads after a slave dies.
+function testFailoverOneBackup {
+    echo "Running testFailoverOneBackup:"
+    STORAGE_ID=('3000000000' '4000000000' '2000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=1
+    testFailover 1
+}
+
+# Testing reads after a slave dies with every range on every node.
+function testFailoverTwoBackups {
+    echo "Running testFailoverTwoBackups:"
+    STORAGE_ID=('2000000000' '2500000000' '3000000000')
+    KEYS=('bubble:' 'insertion:' 'merge:' 'heap:' 'quick:' 'radix:')
+    REPLICAS=2
+    testFailover 2
+}
+
+# Testing that a write which fewer replicas than the write quorum apply
+# fails as unavailable, while staying on the primary, and that one meeting
+# the quorum succeeds.
+function testWriteQuorum {
+    echo "Running testWriteQuorum:"
+    STORAGE_ID=('3000000000' '4000000000')
+    REPLICAS=1
+    QUORUM=3
+    startStorageServers
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} p bubble: value 2> /dev/null | grep -c "no storage server available"`
+    RESULT="${RESULT} `${LRUNNER} -port=${STORAGE_PORT} g bubble: 2> /dev/null`"
+    stopStorageServers
+    QUORUM=2
+    startStorageServers
+    RESULT="${RESULT} `${LRUNNER} -port=${STORAGE_PORT} p bubble: value 2> /dev/null`"
+    stopStorageServers
+    QUORUM=0
+    if [ "${RESULT}" == "1 value OK" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+QUORUM=0
+testFailoverOneBackup
+testFailoverTwoBackups
+testWriteQuorum
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,125 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+DATA_DIR=$(mktemp -d)
+OUT=/tmp/retrytest_$$.txt
+
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} -datadir=${DATA_DIR} 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that a libstore whose storage server restarts fails the reads
+# made meanwhile with an unavailable error and reconnects afterwards.
+function testReconnect {
+    echo "Running testReconnect:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" value > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} -n=20 -every=500ms g "alice:usrid" > ${OUT} 2> /dev/null &
+    READER_PID=$!
+    sleep 2
+    killStorageServer
+    sleep 3
+    startStorageServer
+    wait ${READER_PID}
+    BEFORE=`head -1 ${OUT} | grep "^value$" | wc -l`
+    FAILED=`grep "no storage server available" ${OUT} | wc -l`
+    AFTER=`tail -1 ${OUT} | grep "^value$" | wc -l`
+    if [ "${FAILED}" -ge 1 ]
+    then
+        checkResult $((BEFORE + AFTER)) 2
+    else
+        checkResult 0 1
+    fi
+}
+
+# Testing that a read made while the storage server is briefly frozen is
+# retried until it succeeds.
+function testRetryRead {
+    echo "Running testRetryRead:"
+    ${LRUNNER} -port=${STORAGE_PORT} -calltimeout=300ms -n=2 -every=2s g "alice:usrid" > ${OUT} 2> /dev/null &
+    READER_PID=$!
+    sleep 1
+    kill -STOP ${STORAGE_SERVER_PID}
+    sleep 1.6
+    kill -CONT ${STORAGE_SERVER_PID}
+    wait ${READER_PID}
+    PASS=`grep "^value$" ${OUT} | wc -l`
+    checkResult ${PASS} 2
+}
+
+# Testing that reads from a storage server that stopped answering time out
+# instead of hanging, and that the libstore recovers once it answers again.
+function testCallTimeout {
+    echo "Running testCallTimeout:"
+    ${LRUNNER} -port=${STORAGE_PORT} -calltimeout=1s -n=3 -every=2s g "alice:usrid" > ${OUT} 2> /dev/null &
+    READER_PID=$!
+    sleep 1
+    kill -STOP ${STORAGE_SERVER_PID}
+    sleep 12
+    kill -CONT ${STORAGE_SERVER_PID}
+    wait ${READER_PID}
+    PASS=`sed -n 1p ${OUT} | grep "^value$" | wc -l`
+    PASS=$((PASS + `sed -n 2p ${OUT} | grep "no storage server available" | wc -l`))
+    PASS=$((PASS + `sed -n 3p ${OUT} | grep "^value$" | wc -l`))
+    checkResult ${PASS} 3
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServer
+testReconnect
+testRetryRead
+testCallTimeout
+killStorageServer
+rm -rf ${DATA_DIR} ${OUT}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,114 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+
+# Starts a single storage server with the extra flags given as arguments.
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} "$@" 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Prints the number of seconds since the Unix epoch.
+function now {
+    date +%s
+}
+
+# Testing that a libstore that died holding a lease neither crashes the
+# storage server nor holds up writes to other keys, and that writes to the
+# leased key go through once the lease has expired.
+function testDeadLeaseHolder {
+    echo "Running testDeadLeaseHolder:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" old > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} -l -fl g "alice:usrid" > /dev/null 2>&1 &
+    HOLDER_PID=$!
+    sleep 1
+    kill -9 ${HOLDER_PID}
+    wait ${HOLDER_PID} 2> /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" new > /dev/null &
+    WRITER_PID=$!
+    sleep 1
+    START=`now`
+    OTHER=`${LRUNNER} -port=${STORAGE_PORT} p "bob:usrid" value 2> /dev/null`
+    READ=`${LRUNNER} -port=${STORAGE_PORT} g "bob:usrid" 2> /dev/null`
+    FAST=$(( `now` - START <= 2 ))
+    wait ${WRITER_PID}
+    AFTER=`${LRUNNER} -port=${STORAGE_PORT} g "alice:usrid" 2> /dev/null`
+    checkResult "${OTHER} ${READ} ${FAST} ${AFTER}" "OK value 1 new"
+}
+
+# Testing that the leases of several libstores are revoked at once, so that
+# a write waits for the slowest one rather than for all of them in turn.
+function testParallelRevoke {
+    echo "Running testParallelRevoke:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "carol:usrid" old > /dev/null
+    HOLDER_PIDS=()
+    for i in `seq 1 3`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} -l -fl g "carol:usrid" > /dev/null 2>&1 &
+        HOLDER_PIDS+=($!)
+    done
+    sleep 1
+    # Dead holders are waited out until their leases expire, in parallel.
+    kill -9 ${HOLDER_PIDS[@]}
+    wait ${HOLDER_PIDS[@]} 2> /dev/null
+    START=`now`
+    ${LRUNNER} -port=${STORAGE_PORT} p "carol:usrid" new > /dev/null
+    ELAPSED=$(( `now` - START ))
+    checkResult `[ ${ELAPSED} -lt 20 ] && echo yes` yes
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServer
+testDeadLeaseHolder
+testParallelRevoke
+killStorageServer
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
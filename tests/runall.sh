@@ -19,4 +19,27 @@ $GOPATH/tests/libtest.sh
 $GOPATH/tests/libtest2.sh
 $GOPATH/tests/storagetest.sh
 $GOPATH/tests/storagetest2.sh
-$GOPATH/tests/stresstest.sh
\ No newline at end of file
+$GOPATH/tests/stresstest.sh
+$GOPATH/tests/persisttest.sh
+$GOPATH/tests/replicatest.sh
+$GOPATH/tests/rafttest.sh
+$GOPATH/tests/membertest.sh
+$GOPATH/tests/fdtest.sh
+$GOPATH/tests/vnodetest.sh
+$GOPATH/tests/scantest.sh
+$GOPATH/tests/versiontest.sh
+$GOPATH/tests/multigettest.sh
+$GOPATH/tests/ttltest.sh
+$GOPATH/tests/revoketest.sh
+$GOPATH/tests/enginetest.sh
+$GOPATH/tests/listrangetest.sh
+$GOPATH/tests/antientropytest.sh
+$GOPATH/tests/backuptest.sh
+$GOPATH/tests/admintest.sh
+$GOPATH/tests/watchtest.sh
+$GOPATH/tests/txntest.sh
+$GOPATH/tests/leasetest.sh
+$GOPATH/tests/cachetest.sh
+$GOPATH/tests/retrytest.sh
+$GOPATH/tests/errortest.sh
+$GOPATH/tests/deadlinetest.sh
@@ -0,0 +1,148 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+STORAGE_ID=('1000000000' '2000000000' '3000000000')
+USERS=('alice' 'bob' 'carol' 'dave' 'erin' 'frank' 'grace' 'heidi')
+POSTS=('post_1' 'post_2' 'post_3' 'post_4' 'post_5')
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=1 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Stores a user key for every user and a post key for every post of alice.
+function putKeys {
+    for USER in "${USERS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${USER}:usrid ${USER} > /dev/null
+    done
+    for POST in "${POSTS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p alice:${POST} hello > /dev/null
+    done
+}
+
+# Scans prefix $1 with limit $2 page by page and leaves the keys in SCANNED,
+# one per line.
+function scanAll {
+    SCANNED=""
+    NEXT=""
+    while true
+    do
+        OUT=`${LRUNNER} -port=${STORAGE_PORT} sc "$1" "${NEXT}" $2 2> /dev/null`
+        if [ -n "`echo "${OUT}" | grep '^ERROR'`" ]
+        then
+            SCANNED="ERROR"
+            return
+        fi
+        SCANNED="${SCANNED}`echo "${OUT}" | grep -v '^NEXT: '`
+"
+        NEXT=`echo "${OUT}" | grep '^NEXT: ' | cut -d' ' -f2`
+        if [ -z "${NEXT}" ]
+        then
+            break
+        fi
+    done
+    SCANNED=`echo "${SCANNED}" | grep -v '^$'`
+}
+
+# Checks that SCANNED holds exactly the keys given as arguments, in order.
+function checkScanned {
+    if [ "${SCANNED}" == "`printf '%s\n' "$@" | LC_ALL=C sort`" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing a scan of a prefix that lives on a single partition.
+function testScanPartition {
+    echo "Running testScanPartition:"
+    scanAll "alice:post" 0
+    checkScanned "${POSTS[@]/#/alice:}"
+}
+
+# Testing a scan across the whole ring.
+function testScanRing {
+    echo "Running testScanRing:"
+    scanAll "" 0
+    checkScanned "${USERS[@]/%/:usrid}" "${POSTS[@]/#/alice:}"
+}
+
+# Testing that paging through a scan with continuation tokens returns every
+# key once.
+function testScanPaging {
+    echo "Running testScanPaging:"
+    scanAll "" 3
+    checkScanned "${USERS[@]/%/:usrid}" "${POSTS[@]/#/alice:}"
+}
+
+# Testing that a ring-wide scan still sees every key once a server is dead.
+function testScanAfterFailure {
+    echo "Running testScanAfterFailure:"
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+    scanAll "" 4
+    checkScanned "${USERS[@]/%/:usrid}" "${POSTS[@]/#/alice:}"
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+putKeys
+testScanPartition
+testScanRing
+testScanPaging
+testScanAfterFailure
+stopStorageServers
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
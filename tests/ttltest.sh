@@ -0,0 +1,144 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+DATA_DIR=$(mktemp -d)
+
+# Starts a single storage server with the extra flags given as arguments.
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} "$@" 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Prints what a Get of key $1 returns.
+function get {
+    ${LRUNNER} -port=${STORAGE_PORT} g $1 2> /dev/null | cut -d' ' -f1
+}
+
+# Testing that a key written with a TTL is readable until it expires.
+function testPutExpires {
+    echo "Running testPutExpires:"
+    ${LRUNNER} -port=${STORAGE_PORT} -ttl=2 p "alice:session" token > /dev/null
+    BEFORE=`get "alice:session"`
+    sleep 3
+    AFTER=`get "alice:session"`
+    checkResult "${BEFORE} ${AFTER}" "token ERROR:"
+}
+
+# Testing that a Put without a TTL makes a key permanent again.
+function testPutClearsTTL {
+    echo "Running testPutClearsTTL:"
+    ${LRUNNER} -port=${STORAGE_PORT} -ttl=2 p "bob:session" token > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "bob:session" forever > /dev/null
+    sleep 3
+    checkResult "`get "bob:session"`" "forever"
+}
+
+# Testing that a list expires as a whole, appends without a TTL leaving its
+# expiry time alone.
+function testListExpires {
+    echo "Running testListExpires:"
+    ${LRUNNER} -port=${STORAGE_PORT} -ttl=2 la "carol:stories" 1 > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "carol:stories" 2 > /dev/null
+    BEFORE=`${LRUNNER} -port=${STORAGE_PORT} lg "carol:stories" 2> /dev/null | wc -l`
+    sleep 3
+    AFTER=`${LRUNNER} -port=${STORAGE_PORT} lg "carol:stories" 2> /dev/null | cut -d' ' -f1`
+    checkResult "${BEFORE} ${AFTER}" "2 ERROR:"
+}
+
+# Testing that an expired key can be created again.
+function testCreateAfterExpiry {
+    echo "Running testCreateAfterExpiry:"
+    ${LRUNNER} -port=${STORAGE_PORT} -ttl=1 p "dave:ratelimit" 10 > /dev/null
+    FIRST=`${LRUNNER} -port=${STORAGE_PORT} pa "dave:ratelimit" 9 2> /dev/null | cut -d' ' -f1`
+    sleep 2
+    SECOND=`${LRUNNER} -port=${STORAGE_PORT} pa "dave:ratelimit" 8 2> /dev/null | cut -d' ' -f1`
+    checkResult "${FIRST} ${SECOND} `get "dave:ratelimit"`" "CONFLICT OK 8"
+}
+
+# Testing that expired keys do not show up in scans.
+function testScanSkipsExpired {
+    echo "Running testScanSkipsExpired:"
+    ${LRUNNER} -port=${STORAGE_PORT} -ttl=1 p "erin:story_1" a > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "erin:story_2" b > /dev/null
+    sleep 2
+    checkResult "`${LRUNNER} -port=${STORAGE_PORT} sc "erin:story_" "" 0 2> /dev/null`" "erin:story_2"
+}
+
+# Testing that expiry times survive a crash.
+function testExpiryRecovered {
+    echo "Running testExpiryRecovered:"
+    ${LRUNNER} -port=${STORAGE_PORT} -ttl=6 p "frank:session" token > /dev/null
+    killStorageServer
+    startStorageServer -datadir=${DATA_DIR}
+    BEFORE=`get "frank:session"`
+    sleep 4
+    AFTER=`get "frank:session"`
+    checkResult "${BEFORE} ${AFTER}" "token ERROR:"
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServer
+testPutExpires
+testPutClearsTTL
+testListExpires
+testCreateAfterExpiry
+testScanSkipsExpired
+killStorageServer
+startStorageServer -datadir=${DATA_DIR}
+testExpiryRecovered
+killStorageServer
+startStorageServer -raft
+testPutExpires
+testCreateAfterExpiry
+killStorageServer
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,166 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+STORAGE_ID=('3000000000' '1000000000' '2000000000')
+OUT=$(mktemp)
+DATA_DIR=$(mktemp -d)
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=1 \
+        -datadir=${DATA_DIR}/0 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" \
+            -datadir=${DATA_DIR}/$i 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that a transaction over keys spread across the ring applies every
+# one of its writes.
+function testTxnCommit {
+    echo "Running testTxnCommit:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "amy:usrid" amy > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "ben:sublist" amy > /dev/null
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} tx p "amy:usrid" amy2 lr "ben:sublist" amy \
+        la "cat:sublist" amy p "dan:usrid" dan`
+    # A transaction may not write the same key twice.
+    DUP=`${LRUNNER} -port=${STORAGE_PORT} tx p "amy:usrid" amy3 d "amy:usrid" | cut -c1-5`
+    ${LRUNNER} -port=${STORAGE_PORT} mg "amy:usrid" "dan:usrid" > ${OUT}
+    ${LRUNNER} -port=${STORAGE_PORT} mgl "ben:sublist" "cat:sublist" >> ${OUT}
+    checkResult "${RESULT} ${DUP} `cat ${OUT} | tr '\n' ','`" "OK ERROR amy:usrid amy2,dan:usrid dan,cat:sublist amy,"
+}
+
+# Testing that a transaction with a write that fails applies none of its
+# writes.
+function testTxnAbort {
+    echo "Running testTxnAbort:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "eve:usrid" eve > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "fay:sublist" eve > /dev/null
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} tx p "eve:usrid" eve2 la "fay:sublist" gus \
+        p "gus:usrid" gus lr "hal:sublist" eve | cut -c1-5`
+    ${LRUNNER} -port=${STORAGE_PORT} mg "eve:usrid" "gus:usrid" > ${OUT}
+    ${LRUNNER} -port=${STORAGE_PORT} mgl "fay:sublist" >> ${OUT}
+    checkResult "${RESULT} `cat ${OUT} | tr '\n' ','`" "ERROR eve:usrid eve,fay:sublist eve,"
+}
+
+# Testing that concurrent transactions writing the same keys are applied
+# one after the other, never interleaved.
+function testTxnConcurrent {
+    echo "Running testTxnConcurrent:"
+    for i in `seq 1 10`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} tx p "ian:usrid" $i p "jo:usrid" $i p "kim:usrid" $i > /dev/null &
+        PIDS[$i]=$!
+    done
+    for i in `seq 1 10`
+    do
+        wait ${PIDS[$i]}
+    done
+    VALUES=`${LRUNNER} -port=${STORAGE_PORT} mg "ian:usrid" "jo:usrid" "kim:usrid" | awk '{print $2}' | sort -u`
+    checkResult "`echo ${VALUES} | wc -w`" "1"
+}
+
+# Testing that transactions go on once a storage server dies, with the
+# backups of its key ranges taking part instead.
+function testTxnAfterFailure {
+    echo "Running testTxnAfterFailure:"
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+    sleep 2
+    ARGS=""
+    for i in `seq 0 9`
+    do
+        ARGS="${ARGS} p lee_$i:usrid lee"
+    done
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} tx ${ARGS} 2> /dev/null`
+    COUNT=`${LRUNNER} -port=${STORAGE_PORT} sc "lee_" "" 0 2> /dev/null | wc -l`
+    checkResult "${RESULT} ${COUNT}" "OK 10"
+}
+
+# Testing that a storage server without a data directory, which could not
+# keep its transaction log over a restart, refuses transactions.
+function testTxnWithoutDataDir {
+    echo "Running testTxnWithoutDataDir:"
+    PORT=$(((RANDOM % 10000) + 10000))
+    ${STORAGE_SERVER} -port=${PORT} 2> /dev/null &
+    PID=$!
+    sleep 2
+    RESULT=`${LRUNNER} -port=${PORT} tx p "mo:usrid" mo p "ned:usrid" ned 2> /dev/null | cut -c1-6`
+    MISSING=`${LRUNNER} -port=${PORT} g "mo:usrid" 2> /dev/null`
+    kill -9 ${PID} 2> /dev/null
+    wait ${PID} 2> /dev/null
+    checkResult "${RESULT} ${MISSING}" "ERROR: ERROR: Key mo:usrid not found"
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+testTxnCommit
+testTxnAbort
+testTxnConcurrent
+testTxnAfterFailure
+stopStorageServers
+testTxnWithoutDataDir
+rm -f ${OUT}
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,147 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+DATA_DIR=$(mktemp -d)
+
+# Starts a single storage server with the extra flags given as arguments.
+function startStorageServer {
+    ${STORAGE_SERVER} -port=${STORAGE_PORT} "$@" 2> /dev/null &
+    STORAGE_SERVER_PID=$!
+    sleep 3
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID}
+    wait ${STORAGE_SERVER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Prints the version of key $1.
+function versionOf {
+    ${LRUNNER} -port=${STORAGE_PORT} gv $1 2> /dev/null | awk '{print $NF}'
+}
+
+# Testing that PutIfAbsent only creates a key once.
+function testPutIfAbsent {
+    echo "Running testPutIfAbsent:"
+    FIRST=`${LRUNNER} -port=${STORAGE_PORT} pa "alice:usrid" x 2> /dev/null | cut -d' ' -f1`
+    SECOND=`${LRUNNER} -port=${STORAGE_PORT} pa "alice:usrid" y 2> /dev/null | cut -d' ' -f1`
+    checkResult "${FIRST} ${SECOND}" "OK CONFLICT"
+}
+
+# Testing that every write moves a key to a higher version.
+function testVersionsGrow {
+    echo "Running testVersionsGrow:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "bob:usrid" 1 > /dev/null
+    V1=`versionOf "bob:usrid"`
+    ${LRUNNER} -port=${STORAGE_PORT} p "bob:usrid" 2 > /dev/null
+    V2=`versionOf "bob:usrid"`
+    checkResult `[ -n "${V1}" ] && [ "${V2}" -gt "${V1}" ] && echo yes` yes
+}
+
+# Testing that ConditionalPut only succeeds for the current version.
+function testConditionalPut {
+    echo "Running testConditionalPut:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "carol:usrid" 1 > /dev/null
+    V=`versionOf "carol:usrid"`
+    FIRST=`${LRUNNER} -port=${STORAGE_PORT} cp "carol:usrid" 2 ${V} 2> /dev/null | cut -d' ' -f1`
+    SECOND=`${LRUNNER} -port=${STORAGE_PORT} cp "carol:usrid" 3 ${V} 2> /dev/null | cut -d' ' -f1`
+    VALUE=`${LRUNNER} -port=${STORAGE_PORT} g "carol:usrid" 2> /dev/null`
+    checkResult "${FIRST} ${SECOND} ${VALUE}" "OK CONFLICT 2"
+}
+
+# Testing that CompareAndSwap only succeeds for the current value.
+function testCompareAndSwap {
+    echo "Running testCompareAndSwap:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "dave:usrid" old > /dev/null
+    FIRST=`${LRUNNER} -port=${STORAGE_PORT} cas "dave:usrid" wrong new 2> /dev/null | cut -d' ' -f1`
+    SECOND=`${LRUNNER} -port=${STORAGE_PORT} cas "dave:usrid" old new 2> /dev/null | cut -d' ' -f1`
+    THIRD=`${LRUNNER} -port=${STORAGE_PORT} cas "dave:usrid" old newer 2> /dev/null | cut -d' ' -f1`
+    checkResult "${FIRST} ${SECOND} ${THIRD}" "CONFLICT OK CONFLICT"
+}
+
+# Testing that of many concurrent PutIfAbsents of a key exactly one wins.
+function testConcurrentCreate {
+    echo "Running testConcurrentCreate:"
+    OUT=$(mktemp)
+    PIDS=()
+    for i in `seq 1 10`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} pa "$1:usrid" ${i} >> ${OUT} 2> /dev/null &
+        PIDS+=($!)
+    done
+    wait ${PIDS[@]}
+    checkResult `grep -c '^OK' ${OUT}` 1
+    rm -f ${OUT}
+}
+
+# Testing that versions survive a crash, so that a version read before it
+# still names the current value.
+function testVersionsRecovered {
+    echo "Running testVersionsRecovered:"
+    ${LRUNNER} -port=${STORAGE_PORT} p "erin:usrid" 1 > /dev/null
+    V=`versionOf "erin:usrid"`
+    killStorageServer
+    startStorageServer -datadir=${DATA_DIR}
+    RESULT=`${LRUNNER} -port=${STORAGE_PORT} cp "erin:usrid" 2 ${V} 2> /dev/null | cut -d' ' -f1`
+    checkResult "${RESULT}" "OK"
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServer
+testPutIfAbsent
+testVersionsGrow
+testConditionalPut
+testCompareAndSwap
+testConcurrentCreate frank
+killStorageServer
+startStorageServer -datadir=${DATA_DIR}
+testVersionsRecovered
+killStorageServer
+startStorageServer -raft
+testConcurrentCreate grace
+killStorageServer
+rm -rf ${DATA_DIR}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,198 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rring
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+RRING=$GOPATH/bin/rring
+STORAGE_ID=('1000000000' '2000000000' '3000000000' '4000000000')
+WEIGHT=(1 1 1 1)
+KEYS=()
+for i in `seq 1 20`
+do
+    KEYS+=("key${i}:")
+done
+
+# Starts storage server $1 with ${VNODES} virtual nodes per unit of weight.
+# Server 0 is the master; any server started after the initial $N joins the
+# running ring.
+function startStorageServer {
+    if [ "$1" -eq 0 ]
+    then
+        ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=${REPLICAS} -vnodes=${VNODES} -weight=${WEIGHT[0]} 2> /dev/null &
+    else
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$1]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" -weight=${WEIGHT[$1]} 2> /dev/null &
+    fi
+    STORAGE_SERVER_PID[$1]=$!
+}
+
+function startStorageServers {
+    for i in `seq 0 $((N - 1))`
+    do
+        startStorageServer $i
+    done
+    sleep 5
+}
+
+function killStorageServer {
+    kill -9 ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+    wait ${STORAGE_SERVER_PID[$1]} 2> /dev/null
+}
+
+function stopStorageServers {
+    for i in `seq 0 $((${#STORAGE_ID[@]} - 1))`
+    do
+        killStorageServer $i
+    done
+}
+
+# Puts value $1 under every key.
+function putKeys {
+    for KEY in "${KEYS[@]}"
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p ${KEY} $1 > /dev/null
+    done
+}
+
+# Counts the keys whose value is $1.
+function countKeys {
+    COUNT=0
+    for KEY in "${KEYS[@]}"
+    do
+        COUNT=$((COUNT + `${LRUNNER} -port=${STORAGE_PORT} g ${KEY} 2> /dev/null | grep "^$1$" | wc -l`))
+    done
+}
+
+# Sets SHARE to the percentage of the hash space, rounded down, that
+# storage server $1 owns according to rring.
+function shareOf {
+    SHARE=`${RRING} -port=${STORAGE_PORT} 2> /dev/null | grep "^${STORAGE_ID[$1]} " | awk '{print $NF}' | cut -d. -f1`
+    if [ -z "${SHARE}" ]
+    then
+        SHARE=0
+    fi
+}
+
+function checkResult {
+    if [ "$1" -eq "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that keys stay readable through a backup when a server dies.
+function testFailoverWithVirtualNodes {
+    echo "Running testFailoverWithVirtualNodes:"
+    N=3
+    REPLICAS=1
+    VNODES=16
+    WEIGHT=(1 1 1 1)
+    startStorageServers
+    putKeys value
+    killStorageServer 1
+    countKeys value
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+}
+
+# Testing that the node IDs do not skew the split: without virtual nodes
+# these IDs give server 0 over half of the ring, with them about a third.
+function testEvenShares {
+    echo "Running testEvenShares:"
+    N=3
+    REPLICAS=0
+    VNODES=64
+    WEIGHT=(1 1 1 1)
+    startStorageServers
+    shareOf 0
+    PASS=0
+    if [ "${SHARE}" -ge 20 ] && [ "${SHARE}" -le 45 ]
+    then
+        PASS=1
+    fi
+    checkResult $PASS 1
+    stopStorageServers
+}
+
+# Testing that a server of weight 4 next to two of weight 1 owns about two
+# thirds of the ring.
+function testWeightedShares {
+    echo "Running testWeightedShares:"
+    N=3
+    REPLICAS=0
+    VNODES=64
+    WEIGHT=(1 1 4 1)
+    startStorageServers
+    shareOf 2
+    PASS=0
+    if [ "${SHARE}" -ge 55 ] && [ "${SHARE}" -le 78 ]
+    then
+        PASS=1
+    fi
+    checkResult $PASS 1
+    stopStorageServers
+}
+
+# Testing that a server joining a ring of virtual nodes receives the keys it
+# takes over.
+function testJoinWithVirtualNodes {
+    echo "Running testJoinWithVirtualNodes:"
+    N=2
+    REPLICAS=0
+    VNODES=16
+    WEIGHT=(1 1 1 1)
+    startStorageServers
+    putKeys value
+    startStorageServer 2
+    sleep 3
+    countKeys value
+    checkResult $COUNT ${#KEYS[@]}
+    stopStorageServers
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+testFailoverWithVirtualNodes
+testEvenShares
+testWeightedShares
+testJoinWithVirtualNodes
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"
@@ -0,0 +1,144 @@
+#!/bin/bash
+
+if [ -z $GOPATH ]; then
+    echo "FAIL: GOPATH environment variable is not set"
+    exit 1
+fi
+
+if [ -n "$(go version | grep 'darwin/amd64')" ]; then    
+    GOOS="darwin_amd64"
+elif [ -n "$(go version | grep 'linux/amd64')" ]; then
+    GOOS="linux_amd64"
+else
+    echo "FAIL: only 64-bit Mac OS X and Linux operating systems are supported"
+    exit 1
+fi
+
+# Build the storage server and the lrunner binary used to talk to it.
+# Exit immediately if there was a compile-time error.
+go install runners/rstorage
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+go install runners/rlibstore
+if [ $? -ne 0 ]; then
+   echo "FAIL: code does not compile"
+   exit $?
+fi
+
+# Pick random port between [10000, 20000).
+STORAGE_PORT=$(((RANDOM % 10000) + 10000))
+STORAGE_SERVER=$GOPATH/bin/rstorage
+LRUNNER=$GOPATH/bin/rlibstore
+STORAGE_ID=('3000000000' '1000000000' '2000000000')
+OUT=$(mktemp)
+
+function startStorageServers {
+    N=${#STORAGE_ID[@]}
+    # Start master storage server.
+    ${STORAGE_SERVER} -N=${N} -id=${STORAGE_ID[0]} -port=${STORAGE_PORT} -replicas=1 2> /dev/null &
+    STORAGE_SERVER_PID[0]=$!
+    # Start slave storage servers.
+    for i in `seq 1 $((N-1))`
+    do
+        STORAGE_SLAVE_PORT=$(((RANDOM % 10000) + 10000))
+        ${STORAGE_SERVER} -id=${STORAGE_ID[$i]} -port=${STORAGE_SLAVE_PORT} -master="localhost:${STORAGE_PORT}" 2> /dev/null &
+        STORAGE_SERVER_PID[$i]=$!
+    done
+    sleep 5
+}
+
+function stopStorageServers {
+    N=${#STORAGE_ID[@]}
+    for i in `seq 0 $((N-1))`
+    do
+        kill -9 ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+        wait ${STORAGE_SERVER_PID[$i]} 2> /dev/null
+    done
+}
+
+# Starts watching with the rlibstore command $1 and argument $2, writing the
+# changes to OUT.
+function startWatcher {
+    ${LRUNNER} -port=${STORAGE_PORT} $1 $2 > ${OUT} 2> /dev/null &
+    WATCHER_PID=$!
+    sleep 1
+}
+
+function stopWatcher {
+    sleep 1
+    kill -9 ${WATCHER_PID}
+    wait ${WATCHER_PID} 2> /dev/null
+}
+
+function checkResult {
+    if [ "$1" == "$2" ]
+    then
+        echo "PASS"
+        PASS_COUNT=$((PASS_COUNT + 1))
+    else
+        echo "FAIL"
+        FAIL_COUNT=$((FAIL_COUNT + 1))
+    fi
+}
+
+# Testing that the changes of a watched key arrive once each, in order, and
+# that changes to other keys do not. Every key has a backup, which reports
+# the changes too.
+function testWatchKey {
+    echo "Running testWatchKey:"
+    startWatcher wk "alice:usrid"
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" first > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:usrid" second > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} d "alice:usrid" > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "alice:sublist" other > /dev/null
+    stopWatcher
+    # Drop the versions.
+    checkResult "`grep -v WATCHING ${OUT} | awk '{NF--; print}' | tr '\n' ','`" \
+        "PUT alice:usrid first,PUT alice:usrid second,DELETE alice:usrid,"
+}
+
+# Testing that the changes of every key with a prefix spanning the ring
+# arrive, those of each key in order.
+function testWatchPrefix {
+    echo "Running testWatchPrefix:"
+    startWatcher wp "carol"
+    ${LRUNNER} -port=${STORAGE_PORT} la "carol:sublist" dave > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} la "carol:sublist" erin > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} lr "carol:sublist" dave > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "carol:usrid" carol > /dev/null
+    ${LRUNNER} -port=${STORAGE_PORT} p "dave:usrid" dave > /dev/null
+    stopWatcher
+    LIST=`grep "carol:sublist" ${OUT} | awk '{print $1, $3}' | tr '\n' ','`
+    OTHERS=`grep -v WATCHING ${OUT} | grep -v "carol:sublist" | awk '{print $1, $2, $3}' | tr '\n' ','`
+    checkResult "${LIST}${OTHERS}" "APPEND dave,APPEND erin,REMOVE dave,PUT carol:usrid carol,"
+}
+
+# Testing that changes still arrive once a storage server dies, from the
+# backups of its key ranges.
+function testWatchAfterFailure {
+    echo "Running testWatchAfterFailure:"
+    startWatcher wp "frank_"
+    kill -9 ${STORAGE_SERVER_PID[1]}
+    wait ${STORAGE_SERVER_PID[1]} 2> /dev/null
+    sleep 2
+    for i in `seq 0 9`
+    do
+        ${LRUNNER} -port=${STORAGE_PORT} p "frank_$i:usrid" value > /dev/null 2>&1
+    done
+    stopWatcher
+    checkResult "`grep "^PUT frank_" ${OUT} | awk '{print $2}' | sort -u | wc -l` `grep -c "^PUT" ${OUT}`" "10 10"
+}
+
+# Run tests
+PASS_COUNT=0
+FAIL_COUNT=0
+startStorageServers
+testWatchKey
+testWatchPrefix
+testWatchAfterFailure
+stopStorageServers
+rm -f ${OUT}
+
+echo "Passed (${PASS_COUNT}/$((PASS_COUNT + FAIL_COUNT))) tests"